@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS subs_user_id_idx;
+DROP INDEX IF EXISTS subs_service_name_idx;
+DROP INDEX IF EXISTS subs_price_idx;
+DROP INDEX IF EXISTS subs_start_date_idx;
\ No newline at end of file
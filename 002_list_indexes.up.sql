@@ -0,0 +1,4 @@
+CREATE INDEX subs_user_id_idx ON subs (user_id);
+CREATE INDEX subs_service_name_idx ON subs (service_name, sub_id);
+CREATE INDEX subs_price_idx ON subs (price, sub_id);
+CREATE INDEX subs_start_date_idx ON subs (start_date, sub_id);
\ No newline at end of file
@@ -0,0 +1 @@
+DROP FUNCTION IF EXISTS sub_charges(DATE, DATE, UUID, VARCHAR);
\ No newline at end of file
@@ -0,0 +1,28 @@
+DROP FUNCTION IF EXISTS sub_charges(DATE, DATE, UUID, VARCHAR);
+
+CREATE FUNCTION sub_charges(
+    IN filter_start DATE,
+    IN filter_end DATE,
+    IN filter_user_id UUID DEFAULT NULL,
+    IN filter_service_name VARCHAR(255) DEFAULT NULL
+)
+RETURNS TABLE (month DATE, sub_id UUID, service_name VARCHAR(255), user_id UUID, price INTEGER) AS $$
+    SELECT m::date, s.sub_id, s.service_name, s.user_id, s.price
+    FROM subs s
+    CROSS JOIN LATERAL generate_series(
+        GREATEST(s.start_date, filter_start)::timestamp,
+        LEAST(COALESCE(s.end_date, filter_end), filter_end)::timestamp,
+        INTERVAL '1 month'
+    ) AS m
+    WHERE
+        (filter_user_id IS NULL OR s.user_id = filter_user_id)
+        AND (filter_service_name IS NULL OR s.service_name = filter_service_name)
+        AND s.start_date <= filter_end
+        AND (s.end_date IS NULL OR s.end_date >= filter_start);
+$$ LANGUAGE sql STABLE;
+
+DROP FUNCTION IF EXISTS fx_rate(CHAR, CHAR, DATE);
+
+DROP TABLE IF EXISTS fx_rates;
+
+ALTER TABLE subs DROP COLUMN IF EXISTS currency;
\ No newline at end of file
@@ -0,0 +1,51 @@
+ALTER TABLE subs ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'RUB';
+
+-- rate is in millionths of to_currency per unit of from_currency, effective
+-- from month until the next rate of the pair
+CREATE TABLE IF NOT EXISTS fx_rates (
+    from_currency CHAR(3) NOT NULL,
+    to_currency CHAR(3) NOT NULL,
+    month DATE NOT NULL,
+    rate BIGINT NOT NULL,
+    PRIMARY KEY (from_currency, to_currency, month)
+);
+
+-- the rate effective at a month, exactly 1 between equal currencies and NULL
+-- when the pair has no rate yet
+CREATE FUNCTION fx_rate(
+    IN from_cur CHAR(3),
+    IN to_cur CHAR(3),
+    IN at_month DATE
+)
+RETURNS BIGINT AS $$
+    SELECT CASE WHEN from_cur = to_cur THEN 1000000 ELSE (
+        SELECT rate
+        FROM fx_rates
+        WHERE from_currency = from_cur AND to_currency = to_cur AND month <= at_month
+        ORDER BY month DESC
+        LIMIT 1
+    ) END;
+$$ LANGUAGE sql STABLE;
+
+DROP FUNCTION IF EXISTS sub_charges(DATE, DATE, UUID, VARCHAR);
+
+CREATE FUNCTION sub_charges(
+    IN filter_start DATE,
+    IN filter_end DATE,
+    IN filter_user_id UUID DEFAULT NULL,
+    IN filter_service_name VARCHAR(255) DEFAULT NULL
+)
+RETURNS TABLE (month DATE, sub_id UUID, service_name VARCHAR(255), user_id UUID, price INTEGER, currency CHAR(3)) AS $$
+    SELECT m::date, s.sub_id, s.service_name, s.user_id, s.price, s.currency
+    FROM subs s
+    CROSS JOIN LATERAL generate_series(
+        GREATEST(s.start_date, filter_start)::timestamp,
+        LEAST(COALESCE(s.end_date, filter_end), filter_end)::timestamp,
+        INTERVAL '1 month'
+    ) AS m
+    WHERE
+        (filter_user_id IS NULL OR s.user_id = filter_user_id)
+        AND (filter_service_name IS NULL OR s.service_name = filter_service_name)
+        AND s.start_date <= filter_end
+        AND (s.end_date IS NULL OR s.end_date >= filter_start);
+$$ LANGUAGE sql STABLE;
\ No newline at end of file
@@ -0,0 +1,62 @@
+DROP FUNCTION IF EXISTS sum_in_period(DATE, DATE, UUID, VARCHAR);
+
+DROP FUNCTION IF EXISTS sub_charges(DATE, DATE, UUID, VARCHAR);
+
+ALTER TABLE subs ALTER COLUMN price TYPE INTEGER USING round(price / 100.0)::integer;
+
+CREATE FUNCTION sum_in_period(
+    IN filter_start DATE,
+    IN filter_end DATE,
+    IN filter_user_id UUID DEFAULT NULL,
+    IN filter_service_name VARCHAR(255) DEFAULT NULL
+)
+RETURNS INTEGER AS $$
+DECLARE
+    sum INTEGER := 0;
+BEGIN
+    WITH filtered AS (
+        SELECT
+            sub_id,
+            GREATEST(start_date, filter_start) AS overlap_start,
+            LEAST(COALESCE(end_date, filter_end), filter_end) AS overlap_end,
+            price
+        FROM subs
+        WHERE
+            (filter_user_id IS NULL OR user_id = filter_user_id)
+            AND (filter_service_name IS NULL OR service_name = filter_service_name)
+            AND start_date <= filter_end
+            AND (end_date IS NULL OR end_date >= filter_start)
+    )
+    SELECT SUM(
+        ((DATE_PART('year', overlap_end) - DATE_PART('year', overlap_start)) * 12 +
+        (DATE_PART('month', overlap_end) - DATE_PART('month', overlap_start)) + 1
+        ) * price
+    )
+    INTO sum
+    FROM filtered
+    WHERE overlap_start <= overlap_end;
+
+    RETURN COALESCE(sum, 0);
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION sub_charges(
+    IN filter_start DATE,
+    IN filter_end DATE,
+    IN filter_user_id UUID DEFAULT NULL,
+    IN filter_service_name VARCHAR(255) DEFAULT NULL
+)
+RETURNS TABLE (month DATE, sub_id UUID, service_name VARCHAR(255), user_id UUID, price INTEGER, currency CHAR(3)) AS $$
+    SELECT m::date, s.sub_id, s.service_name, s.user_id, s.price, s.currency
+    FROM subs s
+    CROSS JOIN LATERAL generate_series(
+        GREATEST(s.start_date, filter_start)::timestamp,
+        LEAST(COALESCE(s.end_date, filter_end), filter_end)::timestamp,
+        INTERVAL '1 month'
+    ) AS m
+    WHERE
+        (filter_user_id IS NULL OR s.user_id = filter_user_id)
+        AND (filter_service_name IS NULL OR s.service_name = filter_service_name)
+        AND s.start_date <= filter_end
+        AND (s.end_date IS NULL OR s.end_date >= filter_start);
+$$ LANGUAGE sql STABLE;
\ No newline at end of file
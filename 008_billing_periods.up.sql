@@ -0,0 +1,124 @@
+-- subs charge every billing_interval billing periods, counted from an anchor
+-- date. Existing subs charge monthly on the first day of their start month.
+ALTER TABLE subs ADD COLUMN billing_period VARCHAR(16) NOT NULL DEFAULT 'monthly';
+ALTER TABLE subs ADD COLUMN billing_interval INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE subs ADD COLUMN anchor_date DATE;
+
+UPDATE subs SET anchor_date = start_date;
+
+ALTER TABLE subs ALTER COLUMN anchor_date SET NOT NULL;
+
+-- the charges of a sub fall on its anchor plus k steps for any integer k, a
+-- step is in days for weekly billing and in months otherwise. charge_range
+-- gives the first and last k of the charges between two months.
+CREATE FUNCTION charge_range(
+    IN billing_period VARCHAR(16),
+    IN billing_interval INTEGER,
+    IN anchor_date DATE,
+    IN from_month DATE,
+    IN to_month DATE,
+    OUT step INTEGER,
+    OUT first_k INTEGER,
+    OUT last_k INTEGER
+) AS $$
+    SELECT
+        n,
+        ceil(lo::numeric / n)::integer,
+        floor(hi::numeric / n)::integer
+    FROM (
+        SELECT
+            billing_interval * CASE billing_period
+                WHEN 'weekly' THEN 7
+                WHEN 'quarterly' THEN 3
+                WHEN 'yearly' THEN 12
+                ELSE 1
+            END AS n,
+            CASE WHEN billing_period = 'weekly'
+                THEN (from_month - anchor_date)::numeric
+                ELSE (EXTRACT(YEAR FROM from_month) - EXTRACT(YEAR FROM anchor_date)) * 12 +
+                    EXTRACT(MONTH FROM from_month) - EXTRACT(MONTH FROM anchor_date)
+            END AS lo,
+            CASE WHEN billing_period = 'weekly'
+                THEN ((to_month + INTERVAL '1 month - 1 day')::date - anchor_date)::numeric
+                ELSE (EXTRACT(YEAR FROM to_month) - EXTRACT(YEAR FROM anchor_date)) * 12 +
+                    EXTRACT(MONTH FROM to_month) - EXTRACT(MONTH FROM anchor_date)
+            END AS hi
+    ) AS span;
+$$ LANGUAGE sql IMMUTABLE;
+
+-- the month of every charge between two months, a month with several weekly
+-- charges is repeated
+CREATE FUNCTION charge_months(
+    IN billing_period VARCHAR(16),
+    IN billing_interval INTEGER,
+    IN anchor_date DATE,
+    IN from_month DATE,
+    IN to_month DATE
+)
+RETURNS SETOF DATE AS $$
+    SELECT CASE WHEN billing_period = 'weekly'
+        THEN date_trunc('month', (anchor_date + k * r.step)::timestamp)::date
+        ELSE (date_trunc('month', anchor_date::timestamp) + make_interval(months => k * r.step))::date
+    END
+    FROM charge_range(billing_period, billing_interval, anchor_date, from_month, to_month) AS r
+    CROSS JOIN LATERAL generate_series(r.first_k, r.last_k) AS k;
+$$ LANGUAGE sql IMMUTABLE;
+
+-- sums count the charges in the period instead of its months
+DROP FUNCTION IF EXISTS sum_in_period(DATE, DATE, UUID, VARCHAR);
+
+CREATE FUNCTION sum_in_period(
+    IN filter_start DATE,
+    IN filter_end DATE,
+    IN filter_user_id UUID DEFAULT NULL,
+    IN filter_service_name VARCHAR(255) DEFAULT NULL
+)
+RETURNS BIGINT AS $$
+DECLARE
+    sum BIGINT := 0;
+BEGIN
+    SELECT SUM(GREATEST(r.last_k - r.first_k + 1, 0)::bigint * s.price)
+    INTO sum
+    FROM subs s
+    CROSS JOIN LATERAL charge_range(
+        s.billing_period,
+        s.billing_interval,
+        s.anchor_date,
+        GREATEST(s.start_date, filter_start),
+        LEAST(COALESCE(s.end_date, filter_end), filter_end)
+    ) AS r
+    WHERE
+        (filter_user_id IS NULL OR s.user_id = filter_user_id)
+        AND (filter_service_name IS NULL OR s.service_name = filter_service_name)
+        AND s.start_date <= filter_end
+        AND (s.end_date IS NULL OR s.end_date >= filter_start);
+
+    RETURN COALESCE(sum, 0);
+END;
+$$ LANGUAGE plpgsql;
+
+-- one row per charge instead of per month
+DROP FUNCTION IF EXISTS sub_charges(DATE, DATE, UUID, VARCHAR);
+
+CREATE FUNCTION sub_charges(
+    IN filter_start DATE,
+    IN filter_end DATE,
+    IN filter_user_id UUID DEFAULT NULL,
+    IN filter_service_name VARCHAR(255) DEFAULT NULL
+)
+RETURNS TABLE (month DATE, sub_id UUID, service_name VARCHAR(255), user_id UUID, price BIGINT, currency CHAR(3)) AS $$
+    SELECT c.month, s.sub_id, s.service_name, s.user_id, s.price, s.currency
+    FROM subs s
+    CROSS JOIN LATERAL charge_months(
+        s.billing_period,
+        s.billing_interval,
+        s.anchor_date,
+        GREATEST(s.start_date, filter_start),
+        LEAST(COALESCE(s.end_date, filter_end), filter_end)
+    ) AS c(month)
+    WHERE
+        (filter_user_id IS NULL OR s.user_id = filter_user_id)
+        AND (filter_service_name IS NULL OR s.service_name = filter_service_name)
+        AND s.start_date <= filter_end
+        AND (s.end_date IS NULL OR s.end_date >= filter_start);
+$$ LANGUAGE sql STABLE;
\ No newline at end of file
@@ -0,0 +1,207 @@
+-- start and end dates keep their day, an end date is the last day of a sub.
+-- Month ends were stored as the first day of their month.
+UPDATE subs SET end_date = (date_trunc('month', end_date) + INTERVAL '1 month - 1 day')::date;
+
+DROP FUNCTION IF EXISTS sum_in_period(DATE, DATE, UUID, VARCHAR);
+
+DROP FUNCTION IF EXISTS sub_charges(DATE, DATE, UUID, VARCHAR);
+
+DROP FUNCTION IF EXISTS charge_months(VARCHAR, INTEGER, DATE, DATE, DATE);
+
+DROP FUNCTION IF EXISTS charge_range(VARCHAR, INTEGER, DATE, DATE, DATE);
+
+-- the step of a billing schedule, in days for weekly billing and in months
+-- otherwise
+CREATE FUNCTION billing_step(
+    IN billing_period VARCHAR(16),
+    IN billing_interval INTEGER
+)
+RETURNS INTEGER AS $$
+    SELECT billing_interval * CASE billing_period
+        WHEN 'weekly' THEN 7
+        WHEN 'quarterly' THEN 3
+        WHEN 'yearly' THEN 12
+        ELSE 1
+    END;
+$$ LANGUAGE sql IMMUTABLE;
+
+-- the date of charge k from the anchor, monthly steps keep the anchor day or
+-- the last day of shorter months
+CREATE FUNCTION charge_at(
+    IN billing_period VARCHAR(16),
+    IN billing_interval INTEGER,
+    IN anchor_date DATE,
+    IN k INTEGER
+)
+RETURNS DATE AS $$
+    SELECT CASE WHEN billing_period = 'weekly'
+        THEN anchor_date + k * billing_step(billing_period, billing_interval)
+        ELSE (anchor_date + make_interval(months => k * billing_step(billing_period, billing_interval)))::date
+    END;
+$$ LANGUAGE sql IMMUTABLE;
+
+-- the last charge on or before day, or with after the first one on or after
+-- it. The step count is exact in days, in months it can be one off.
+CREATE FUNCTION charge_k(
+    IN billing_period VARCHAR(16),
+    IN billing_interval INTEGER,
+    IN anchor_date DATE,
+    IN day DATE,
+    IN after BOOLEAN
+)
+RETURNS INTEGER AS $$
+    SELECT CASE
+        WHEN after AND charge_at(billing_period, billing_interval, anchor_date, k) < day THEN k + 1
+        WHEN NOT after AND charge_at(billing_period, billing_interval, anchor_date, k) > day THEN k - 1
+        ELSE k
+    END
+    FROM (
+        SELECT (CASE WHEN after THEN ceil(d / n) ELSE floor(d / n) END)::integer AS k
+        FROM (
+            SELECT
+                billing_step(billing_period, billing_interval)::numeric AS n,
+                CASE WHEN billing_period = 'weekly'
+                    THEN (day - anchor_date)::numeric
+                    ELSE (EXTRACT(YEAR FROM day) - EXTRACT(YEAR FROM anchor_date)) * 12 +
+                        EXTRACT(MONTH FROM day) - EXTRACT(MONTH FROM anchor_date)
+                END AS d
+        ) AS span
+    ) AS approx;
+$$ LANGUAGE sql IMMUTABLE;
+
+-- charges of the periods cut by a start or end inside a month, billed for
+-- the days they cover. An end cut replaces the full charge replaces_k of its
+-- period, which falls on the same day.
+CREATE FUNCTION sub_prorations(
+    IN billing_period VARCHAR(16),
+    IN billing_interval INTEGER,
+    IN anchor_date DATE,
+    IN start_date DATE,
+    IN end_date DATE,
+    IN price BIGINT
+)
+RETURNS TABLE (charge_date DATE, amount BIGINT, replaces_k INTEGER) AS $$
+    SELECT
+        start_date,
+        round(price::numeric * (LEAST(p.next, end_date + 1) - start_date) / (p.next - p.at))::bigint,
+        NULL::integer
+    FROM (
+        SELECT
+            charge_at(billing_period, billing_interval, anchor_date, k) AS at,
+            charge_at(billing_period, billing_interval, anchor_date, k + 1) AS next
+        FROM charge_k(billing_period, billing_interval, anchor_date, start_date, false) AS k
+    ) AS p
+    WHERE
+        EXTRACT(DAY FROM start_date) <> 1
+        AND p.at < start_date
+        AND (end_date IS NULL OR end_date >= start_date)
+    UNION ALL
+    SELECT
+        p.at,
+        round(price::numeric * (end_date + 1 - p.at) / (p.next - p.at))::bigint,
+        p.k
+    FROM (
+        SELECT
+            k,
+            charge_at(billing_period, billing_interval, anchor_date, k) AS at,
+            charge_at(billing_period, billing_interval, anchor_date, k + 1) AS next
+        FROM charge_k(billing_period, billing_interval, anchor_date, end_date, false) AS k
+    ) AS p
+    WHERE
+        EXTRACT(DAY FROM end_date + 1) <> 1
+        AND p.at >= start_date
+        AND p.next > end_date + 1;
+$$ LANGUAGE sql IMMUTABLE;
+
+-- every charge of a sub between two days
+CREATE FUNCTION sub_charge_list(
+    IN billing_period VARCHAR(16),
+    IN billing_interval INTEGER,
+    IN anchor_date DATE,
+    IN start_date DATE,
+    IN end_date DATE,
+    IN price BIGINT,
+    IN from_day DATE,
+    IN to_day DATE
+)
+RETURNS TABLE (charge_date DATE, amount BIGINT) AS $$
+    WITH p AS (
+        SELECT * FROM sub_prorations(billing_period, billing_interval, anchor_date, start_date, end_date, price)
+    )
+    SELECT charge_at(billing_period, billing_interval, anchor_date, k), price
+    FROM generate_series(
+        charge_k(billing_period, billing_interval, anchor_date, GREATEST(start_date, from_day), true),
+        charge_k(billing_period, billing_interval, anchor_date, LEAST(COALESCE(end_date, to_day), to_day), false)
+    ) AS k
+    WHERE NOT EXISTS (SELECT 1 FROM p WHERE p.replaces_k = k)
+    UNION ALL
+    SELECT p.charge_date, p.amount
+    FROM p
+    WHERE p.charge_date BETWEEN GREATEST(start_date, from_day) AND LEAST(COALESCE(end_date, to_day), to_day);
+$$ LANGUAGE sql IMMUTABLE;
+
+-- the full charges are counted rather than listed, so a long period costs
+-- no more than a short one
+CREATE FUNCTION sum_in_period(
+    IN filter_start DATE,
+    IN filter_end DATE,
+    IN filter_user_id UUID DEFAULT NULL,
+    IN filter_service_name VARCHAR(255) DEFAULT NULL
+)
+RETURNS BIGINT AS $$
+DECLARE
+    sum BIGINT := 0;
+    last_day DATE := (filter_end + INTERVAL '1 month - 1 day')::date;
+BEGIN
+    SELECT SUM((GREATEST(r.last_k - r.first_k + 1, 0) - x.replaced)::bigint * s.price + x.prorated)
+    INTO sum
+    FROM subs s
+    CROSS JOIN LATERAL (
+        SELECT
+            charge_k(s.billing_period, s.billing_interval, s.anchor_date, GREATEST(s.start_date, filter_start), true) AS first_k,
+            charge_k(s.billing_period, s.billing_interval, s.anchor_date, LEAST(COALESCE(s.end_date, last_day), last_day), false) AS last_k
+    ) AS r
+    CROSS JOIN LATERAL (
+        SELECT
+            COUNT(*) FILTER (WHERE p.replaces_k BETWEEN r.first_k AND r.last_k) AS replaced,
+            COALESCE(SUM(p.amount) FILTER (
+                WHERE p.charge_date BETWEEN GREATEST(s.start_date, filter_start) AND LEAST(COALESCE(s.end_date, last_day), last_day)
+            ), 0) AS prorated
+        FROM sub_prorations(s.billing_period, s.billing_interval, s.anchor_date, s.start_date, s.end_date, s.price) AS p
+    ) AS x
+    WHERE
+        (filter_user_id IS NULL OR s.user_id = filter_user_id)
+        AND (filter_service_name IS NULL OR s.service_name = filter_service_name)
+        AND s.start_date <= last_day
+        AND (s.end_date IS NULL OR s.end_date >= filter_start);
+
+    RETURN COALESCE(sum, 0);
+END;
+$$ LANGUAGE plpgsql;
+
+-- price is the amount of each charge, prorated ones included
+CREATE FUNCTION sub_charges(
+    IN filter_start DATE,
+    IN filter_end DATE,
+    IN filter_user_id UUID DEFAULT NULL,
+    IN filter_service_name VARCHAR(255) DEFAULT NULL
+)
+RETURNS TABLE (month DATE, sub_id UUID, service_name VARCHAR(255), user_id UUID, price BIGINT, currency CHAR(3)) AS $$
+    SELECT date_trunc('month', c.charge_date::timestamp)::date, s.sub_id, s.service_name, s.user_id, c.amount, s.currency
+    FROM subs s
+    CROSS JOIN LATERAL sub_charge_list(
+        s.billing_period,
+        s.billing_interval,
+        s.anchor_date,
+        s.start_date,
+        s.end_date,
+        s.price,
+        filter_start,
+        (filter_end + INTERVAL '1 month - 1 day')::date
+    ) AS c
+    WHERE
+        (filter_user_id IS NULL OR s.user_id = filter_user_id)
+        AND (filter_service_name IS NULL OR s.service_name = filter_service_name)
+        AND s.start_date < filter_end + INTERVAL '1 month'
+        AND (s.end_date IS NULL OR s.end_date >= filter_start);
+$$ LANGUAGE sql STABLE;
\ No newline at end of file
@@ -0,0 +1,80 @@
+DROP FUNCTION IF EXISTS sum_in_period(DATE, DATE, UUID, VARCHAR);
+
+DROP FUNCTION IF EXISTS sub_charges(DATE, DATE, UUID, VARCHAR);
+
+DROP FUNCTION IF EXISTS sub_charge_spans(UUID, BIGINT);
+
+DROP TABLE IF EXISTS sub_pauses;
+
+-- the full charges of each price span are counted rather than listed, so a
+-- long period costs no more than a short one
+CREATE FUNCTION sum_in_period(
+    IN filter_start DATE,
+    IN filter_end DATE,
+    IN filter_user_id UUID DEFAULT NULL,
+    IN filter_service_name VARCHAR(255) DEFAULT NULL
+)
+RETURNS BIGINT AS $$
+DECLARE
+    sum BIGINT := 0;
+    last_day DATE := (filter_end + INTERVAL '1 month - 1 day')::date;
+BEGIN
+    SELECT SUM((GREATEST(r.last_k - r.first_k + 1, 0) - x.replaced)::bigint * sp.price + x.prorated)
+    INTO sum
+    FROM subs s
+    CROSS JOIN LATERAL sub_price_spans(s.sub_id, s.price) AS sp
+    CROSS JOIN LATERAL (
+        SELECT
+            GREATEST(s.start_date, filter_start, sp.from_day) AS lo,
+            LEAST(COALESCE(s.end_date, last_day), last_day, sp.to_day) AS hi
+    ) AS w
+    CROSS JOIN LATERAL (
+        SELECT
+            charge_k(s.billing_period, s.billing_interval, s.anchor_date, w.lo, true) AS first_k,
+            charge_k(s.billing_period, s.billing_interval, s.anchor_date, w.hi, false) AS last_k
+    ) AS r
+    CROSS JOIN LATERAL (
+        SELECT
+            COUNT(*) FILTER (WHERE p.replaces_k BETWEEN r.first_k AND r.last_k) AS replaced,
+            COALESCE(SUM(p.amount) FILTER (WHERE p.charge_date BETWEEN w.lo AND w.hi), 0) AS prorated
+        FROM sub_prorations(s.billing_period, s.billing_interval, s.anchor_date, s.start_date, s.end_date, sp.price) AS p
+    ) AS x
+    WHERE
+        (filter_user_id IS NULL OR s.user_id = filter_user_id)
+        AND (filter_service_name IS NULL OR s.service_name = filter_service_name)
+        AND s.start_date <= last_day
+        AND (s.end_date IS NULL OR s.end_date >= filter_start)
+        AND w.lo <= w.hi;
+
+    RETURN COALESCE(sum, 0);
+END;
+$$ LANGUAGE plpgsql;
+
+-- price is the amount of each charge at the price of its span, prorated ones
+-- included
+CREATE FUNCTION sub_charges(
+    IN filter_start DATE,
+    IN filter_end DATE,
+    IN filter_user_id UUID DEFAULT NULL,
+    IN filter_service_name VARCHAR(255) DEFAULT NULL
+)
+RETURNS TABLE (month DATE, sub_id UUID, service_name VARCHAR(255), user_id UUID, price BIGINT, currency CHAR(3)) AS $$
+    SELECT date_trunc('month', c.charge_date::timestamp)::date, s.sub_id, s.service_name, s.user_id, c.amount, s.currency
+    FROM subs s
+    CROSS JOIN LATERAL sub_price_spans(s.sub_id, s.price) AS sp
+    CROSS JOIN LATERAL sub_charge_list(
+        s.billing_period,
+        s.billing_interval,
+        s.anchor_date,
+        s.start_date,
+        s.end_date,
+        sp.price,
+        GREATEST(filter_start, sp.from_day),
+        LEAST((filter_end + INTERVAL '1 month - 1 day')::date, sp.to_day)
+    ) AS c
+    WHERE
+        (filter_user_id IS NULL OR s.user_id = filter_user_id)
+        AND (filter_service_name IS NULL OR s.service_name = filter_service_name)
+        AND s.start_date < filter_end + INTERVAL '1 month'
+        AND (s.end_date IS NULL OR s.end_date >= filter_start);
+$$ LANGUAGE sql STABLE;
\ No newline at end of file
@@ -0,0 +1,106 @@
+-- a sub starts with trial_months free months, then charges intro_price for
+-- intro_months months, both counted from its start day
+ALTER TABLE subs ADD COLUMN trial_months INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE subs ADD COLUMN intro_price BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE subs ADD COLUMN intro_months INTEGER NOT NULL DEFAULT 0;
+
+-- the runs of days of a sub charged after its trial, its intro months at
+-- intro_price and the days after them at base_price. A NULL bound is open.
+CREATE FUNCTION sub_phases(
+    IN phase_start DATE,
+    IN phase_trial_months INTEGER,
+    IN phase_intro_months INTEGER,
+    IN phase_intro_price BIGINT,
+    IN base_price BIGINT
+)
+RETURNS TABLE (from_day DATE, to_day DATE, price BIGINT) AS $$
+    SELECT
+        (phase_start + make_interval(months => phase_trial_months))::date,
+        (phase_start + make_interval(months => phase_trial_months + phase_intro_months))::date - 1,
+        phase_intro_price
+    WHERE phase_intro_months > 0
+    UNION ALL
+    SELECT
+        (phase_start + make_interval(months => phase_trial_months + phase_intro_months))::date,
+        NULL::date,
+        base_price;
+$$ LANGUAGE sql IMMUTABLE;
+
+DROP FUNCTION IF EXISTS sum_in_period(DATE, DATE, UUID, VARCHAR);
+
+DROP FUNCTION IF EXISTS sub_charges(DATE, DATE, UUID, VARCHAR);
+
+-- the full charges of each charged span and phase are counted rather than
+-- listed, so a long period costs no more than a short one
+CREATE FUNCTION sum_in_period(
+    IN filter_start DATE,
+    IN filter_end DATE,
+    IN filter_user_id UUID DEFAULT NULL,
+    IN filter_service_name VARCHAR(255) DEFAULT NULL
+)
+RETURNS BIGINT AS $$
+DECLARE
+    sum BIGINT := 0;
+    last_day DATE := (filter_end + INTERVAL '1 month - 1 day')::date;
+BEGIN
+    SELECT SUM((GREATEST(r.last_k - r.first_k + 1, 0) - x.replaced)::bigint * ph.price + x.prorated)
+    INTO sum
+    FROM subs s
+    CROSS JOIN LATERAL sub_charge_spans(s.sub_id, s.price) AS sp
+    CROSS JOIN LATERAL sub_phases(s.start_date, s.trial_months, s.intro_months, s.intro_price, sp.price) AS ph
+    CROSS JOIN LATERAL (
+        SELECT
+            GREATEST(s.start_date, filter_start, sp.from_day, ph.from_day) AS lo,
+            LEAST(COALESCE(s.end_date, last_day), last_day, sp.to_day, ph.to_day) AS hi
+    ) AS w
+    CROSS JOIN LATERAL (
+        SELECT
+            charge_k(s.billing_period, s.billing_interval, s.anchor_date, w.lo, true) AS first_k,
+            charge_k(s.billing_period, s.billing_interval, s.anchor_date, w.hi, false) AS last_k
+    ) AS r
+    CROSS JOIN LATERAL (
+        SELECT
+            COUNT(*) FILTER (WHERE p.replaces_k BETWEEN r.first_k AND r.last_k) AS replaced,
+            COALESCE(SUM(p.amount) FILTER (WHERE p.charge_date BETWEEN w.lo AND w.hi), 0) AS prorated
+        FROM sub_prorations(s.billing_period, s.billing_interval, s.anchor_date, s.start_date, s.end_date, ph.price) AS p
+    ) AS x
+    WHERE
+        (filter_user_id IS NULL OR s.user_id = filter_user_id)
+        AND (filter_service_name IS NULL OR s.service_name = filter_service_name)
+        AND s.start_date <= last_day
+        AND (s.end_date IS NULL OR s.end_date >= filter_start)
+        AND w.lo <= w.hi;
+
+    RETURN COALESCE(sum, 0);
+END;
+$$ LANGUAGE plpgsql;
+
+-- price is the amount of each charge outside pauses and trials at the price of
+-- its span or intro phase, prorated ones included
+CREATE FUNCTION sub_charges(
+    IN filter_start DATE,
+    IN filter_end DATE,
+    IN filter_user_id UUID DEFAULT NULL,
+    IN filter_service_name VARCHAR(255) DEFAULT NULL
+)
+RETURNS TABLE (month DATE, sub_id UUID, service_name VARCHAR(255), user_id UUID, price BIGINT, currency CHAR(3)) AS $$
+    SELECT date_trunc('month', c.charge_date::timestamp)::date, s.sub_id, s.service_name, s.user_id, c.amount, s.currency
+    FROM subs s
+    CROSS JOIN LATERAL sub_charge_spans(s.sub_id, s.price) AS sp
+    CROSS JOIN LATERAL sub_phases(s.start_date, s.trial_months, s.intro_months, s.intro_price, sp.price) AS ph
+    CROSS JOIN LATERAL sub_charge_list(
+        s.billing_period,
+        s.billing_interval,
+        s.anchor_date,
+        s.start_date,
+        s.end_date,
+        ph.price,
+        GREATEST(filter_start, sp.from_day, ph.from_day),
+        LEAST((filter_end + INTERVAL '1 month - 1 day')::date, sp.to_day, ph.to_day)
+    ) AS c
+    WHERE
+        (filter_user_id IS NULL OR s.user_id = filter_user_id)
+        AND (filter_service_name IS NULL OR s.service_name = filter_service_name)
+        AND s.start_date < filter_end + INTERVAL '1 month'
+        AND (s.end_date IS NULL OR s.end_date >= filter_start);
+$$ LANGUAGE sql STABLE;
\ No newline at end of file
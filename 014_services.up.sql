@@ -0,0 +1,111 @@
+-- the service catalog, service_names holds the lowercased and trimmed name
+-- and aliases of every service so no two services share one
+CREATE TABLE IF NOT EXISTS services (
+    service_id UUID PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    aliases VARCHAR(255)[] NOT NULL DEFAULT '{}',
+    default_price BIGINT NOT NULL DEFAULT 0,
+    currency CHAR(3) NOT NULL DEFAULT 'RUB',
+    category VARCHAR(255) NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS service_names (
+    name_key VARCHAR(255) PRIMARY KEY,
+    service_id UUID NOT NULL REFERENCES services (service_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS service_names_service_id ON service_names (service_id);
+
+-- sums filter service names case-insensitively
+CREATE INDEX IF NOT EXISTS subs_service_key ON subs (lower(btrim(service_name)));
+
+DROP FUNCTION IF EXISTS sum_in_period(DATE, DATE, UUID, VARCHAR);
+
+DROP FUNCTION IF EXISTS sub_charges(DATE, DATE, UUID, VARCHAR);
+
+-- the full charges of each charged span and phase are counted rather than
+-- listed, so a long period costs no more than a short one
+CREATE FUNCTION sum_in_period(
+    IN filter_start DATE,
+    IN filter_end DATE,
+    IN filter_user_id UUID DEFAULT NULL,
+    IN filter_service_name VARCHAR(255) DEFAULT NULL
+)
+RETURNS BIGINT AS $$
+DECLARE
+    sum BIGINT := 0;
+    last_day DATE := (filter_end + INTERVAL '1 month - 1 day')::date;
+BEGIN
+    SELECT SUM((GREATEST(r.last_k - r.first_k + 1, 0) - x.replaced)::bigint * ph.price + x.prorated)
+    INTO sum
+    FROM subs s
+    CROSS JOIN LATERAL sub_charge_spans(s.sub_id, s.price) AS sp
+    CROSS JOIN LATERAL sub_phases(s.start_date, s.trial_months, s.intro_months, s.intro_price, sp.price) AS ph
+    CROSS JOIN LATERAL (
+        SELECT
+            GREATEST(s.start_date, filter_start, sp.from_day, ph.from_day) AS lo,
+            LEAST(COALESCE(s.end_date, last_day), last_day, sp.to_day, ph.to_day) AS hi
+    ) AS w
+    CROSS JOIN LATERAL (
+        SELECT
+            charge_k(s.billing_period, s.billing_interval, s.anchor_date, w.lo, true) AS first_k,
+            charge_k(s.billing_period, s.billing_interval, s.anchor_date, w.hi, false) AS last_k
+    ) AS r
+    CROSS JOIN LATERAL (
+        SELECT
+            COUNT(*) FILTER (WHERE p.replaces_k BETWEEN r.first_k AND r.last_k) AS replaced,
+            COALESCE(SUM(p.amount) FILTER (WHERE p.charge_date BETWEEN w.lo AND w.hi), 0) AS prorated
+        FROM sub_prorations(s.billing_period, s.billing_interval, s.anchor_date, s.start_date, s.end_date, ph.price) AS p
+    ) AS x
+    WHERE
+        (filter_user_id IS NULL OR (s.user_id = filter_user_id AND NOT EXISTS (SELECT 1 FROM sub_members m WHERE m.sub_id = s.sub_id)))
+        AND (filter_service_name IS NULL OR lower(btrim(s.service_name)) = lower(btrim(filter_service_name)))
+        AND s.start_date <= last_day
+        AND (s.end_date IS NULL OR s.end_date >= filter_start)
+        AND w.lo <= w.hi;
+
+    -- the shares of a user are split from each charge, so the charges of
+    -- shared subs are listed
+    IF filter_user_id IS NOT NULL THEN
+        SELECT COALESCE(sum, 0) + COALESCE(SUM(c.price), 0)
+        INTO sum
+        FROM sub_charges(filter_start, filter_end, filter_user_id, filter_service_name) AS c
+        WHERE EXISTS (SELECT 1 FROM sub_members m WHERE m.sub_id = c.sub_id);
+    END IF;
+
+    RETURN COALESCE(sum, 0);
+END;
+$$ LANGUAGE plpgsql;
+
+-- price is the share of user_id in each charge outside pauses and trials at
+-- the price of its span or intro phase, prorated ones included. A filter user
+-- only gets their own shares.
+CREATE FUNCTION sub_charges(
+    IN filter_start DATE,
+    IN filter_end DATE,
+    IN filter_user_id UUID DEFAULT NULL,
+    IN filter_service_name VARCHAR(255) DEFAULT NULL
+)
+RETURNS TABLE (month DATE, sub_id UUID, service_name VARCHAR(255), user_id UUID, price BIGINT, currency CHAR(3)) AS $$
+    SELECT date_trunc('month', c.charge_date::timestamp)::date, s.sub_id, s.service_name, sh.user_id, sh.amount, s.currency
+    FROM subs s
+    CROSS JOIN LATERAL sub_charge_spans(s.sub_id, s.price) AS sp
+    CROSS JOIN LATERAL sub_phases(s.start_date, s.trial_months, s.intro_months, s.intro_price, sp.price) AS ph
+    CROSS JOIN LATERAL sub_charge_list(
+        s.billing_period,
+        s.billing_interval,
+        s.anchor_date,
+        s.start_date,
+        s.end_date,
+        ph.price,
+        GREATEST(filter_start, sp.from_day, ph.from_day),
+        LEAST((filter_end + INTERVAL '1 month - 1 day')::date, sp.to_day, ph.to_day)
+    ) AS c
+    CROSS JOIN LATERAL charge_shares(s.sub_id, s.user_id, c.amount) AS sh
+    WHERE
+        (filter_user_id IS NULL OR sh.user_id = filter_user_id)
+        AND (filter_user_id IS NULL OR s.user_id = filter_user_id OR EXISTS (SELECT 1 FROM sub_members m WHERE m.sub_id = s.sub_id AND m.user_id = filter_user_id))
+        AND (filter_service_name IS NULL OR lower(btrim(s.service_name)) = lower(btrim(filter_service_name)))
+        AND s.start_date < filter_end + INTERVAL '1 month'
+        AND (s.end_date IS NULL OR s.end_date >= filter_start);
+$$ LANGUAGE sql STABLE;
\ No newline at end of file
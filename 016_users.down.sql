@@ -0,0 +1,3 @@
+ALTER TABLE subs DROP CONSTRAINT IF EXISTS subs_user_id_fkey;
+
+DROP TABLE IF EXISTS users;
\ No newline at end of file
@@ -0,0 +1,14 @@
+-- users owning subs, every user id already in use becomes a user so the
+-- foreign key holds. Deleting a user with subs is refused, cascading deletes
+-- remove their subs first.
+CREATE TABLE IF NOT EXISTS users (
+    user_id UUID PRIMARY KEY,
+    display_name VARCHAR(255) NOT NULL DEFAULT '',
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    default_currency CHAR(3) NOT NULL DEFAULT 'RUB',
+    timezone VARCHAR(64) NOT NULL DEFAULT 'UTC'
+);
+
+INSERT INTO users (user_id) SELECT DISTINCT user_id FROM subs ON CONFLICT DO NOTHING;
+
+ALTER TABLE subs ADD CONSTRAINT subs_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (user_id) ON DELETE RESTRICT;
\ No newline at end of file
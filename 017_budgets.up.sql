@@ -0,0 +1,12 @@
+-- monthly spend limits of users, at most one per category or service name
+-- and one of all their spend
+CREATE TABLE IF NOT EXISTS budgets (
+    budget_id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    monthly_limit BIGINT NOT NULL,
+    currency CHAR(3) NOT NULL DEFAULT 'RUB',
+    category VARCHAR(255) NOT NULL DEFAULT '',
+    service_name VARCHAR(255) NOT NULL DEFAULT ''
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS budgets_scope ON budgets (user_id, category, lower(btrim(service_name)));
\ No newline at end of file
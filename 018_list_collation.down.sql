@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS subs_service_name_idx;
+CREATE INDEX subs_service_name_idx ON subs (service_name, sub_id);
\ No newline at end of file
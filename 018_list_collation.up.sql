@@ -0,0 +1,3 @@
+-- list orders and cursors compare service names bytewise
+DROP INDEX IF EXISTS subs_service_name_idx;
+CREATE INDEX subs_service_name_idx ON subs (service_name COLLATE "C", sub_id);
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE sub_members DROP CONSTRAINT IF EXISTS sub_members_user_id_fkey;
\ No newline at end of file
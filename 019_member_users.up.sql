@@ -0,0 +1,5 @@
+-- members are users too, every member id without one becomes a user so the
+-- foreign key holds
+INSERT INTO users (user_id) SELECT DISTINCT user_id FROM sub_members ON CONFLICT DO NOTHING;
+
+ALTER TABLE sub_members ADD CONSTRAINT sub_members_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (user_id) ON DELETE RESTRICT;
\ No newline at end of file
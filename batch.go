@@ -0,0 +1,307 @@
+package subs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+var ErrBatchAborted = errors.New("batch aborted")
+
+const maxBatchOps = 1000
+
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// BatchOp is a single create, update or delete of a batch, ID and Version
+// are those of the Update and Delete calls
+type BatchOp struct {
+	Op      string `json:"op"`
+	ID      string `json:"sub_id"`
+	Version int    `json:"version"`
+	Sub     Sub    `json:"sub"`
+}
+
+// BatchResult holds the ID and new version of a created or updated sub
+type BatchResult struct {
+	ID      string
+	Version int
+	Err     error
+}
+
+type batchRequest struct {
+	Mode string    `json:"mode"`
+	Ops  []BatchOp `json:"ops"`
+}
+
+type batchItem struct {
+	Status   int      `json:"status"`
+	ID       string   `json:"sub_id,omitempty"`
+	Version  int      `json:"version,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Warnings []string `json:"budget_warnings,omitempty"`
+}
+
+// abortBatch marks every op of a failed atomic batch without an error of its own
+func abortBatch(results []BatchResult) {
+
+	for i := range results {
+		if results[i].Err == nil {
+			results[i] = BatchResult{Err: ErrBatchAborted}
+		}
+	}
+}
+
+func validateBatchOp(op BatchOp) error {
+
+	if op.Version < 0 {
+		return errors.New("invalid version")
+	}
+
+	switch op.Op {
+	case BatchCreate:
+		return validateSub(op.Sub)
+	case BatchUpdate:
+		if err := uuid.Validate(op.ID); err != nil {
+			return err
+		}
+		return validateSub(op.Sub)
+	case BatchDelete:
+		return uuid.Validate(op.ID)
+	}
+
+	return errors.New("unknown op")
+}
+
+func batchResultItem(op string, res BatchResult) batchItem {
+
+	switch {
+	case errors.Is(res.Err, ErrNotFound):
+		return batchItem{Status: http.StatusNotFound, Error: "not found"}
+	case errors.Is(res.Err, ErrVersionMismatch):
+		return batchItem{Status: http.StatusPreconditionFailed, Error: "version mismatch"}
+	case errors.Is(res.Err, ErrUnknownUser):
+		return batchItem{Status: http.StatusBadRequest, Error: "invalid request: unknown user"}
+	case errors.Is(res.Err, ErrOverBudget):
+		return batchItem{Status: http.StatusConflict, Error: "over budget"}
+	case errors.Is(res.Err, ErrBatchAborted):
+		return batchItem{Status: http.StatusFailedDependency, Error: "batch aborted"}
+	}
+
+	switch op {
+	case BatchCreate:
+		return batchItem{Status: http.StatusCreated, ID: res.ID, Version: res.Version}
+	case BatchUpdate:
+		return batchItem{Status: http.StatusOK, ID: res.ID, Version: res.Version}
+	}
+
+	return batchItem{Status: http.StatusNoContent, ID: res.ID}
+}
+
+// checkBatchBudgets returns the breaches of each create and update of ops.
+// They are checked in order, each against the stored subs and the ops before
+// it, but for those failing over budget in strict mode. The budgets and their
+// spend are read once for all ops. Updates of missing subs are left to fail
+// in the batch.
+func checkBatchBudgets(ctx context.Context, ops []BatchOp, catalog serviceCatalog) ([][]BudgetBreach, error) {
+
+	breaches := make([][]BudgetBreach, len(ops))
+	budgets, err := db.ListBudgets(ctx, "")
+	if err != nil || len(budgets) == 0 {
+		return breaches, err
+	}
+
+	var changes []budgetChange
+	var index []int
+	for n, op := range ops {
+		if op.Op == BatchDelete {
+			continue
+		}
+
+		var id string
+		if op.Op == BatchUpdate {
+			id = op.ID
+		}
+
+		c, err := readBudgetChange(ctx, id, func(c *chargedSub) { c.sub = op.Sub })
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+		index = append(index, n)
+	}
+
+	spend, err := readBudgetSpend(ctx, changes, budgets, catalog)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, c := range changes {
+		found, deltas, err := spend.check(c)
+		if err != nil {
+			return nil, err
+		}
+		if !budgetStrict || len(found) == 0 {
+			spend.add(deltas)
+		}
+		breaches[index[i]] = found
+	}
+
+	return breaches, nil
+}
+
+// batchHandler applies a list of ops. In the default atomic mode any failed op
+// fails the whole batch, which responds 400 or 409 with the per op status.
+// Best effort mode applies every valid op it can and responds 207. Creates and
+// updates breaching budgets list the breaches, or fail with 409 in strict
+// mode, like checkBatchBudgets checks them.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Printf("batch: resp 400: %v", err)
+		http.Error(w, "invalid request: json error", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if req.Mode != "" && req.Mode != "atomic" && req.Mode != "best_effort" {
+		logger.Printf("batch: resp 400: invalid mode %v", req.Mode)
+		http.Error(w, "invalid request: invalid mode", http.StatusBadRequest)
+		return
+	}
+	atomic := req.Mode != "best_effort"
+
+	if len(req.Ops) == 0 || len(req.Ops) > maxBatchOps {
+		logger.Printf("batch: resp 400: %v ops", len(req.Ops))
+		http.Error(w, "invalid request: invalid number of ops", http.StatusBadRequest)
+		return
+	}
+
+	items := make([]batchItem, len(req.Ops))
+	var ops []BatchOp
+	var index []int
+	for i, op := range req.Ops {
+		if err := validateBatchOp(op); err != nil {
+			items[i] = batchItem{Status: http.StatusBadRequest, Error: "invalid request: " + err.Error()}
+			continue
+		}
+		ops = append(ops, op)
+		index = append(index, i)
+	}
+
+	if atomic && len(ops) < len(req.Ops) {
+		for _, i := range index {
+			items[i] = batchResultItem("", BatchResult{Err: ErrBatchAborted})
+		}
+		writeBatch(w, http.StatusBadRequest, items)
+		logger.Printf("batch: resp 400: %v invalid ops", len(req.Ops)-len(ops))
+		return
+	}
+
+	var results []BatchResult
+	var breaches [][]BudgetBreach
+	if len(ops) > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+		defer cancel()
+
+		var subs []*Sub
+		for i := range ops {
+			if ops[i].Op != BatchDelete {
+				subs = append(subs, &ops[i].Sub)
+			}
+		}
+
+		catalog, err := readCatalog(ctx)
+		if err == nil {
+			catalog.resolveAll(subs...)
+			breaches, err = checkBatchBudgets(ctx, ops, catalog)
+		}
+		if err == nil && budgetStrict {
+			results, err = batchWithinBudgets(ctx, ops, breaches, atomic)
+		} else if err == nil {
+			results, err = db.Batch(ctx, ops, atomic)
+		}
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				logger.Printf("batch: resp 504: %v; %v ops", err, len(ops))
+				http.Error(w, "timeout", http.StatusGatewayTimeout)
+				return
+			}
+
+			logger.Printf("batch: resp 500: %v; %v ops", err, len(ops))
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	status := http.StatusOK
+	if !atomic {
+		status = http.StatusMultiStatus
+	}
+	for n, res := range results {
+		items[index[n]] = batchResultItem(ops[n].Op, res)
+		if atomic && res.Err != nil {
+			status = http.StatusConflict
+		}
+		if res.Err == nil || res.Err == ErrOverBudget {
+			for _, breach := range breaches[n] {
+				items[index[n]].Warnings = append(items[index[n]].Warnings, breach.String())
+			}
+		}
+	}
+
+	writeBatch(w, status, items)
+	logger.Printf("batch: resp %d; %v ops, atomic %v", status, len(req.Ops), atomic)
+}
+
+// batchWithinBudgets fails the ops with breaches with ErrOverBudget, an atomic
+// batch aborts, and applies the rest
+func batchWithinBudgets(ctx context.Context, ops []BatchOp, breaches [][]BudgetBreach, atomic bool) ([]BatchResult, error) {
+
+	results := make([]BatchResult, len(ops))
+	var within []BatchOp
+	var index []int
+	for n, op := range ops {
+		if len(breaches[n]) > 0 {
+			results[n] = BatchResult{Err: ErrOverBudget}
+			continue
+		}
+		within = append(within, op)
+		index = append(index, n)
+	}
+
+	if atomic && len(within) < len(ops) {
+		abortBatch(results)
+		return results, nil
+	}
+	if len(within) == 0 {
+		return results, nil
+	}
+
+	applied, err := db.Batch(ctx, within, atomic)
+	if err != nil {
+		return nil, err
+	}
+	for i, res := range applied {
+		results[index[i]] = res
+	}
+
+	return results, nil
+}
+
+func writeBatch(w http.ResponseWriter, status int, items []batchItem) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]batchItem{"results": items})
+}
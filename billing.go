@@ -0,0 +1,305 @@
+package subs
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+const defaultBillingPeriod = "monthly"
+
+// billingMonths is the length of a billing period in months, weekly periods
+// are stepped in days instead. A sub charges its price every Billing_Interval
+// periods, on its anchor date plus whole steps in either direction, and the
+// charges inside its active months are billed.
+var billingMonths = map[string]int{
+	"weekly":    0,
+	"monthly":   1,
+	"quarterly": 3,
+	"yearly":    12,
+}
+
+// upper bound of billing_interval, ten years of monthly periods
+const maxBillingInterval = 120
+
+// withBillingDefaults fills in zero billing fields, monthly charges from the
+// first day of the start month like before billing periods
+func withBillingDefaults(sub Sub) Sub {
+
+	if sub.Billing_Period == "" {
+		sub.Billing_Period = defaultBillingPeriod
+	}
+
+	if sub.Billing_Interval == 0 {
+		sub.Billing_Interval = 1
+	}
+
+	if sub.Anchor == "" && validateSubDate(sub.Start) == nil {
+		sub.Anchor = dayDate(monthDay(monthIndex(sub.Start)))
+	}
+
+	return sub
+}
+
+func validateBilling(sub Sub) error {
+
+	if _, ok := billingMonths[sub.Billing_Period]; !ok {
+		return errors.New("invalid billing period")
+	}
+
+	if sub.Billing_Interval < 1 || sub.Billing_Interval > maxBillingInterval {
+		return errors.New("invalid billing interval")
+	}
+
+	if err := validateAnchor(sub.Anchor); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func validateAnchor(date string) error {
+
+	if err := validateDay(date); err != nil {
+		return errors.New("invalid anchor date")
+	}
+
+	return nil
+}
+
+// activeMonths is the [start, end] month index range of sub inside [from, to],
+// an open-ended sub lasts until the end of the period. start > end if they
+// don't overlap.
+func activeMonths(sub Sub, from int, to int) (int, int) {
+
+	start := max(monthIndex(sub.Start), from)
+	end := to
+	if sub.End != nil {
+		end = min(monthIndex(*sub.End), to)
+	}
+
+	return start, end
+}
+
+// schedule steps through the charge days of a sub from its anchor, in days
+// for weekly billing and in months otherwise
+type schedule struct {
+	weekly bool
+	step   int
+	anchor time.Time
+}
+
+func newSchedule(sub Sub) schedule {
+
+	sub = withBillingDefaults(sub)
+	anchor, _ := time.Parse(time.DateOnly, sub.Anchor)
+
+	if sub.Billing_Period == "weekly" {
+		return schedule{weekly: true, step: 7 * sub.Billing_Interval, anchor: anchor}
+	}
+
+	return schedule{step: billingMonths[sub.Billing_Period] * sub.Billing_Interval, anchor: anchor}
+}
+
+// at mirrors the charge_at SQL function, the dayIndex of charge k. Monthly
+// steps keep the anchor day, or the last day of shorter months.
+func (s schedule) at(k int) int {
+
+	if s.weekly {
+		return dayIndex(s.anchor) + k*s.step
+	}
+
+	return addMonths(dayIndex(s.anchor), k*s.step)
+}
+
+// k mirrors the charge_k SQL function, the last charge on or before day, or
+// with after the first one on or after it
+func (s schedule) k(day int, after bool) int {
+
+	// the step count is exact in days, in months it can be one off
+	d := day - dayIndex(s.anchor)
+	if !s.weekly {
+		d = dayMonth(day) - (s.anchor.Year()*12 + int(s.anchor.Month()) - 1)
+	}
+
+	if after {
+		k := ceilDiv(d, s.step)
+		if s.at(k) < day {
+			k++
+		}
+		return k
+	}
+
+	k := floorDiv(d, s.step)
+	if s.at(k) > day {
+		k--
+	}
+	return k
+}
+
+// proration is a charge of a period cut by a start or end inside a month,
+// billed for the days it covers. An end cut replaces the full charge of the
+// period, which falls on the same day.
+type proration struct {
+	day      int
+	amount   Money
+	replaces bool
+}
+
+// prorations mirrors the sub_prorations SQL function, prorating price
+func (s schedule) prorations(sub Sub, price Money) []proration {
+
+	start := startDay(sub.Start)
+	end := math.MaxInt32
+	if sub.End != nil {
+		end = endDay(*sub.End)
+	}
+	if start > end {
+		return nil
+	}
+
+	var list []proration
+
+	// a start inside a month cuts the period it falls in, unless a charge
+	// starts a period on that very day
+	if start != monthDay(dayMonth(start)) {
+		k := s.k(start, false)
+		if from, next := s.at(k), s.at(k+1); from < start {
+			list = append(list, proration{day: start, amount: prorate(price, min(next, end+1)-start, next-from)})
+		}
+	}
+
+	// an end inside a month cuts the period of the last charge, unless that
+	// period ends with the sub
+	if sub.End != nil && end+1 != monthDay(dayMonth(end)+1) {
+		k := s.k(end, false)
+		if from, next := s.at(k), s.at(k+1); from >= start && next > end+1 {
+			list = append(list, proration{day: from, amount: prorate(price, end+1-from, next-from), replaces: true})
+		}
+	}
+
+	return list
+}
+
+// prorate is the price of days of a period, rounded half up like round() on
+// numerics in SQL
+func prorate(price Money, days int, period int) Money {
+	return (price*Money(days)*2 + Money(period)) / (Money(period) * 2)
+}
+
+// subCharges is the number and total amount of the subChargeRuns of sub
+func subCharges(sub Sub, from int, to int) (int, Money) {
+
+	count, amount := 0, Money(0)
+	for _, run := range subChargeRuns(sub, from, to) {
+		count += run.count
+		amount += Money(run.count) * run.amount
+	}
+
+	return count, amount
+}
+
+// chargeRun is count charges of the same amount
+type chargeRun struct {
+	amount Money
+	count  int
+}
+
+// subChargeRuns mirrors the sub_charge_list SQL function over the sub_phases
+// of sub, the charges of sub on days inside the [from, to] month indexes.
+// Charges in a trial are not listed.
+func subChargeRuns(sub Sub, from int, to int) []chargeRun {
+
+	start, end := activeMonths(sub, from, to)
+	if start > end {
+		return nil
+	}
+
+	lo := max(startDay(sub.Start), monthDay(from))
+	hi := monthDay(to+1) - 1
+	if sub.End != nil {
+		hi = min(endDay(*sub.End), hi)
+	}
+
+	s := newSchedule(sub)
+	var runs []chargeRun
+	for _, p := range subPhases(sub) {
+		runs = append(runs, s.runs(sub, p.price, max(lo, p.from), min(hi, p.to))...)
+	}
+
+	return runs
+}
+
+// runs lists the charges of sub at price on the days from lo to hi, the full
+// ones in the first run and each prorated one in its own
+func (s schedule) runs(sub Sub, price Money, lo int, hi int) []chargeRun {
+
+	if lo > hi {
+		return nil
+	}
+
+	runs := []chargeRun{{amount: price, count: max(s.k(hi, false)-s.k(lo, true)+1, 0)}}
+	for _, p := range s.prorations(sub, price) {
+		if p.day < lo || p.day > hi {
+			continue
+		}
+		if p.replaces {
+			runs[0].count--
+		}
+		runs = append(runs, chargeRun{amount: p.amount, count: 1})
+	}
+
+	return runs
+}
+
+func floorDiv(a int, b int) int {
+
+	// Go division truncates towards zero
+	if a%b != 0 && a < 0 {
+		return a/b - 1
+	}
+
+	return a / b
+}
+
+func ceilDiv(a int, b int) int {
+
+	if a%b != 0 && a > 0 {
+		return a/b + 1
+	}
+
+	return a / b
+}
+
+// addMonths mirrors date + interval in SQL, the day months after day with the
+// same day of the month, or the last day of a shorter month
+func addMonths(day int, months int) int {
+
+	t := time.Unix(int64(day)*86400, 0).UTC()
+	month := t.Year()*12 + int(t.Month()) - 1 + months
+	days := monthDay(month+1) - monthDay(month)
+
+	return monthDay(month) + min(t.Day(), days) - 1
+}
+
+// dayIndex counts the days from the epoch to t
+func dayIndex(t time.Time) int {
+	return int(t.Unix() / 86400)
+}
+
+// monthDay is the dayIndex of the first day of the month index
+func monthDay(month int) int {
+	return dayIndex(time.Date(month/12, time.Month(month%12+1), 1, 0, 0, 0, 0, time.UTC))
+}
+
+// dayMonth is the month index of a dayIndex
+func dayMonth(day int) int {
+
+	t := time.Unix(int64(day)*86400, 0).UTC()
+	return t.Year()*12 + int(t.Month()) - 1
+}
+
+// dayDate is the YYYY-MM-DD date of a dayIndex
+func dayDate(day int) string {
+	return time.Unix(int64(day)*86400, 0).UTC().Format(time.DateOnly)
+}
@@ -0,0 +1,161 @@
+package subs
+
+import "testing"
+
+func TestSubCharges(t *testing.T) {
+
+	end := "12-2025"
+	for _, tc := range []struct {
+		sub      Sub
+		from, to string
+		expected int
+	}{
+		// without billing fields a sub charges every active month
+		{Sub{Start: "03-2024"}, "01-2024", "12-2024", 10},
+		{Sub{Start: "03-2024", End: &end}, "01-2025", "12-2026", 12},
+		{Sub{Start: "03-2024"}, "01-2023", "02-2024", 0},
+
+		{Sub{Start: "03-2024", Billing_Period: "monthly", Billing_Interval: 2, Anchor: "2024-03-31"}, "01-2024", "12-2024", 5},
+		{Sub{Start: "03-2024", Billing_Period: "quarterly", Billing_Interval: 1, Anchor: "2024-03-15"}, "01-2024", "12-2024", 4},
+		{Sub{Start: "03-2024", Billing_Period: "quarterly", Billing_Interval: 1, Anchor: "2024-03-15"}, "04-2024", "05-2024", 0},
+		{Sub{Start: "03-2024", Billing_Period: "yearly", Billing_Interval: 1, Anchor: "2024-03-15"}, "01-2024", "12-2026", 3},
+		{Sub{Start: "03-2024", Billing_Period: "yearly", Billing_Interval: 1, Anchor: "2024-03-15"}, "04-2024", "02-2025", 0},
+		{Sub{Start: "03-2024", End: &end, Billing_Period: "yearly", Billing_Interval: 1, Anchor: "2024-03-15"}, "01-2024", "12-2030", 2},
+
+		// an anchor before the start only sets the phase of the charges
+		{Sub{Start: "03-2024", Billing_Period: "yearly", Billing_Interval: 2, Anchor: "2019-06-01"}, "01-2024", "12-2030", 3},
+
+		// July 2024 has five Mondays and August four
+		{Sub{Start: "07-2024", Billing_Period: "weekly", Billing_Interval: 1, Anchor: "2024-07-01"}, "07-2024", "07-2024", 5},
+		{Sub{Start: "07-2024", Billing_Period: "weekly", Billing_Interval: 1, Anchor: "2024-07-01"}, "07-2024", "08-2024", 9},
+		{Sub{Start: "07-2024", Billing_Period: "weekly", Billing_Interval: 2, Anchor: "2024-07-01"}, "07-2024", "08-2024", 5},
+		{Sub{Start: "07-2024", Billing_Period: "weekly", Billing_Interval: 1, Anchor: "2030-01-07"}, "08-2024", "08-2024", 4},
+
+		// charges in a trial are skipped, intro ones counted
+		{Sub{Start: "03-2024", Trial_Months: 2}, "01-2024", "12-2024", 8},
+		{Sub{Start: "03-2024", Trial_Months: 2, Intro_Months: 3}, "01-2024", "12-2024", 8},
+		{Sub{Start: "07-2024", Billing_Period: "weekly", Billing_Interval: 1, Anchor: "2024-07-01", Trial_Months: 1}, "07-2024", "08-2024", 4},
+		{Sub{Start: "03-2024", End: &end, Billing_Period: "yearly", Billing_Interval: 1, Anchor: "2024-03-15", Trial_Months: 12}, "01-2024", "12-2030", 1},
+	} {
+		if n, _ := subCharges(tc.sub, monthIndex(tc.from), monthIndex(tc.to)); n != tc.expected {
+			t.Errorf("%v in %v..%v: expected %v charges, got %v", tc.sub, tc.from, tc.to, tc.expected, n)
+		}
+	}
+}
+
+func TestProration(t *testing.T) {
+
+	for _, tc := range []struct {
+		start    string
+		end      string
+		billing  string
+		anchor   string
+		from, to string
+		expected Money
+	}{
+		// calendar months, July 20th to 31st is 12 of 31 days of 31.00
+		{"2024-07-20", "", "monthly", "", "07-2024", "07-2024", 1200},
+		{"2024-07-20", "", "monthly", "", "07-2024", "08-2024", 1200 + 3100},
+		// September 1st to 10th is 10 of 30 days
+		{"07-2024", "2024-09-10", "monthly", "", "07-2024", "12-2024", 3100 + 3100 + 1033},
+		// both cuts in the same period, July 10th to 19th
+		{"2024-07-10", "2024-07-19", "monthly", "", "01-2024", "12-2024", 1000},
+		// a start on a charge day or an end before the next one cuts nothing
+		{"2024-07-15", "2024-08-14", "monthly", "2024-01-15", "01-2024", "12-2024", 3100},
+		// a yearly period of 365 days from March 15th 2024 has 316 left on May 3rd
+		{"2024-05-03", "", "yearly", "2024-03-15", "05-2024", "05-2024", 2684},
+		{"2024-05-03", "", "yearly", "2024-03-15", "06-2024", "02-2025", 0},
+		{"2024-05-03", "2025-03-31", "yearly", "2024-03-15", "01-2024", "12-2025", 2684 + 3100},
+		{"2024-05-03", "2025-03-20", "yearly", "2024-03-15", "01-2024", "12-2025", 2684 + 51},
+		// month forms keep whole charges, March 15th 2025 only
+		{"05-2024", "05-2025", "yearly", "2024-03-15", "01-2024", "12-2025", 3100},
+		// a day before the start
+		{"2024-07-20", "2024-07-10", "monthly", "", "01-2024", "12-2024", 0},
+	} {
+		sub := Sub{Price: 3100, Start: tc.start, Billing_Period: tc.billing, Billing_Interval: 1, Anchor: tc.anchor}
+		if tc.end != "" {
+			sub.End = &tc.end
+		}
+		sub = withBillingDefaults(sub)
+
+		if _, amount := subCharges(sub, monthIndex(tc.from), monthIndex(tc.to)); amount != tc.expected {
+			t.Errorf("%v in %v..%v: expected %v, got %v", sub, tc.from, tc.to, tc.expected, amount)
+		}
+	}
+}
+
+func TestIntroPrice(t *testing.T) {
+
+	for _, tc := range []struct {
+		start    string
+		trial    int
+		intro    int
+		from, to string
+		expected Money
+	}{
+		{"01-2024", 0, 2, "01-2024", "06-2024", 2*1000 + 4*3100},
+		{"01-2024", 1, 2, "01-2024", "06-2024", 2*1000 + 3*3100},
+		{"01-2024", 1, 2, "03-2024", "03-2024", 1000},
+		// the trial of January 31st lasts until February 28th, the intro months
+		// until April 29th and the charges fall on the first of the month
+		{"2024-01-31", 1, 2, "01-2024", "06-2024", 2*1000 + 2*3100},
+		// a start inside a month prorates the intro price without a trial
+		{"2024-07-20", 0, 1, "07-2024", "08-2024", 387 + 1000},
+	} {
+		sub := withBillingDefaults(Sub{Price: 3100, Start: tc.start, Trial_Months: tc.trial, Intro_Price: 1000, Intro_Months: tc.intro})
+
+		if _, amount := subCharges(sub, monthIndex(tc.from), monthIndex(tc.to)); amount != tc.expected {
+			t.Errorf("%v in %v..%v: expected %v, got %v", sub, tc.from, tc.to, tc.expected, amount)
+		}
+	}
+}
+
+func TestCanonicalDate(t *testing.T) {
+
+	for _, tc := range []struct {
+		date     string
+		end      bool
+		expected string
+	}{
+		{"07-2024", false, "07-2024"},
+		{"2024-07-01", false, "07-2024"},
+		{"2024-07-31", false, "2024-07-31"},
+		{"2024-07-31", true, "07-2024"},
+		{"2024-02-29", true, "02-2024"},
+		{"2024-02-28", true, "2024-02-28"},
+		{"2024-02-30", true, "2024-02-30"},
+	} {
+		if d := canonicalDate(tc.date, tc.end); d != tc.expected {
+			t.Errorf("%v, end %v: expected %v, got %v", tc.date, tc.end, tc.expected, d)
+		}
+	}
+
+	for _, tc := range []struct {
+		date       string
+		start, end string
+	}{
+		{"07-2024", "2024-07-01", "2024-07-31"},
+		{"02-2024", "2024-02-01", "2024-02-29"},
+		{"2024-07-20", "2024-07-20", "2024-07-20"},
+	} {
+		if s, e := isoDay(tc.date, false), isoDay(tc.date, true); s != tc.start || e != tc.end {
+			t.Errorf("%v: expected %v..%v, got %v..%v", tc.date, tc.start, tc.end, s, e)
+		}
+	}
+}
+
+func TestDivision(t *testing.T) {
+
+	for _, tc := range []struct{ a, b, floor, ceil int }{
+		{0, 3, 0, 0},
+		{1, 3, 0, 1},
+		{3, 3, 1, 1},
+		{-1, 3, -1, 0},
+		{-3, 3, -1, -1},
+		{-7, 3, -3, -2},
+	} {
+		if f, c := floorDiv(tc.a, tc.b), ceilDiv(tc.a, tc.b); f != tc.floor || c != tc.ceil {
+			t.Errorf("%v / %v: expected %v and %v, got %v and %v", tc.a, tc.b, tc.floor, tc.ceil, f, c)
+		}
+	}
+}
@@ -5,13 +5,97 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"subs"
+	"time"
 
 	"github.com/golang-migrate/migrate/v4"
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 )
 
+// unset env vars yield zero values, malformed ones stop the service
+func envInt(name string) int {
+
+	s := os.Getenv(name)
+	if s == "" {
+		return 0
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 {
+		log.Fatalf("invalid %v: %v", name, s)
+	}
+
+	return i
+}
+
+func envDuration(name string) time.Duration {
+
+	s := os.Getenv(name)
+	if s == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		log.Fatalf("invalid %v: %v", name, s)
+	}
+
+	return d
+}
+
+// openDSN picks the sql backend by the DB_DSN scheme, postgres built from DB_* vars by default
+func openDSN() subs.DB {
+
+	conn_str := os.Getenv("DB_DSN")
+	if conn_str == "" {
+		conn_str = fmt.Sprintf("postgres://%v:%v@%v:5432/%v?sslmode=disable", os.Getenv("DB_USER"), os.Getenv("DB_PASS"), os.Getenv("DB_HOST"), os.Getenv("DB_DB"))
+	}
+
+	scheme, path, _ := strings.Cut(conn_str, "://")
+	switch scheme {
+	case "postgres", "postgresql":
+		return openPostgres(conn_str)
+	case "sqlite":
+		db, err := subs.NewSQLiteDB(path)
+		if err != nil {
+			log.Fatalf("sqlite error: %v", err)
+		}
+		return db
+	}
+
+	log.Fatalf("unknown db scheme: %v", scheme)
+	return nil
+}
+
+func openPostgres(conn_str string) subs.DB {
+
+	pool := subs.PoolConfig{
+		MinConns:          int32(envInt("DB_POOL_MIN_CONNS")),
+		MaxConns:          int32(envInt("DB_POOL_MAX_CONNS")),
+		MaxConnIdleTime:   envDuration("DB_POOL_MAX_IDLE_TIME"),
+		MaxConnLifetime:   envDuration("DB_POOL_MAX_LIFETIME"),
+		HealthCheckPeriod: envDuration("DB_POOL_HEALTH_CHECK_PERIOD"),
+	}
+
+	db, err := subs.NewPGXDB(conn_str, pool)
+	if err != nil {
+		log.Fatalf("postgres connection error: %v", err)
+	}
+
+	mig, err := migrate.New("file://", conn_str)
+	if err != nil {
+		log.Fatalf("migration error: %v", err)
+	}
+
+	if err := mig.Up(); err != nil && err != migrate.ErrNoChange {
+		log.Fatalf("migration error: %v", err)
+	}
+
+	return db
+}
+
 func main() {
 
 	if s := os.Getenv("LOG_TO_FILE"); s != "" {
@@ -26,20 +110,42 @@ func main() {
 		}
 	}
 
-	conn_str := fmt.Sprintf("postgres://%v:%v@%v:5432/%v?sslmode=disable", os.Getenv("DB_USER"), os.Getenv("DB_PASS"), os.Getenv("DB_HOST"), os.Getenv("DB_DB"))
+	var db subs.DB
+	switch storage := os.Getenv("SUBS_STORAGE"); storage {
+	case "memory":
+		mem, err := subs.NewMemDB(os.Getenv("SUBS_SNAPSHOT"))
+		if err != nil {
+			log.Fatalf("memory storage error: %v", err)
+		}
+		db = mem
+	case "", "sql", "postgres":
+		// postgres is the name of sql storage from before sqlite
+		db = openDSN()
+	default:
+		log.Fatalf("unknown storage: %v", storage)
+	}
 
-	db, err := subs.NewPGXDB(conn_str)
-	if err != nil {
-		log.Fatalf("postgres connection error: %v", err)
+	if d := envDuration("QUERY_TIMEOUT"); d > 0 {
+		subs.SetQueryTimeout(d)
+	}
+	if d := envDuration("IDEMPOTENCY_TTL"); d > 0 {
+		subs.SetIdempotencyTTL(d)
 	}
 
-	mig, err := migrate.New("file://", conn_str)
-	if err != nil {
-		log.Fatalf("migration error: %v", err)
+	switch s := os.Getenv("USER_DELETE"); s {
+	case "", "block":
+	case "cascade":
+		subs.SetUserDeleteCascade(true)
+	default:
+		log.Fatalf("invalid USER_DELETE: %v", s)
 	}
 
-	if err := mig.Up(); err != nil && err != migrate.ErrNoChange {
-		log.Fatalf("migration error: %v", err)
+	switch s := os.Getenv("BUDGET_MODE"); s {
+	case "", "warn":
+	case "strict":
+		subs.SetBudgetStrict(true)
+	default:
+		log.Fatalf("invalid BUDGET_MODE: %v", s)
 	}
 
 	subs.Start(db)
@@ -0,0 +1,741 @@
+package subs
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+var ErrBudgetConflict = errors.New("budget exists")
+var ErrOverBudget = errors.New("over budget")
+
+// writes of subs, their prices, pauses and members breaching a budget of a
+// user sharing them respond with a Budget-Warning header, or fail with 409 in
+// strict mode
+var budgetStrict = false
+
+func SetBudgetStrict(strict bool) {
+	budgetStrict = strict
+}
+
+// budgetCheckMonths is how many months of a sub from the current one a write
+// is checked against the budgets of its user
+const budgetCheckMonths = 12
+
+// Budget limits the monthly spend of a user in Currency, as GET
+// /users/{id}/spend sums it. A budget of a Category or a Service only limits
+// the subs of that category or service name, otherwise all of them.
+type Budget struct {
+	ID            string `json:"budget_id"`
+	User_ID       string `json:"user_id"`
+	Monthly_Limit Money  `json:"monthly_limit"`
+	Currency      string `json:"currency"`
+	Category      string `json:"category"`
+	Service       string `json:"service_name"`
+}
+
+// BudgetMonth is the spend a budget limits in a month
+type BudgetMonth struct {
+	Month string `json:"month"`
+	Sum   Money  `json:"sum"`
+}
+
+// BudgetEvaluation lists the months a budget is exceeded in
+type BudgetEvaluation struct {
+	Budget
+	Months_Over []BudgetMonth `json:"months_over"`
+}
+
+// BudgetBreach is the first month a write of a sub takes a budget over its
+// limit in
+type BudgetBreach struct {
+	Budget
+	BudgetMonth
+}
+
+func (b BudgetBreach) String() string {
+	return fmt.Sprintf("budget %v over in %v: %v of %v %v", b.ID, b.Month, b.Sum, b.Monthly_Limit, b.Currency)
+}
+
+func normalizeBudget(budget Budget) Budget {
+
+	budget.Category = strings.TrimSpace(budget.Category)
+	budget.Service = strings.TrimSpace(budget.Service)
+
+	return budget
+}
+
+func validateBudget(budget Budget) error {
+
+	if budget.Monthly_Limit < 0 {
+		return errors.New("invalid monthly limit")
+	}
+
+	if budget.Monthly_Limit > maxPrice {
+		return errors.New("monthly limit too large")
+	}
+
+	if err := validateCurrency(budget.Currency); err != nil {
+		return err
+	}
+
+	if budget.Category != "" && budget.Service != "" {
+		return errors.New("both category and service name")
+	}
+
+	if len(budget.Category) > maxServiceNameLen {
+		return errors.New("category too long")
+	}
+
+	if len(budget.Service) > maxServiceNameLen {
+		return errors.New("service name too long")
+	}
+
+	return nil
+}
+
+// sameBudgetScope tells whether two budgets of a user limit the same subs,
+// like the budgets_scope index
+func sameBudgetScope(a Budget, b Budget) bool {
+	return a.User_ID == b.User_ID && a.Category == b.Category && serviceKey(a.Service) == serviceKey(b.Service)
+}
+
+// compareBudgets orders budgets by category, service name and id bytewise
+func compareBudgets(a Budget, b Budget) int {
+
+	if c := cmp.Compare(a.Category, b.Category); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.Service, b.Service); c != 0 {
+		return c
+	}
+
+	return cmp.Compare(a.ID, b.ID)
+}
+
+// budgetFilter is the sum filter of the spend budget limits in [from, to],
+// its service resolved against catalog so it follows a renamed entry
+func budgetFilter(budget Budget, catalog serviceCatalog, from int, to int) Sub {
+
+	end := monthDate(to)
+	service := catalog.resolve(Sub{Service: budget.Service}).Service
+	return Sub{Start: monthDate(from), End: &end, User_ID: budget.User_ID, Service: service, Category: budget.Category, Currency: budget.Currency}
+}
+
+// checkBudgets returns the breaches of writing sub over the sub id, a new one
+// without an id, like checkBudgetChange
+func checkBudgets(ctx context.Context, sub Sub, id string) ([]BudgetBreach, error) {
+	return checkBudgetChange(ctx, id, func(c *chargedSub) { c.sub = sub })
+}
+
+// chargedSub is a sub with the prices, pauses and members its charges depend on
+type chargedSub struct {
+	sub     Sub
+	prices  priceTable
+	pauses  pauseTable
+	members memberTable
+}
+
+// budgetChange is a write of the sub id, a new one without an id. It is
+// checked in [from, to], budgetCheckMonths from the later of its start and
+// the current month, and in no month when to is before from.
+type budgetChange struct {
+	id     string
+	before chargedSub
+	after  chargedSub
+	from   int
+	to     int
+}
+
+// readBudgetChange reads the sub id with its prices, pauses and members, and
+// applies change to a copy of them
+func readBudgetChange(ctx context.Context, id string, change func(*chargedSub)) (budgetChange, error) {
+
+	before := chargedSub{prices: make(priceTable), pauses: make(pauseTable), members: make(memberTable)}
+	if id != "" {
+		old, err := db.Read(ctx, id)
+		if err != nil {
+			return budgetChange{}, err
+		}
+		before.sub = old
+		before.pauses[id] = old.Pauses
+
+		list, err := db.ListPrices(ctx, id)
+		if err != nil {
+			return budgetChange{}, err
+		}
+		for _, price := range list {
+			before.prices.set(id, price)
+		}
+
+		shares, err := db.ListMembers(ctx, id)
+		if err != nil {
+			return budgetChange{}, err
+		}
+		for _, member := range shares {
+			before.members.set(id, member)
+		}
+	}
+
+	after := chargedSub{
+		sub:     before.sub,
+		prices:  priceTable{id: slices.Clone(before.prices[id])},
+		pauses:  pauseTable{id: slices.Clone(before.pauses[id])},
+		members: memberTable{id: slices.Clone(before.members[id])},
+	}
+	change(&after)
+	after.sub = normalizeSub(after.sub)
+	after.sub.ID = id
+
+	from := max(monthIndex(after.sub.Start), dayMonth(dayIndex(time.Now().UTC())))
+	to := from + budgetCheckMonths - 1
+	if after.sub.End != nil {
+		to = min(to, monthIndex(*after.sub.End))
+	}
+
+	return budgetChange{id: id, before: before, after: after, from: from, to: to}, nil
+}
+
+// users are the owners and members of the sub before and after c
+func (c budgetChange) users() []string {
+
+	var users []string
+	for _, charged := range []chargedSub{c.before, c.after} {
+		if charged.sub.User_ID != "" {
+			users = append(users, charged.sub.User_ID)
+		}
+		for _, member := range charged.members[c.id] {
+			users = append(users, member.User_ID)
+		}
+	}
+	slices.Sort(users)
+
+	return slices.Compact(users)
+}
+
+// budgetSpend is the monthly spend of the budgets of the users of a request's
+// changes, read once so that each change is checked in memory
+type budgetSpend struct {
+	rates   rateTable
+	catalog serviceCatalog
+	budgets map[string][]Budget
+	spend   map[string]map[string]Money
+}
+
+// readBudgetSpend reads the spend of those of budgets whose user changes
+// share a sub with, in the months the changes are checked in. A budget is
+// summed once per run of adjacent months. Budgets that can't be converted
+// for lack of fx rates are skipped.
+func readBudgetSpend(ctx context.Context, changes []budgetChange, budgets []Budget, catalog serviceCatalog) (*budgetSpend, error) {
+
+	s := &budgetSpend{catalog: catalog, budgets: make(map[string][]Budget), spend: make(map[string]map[string]Money)}
+
+	spans := make(map[string][][2]int)
+	for _, c := range changes {
+		if c.to < c.from {
+			continue
+		}
+		for _, user := range c.users() {
+			spans[user] = append(spans[user], [2]int{c.from, c.to})
+		}
+	}
+
+	var checked []Budget
+	for _, budget := range budgets {
+		if _, ok := spans[budget.User_ID]; ok {
+			checked = append(checked, budget)
+		}
+	}
+	if len(checked) == 0 {
+		return s, nil
+	}
+
+	list, err := db.ListRates(ctx, "", "")
+	if err != nil {
+		return nil, err
+	}
+	s.rates = make(rateTable)
+	for _, rate := range list {
+		s.rates.set(rate)
+	}
+
+	for _, budget := range checked {
+
+		spend := make(map[string]Money)
+		var err error
+		for _, span := range mergeSpans(spans[budget.User_ID]) {
+			var groups []SumGroup
+			groups, err = db.SumGroups(ctx, budgetFilter(budget, catalog, span[0], span[1]), "month")
+			if err != nil {
+				break
+			}
+			for _, month := range groups {
+				spend[month.Group] = month.Sum
+			}
+		}
+		var rerr *RateError
+		if errors.As(err, &rerr) {
+			logger.Printf("budget %v not checked: %v", budget.ID, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		s.budgets[budget.User_ID] = append(s.budgets[budget.User_ID], budget)
+		s.spend[budget.ID] = spend
+	}
+
+	return s, nil
+}
+
+// mergeSpans joins overlapping and adjacent spans of months, ordered by start
+func mergeSpans(spans [][2]int) [][2]int {
+
+	spans = slices.Clone(spans)
+	slices.SortFunc(spans, func(a [2]int, b [2]int) int { return cmp.Compare(a[0], b[0]) })
+
+	var merged [][2]int
+	for _, span := range spans {
+		if n := len(merged); n > 0 && span[0] <= merged[n-1][1]+1 {
+			merged[n-1][1] = max(merged[n-1][1], span[1])
+			continue
+		}
+		merged = append(merged, span)
+	}
+
+	return merged
+}
+
+// check returns the breaches of c against the spend, and the change of spend
+// per budget and month it makes. A month is breached when c raises the spend
+// in it over the limit.
+func (s *budgetSpend) check(c budgetChange) ([]BudgetBreach, map[string]map[string]Money, error) {
+
+	if c.to < c.from {
+		return nil, nil, nil
+	}
+
+	var stored []Sub
+	if c.id != "" {
+		stored = append(stored, c.before.sub)
+	}
+
+	var breaches []BudgetBreach
+	deltas := make(map[string]map[string]Money)
+	for _, user := range c.users() {
+		for _, budget := range s.budgets[user] {
+
+			filter := budgetFilter(budget, s.catalog, c.from, c.to)
+
+			old, err := sumCharges(slices.Values(stored), filter, "month", s.rates, c.before.prices, c.before.pauses, c.before.members)
+			var charges map[string]Money
+			if err == nil {
+				charges, err = sumCharges(slices.Values([]Sub{c.after.sub}), filter, "month", s.rates, c.after.prices, c.after.pauses, c.after.members)
+			}
+			var rerr *RateError
+			if errors.As(err, &rerr) {
+				logger.Printf("budget %v not checked: %v", budget.ID, err)
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+
+			delta := make(map[string]Money)
+			breached := false
+			for i := c.from; i <= c.to; i++ {
+				month := monthDate(i)
+				if charges[month] == old[month] {
+					continue
+				}
+				delta[month] = charges[month] - old[month]
+
+				if sum := s.spend[budget.ID][month] + delta[month]; !breached && delta[month] > 0 && sum > budget.Monthly_Limit {
+					breaches = append(breaches, BudgetBreach{Budget: budget, BudgetMonth: BudgetMonth{Month: month, Sum: sum}})
+					breached = true
+				}
+			}
+			deltas[budget.ID] = delta
+		}
+	}
+
+	return breaches, deltas, nil
+}
+
+// add counts the deltas of a checked change in the spend, for the changes
+// after it
+func (s *budgetSpend) add(deltas map[string]map[string]Money) {
+
+	for id, delta := range deltas {
+		for month, amount := range delta {
+			s.spend[id][month] += amount
+		}
+	}
+}
+
+// checkBudgetChange returns the breaches of the budgets of the owner and the
+// members of the sub id, before or after change, by changing it. A new sub
+// has no id. Budgets that can't be converted for lack of fx rates are
+// skipped.
+//
+// The stored subs are read apart from the write, so concurrent writes may
+// take a budget over its limit together without a breach.
+func checkBudgetChange(ctx context.Context, id string, change func(*chargedSub)) ([]BudgetBreach, error) {
+
+	c, err := readBudgetChange(ctx, id, change)
+	if err != nil || c.to < c.from {
+		return nil, err
+	}
+
+	var budgets []Budget
+	for _, user := range c.users() {
+		list, err := db.ListBudgets(ctx, user)
+		if err != nil {
+			return nil, err
+		}
+		budgets = append(budgets, list...)
+	}
+	if len(budgets) == 0 {
+		return nil, nil
+	}
+
+	catalog, err := readCatalog(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	spend, err := readBudgetSpend(ctx, []budgetChange{c}, budgets, catalog)
+	if err != nil {
+		return nil, err
+	}
+
+	breaches, _, err := spend.check(c)
+	return breaches, err
+}
+
+// checkBudgetWrite sets a Budget-Warning header per breach of change, which
+// fail the write with ErrOverBudget in strict mode
+func checkBudgetWrite(w http.ResponseWriter, ctx context.Context, id string, change func(*chargedSub)) ([]BudgetBreach, error) {
+
+	breaches, err := checkBudgetChange(ctx, id, change)
+	budgetWarnings(w, breaches)
+	if err == nil && budgetStrict && len(breaches) > 0 {
+		err = ErrOverBudget
+	}
+
+	return breaches, err
+}
+
+// budgetWarnings sets a Budget-Warning header per breached budget
+func budgetWarnings(w http.ResponseWriter, breaches []BudgetBreach) {
+
+	for _, breach := range breaches {
+		w.Header().Add("Budget-Warning", breach.String())
+	}
+}
+
+// decodeBudget reads the budget of a request, in the default currency of the
+// user unless it has one
+func decodeBudget(r *http.Request, user User) (Budget, error) {
+
+	var budget Budget
+	if err := json.NewDecoder(r.Body).Decode(&budget); err != nil {
+		return budget, errors.New("json error")
+	}
+	defer r.Body.Close()
+
+	budget = normalizeBudget(budget)
+	if budget.User_ID != "" && budget.User_ID != user.ID {
+		return budget, errors.New("user id mismatch")
+	}
+	budget.User_ID = user.ID
+	if budget.Currency == "" {
+		budget.Currency = user.Default_Currency
+	}
+
+	return budget, validateBudget(budget)
+}
+
+// resolveBudgetService names a budget of a service after its catalog entry,
+// like a sum filter
+func resolveBudgetService(ctx context.Context, budget *Budget) error {
+
+	if budget.Service == "" {
+		return nil
+	}
+
+	filter := Sub{Service: budget.Service}
+	if err := resolveFilterService(ctx, &filter, ""); err != nil {
+		return err
+	}
+	budget.Service = filter.Service
+
+	return nil
+}
+
+func listBudgetsHandler(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	user, ok := readUser(w, r, ctx, "list budgets")
+	if !ok {
+		return
+	}
+
+	budgets, err := db.ListBudgets(ctx, user.ID)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("list budgets: resp 504: %v; valid req %v", err, user.ID)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("list budgets: resp 500: %v; valid req %v", err, user.ID)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	if budgets == nil {
+		budgets = []Budget{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]Budget{"budgets": budgets})
+	logger.Printf("list budgets: resp 200 with %v entries; req %v", len(budgets), user.ID)
+}
+
+func createBudgetHandler(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	user, ok := readUser(w, r, ctx, "create budget")
+	if !ok {
+		return
+	}
+
+	budget, err := decodeBudget(r, user)
+	if err != nil {
+		logger.Printf("create budget: resp 400: %v; req %v", err, budget)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = resolveBudgetService(ctx, &budget)
+	if err == nil {
+		budget.ID, err = db.CreateBudget(ctx, budget)
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			logger.Printf("create budget: resp 404; valid req %v", budget)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if err == ErrBudgetConflict {
+			logger.Printf("create budget: resp 409; valid req %v", budget)
+			http.Error(w, "budget exists", http.StatusConflict)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("create budget: resp 504: %v; valid req %v", err, budget)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("create budget: resp 500: %v; valid req %v", err, budget)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"budget_id": budget.ID})
+	logger.Printf("create budget: resp 201 with %v; req %v", budget.ID, budget)
+}
+
+func updateBudgetHandler(w http.ResponseWriter, r *http.Request) {
+
+	budget_id := mux.Vars(r)["budget_id"]
+	if err := uuid.Validate(budget_id); err != nil {
+		logger.Printf("update budget: resp 400: %v; req %v", err, r.URL.Path)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	user, ok := readUser(w, r, ctx, "update budget")
+	if !ok {
+		return
+	}
+
+	budget, err := decodeBudget(r, user)
+	if err == nil && budget.ID != "" && budget.ID != budget_id {
+		err = errors.New("budget id mismatch")
+	}
+	if err != nil {
+		logger.Printf("update budget: resp 400: %v; req %v, %v", err, r.URL.Path, budget)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	budget.ID = budget_id
+
+	err = resolveBudgetService(ctx, &budget)
+	if err == nil {
+		err = db.UpdateBudget(ctx, budget)
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			logger.Printf("update budget: resp 404; valid req %v", r.URL.Path)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if err == ErrBudgetConflict {
+			logger.Printf("update budget: resp 409; valid req %v, %v", r.URL.Path, budget)
+			http.Error(w, "budget exists", http.StatusConflict)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("update budget: resp 504: %v; valid req %v, %v", err, r.URL.Path, budget)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("update budget: resp 500: %v; valid req %v, %v", err, r.URL.Path, budget)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(budget)
+	logger.Printf("update budget: resp 200; req %v, %v", r.URL.Path, budget)
+}
+
+func deleteBudgetHandler(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	id, budget_id := vars["id"], vars["budget_id"]
+	for _, v := range []string{id, budget_id} {
+		if err := uuid.Validate(v); err != nil {
+			logger.Printf("delete budget: resp 400: %v; req %v", err, r.URL.Path)
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	if err := db.DeleteBudget(ctx, id, budget_id); err != nil {
+		if err == ErrNotFound {
+			logger.Printf("delete budget: resp 404; valid req %v", r.URL.Path)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("delete budget: resp 504: %v; valid req %v", err, r.URL.Path)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("delete budget: resp 500: %v; valid req %v", err, r.URL.Path)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Printf("delete budget: resp 204; req %v", r.URL.Path)
+}
+
+// evaluateBudgetsHandler reports the months of the period each budget of a
+// user is exceeded in, summed per month like GET /subs/sum?group_by=month
+func evaluateBudgetsHandler(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	user, ok := readUser(w, r, ctx, "evaluate budgets")
+	if !ok {
+		return
+	}
+
+	start_date := r.URL.Query().Get("start_date")
+	end_date := r.URL.Query().Get("end_date")
+
+	err := validateFilter(Sub{Start: start_date, End: &end_date})
+	if err == nil && monthIndex(end_date) < monthIndex(start_date) {
+		err = errors.New("end period before start period")
+	}
+	if err == nil && monthIndex(end_date)-monthIndex(start_date) >= maxSumMonths {
+		err = errors.New("period too long")
+	}
+	if err != nil {
+		logger.Printf("evaluate budgets: resp 400: %v; req %v", err, r.URL.RawQuery)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	budgets, err := db.ListBudgets(ctx, user.ID)
+	var services []Service
+	if err == nil {
+		services, err = db.ListServices(ctx)
+	}
+	catalog := newServiceCatalog(services)
+
+	evaluations := []BudgetEvaluation{}
+	for _, budget := range budgets {
+		if err != nil {
+			break
+		}
+
+		var spend []SumGroup
+		spend, err = db.SumGroups(ctx, budgetFilter(budget, catalog, monthIndex(start_date), monthIndex(end_date)), "month")
+
+		evaluation := BudgetEvaluation{Budget: budget, Months_Over: []BudgetMonth{}}
+		for _, month := range spend {
+			if month.Sum > budget.Monthly_Limit {
+				evaluation.Months_Over = append(evaluation.Months_Over, BudgetMonth{Month: month.Group, Sum: month.Sum})
+			}
+		}
+		evaluations = append(evaluations, evaluation)
+	}
+	if err != nil {
+		var rerr *RateError
+		if errors.As(err, &rerr) {
+			logger.Printf("evaluate budgets: resp 422: %v; valid req %v", err, r.URL.RawQuery)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("evaluate budgets: resp 504: %v; valid req %v", err, r.URL.RawQuery)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("evaluate budgets: resp 500: %v; valid req %v", err, r.URL.RawQuery)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]BudgetEvaluation{"budgets": evaluations})
+	logger.Printf("evaluate budgets: resp 200 with %v budgets; req %v, %v", len(evaluations), user.ID, r.URL.RawQuery)
+}
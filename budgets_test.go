@@ -0,0 +1,369 @@
+package subs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestValidateBudget(t *testing.T) {
+
+	budget := normalizeBudget(Budget{Category: " video ", Service: " "})
+	if budget != (Budget{Category: "video"}) {
+		t.Errorf("unexpected normalized budget: %v", budget)
+	}
+
+	for _, budget := range []Budget{
+		{Currency: "RUB"},
+		{Monthly_Limit: maxPrice, Currency: "USD", Category: "video"},
+		{Monthly_Limit: 100, Currency: "RUB", Service: strings.Repeat("a", maxServiceNameLen)},
+	} {
+		if err := validateBudget(budget); err != nil {
+			t.Errorf("%v: expected nil, got %v", budget, err)
+		}
+	}
+
+	for _, budget := range []Budget{
+		{Monthly_Limit: -1, Currency: "RUB"},
+		{Monthly_Limit: maxPrice + 1, Currency: "RUB"},
+		{Monthly_Limit: 100},
+		{Monthly_Limit: 100, Currency: "rub"},
+		{Monthly_Limit: 100, Currency: "RUB", Category: "video", Service: "a"},
+		{Monthly_Limit: 100, Currency: "RUB", Category: strings.Repeat("a", maxServiceNameLen+1)},
+	} {
+		if err := validateBudget(budget); err == nil {
+			t.Errorf("%v: expected err, got nil", budget)
+		}
+	}
+}
+
+func TestBudgetHandlers(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m := h.m
+
+	do := func(method string, path string, body string) (int, string, []string) {
+		t.Helper()
+
+		resp, b := h.send(method, path, body)
+		return resp.StatusCode, b, resp.Header.Values("Budget-Warning")
+	}
+
+	created := func(body string, key string) string {
+		t.Helper()
+
+		var r map[string]string
+		if err := json.Unmarshal([]byte(body), &r); err != nil {
+			t.Fatal(err)
+		}
+		return r[key]
+	}
+
+	user := addUser(t, m)
+	budgets := "/users/" + user + "/budgets"
+	var total, video string
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, body := range []string{
+			`{"monthly_limit": "-1.00"}`,
+			`{"monthly_limit": "1.00", "category": "video", "service_name": "a"}`,
+			`{"monthly_limit": "1.00", "user_id": "` + uuid.NewString() + `"}`,
+			`{"monthly_limit": `,
+		} {
+			if status, _, _ := do("POST", budgets, body); status != 400 {
+				t.Errorf("%v: expected status: 400, got %v", body, status)
+			}
+		}
+		for _, path := range []string{budgets + "/evaluation", budgets + "/evaluation?start_date=02-2030&end_date=01-2030", "/users/abc/budgets"} {
+			if status, _, _ := do("GET", path, ""); status != 400 {
+				t.Errorf("%v: expected status: 400, got %v", path, status)
+			}
+		}
+		if status, _, _ := do("GET", "/users/"+uuid.NewString()+"/budgets", ""); status != 404 {
+			t.Errorf("expected status: 404, got %v", status)
+		}
+	})
+
+	t.Run("create", func(t *testing.T) {
+		status, body, _ := do("POST", budgets, `{"monthly_limit": "10.00"}`)
+		if status != 201 {
+			t.Fatalf("expected status: 201, got %v %v", status, body)
+		}
+		total = created(body, "budget_id")
+
+		status, body, _ = do("POST", budgets, `{"monthly_limit": "3.00", "category": "video"}`)
+		if status != 201 {
+			t.Fatalf("expected status: 201, got %v %v", status, body)
+		}
+		video = created(body, "budget_id")
+
+		if status, _, _ := do("POST", budgets, `{"monthly_limit": "1.00", "category": " video "}`); status != 409 {
+			t.Errorf("expected status: 409, got %v", status)
+		}
+
+		// budgets are in the default currency of their user
+		status, body, _ = do("GET", budgets, "")
+		expected := `{"budgets":[{"budget_id":"` + total + `","user_id":"` + user + `","monthly_limit":"10.00","currency":"RUB","category":"","service_name":""},` +
+			`{"budget_id":"` + video + `","user_id":"` + user + `","monthly_limit":"3.00","currency":"RUB","category":"video","service_name":""}]}`
+		if status != 200 || body != expected {
+			t.Errorf("expected %v, got %v %v", expected, status, body)
+		}
+	})
+
+	var sub_id string
+
+	t.Run("warnings", func(t *testing.T) {
+		status, _, warnings := do("POST", "/subs", `{"service_name": "a", "price": "5.00", "user_id": "`+user+`", "start_date": "01-2030", "category": "video"}`)
+		if status != 201 || len(warnings) != 1 || warnings[0] != "budget "+video+" over in 01-2030: 5.00 of 3.00 RUB" {
+			t.Errorf("expected a warning of budget %v, got %v %v", video, status, warnings)
+		}
+
+		status, body, warnings := do("POST", "/subs", `{"service_name": "b", "price": "4.00", "user_id": "`+user+`", "start_date": "01-2030"}`)
+		if status != 201 || len(warnings) != 0 {
+			t.Fatalf("expected no warnings, got %v %v %v", status, body, warnings)
+		}
+		sub_id = created(body, "sub_id")
+
+		status, _, warnings = do("PUT", "/subs/"+sub_id, `{"service_name": "b", "price": "6.00", "user_id": "`+user+`", "start_date": "01-2030"}`)
+		if status != 200 || len(warnings) != 1 || !strings.HasPrefix(warnings[0], "budget "+total+" over in 01-2030: 11.00") {
+			t.Errorf("expected a warning of budget %v, got %v %v", total, status, warnings)
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		SetBudgetStrict(true)
+		defer SetBudgetStrict(false)
+
+		status, body, warnings := do("PATCH", "/subs/"+sub_id, `{"price": "7.00"}`)
+		if status != 409 || body != "over budget" || len(warnings) != 1 {
+			t.Errorf("expected status: 409, got %v %v %v", status, body, warnings)
+		}
+
+		// writes lowering the spend pass even while over a budget
+		if status, body, warnings := do("PATCH", "/subs/"+sub_id, `{"price": "5.50"}`); status != 200 || len(warnings) != 0 {
+			t.Errorf("expected status: 200, got %v %v %v", status, body, warnings)
+		}
+	})
+
+	t.Run("evaluation", func(t *testing.T) {
+		status, body, _ := do("GET", budgets+"/evaluation?start_date=12-2029&end_date=02-2030", "")
+		if status != 200 || strings.Count(body, `"budget_id"`) != 2 {
+			t.Fatalf("expected 2 budgets, got %v %v", status, body)
+		}
+		for _, over := range []string{
+			`"category":"","service_name":"","months_over":[{"month":"01-2030","sum":"10.50"},{"month":"02-2030","sum":"10.50"}]`,
+			`"category":"video","service_name":"","months_over":[{"month":"01-2030","sum":"5.00"},{"month":"02-2030","sum":"5.00"}]`,
+		} {
+			if !strings.Contains(body, over) {
+				t.Errorf("expected %v, got %v", over, body)
+			}
+		}
+
+		status, body, _ = do("GET", budgets+"/evaluation?start_date=12-2029&end_date=12-2029", "")
+		if status != 200 || strings.Count(body, `"months_over":[]`) != 2 {
+			t.Errorf("expected no months over, got %v %v", status, body)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		status, body, _ := do("PUT", budgets+"/"+video, `{"monthly_limit": "8.00", "category": "video"}`)
+		if status != 200 || !strings.Contains(body, `"monthly_limit":"8.00"`) {
+			t.Errorf("expected status: 200, got %v %v", status, body)
+		}
+		if status, _, _ := do("PUT", budgets+"/"+video, `{"monthly_limit": "8.00"}`); status != 409 {
+			t.Errorf("expected status: 409, got %v", status)
+		}
+		if status, _, _ := do("PUT", budgets+"/"+uuid.NewString(), `{"monthly_limit": "8.00"}`); status != 404 {
+			t.Errorf("expected status: 404, got %v", status)
+		}
+		if status, _, _ := do("PUT", budgets+"/abc", `{"monthly_limit": "8.00"}`); status != 400 {
+			t.Errorf("expected status: 400, got %v", status)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if status, _, _ := do("DELETE", budgets+"/"+total, ""); status != 204 {
+			t.Errorf("expected status: 204, got %v", status)
+		}
+		if status, _, _ := do("DELETE", budgets+"/"+total, ""); status != 404 {
+			t.Errorf("expected status: 404, got %v", status)
+		}
+		if status, body, _ := do("GET", budgets, ""); status != 200 || strings.Count(body, `"budget_id"`) != 1 {
+			t.Errorf("expected 1 budget, got %v %v", status, body)
+		}
+	})
+
+	// the video budget of 8.00 is left, with 5.00 spent
+	over := `{"op": "create", "sub": {"service_name": "c", "price": "4.00", "user_id": "` + user + `", "start_date": "01-2030", "category": "video"}}`
+	within := `{"op": "create", "sub": {"service_name": "d", "price": "1.00", "user_id": "` + user + `", "start_date": "01-2030", "category": "video"}}`
+	batch := func(mode string) (int, []batchItem) {
+		t.Helper()
+
+		status, body, _ := do("POST", "/subs:batch", `{"mode": "`+mode+`", "ops": [`+over+`, `+within+`]}`)
+		var r map[string][]batchItem
+		if err := json.Unmarshal([]byte(body), &r); err != nil {
+			t.Fatalf("%v: %v", err, body)
+		}
+		return status, r["results"]
+	}
+
+	t.Run("batch", func(t *testing.T) {
+		SetBudgetStrict(true)
+		defer SetBudgetStrict(false)
+
+		warning := "budget " + video + " over in 01-2030: 9.00 of 8.00 RUB"
+		status, items := batch("atomic")
+		if status != 409 || len(items) != 2 || items[0].Status != 409 || items[0].Error != "over budget" || fmt.Sprint(items[0].Warnings) != "["+warning+"]" || items[1].Status != 424 {
+			t.Errorf("expected status: 409 of the op over budget, got %v %v", status, items)
+		}
+
+		status, items = batch("best_effort")
+		if status != 207 || len(items) != 2 || items[0].Status != 409 || items[1].Status != 201 {
+			t.Errorf("expected statuses: 409, 201, got %v %v", status, items)
+		}
+
+		// ops count the spend of the ops before them
+		SetBudgetStrict(false)
+		status, items = batch("atomic")
+		if status != 200 || len(items) != 2 || items[0].Status != 201 || items[1].Status != 201 ||
+			fmt.Sprint(items[0].Warnings) != "[budget "+video+" over in 01-2030: 10.00 of 8.00 RUB]" ||
+			fmt.Sprint(items[1].Warnings) != "[budget "+video+" over in 01-2030: 11.00 of 8.00 RUB]" {
+			t.Errorf("expected warnings of budget %v, got %v %v", video, status, items)
+		}
+	})
+
+	t.Run("import", func(t *testing.T) {
+		csv := "service_name,price,user_id,start_date,end_date,category\n" +
+			"e,1.00," + user + ",01-2030,,music\n" +
+			"f,1.00," + user + ",01-2030,,video\n"
+
+		status, body, _ := do("POST", "/subs/import?dry_run=true", csv)
+		if status != 200 || !strings.Contains(body, `"budget_warnings":[{"line":3,"warning":"budget `+video+` over in 01-2030: 12.00 of 8.00 RUB"}]`) {
+			t.Errorf("expected a warning on line 3, got %v %v", status, body)
+		}
+
+		SetBudgetStrict(true)
+		defer SetBudgetStrict(false)
+
+		status, body, _ = do("POST", "/subs/import", csv)
+		if status != 409 || !strings.Contains(body, `"errors":[{"line":3,"error":"over budget"}]`) || strings.Contains(body, "sub_ids") {
+			t.Errorf("expected status: 409, got %v %v", status, body)
+		}
+	})
+
+	t.Run("shares", func(t *testing.T) {
+		member := addUser(t, m)
+		status, body, _ := do("POST", "/users/"+member+"/budgets", `{"monthly_limit": "1.00"}`)
+		if status != 201 {
+			t.Fatalf("expected status: 201, got %v %v", status, body)
+		}
+		shared := created(body, "budget_id")
+
+		status, body, _ = do("POST", "/subs", `{"service_name": "g", "price": "4.00", "user_id": "`+user+`", "start_date": "01-2030", "category": "music"}`)
+		if status != 201 {
+			t.Fatalf("expected status: 201, got %v %v", status, body)
+		}
+		path := "/subs/" + created(body, "sub_id")
+
+		// the budgets of members are checked too
+		status, _, warnings := do("PUT", path+"/members/"+member, `{"percent": 50}`)
+		if status != 200 || fmt.Sprint(warnings) != "[budget "+shared+" over in 01-2030: 2.00 of 1.00 RUB]" {
+			t.Errorf("expected a warning of budget %v, got %v %v", shared, status, warnings)
+		}
+
+		SetBudgetStrict(true)
+		defer SetBudgetStrict(false)
+
+		if status, body, warnings := do("PUT", path+"/prices/02-2030", `{"price": "6.00"}`); status != 409 || body != "over budget" || len(warnings) != 1 {
+			t.Errorf("expected status: 409, got %v %v %v", status, body, warnings)
+		}
+		if status, body, warnings := do("PUT", path+"/prices/02-2030", `{"price": "2.00"}`); status != 200 || len(warnings) != 0 {
+			t.Errorf("expected status: 200, got %v %v %v", status, body, warnings)
+		}
+		if status, body, warnings := do("DELETE", path+"/prices/02-2030", ""); status != 409 || len(warnings) != 1 {
+			t.Errorf("expected status: 409, got %v %v %v", status, body, warnings)
+		}
+		if status, body, warnings := do("DELETE", path+"/members/"+member, ""); status != 204 || len(warnings) != 0 {
+			t.Errorf("expected status: 204, got %v %v %v", status, body, warnings)
+		}
+	})
+}
+
+func TestBudgetChecksAtScale(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m := h.m
+
+	user := addUser(t, m)
+	for _, budget := range []Budget{
+		{User_ID: user, Monthly_Limit: 10000, Currency: "RUB"},
+		{User_ID: user, Monthly_Limit: 10000, Currency: "RUB", Category: "video"},
+		{User_ID: user, Monthly_Limit: 10000, Currency: "RUB", Service: "a"},
+	} {
+		if _, err := m.CreateBudget(context.Background(), budget); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// budgets and their spend are read once per request rather than per row
+	// or op, whatever their number
+	t.Run("import", func(t *testing.T) {
+		var csv strings.Builder
+		csv.WriteString("service_name,price,user_id,start_date,end_date,category\n")
+		for range maxImportRows {
+			csv.WriteString("a,1.00," + user + ",01-2030,,video\n")
+		}
+
+		m.queries.Store(0)
+		status, body := h.do("POST", "/subs/import", csv.String())
+		if status != 201 {
+			t.Fatalf("expected status: 201, got %v", status)
+		}
+		if queries := m.queries.Load(); queries > 10 {
+			t.Errorf("expected at most 10 queries, got %v", queries)
+		}
+
+		// the 101st row takes each budget over 100.00
+		var res importResult
+		if err := json.Unmarshal([]byte(body), &res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Warnings) != 3*(maxImportRows-100) || res.Warnings[0].Line != 102 {
+			t.Errorf("expected warnings from line 102 on, got %v starting %v", len(res.Warnings), res.Warnings[0])
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		ops := make([]string, maxBatchOps)
+		for i := range ops {
+			ops[i] = `{"op": "create", "sub": {"service_name": "b", "price": "1.00", "user_id": "` + user + `", "start_date": "01-2030"}}`
+		}
+
+		SetBudgetStrict(true)
+		defer SetBudgetStrict(false)
+
+		m.queries.Store(0)
+		status, body := h.do("POST", "/subs:batch", `{"mode": "best_effort", "ops": [`+strings.Join(ops, ",")+`]}`)
+		if status != 207 {
+			t.Fatalf("expected status: 207, got %v", status)
+		}
+		if queries := m.queries.Load(); queries > 10 {
+			t.Errorf("expected at most 10 queries, got %v", queries)
+		}
+
+		// the import took the total over already
+		var r map[string][]batchItem
+		if err := json.Unmarshal([]byte(body), &r); err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range r["results"] {
+			if item.Status != 409 {
+				t.Fatalf("expected status: 409, got %v", item)
+			}
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package subs_test
+
+import (
+	"context"
+	"subs"
+	"subs/dbtest"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestMemDBConformance(t *testing.T) {
+
+	dbtest.RunConformance(t, func() subs.DB {
+		m, err := subs.NewMemDB("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	})
+}
+
+func TestMockDBConformance(t *testing.T) {
+
+	dbtest.RunConformance(t, func() subs.DB {
+		return subs.NewMockDB()
+	})
+}
+
+func TestSQLiteDBConformance(t *testing.T) {
+
+	dbtest.RunConformance(t, func() subs.DB {
+		d, err := subs.NewSQLiteDB(":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		return d
+	})
+}
+
+func TestIntegConformance(t *testing.T) {
+
+	str := subs.StartPostgres(t)
+
+	d, err := subs.NewPGXDB(str, subs.PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	conn, err := pgx.Connect(context.Background(), str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(context.Background())
+
+	dbtest.RunConformance(t, func() subs.DB {
+		if _, err := conn.Exec(context.Background(), "TRUNCATE subs, idempotency_keys, fx_rates, sub_prices, sub_pauses, sub_members, services, service_names, users, budgets"); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	})
+}
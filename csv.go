@@ -0,0 +1,415 @@
+package subs
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// upper bound of rows in a single import, they are written in one batch
+const maxImportRows = 10000
+
+var csvColumns = []string{"sub_id", "service_name", "price", "user_id", "start_date", "end_date", "currency", "billing_period", "billing_interval", "anchor_date",
+	"trial_months", "intro_price", "intro_months", "category", "tags", "version"}
+
+// columns an import requires, sub_id and version are ignored so an export
+// can be imported back. Without a currency column, or in an empty cell,
+// prices are in defaultCurrency. Missing billing columns or empty cells are
+// filled by withBillingDefaults, missing trial, intro, category and tags
+// columns or empty cells mean none. Tags are comma separated in their cell.
+var csvImportColumns = []string{"service_name", "price", "user_id", "start_date", "end_date"}
+
+type importError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// importWarning is a budget breached by the row on Line
+type importWarning struct {
+	Line    int    `json:"line"`
+	Warning string `json:"warning"`
+}
+
+type importResult struct {
+	Dry_Run  bool            `json:"dry_run"`
+	Rows     int             `json:"rows"`
+	Sub_IDs  []string        `json:"sub_ids,omitempty"`
+	Errors   []importError   `json:"errors,omitempty"`
+	Warnings []importWarning `json:"budget_warnings,omitempty"`
+}
+
+func csvRecord(sub Sub) []string {
+
+	var end string
+	if sub.End != nil {
+		end = *sub.End
+	}
+
+	return []string{sub.ID, sub.Service, sub.Price.String(), sub.User_ID, sub.Start, end, sub.Currency,
+		sub.Billing_Period, strconv.Itoa(sub.Billing_Interval), sub.Anchor,
+		strconv.Itoa(sub.Trial_Months), sub.Intro_Price.String(), strconv.Itoa(sub.Intro_Months),
+		sub.Category, strings.Join(sub.Tags, ","), strconv.Itoa(sub.Version)}
+}
+
+// exportHandler streams every sub matching the list filters from db.Iter.
+// Once the first row is out, an error can only cut the export short.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+
+	v := r.URL.Query()
+	if f := v.Get("format"); f != "" && f != "csv" {
+		logger.Printf("export: resp 400: unsupported format %v", f)
+		http.Error(w, "invalid request: unsupported format", http.StatusBadRequest)
+		return
+	}
+
+	v.Del("limit")
+	q, err := parseListQuery(v)
+	if err != nil {
+		logger.Printf("export: resp 400: %v; req %v", err, r.URL.RawQuery)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.Limit = 0
+
+	ctx, started, cancel := streamContext(r.Context())
+	defer cancel()
+	extend, reset := streamDeadline(w)
+	defer reset()
+
+	out := csv.NewWriter(w)
+	var rows int
+	for sub, err := range db.Iter(ctx, q) {
+
+		if err != nil && rows == 0 {
+			if streamTimedOut(ctx, err) {
+				logger.Printf("export: resp 504: %v; valid req %v", err, r.URL.RawQuery)
+				http.Error(w, "timeout", http.StatusGatewayTimeout)
+				return
+			}
+
+			logger.Printf("export: resp 500: %v; valid req %v", err, r.URL.RawQuery)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			out.Flush()
+			logger.Printf("export: cut short after %v rows: %v; req %v", rows, err, r.URL.RawQuery)
+			return
+		}
+
+		if rows == 0 {
+			started()
+			extend()
+			writeCSVHeader(w, out)
+		}
+
+		if err := out.Write(csvRecord(sub)); err != nil {
+			logger.Printf("export: cut short after %v rows: %v; req %v", rows, err, r.URL.RawQuery)
+			return
+		}
+		rows++
+
+		if rows%streamFlushRows == 0 {
+			out.Flush()
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			extend()
+		}
+	}
+
+	if rows == 0 {
+		writeCSVHeader(w, out)
+	}
+	out.Flush()
+
+	logger.Printf("export: resp 200 with %v rows; req %v", rows, r.URL.RawQuery)
+}
+
+func writeCSVHeader(w http.ResponseWriter, out *csv.Writer) {
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="subs.csv"`)
+	out.Write(csvColumns)
+}
+
+// parseImport reads CSV subs by header name and their lines, every invalid
+// row is reported with its line instead of stopping at the first one
+func parseImport(body io.Reader) ([]Sub, []int, []importError, error) {
+
+	in := csv.NewReader(body)
+	in.FieldsPerRecord = -1
+	in.ReuseRecord = true
+
+	header, err := in.Read()
+	if err == io.EOF {
+		return nil, nil, nil, errors.New("empty csv")
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	index := make(map[string]int)
+	for i, name := range header {
+		index[name] = i
+	}
+	for _, name := range csvImportColumns {
+		if _, ok := index[name]; !ok {
+			return nil, nil, nil, fmt.Errorf("missing %v column", name)
+		}
+	}
+
+	var subs []Sub
+	var lines []int
+	var errs []importError
+	for {
+		record, err := in.Read()
+		if err == io.EOF {
+			break
+		}
+
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			// the reader can't resync after a malformed row
+			errs = append(errs, importError{Line: perr.Line, Error: perr.Err.Error()})
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		line, _ := in.FieldPos(0)
+		if len(subs)+len(errs) == maxImportRows {
+			return nil, nil, nil, fmt.Errorf("more than %v rows", maxImportRows)
+		}
+		if len(record) != len(header) {
+			errs = append(errs, importError{Line: line, Error: "wrong number of fields"})
+			continue
+		}
+
+		sub := Sub{
+			Service:  record[index["service_name"]],
+			User_ID:  record[index["user_id"]],
+			Start:    record[index["start_date"]],
+			Currency: defaultCurrency,
+		}
+		if end := record[index["end_date"]]; end != "" {
+			sub.End = &end
+		}
+		if i, ok := index["currency"]; ok && record[i] != "" {
+			sub.Currency = record[i]
+		}
+		if i, ok := index["billing_period"]; ok {
+			sub.Billing_Period = record[i]
+		}
+		if i, ok := index["anchor_date"]; ok {
+			sub.Anchor = record[i]
+		}
+		if i, ok := index["category"]; ok {
+			sub.Category = record[i]
+		}
+		if i, ok := index["tags"]; ok && record[i] != "" {
+			sub.Tags = strings.Split(record[i], ",")
+		}
+		if i, ok := index["billing_interval"]; ok && record[i] != "" {
+			if sub.Billing_Interval, err = strconv.Atoi(record[i]); err != nil || sub.Billing_Interval == 0 {
+				errs = append(errs, importError{Line: line, Error: "invalid billing interval"})
+				continue
+			}
+		}
+		if i, ok := index["trial_months"]; ok && record[i] != "" {
+			if sub.Trial_Months, err = strconv.Atoi(record[i]); err != nil {
+				errs = append(errs, importError{Line: line, Error: "invalid trial months"})
+				continue
+			}
+		}
+		if i, ok := index["intro_months"]; ok && record[i] != "" {
+			if sub.Intro_Months, err = strconv.Atoi(record[i]); err != nil {
+				errs = append(errs, importError{Line: line, Error: "invalid intro months"})
+				continue
+			}
+		}
+		if i, ok := index["intro_price"]; ok && record[i] != "" {
+			if sub.Intro_Price, err = parseMoney(record[i]); err != nil {
+				errs = append(errs, importError{Line: line, Error: "invalid intro price"})
+				continue
+			}
+		}
+
+		sub.Price, err = parseMoney(record[index["price"]])
+		if err != nil {
+			errs = append(errs, importError{Line: line, Error: "invalid price"})
+			continue
+		}
+
+		sub = normalizeSub(sub)
+		if err := validateSub(sub); err != nil {
+			errs = append(errs, importError{Line: line, Error: err.Error()})
+			continue
+		}
+
+		subs = append(subs, sub)
+		lines = append(lines, line)
+	}
+
+	return subs, lines, errs, nil
+}
+
+// importHandler creates a sub per CSV row, all of them or none if any row is
+// invalid. A dry run only validates the rows.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+
+	var dry_run bool
+	if s := r.URL.Query().Get("dry_run"); s != "" {
+		var err error
+		if dry_run, err = strconv.ParseBool(s); err != nil {
+			logger.Printf("import: resp 400: invalid dry_run %v", s)
+			http.Error(w, "invalid request: invalid dry_run", http.StatusBadRequest)
+			return
+		}
+	}
+
+	subs, lines, errs, err := parseImport(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		logger.Printf("import: resp 400: %v", err)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res := importResult{Dry_Run: dry_run, Rows: len(subs) + len(errs), Errors: errs}
+
+	if len(errs) > 0 {
+		writeImport(w, http.StatusBadRequest, res)
+		logger.Printf("import: resp 400: %v invalid rows of %v", len(errs), res.Rows)
+		return
+	}
+
+	if len(subs) == 0 {
+		writeImport(w, http.StatusOK, res)
+		logger.Printf("import: resp 200: %v valid rows, dry run %v", res.Rows, dry_run)
+		return
+	}
+
+	ops := make([]BatchOp, len(subs))
+	resolved := make([]*Sub, len(subs))
+	for i, sub := range subs {
+		ops[i] = BatchOp{Op: BatchCreate, Sub: sub}
+		resolved[i] = &ops[i].Sub
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	// a dry run reports rows of unknown users like the import itself
+	res.Errors, err = importUnknownUsers(ctx, subs, lines)
+	if err == nil && len(res.Errors) > 0 {
+		writeImport(w, http.StatusBadRequest, res)
+		logger.Printf("import: resp 400: unknown user on line %v of %v rows", res.Errors[0].Line, res.Rows)
+		return
+	}
+
+	// rows are checked like the ops of a batch, rows breaching a budget fail
+	// the whole import in strict mode
+	var catalog serviceCatalog
+	var breaches [][]BudgetBreach
+	if err == nil {
+		catalog, err = readCatalog(ctx)
+	}
+	if err == nil {
+		catalog.resolveAll(resolved...)
+		breaches, err = checkBatchBudgets(ctx, ops, catalog)
+	}
+	if err == nil {
+		for i := range breaches {
+			for _, breach := range breaches[i] {
+				res.Warnings = append(res.Warnings, importWarning{Line: lines[i], Warning: breach.String()})
+			}
+			if budgetStrict && len(breaches[i]) > 0 {
+				res.Errors = append(res.Errors, importError{Line: lines[i], Error: "over budget"})
+			}
+		}
+	}
+	if err == nil && len(res.Errors) > 0 {
+		writeImport(w, http.StatusConflict, res)
+		logger.Printf("import: resp 409: over budget on line %v of %v rows", res.Errors[0].Line, res.Rows)
+		return
+	}
+	if err == nil && dry_run {
+		writeImport(w, http.StatusOK, res)
+		logger.Printf("import: resp 200: %v valid rows, dry run %v", res.Rows, dry_run)
+		return
+	}
+
+	var results []BatchResult
+	if err == nil {
+		results, err = db.Batch(ctx, ops, true)
+	}
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("import: resp 504: %v; %v valid rows", err, res.Rows)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("import: resp 500: %v; %v valid rows", err, res.Rows)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	// a user deleted since their rows were checked aborts the import too
+	for i, result := range results {
+		if result.Err == ErrUnknownUser {
+			res.Errors = append(res.Errors, importError{Line: lines[i], Error: "unknown user"})
+		}
+	}
+	if len(res.Errors) > 0 {
+		writeImport(w, http.StatusBadRequest, res)
+		logger.Printf("import: resp 400: unknown user on line %v of %v rows", res.Errors[0].Line, res.Rows)
+		return
+	}
+
+	for _, result := range results {
+		res.Sub_IDs = append(res.Sub_IDs, result.ID)
+	}
+
+	writeImport(w, http.StatusCreated, res)
+	logger.Printf("import: resp 201 with %v subs", len(res.Sub_IDs))
+}
+
+// importUnknownUsers lists the rows of subs whose user doesn't exist, reading
+// each user once
+func importUnknownUsers(ctx context.Context, subs []Sub, lines []int) ([]importError, error) {
+
+	known := make(map[string]bool)
+	var errs []importError
+	for i, sub := range subs {
+		ok, seen := known[sub.User_ID]
+		if !seen {
+			_, err := db.ReadUser(ctx, sub.User_ID)
+			if err != nil && err != ErrNotFound {
+				return nil, err
+			}
+			ok = err == nil
+			known[sub.User_ID] = ok
+		}
+		if !ok {
+			errs = append(errs, importError{Line: lines[i], Error: "unknown user"})
+		}
+	}
+
+	return errs, nil
+}
+
+func writeImport(w http.ResponseWriter, status int, res importResult) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
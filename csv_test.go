@@ -0,0 +1,256 @@
+package subs
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestExportHandler(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m, server := h.m, h.server
+
+	user := uuid.NewString()
+	end := "12-2024"
+
+	// more than a page of subs
+	const count = maxListLimit + 5
+	for i := range count {
+		id := uuid.NewString()
+		m.db[id] = Sub{ID: id, Service: fmt.Sprintf("service_%04d", i), Price: Money(i), User_ID: user, Start: "01-2024", End: &end, Version: 1}
+	}
+	other := uuid.NewString()
+	m.db[other] = Sub{ID: other, Service: "other", Price: 100, User_ID: uuid.NewString(), Start: "01-2024", Currency: "USD",
+		Billing_Period: "yearly", Billing_Interval: 1, Anchor: "2024-01-15", Category: "video", Tags: []string{"a", "b"}, Version: 2}
+
+	export := func(query string) (int, [][]string) {
+		t.Helper()
+
+		resp, err := http.Get(server.URL + "/subs/export" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			return resp.StatusCode, nil
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/csv" {
+			t.Errorf("expected content type: text/csv, got %v", ct)
+		}
+
+		records, err := csv.NewReader(resp.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.StatusCode, records
+	}
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, query := range []string{"?format=xlsx", "?user_id=1", "?sort=user_id"} {
+			if status, _ := export(query); status != 400 {
+				t.Errorf("%v: expected status: 400, got %v", query, status)
+			}
+		}
+	})
+
+	t.Run("all", func(t *testing.T) {
+		status, records := export("?format=csv&sort=-price&limit=1")
+		if status != 200 {
+			t.Fatalf("expected status: 200, got %v", status)
+		}
+		if len(records) != count+2 {
+			t.Fatalf("expected %v records, got %v", count+2, len(records))
+		}
+		if strings.Join(records[0], ",") != strings.Join(csvColumns, ",") {
+			t.Errorf("unexpected header: %v", records[0])
+		}
+		if records[1][2] != Money(count-1).String() || records[len(records)-1][2] != "0.00" {
+			t.Errorf("expected rows sorted by price descending, got %v ... %v", records[1], records[len(records)-1])
+		}
+	})
+
+	t.Run("filter", func(t *testing.T) {
+		status, records := export("?service_name=other")
+		if status != 200 {
+			t.Fatalf("expected status: 200, got %v", status)
+		}
+		if len(records) != 2 {
+			t.Fatalf("expected 2 records, got %v", len(records))
+		}
+
+		expected := []string{other, "other", "1.00", m.db[other].User_ID, "01-2024", "", "USD", "yearly", "1", "2024-01-15", "0", "0.00", "0", "video", "a,b", "2"}
+		if strings.Join(records[1], ",") != strings.Join(expected, ",") {
+			t.Errorf("expected row: %v, got %v", expected, records[1])
+		}
+	})
+}
+
+func TestImportHandler(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m, server := h.m, h.server
+
+	user := addUser(t, m)
+
+	post := func(query string, body string) (int, importResult) {
+		t.Helper()
+
+		resp, err := http.Post(server.URL+"/subs/import"+query, "text/csv", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var res importResult
+		json.NewDecoder(resp.Body).Decode(&res)
+
+		return resp.StatusCode, res
+	}
+
+	valid := "service_name,price,user_id,start_date,end_date\n" +
+		"a,100," + user + ",01-2024,\n" +
+		"b,200," + user + ",02-2024,12-2024\n"
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, tc := range []struct{ query, body string }{
+			{"", ""},
+			{"", "service_name,price\na,100\n"},
+			{"?dry_run=maybe", valid},
+		} {
+			if status, _ := post(tc.query, tc.body); status != 400 {
+				t.Errorf("%q: expected status: 400, got %v", tc.body, status)
+			}
+		}
+	})
+
+	t.Run("invalid rows", func(t *testing.T) {
+		body := valid +
+			"c,-1," + user + ",01-2024,\n" +
+			"d,100," + user + ",13-2024,\n" +
+			"e,100\n" +
+			"f,abc," + user + ",01-2024,\n" +
+			"g,9.999," + user + ",01-2024,\n"
+
+		status, res := post("", body)
+		if status != 400 {
+			t.Fatalf("expected status: 400, got %v", status)
+		}
+
+		var lines []int
+		for _, e := range res.Errors {
+			lines = append(lines, e.Line)
+		}
+		if fmt.Sprint(lines) != "[4 5 6 7 8]" {
+			t.Errorf("expected errors on lines [4 5 6 7 8], got %v", res.Errors)
+		}
+		if res.Rows != 7 {
+			t.Errorf("expected 7 rows, got %v", res.Rows)
+		}
+		if len(m.db) != 0 {
+			t.Errorf("expected no subs, got %v", len(m.db))
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		status, res := post("?dry_run=true", valid)
+		if status != 200 {
+			t.Fatalf("expected status: 200, got %v", status)
+		}
+		if res.Rows != 2 || !res.Dry_Run {
+			t.Errorf("unexpected result: %+v", res)
+		}
+		if len(m.db) != 0 {
+			t.Errorf("expected no subs, got %v", len(m.db))
+		}
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		status, res := post("", valid+"c,100,"+uuid.NewString()+",01-2024,\n")
+		if status != 400 || fmt.Sprint(res.Errors) != "[{4 unknown user}]" {
+			t.Errorf("expected unknown user on line 4, got %v %+v", status, res)
+		}
+		if len(m.db) != 0 {
+			t.Errorf("expected no subs, got %v", len(m.db))
+		}
+	})
+
+	t.Run("unknown user dry run", func(t *testing.T) {
+		unknown := uuid.NewString()
+		status, res := post("?dry_run=true", valid+"c,100,"+unknown+",01-2024,\n"+"d,100,"+unknown+",01-2024,\n")
+		if status != 400 || fmt.Sprint(res.Errors) != "[{4 unknown user} {5 unknown user}]" || !res.Dry_Run {
+			t.Errorf("expected unknown user on lines 4 and 5, got %v %+v", status, res)
+		}
+		if len(m.db) != 0 {
+			t.Errorf("expected no subs, got %v", len(m.db))
+		}
+	})
+
+	t.Run("import", func(t *testing.T) {
+		// columns in any order, extra columns of an export are ignored
+		body := "sub_id,user_id,start_date,end_date,service_name,price,version\n" +
+			"x," + user + ",01-2024,,a,100,7\n" +
+			"y," + user + ",02-2024,12-2024,b,9.99,7\n"
+
+		status, res := post("", body)
+		if status != 201 {
+			t.Fatalf("expected status: 201, got %v", status)
+		}
+		if len(res.Sub_IDs) != 2 || len(m.db) != 2 {
+			t.Fatalf("expected 2 subs, got %v", res.Sub_IDs)
+		}
+
+		end := "12-2024"
+		compareSubs(t, Sub{Service: "b", Price: 999, User_ID: user, Start: "02-2024", End: &end}, m.db[res.Sub_IDs[1]])
+		if v := m.db[res.Sub_IDs[1]].Version; v != 1 {
+			t.Errorf("expected version: 1, got %v", v)
+		}
+	})
+
+	t.Run("billing", func(t *testing.T) {
+		header := "service_name,price,user_id,start_date,end_date,billing_period,billing_interval,anchor_date\n"
+
+		status, res := post("?dry_run=true", header+
+			"a,100,"+user+",01-2024,,daily,1,\n"+
+			"b,100,"+user+",01-2024,,yearly,x,\n"+
+			"c,100,"+user+",01-2024,,yearly,1,01-2024\n")
+		if status != 400 || len(res.Errors) != 3 {
+			t.Errorf("expected 3 invalid rows, got %v %+v", status, res)
+		}
+
+		status, res = post("", header+
+			"d,100,"+user+",01-2024,,,,\n"+
+			"e,100,"+user+",01-2024,,weekly,2,2024-01-03\n")
+		if status != 201 || len(res.Sub_IDs) != 2 {
+			t.Fatalf("expected 2 subs, got %v %+v", status, res)
+		}
+
+		compareSubs(t, Sub{Service: "d", Price: 10000, User_ID: user, Start: "01-2024", Billing_Period: "monthly", Billing_Interval: 1, Anchor: "2024-01-01"}, m.db[res.Sub_IDs[0]])
+		compareSubs(t, Sub{Service: "e", Price: 10000, User_ID: user, Start: "01-2024", Billing_Period: "weekly", Billing_Interval: 2, Anchor: "2024-01-03"}, m.db[res.Sub_IDs[1]])
+	})
+
+	t.Run("labels", func(t *testing.T) {
+		header := "service_name,price,user_id,start_date,end_date,category,tags\n"
+
+		status, res := post("", header+
+			"a,100,"+user+",01-2024,,,\n"+
+			"b,100,"+user+",01-2024,, video ,\"b, a\"\n")
+		if status != 201 || len(res.Sub_IDs) != 2 {
+			t.Fatalf("expected 2 subs, got %v %+v", status, res)
+		}
+
+		compareSubs(t, Sub{Service: "a", Price: 10000, User_ID: user, Start: "01-2024"}, m.db[res.Sub_IDs[0]])
+		compareSubs(t, Sub{Service: "b", Price: 10000, User_ID: user, Start: "01-2024", Category: "video", Tags: []string{"a", "b"}}, m.db[res.Sub_IDs[1]])
+
+		if status, res := post("", header+"c,100,"+user+",01-2024,,,\"a,,b\"\n"); status != 400 || len(res.Errors) != 1 {
+			t.Errorf("expected an invalid tag, got %v %+v", status, res)
+		}
+	})
+}
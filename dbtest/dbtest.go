@@ -0,0 +1,2243 @@
+// Package dbtest is the shared specification every subs.DB implementation
+// is checked against, it follows the semantics of the postgres schema.
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"subs"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func end(s string) *string {
+	return &s
+}
+
+func compareSubs(t *testing.T, s1 subs.Sub, s2 subs.Sub) {
+
+	t.Helper()
+
+	if s1.Service != s2.Service || s1.Price != s2.Price || s1.User_ID != s2.User_ID || s1.Start != s2.Start {
+		t.Fatalf("expected %v, got %v", s1, s2)
+	}
+	if (s1.End == nil) != (s2.End == nil) || (s1.End != nil && *s1.End != *s2.End) {
+		t.Fatalf("expected %v, got %v", s1, s2)
+	}
+	if s1.Currency != "" && s1.Currency != s2.Currency {
+		t.Fatalf("expected %v, got %v", s1, s2)
+	}
+	if s1.Billing_Period != "" && (s1.Billing_Period != s2.Billing_Period || s1.Billing_Interval != s2.Billing_Interval || s1.Anchor != s2.Anchor) {
+		t.Fatalf("expected %v, got %v", s1, s2)
+	}
+	if s1.Category != s2.Category || fmt.Sprint(s1.Tags) != fmt.Sprint(s2.Tags) {
+		t.Fatalf("expected %v, got %v", s1, s2)
+	}
+}
+
+// create stores s in RUB unless it has a currency, like a validated request
+func create(t *testing.T, d subs.DB, s subs.Sub) string {
+
+	t.Helper()
+
+	if s.Currency == "" {
+		s.Currency = "RUB"
+	}
+
+	id, err := d.Create(context.Background(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+// newUser registers a user for the subs of a test
+func newUser(t *testing.T, d subs.DB) string {
+
+	t.Helper()
+
+	id, err := d.CreateUser(context.Background(), subs.User{Display_Name: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+// RunConformance runs the suite against a DB, factory must return an empty
+// database on every call
+func RunConformance(t *testing.T, factory func() subs.DB) {
+
+	t.Helper()
+
+	t.Run("crud", func(t *testing.T) { testCRUD(t, factory()) })
+	t.Run("not found", func(t *testing.T) { testNotFound(t, factory()) })
+	t.Run("open end", func(t *testing.T) { testOpenEnd(t, factory()) })
+	t.Run("patch", func(t *testing.T) { testPatch(t, factory()) })
+	t.Run("version", func(t *testing.T) { testVersion(t, factory()) })
+	t.Run("list", func(t *testing.T) { testList(t, factory()) })
+	t.Run("iter", func(t *testing.T) { testIter(t, factory()) })
+	t.Run("sum", func(t *testing.T) { testSum(t, factory()) })
+	t.Run("sum groups", func(t *testing.T) { testSumGroups(t, factory()) })
+	t.Run("concurrent", func(t *testing.T) { testConcurrent(t, factory()) })
+	t.Run("batch", func(t *testing.T) { testBatch(t, factory()) })
+	t.Run("idempotency keys", func(t *testing.T) { testIdempotencyKeys(t, factory()) })
+	t.Run("fx rates", func(t *testing.T) { testRates(t, factory()) })
+	t.Run("converted sum", func(t *testing.T) { testConvertedSum(t, factory()) })
+	t.Run("billing periods", func(t *testing.T) { testBillingPeriods(t, factory()) })
+	t.Run("day dates", func(t *testing.T) { testDayDates(t, factory()) })
+	t.Run("prices", func(t *testing.T) { testPrices(t, factory()) })
+	t.Run("pauses", func(t *testing.T) { testPauses(t, factory()) })
+	t.Run("trials", func(t *testing.T) { testTrials(t, factory()) })
+	t.Run("members", func(t *testing.T) { testMembers(t, factory()) })
+	t.Run("services", func(t *testing.T) { testServices(t, factory()) })
+	t.Run("tags", func(t *testing.T) { testTags(t, factory()) })
+	t.Run("users", func(t *testing.T) { testUsers(t, factory()) })
+	t.Run("budgets", func(t *testing.T) { testBudgets(t, factory()) })
+}
+
+func testCRUD(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+
+	s := subs.Sub{
+		Service:  "service",
+		Price:    400,
+		User_ID:  newUser(t, d),
+		Start:    "07-2024",
+		End:      end("09-2024"),
+		Currency: "EUR",
+	}
+	id := create(t, d, s)
+
+	got, err := d.Read(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != id {
+		t.Errorf("expected id: %v, got: %v", id, got.ID)
+	}
+	compareSubs(t, s, got)
+
+	// zero billing fields are stored as monthly charges from the start month
+	if got.Billing_Period != "monthly" || got.Billing_Interval != 1 || got.Anchor != "2024-07-01" {
+		t.Errorf("expected default billing, got %v", got)
+	}
+
+	s.Service = "service_2"
+	s.Price = 700
+	s.Currency = "USD"
+	if _, err := d.Update(ctx, id, s, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = d.Read(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareSubs(t, s, got)
+
+	if err := d.Delete(ctx, id, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Read(ctx, id); err != subs.ErrNotFound {
+		t.Errorf("expected %v, got %v", subs.ErrNotFound, err)
+	}
+}
+
+func testNotFound(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+	id := uuid.NewString()
+	s := subs.Sub{Service: "service", User_ID: newUser(t, d), Start: "07-2024"}
+
+	if _, err := d.Read(ctx, id); err != subs.ErrNotFound {
+		t.Errorf("read: expected %v, got %v", subs.ErrNotFound, err)
+	}
+	if _, err := d.Update(ctx, id, s, 0); err != subs.ErrNotFound {
+		t.Errorf("update: expected %v, got %v", subs.ErrNotFound, err)
+	}
+	if err := d.Delete(ctx, id, 0); err != subs.ErrNotFound {
+		t.Errorf("delete: expected %v, got %v", subs.ErrNotFound, err)
+	}
+
+	// a deleted sub is gone for every call
+	id = create(t, d, s)
+	if err := d.Delete(ctx, id, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, id, 0); err != subs.ErrNotFound {
+		t.Errorf("second delete: expected %v, got %v", subs.ErrNotFound, err)
+	}
+	if _, err := d.Update(ctx, id, s, 0); err != subs.ErrNotFound {
+		t.Errorf("update deleted: expected %v, got %v", subs.ErrNotFound, err)
+	}
+}
+
+func testOpenEnd(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+
+	s := subs.Sub{Service: "service", Price: 100, User_ID: newUser(t, d), Start: "11-2024"}
+	id := create(t, d, s)
+
+	got, err := d.Read(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.End != nil {
+		t.Fatalf("expected no end date, got %v", *got.End)
+	}
+
+	// an open sub is active until the end of any period
+	sum, err := d.Sum(ctx, subs.Sub{Start: "01-2024", End: end("03-2026")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 100*17 {
+		t.Errorf("expected sum: %v, got %v", 100*17, sum)
+	}
+
+	page, err := d.List(ctx, subs.ListQuery{From: "01-2030"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Subs) != 1 {
+		t.Errorf("expected open sub listed from 01-2030, got %v", page.Subs)
+	}
+
+	// close, then reopen
+	s.End = end("12-2024")
+	if _, err := d.Update(ctx, id, s, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err = d.List(ctx, subs.ListQuery{From: "01-2025"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Subs) != 0 {
+		t.Errorf("expected closed sub not listed from 01-2025, got %v", page.Subs)
+	}
+
+	s.End = nil
+	if _, err := d.Update(ctx, id, s, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = d.Read(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareSubs(t, s, got)
+}
+
+func testPatch(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+
+	s := subs.Sub{Service: "service", Price: 100, User_ID: newUser(t, d), Start: "01-2024"}
+	id := create(t, d, s)
+
+	price := subs.Money(200)
+	if _, err := d.Patch(ctx, id, subs.SubPatch{Price: &price}, 0); err != nil {
+		t.Fatal(err)
+	}
+	s.Price = price
+
+	got, err := d.Read(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareSubs(t, s, got)
+
+	service, start := "service_2", "03-2024"
+	if _, err := d.Patch(ctx, id, subs.SubPatch{Service: &service, Start: &start, End: end("06-2024"), SetEnd: true}, 0); err != nil {
+		t.Fatal(err)
+	}
+	s.Service, s.Start, s.End = service, start, end("06-2024")
+
+	got, err = d.Read(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareSubs(t, s, got)
+
+	// explicit nil end reopens the sub
+	if _, err := d.Patch(ctx, id, subs.SubPatch{SetEnd: true}, 0); err != nil {
+		t.Fatal(err)
+	}
+	s.End = nil
+
+	got, err = d.Read(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareSubs(t, s, got)
+
+	if _, err := d.Patch(ctx, id, subs.SubPatch{}, 0); err != nil {
+		t.Errorf("empty patch: expected nil, got %v", err)
+	}
+
+	missing := uuid.NewString()
+	if _, err := d.Patch(ctx, missing, subs.SubPatch{Price: &price}, 0); err != subs.ErrNotFound {
+		t.Errorf("expected %v, got %v", subs.ErrNotFound, err)
+	}
+	if _, err := d.Patch(ctx, missing, subs.SubPatch{}, 0); err != subs.ErrNotFound {
+		t.Errorf("empty patch: expected %v, got %v", subs.ErrNotFound, err)
+	}
+}
+
+func testVersion(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+
+	s := subs.Sub{Service: "service", Price: 100, User_ID: newUser(t, d), Start: "01-2024"}
+	id := create(t, d, s)
+
+	read := func() int {
+		t.Helper()
+		got, err := d.Read(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got.Version
+	}
+
+	if v := read(); v != 1 {
+		t.Fatalf("expected version: 1, got %v", v)
+	}
+
+	v, err := d.Update(ctx, id, s, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 2 || read() != 2 {
+		t.Fatalf("expected version: 2, got %v", v)
+	}
+
+	if _, err := d.Update(ctx, id, s, 1); err != subs.ErrVersionMismatch {
+		t.Errorf("stale update: expected %v, got %v", subs.ErrVersionMismatch, err)
+	}
+
+	price := subs.Money(200)
+	if _, err := d.Patch(ctx, id, subs.SubPatch{Price: &price}, 1); err != subs.ErrVersionMismatch {
+		t.Errorf("stale patch: expected %v, got %v", subs.ErrVersionMismatch, err)
+	}
+	if _, err := d.Patch(ctx, id, subs.SubPatch{}, 1); err != subs.ErrVersionMismatch {
+		t.Errorf("stale empty patch: expected %v, got %v", subs.ErrVersionMismatch, err)
+	}
+
+	// unconditional writes bump the version too
+	v, err = d.Patch(ctx, id, subs.SubPatch{Price: &price}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 3 || read() != 3 {
+		t.Fatalf("expected version: 3, got %v", v)
+	}
+
+	got, err := d.Read(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Price != price {
+		t.Errorf("stale writes must not apply, expected price: %v, got %v", price, got.Price)
+	}
+
+	if err := d.Delete(ctx, id, 2); err != subs.ErrVersionMismatch {
+		t.Errorf("stale delete: expected %v, got %v", subs.ErrVersionMismatch, err)
+	}
+
+	missing := uuid.NewString()
+	if _, err := d.Update(ctx, missing, s, 1); err != subs.ErrNotFound {
+		t.Errorf("expected %v, got %v", subs.ErrNotFound, err)
+	}
+	if err := d.Delete(ctx, missing, 1); err != subs.ErrNotFound {
+		t.Errorf("expected %v, got %v", subs.ErrNotFound, err)
+	}
+
+	// concurrent writes conditioned on the same version, exactly one of them applies
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var applied int
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := d.Update(ctx, id, s, 3)
+			if err != nil && err != subs.ErrVersionMismatch {
+				t.Error(err)
+			}
+			if err == nil {
+				mu.Lock()
+				applied++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if applied != 1 {
+		t.Errorf("expected 1 applied write, got %v", applied)
+	}
+
+	if err := d.Delete(ctx, id, 4); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testList(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+	user := newUser(t, d)
+
+	for _, s := range []subs.Sub{
+		{Service: "a", Price: 100, User_ID: user, Start: "11-2023", End: end("02-2024")},
+		{Service: "b", Price: 300, User_ID: user, Start: "01-2024"},
+		{Service: "c", Price: 200, User_ID: newUser(t, d), Start: "06-2024", End: end("06-2024")},
+		{Service: "d", Price: 250, User_ID: newUser(t, d), Start: "12-2022"},
+	} {
+		create(t, d, s)
+	}
+
+	check := func(q subs.ListQuery, expected ...string) {
+		t.Helper()
+
+		var got []string
+		for {
+			page, err := d.List(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, sub := range page.Subs {
+				got = append(got, sub.Service)
+			}
+			if page.Next_Cursor == "" {
+				break
+			}
+			q.After = page.Next_Cursor
+		}
+
+		if len(got) != len(expected) {
+			t.Fatalf("%+v: expected %v, got %v", q, expected, got)
+		}
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Fatalf("%+v: expected %v, got %v", q, expected, got)
+			}
+		}
+	}
+
+	check(subs.ListQuery{Sort: "service_name"}, "a", "b", "c", "d")
+	check(subs.ListQuery{Sort: "-start_date", Limit: 1}, "c", "b", "a", "d")
+	check(subs.ListQuery{Sort: "price", Limit: 3}, "a", "c", "d", "b")
+	check(subs.ListQuery{Sort: "service_name", User_ID: user}, "a", "b")
+	check(subs.ListQuery{Sort: "service_name", From: "03-2024", To: "05-2024"}, "b", "d")
+	check(subs.ListQuery{Sort: "service_name", To: "12-2023"}, "a", "d")
+	min_price, max_price := subs.Money(150), subs.Money(250)
+	check(subs.ListQuery{Sort: "-service_name", MinPrice: &min_price, MaxPrice: &max_price, Limit: 1}, "d", "c")
+
+	// names order bytewise, whatever the collation of the database
+	other := newUser(t, d)
+	for _, service := range []string{"a", "B", "_b"} {
+		create(t, d, subs.Sub{Service: service, Price: 100, User_ID: other, Start: "01-2024"})
+	}
+	check(subs.ListQuery{Sort: "service_name", User_ID: other, Limit: 1}, "B", "_b", "a")
+	check(subs.ListQuery{Sort: "-service_name", User_ID: other, Limit: 2}, "a", "_b", "B")
+}
+
+func testIter(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+	user := newUser(t, d)
+
+	// more than a page of iterPages
+	const count = 1100
+	ops := make([]subs.BatchOp, count)
+	for i := range count {
+		ops[i] = subs.BatchOp{Op: subs.BatchCreate, Sub: subs.Sub{Service: "service", Price: subs.Money(i % 10), User_ID: user, Start: "01-2024"}}
+	}
+	if _, err := d.Batch(ctx, ops, true); err != nil {
+		t.Fatal(err)
+	}
+	create(t, d, subs.Sub{Service: "other", Price: 5, User_ID: newUser(t, d), Start: "01-2024"})
+
+	collect := func(q subs.ListQuery) []subs.Sub {
+		t.Helper()
+
+		var got []subs.Sub
+		for sub, err := range d.Iter(ctx, q) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, sub)
+		}
+		return got
+	}
+
+	for _, q := range []subs.ListQuery{
+		{User_ID: user},
+		{User_ID: user, Sort: "-price"},
+		{Sort: "price", Limit: 1050},
+		{Service: "other"},
+		{Service: "none"},
+	} {
+		got := collect(q)
+
+		// the same subs as a single page
+		page, err := d.List(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(page.Subs) {
+			t.Fatalf("%+v: expected %v subs, got %v", q, len(page.Subs), len(got))
+		}
+		for i := range got {
+			if got[i].ID != page.Subs[i].ID {
+				t.Fatalf("%+v: sub %v: expected %v, got %v", q, i, page.Subs[i].ID, got[i].ID)
+			}
+		}
+	}
+
+	// start after a cursor of List
+	page, err := d.List(ctx, subs.ListQuery{User_ID: user, Sort: "price", Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := collect(subs.ListQuery{User_ID: user, Sort: "price", After: page.Next_Cursor})
+	if len(got) != count-100 || got[0].Price < page.Subs[99].Price {
+		t.Errorf("expected %v subs after the first page, got %v", count-100, len(got))
+	}
+
+	// stop early
+	var n int
+	for _, err := range d.Iter(ctx, subs.ListQuery{User_ID: user}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+		if n == 10 {
+			break
+		}
+	}
+
+	var failed bool
+	for _, err := range d.Iter(ctx, subs.ListQuery{Sort: "price", After: "not a cursor"}) {
+		failed = err != nil
+	}
+	if !failed {
+		t.Error("expected invalid cursor error")
+	}
+}
+
+func testSum(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+	user := newUser(t, d)
+
+	for _, s := range []subs.Sub{
+		{Service: "a", Price: 100, User_ID: user, Start: "11-2023", End: end("02-2024")},
+		{Service: "b", Price: 10, User_ID: user, Start: "06-2022"},
+		{Service: "a", Price: 1, User_ID: newUser(t, d), Start: "01-2025"},
+		{Service: "c", Price: 1000, User_ID: newUser(t, d), Start: "12-2021", End: end("01-2024")},
+	} {
+		create(t, d, s)
+	}
+
+	for _, tc := range []struct {
+		filter   subs.Sub
+		expected subs.Money
+	}{
+		// a: 11-2023..02-2024 spans a year boundary
+		{subs.Sub{Start: "10-2023", End: end("03-2024")}, 100*4 + 10*6 + 1000*4},
+		{subs.Sub{Start: "01-2024", End: end("12-2024")}, 100*2 + 10*12 + 1000},
+		{subs.Sub{Start: "12-2024", End: end("02-2025")}, 10*3 + 1*2},
+		// c: 12-2021..01-2024 spans two year boundaries
+		{subs.Sub{Start: "01-2020", End: end("12-2025"), Service: "c"}, 1000 * 26},
+		{subs.Sub{Start: "06-2022", End: end("05-2023"), Service: "c"}, 1000 * 12},
+		{subs.Sub{Start: "01-2020", End: end("12-2025"), Service: "a"}, 100*4 + 1*12},
+		{subs.Sub{Start: "01-2020", End: end("12-2025"), User_ID: user, Service: "a"}, 100 * 4},
+		{subs.Sub{Start: "01-2020", End: end("11-2021")}, 0},
+		{subs.Sub{Start: "01-2024", End: end("01-2024"), User_ID: newUser(t, d)}, 0},
+	} {
+		sum, err := d.Sum(ctx, tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum != tc.expected {
+			t.Errorf("%v: expected sum: %v, got %v", tc.filter, tc.expected, sum)
+		}
+	}
+
+	// sums far beyond 32 bits stay exact
+	large := subs.Sub{Start: "01-2000", End: end("12-2099"), Service: "large"}
+	create(t, d, subs.Sub{Service: "large", Price: 99_999_999_999, User_ID: user, Start: "01-2000"})
+	create(t, d, subs.Sub{Service: "large", Price: 1, User_ID: user, Start: "01-2000"})
+
+	sum, err := d.Sum(ctx, large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 100_000_000_000*1200 {
+		t.Errorf("%v: expected sum: %v, got %v", large, subs.Money(100_000_000_000*1200), sum)
+	}
+}
+
+func testSumGroups(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+	user, user2 := newUser(t, d), newUser(t, d)
+
+	for _, s := range []subs.Sub{
+		{Service: "a", Price: 100, User_ID: user, Start: "11-2023", End: end("02-2024")},
+		{Service: "b", Price: 10, User_ID: user, Start: "06-2022"},
+		{Service: "a", Price: 1, User_ID: newUser(t, d), Start: "01-2025"},
+		{Service: "c", Price: 1000, User_ID: user2, Start: "12-2021", End: end("01-2024")},
+	} {
+		create(t, d, s)
+	}
+
+	group := func(g string, sum subs.Money) subs.SumGroup {
+		return subs.SumGroup{Group: g, Sum: sum}
+	}
+
+	check := func(filter subs.Sub, group_by string, expected ...subs.SumGroup) {
+		t.Helper()
+
+		groups, err := d.SumGroups(ctx, filter, group_by)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(groups) != len(expected) {
+			t.Fatalf("%v by %v: expected %v, got %v", filter, group_by, expected, groups)
+		}
+		for i := range groups {
+			if groups[i] != expected[i] {
+				t.Fatalf("%v by %v: expected %v, got %v", filter, group_by, expected, groups)
+			}
+		}
+	}
+
+	period := subs.Sub{Start: "12-2023", End: end("03-2024")}
+	check(period, "service_name", group("a", 300), group("b", 40), group("c", 2000))
+	check(period, "month",
+		group("12-2023", 1110), group("01-2024", 1110), group("02-2024", 110), group("03-2024", 10))
+
+	users := []subs.SumGroup{group(user, 340), group(user2, 2000)}
+	if user2 < user {
+		users[0], users[1] = users[1], users[0]
+	}
+	check(period, "user_id", users...)
+
+	// filters apply before grouping, every month of the period has a group
+	check(subs.Sub{Start: "01-2024", End: end("03-2024"), Service: "c"}, "month",
+		group("01-2024", 1000), group("02-2024", 0), group("03-2024", 0))
+	check(subs.Sub{Start: "01-2020", End: end("02-2020")}, "service_name")
+	check(subs.Sub{Start: "11-2020", End: end("02-2021")}, "month",
+		group("11-2020", 0), group("12-2020", 0), group("01-2021", 0), group("02-2021", 0))
+
+	// groups add up to Sum
+	for _, group_by := range []string{"service_name", "user_id", "month"} {
+		filter := subs.Sub{Start: "01-2020", End: end("12-2025"), User_ID: user}
+
+		groups, err := d.SumGroups(ctx, filter, group_by)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum, err := d.Sum(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var total subs.Money
+		for _, g := range groups {
+			total += g.Sum
+		}
+		if total != sum {
+			t.Errorf("%v: expected total: %v, got %v", group_by, sum, total)
+		}
+	}
+}
+
+func testConcurrent(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+	user := newUser(t, d)
+	s := subs.Sub{Service: "service", Price: 100, User_ID: user, Start: "01-2024", End: end("12-2024")}
+
+	const count = 32
+	var wg sync.WaitGroup
+	ids := make([]string, count)
+	for i := range count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			id, err := d.Create(ctx, s)
+			if err != nil {
+				t.Error(err)
+			}
+			ids[i] = id
+		}()
+	}
+	wg.Wait()
+
+	page, err := d.List(ctx, subs.ListQuery{User_ID: user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Subs) != count {
+		t.Fatalf("expected list count: %v, got %v", count, len(page.Subs))
+	}
+
+	// concurrent updates of one sub, one of them wins as a whole
+	for i := range count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			s2 := s
+			s2.Price = subs.Money(i)
+			if _, err := d.Update(ctx, ids[0], s2, 0); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := d.Read(ctx, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Price < 0 || got.Price >= count || got.Service != s.Service {
+		t.Errorf("unexpected sub after concurrent updates: %v", got)
+	}
+
+	// concurrent deletes of one sub, exactly one of them succeeds
+	var mu sync.Mutex
+	var deleted int
+	for range count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := d.Delete(ctx, ids[1], 0)
+			if err != nil && !errors.Is(err, subs.ErrNotFound) {
+				t.Error(err)
+			}
+			if err == nil {
+				mu.Lock()
+				deleted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if deleted != 1 {
+		t.Errorf("expected 1 successful delete, got %v", deleted)
+	}
+
+	sum, err := d.Sum(ctx, subs.Sub{Start: "01-2024", End: end("12-2024"), User_ID: user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (count-2)*100*12 + got.Price*12; sum != expected {
+		t.Errorf("expected sum: %v, got %v", expected, sum)
+	}
+}
+
+func testBatch(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+	user := newUser(t, d)
+	s := subs.Sub{Service: "service", Price: 100, User_ID: user, Start: "01-2024"}
+
+	a := create(t, d, s)
+	b := create(t, d, s)
+	missing := uuid.NewString()
+
+	s2 := s
+	s2.Price = 200
+
+	count := func() int {
+		t.Helper()
+		page, err := d.List(ctx, subs.ListQuery{User_ID: user})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(page.Subs)
+	}
+
+	check := func(results []subs.BatchResult, expected ...error) {
+		t.Helper()
+		if len(results) != len(expected) {
+			t.Fatalf("expected %v results, got %v", len(expected), len(results))
+		}
+		for i := range results {
+			if results[i].Err != expected[i] {
+				t.Errorf("op %v: expected %v, got %v", i, expected[i], results[i].Err)
+			}
+		}
+	}
+
+	ops := []subs.BatchOp{
+		{Op: subs.BatchCreate, Sub: s},
+		{Op: subs.BatchUpdate, ID: a, Version: 1, Sub: s2},
+		{Op: subs.BatchDelete, ID: missing},
+	}
+
+	// a failed atomic batch applies nothing
+	results, err := d.Batch(ctx, ops, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(results, subs.ErrBatchAborted, subs.ErrBatchAborted, subs.ErrNotFound)
+	if n := count(); n != 2 {
+		t.Errorf("expected 2 subs, got %v", n)
+	}
+	if got, _ := d.Read(ctx, a); got.Version != 1 {
+		t.Errorf("expected version: 1, got %v", got.Version)
+	}
+
+	// best effort applies the rest
+	results, err = d.Batch(ctx, ops, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(results, nil, nil, subs.ErrNotFound)
+	if results[1].Version != 2 {
+		t.Errorf("expected version: 2, got %v", results[1].Version)
+	}
+
+	got, err := d.Read(ctx, results[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareSubs(t, s, got)
+	if got, _ := d.Read(ctx, a); got.Price != s2.Price {
+		t.Errorf("expected price: %v, got %v", s2.Price, got.Price)
+	}
+
+	// ops apply in order, the second update sees the first one
+	results, err = d.Batch(ctx, []subs.BatchOp{
+		{Op: subs.BatchDelete, ID: b, Version: 1},
+		{Op: subs.BatchUpdate, ID: a, Version: 2, Sub: s},
+		{Op: subs.BatchUpdate, ID: a, Version: 3, Sub: s2},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(results, nil, nil, nil)
+	if results[2].Version != 4 {
+		t.Errorf("expected version: 4, got %v", results[2].Version)
+	}
+	if _, err := d.Read(ctx, b); err != subs.ErrNotFound {
+		t.Errorf("expected %v, got %v", subs.ErrNotFound, err)
+	}
+
+	results, err = d.Batch(ctx, []subs.BatchOp{{Op: subs.BatchDelete, ID: a, Version: 1}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(results, subs.ErrVersionMismatch)
+
+	// enough creates for a bulk insert
+	ops = nil
+	for range 40 {
+		ops = append(ops, subs.BatchOp{Op: subs.BatchCreate, Sub: subs.Sub{Service: "bulk", Price: 10, User_ID: user, Start: "02-2024", End: end("03-2024")}})
+	}
+	ops = append(ops, subs.BatchOp{Op: subs.BatchDelete, ID: a})
+
+	results, err = d.Batch(ctx, ops, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 41 {
+		t.Errorf("expected 41 subs, got %v", n)
+	}
+
+	got, err = d.Read(ctx, results[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Start != "02-2024" || got.End == nil || *got.End != "03-2024" || got.Version != 1 {
+		t.Errorf("unexpected bulk created sub: %v", got)
+	}
+
+	sum, err := d.Sum(ctx, subs.Sub{Start: "01-2024", End: end("12-2024"), User_ID: user, Service: "bulk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 40*10*2 {
+		t.Errorf("expected sum: %v, got %v", 40*10*2, sum)
+	}
+}
+
+func testIdempotencyKeys(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+	key := uuid.NewString()
+
+	if _, found, err := d.ReserveKey(ctx, key, "hash", time.Hour); err != nil || found {
+		t.Fatalf("first reserve: expected new key, got found %v, err %v", found, err)
+	}
+
+	rec, found, err := d.ReserveKey(ctx, key, "other", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || rec.Hash != "hash" || rec.Status != 0 {
+		t.Fatalf("expected pending record of the first request, got %+v, found %v", rec, found)
+	}
+
+	body := []byte(`{"sub_id":"id"}`)
+	if err := d.CompleteKey(ctx, key, 201, body); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, found, err = d.ReserveKey(ctx, key, "hash", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || rec.Status != 201 || string(rec.Body) != string(body) {
+		t.Fatalf("expected completed record, got %+v, found %v", rec, found)
+	}
+
+	if err := d.CompleteKey(ctx, uuid.NewString(), 201, body); err != subs.ErrNotFound {
+		t.Errorf("complete missing: expected %v, got %v", subs.ErrNotFound, err)
+	}
+
+	// a released key is free again
+	if err := d.ReleaseKey(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := d.ReserveKey(ctx, key, "hash", time.Hour); err != nil || found {
+		t.Errorf("reserve released: expected new key, got found %v, err %v", found, err)
+	}
+
+	// so is an expired one
+	expiring := uuid.NewString()
+	if _, _, err := d.ReserveKey(ctx, expiring, "hash", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, found, err := d.ReserveKey(ctx, expiring, "other", time.Hour); err != nil || found {
+		t.Errorf("reserve expired: expected new key, got found %v, err %v", found, err)
+	}
+
+	// concurrent requests with one key, exactly one of them reserves it
+	concurrent := uuid.NewString()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var reserved int
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, found, err := d.ReserveKey(ctx, concurrent, "hash", time.Hour)
+			if err != nil {
+				t.Error(err)
+			}
+			if err == nil && !found {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reserved != 1 {
+		t.Errorf("expected 1 reservation, got %v", reserved)
+	}
+}
+
+func testRates(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+
+	rate := func(from string, to string, month string, r subs.Rate) subs.FXRate {
+		return subs.FXRate{From: from, To: to, Month: month, Rate: r}
+	}
+
+	for _, r := range []subs.FXRate{
+		rate("USD", "EUR", "03-2024", 950000),
+		rate("USD", "EUR", "01-2024", 900000),
+		rate("RUB", "EUR", "01-2023", 10000),
+		rate("USD", "RUB", "12-2023", 90_500000),
+	} {
+		if err := d.SetRate(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// setting a rate of the same pair and month replaces it
+	if err := d.SetRate(ctx, rate("USD", "RUB", "12-2023", 91_250000)); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(from string, to string, expected ...subs.FXRate) {
+		t.Helper()
+
+		rates, err := d.ListRates(ctx, from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rates) != len(expected) {
+			t.Fatalf("%v to %v: expected %v, got %v", from, to, expected, rates)
+		}
+		for i := range rates {
+			if rates[i] != expected[i] {
+				t.Fatalf("%v to %v: expected %v, got %v", from, to, expected, rates)
+			}
+		}
+	}
+
+	check("", "",
+		rate("RUB", "EUR", "01-2023", 10000),
+		rate("USD", "EUR", "01-2024", 900000),
+		rate("USD", "EUR", "03-2024", 950000),
+		rate("USD", "RUB", "12-2023", 91_250000))
+	check("USD", "",
+		rate("USD", "EUR", "01-2024", 900000),
+		rate("USD", "EUR", "03-2024", 950000),
+		rate("USD", "RUB", "12-2023", 91_250000))
+	check("", "EUR",
+		rate("RUB", "EUR", "01-2023", 10000),
+		rate("USD", "EUR", "01-2024", 900000),
+		rate("USD", "EUR", "03-2024", 950000))
+	check("EUR", "USD")
+
+	if err := d.DeleteRate(ctx, "USD", "EUR", "01-2024"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteRate(ctx, "USD", "EUR", "01-2024"); err != subs.ErrNotFound {
+		t.Errorf("delete missing: expected %v, got %v", subs.ErrNotFound, err)
+	}
+	if err := d.DeleteRate(ctx, "EUR", "USD", "03-2024"); err != subs.ErrNotFound {
+		t.Errorf("delete missing pair: expected %v, got %v", subs.ErrNotFound, err)
+	}
+	check("USD", "EUR", rate("USD", "EUR", "03-2024", 950000))
+}
+
+func testConvertedSum(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+
+	for _, s := range []subs.Sub{
+		{Service: "a", Price: 10, User_ID: newUser(t, d), Start: "01-2024", Currency: "USD"},
+		{Service: "b", Price: 333, User_ID: newUser(t, d), Start: "02-2024", End: end("03-2024"), Currency: "RUB"},
+		{Service: "c", Price: 5, User_ID: newUser(t, d), Start: "01-2024", End: end("01-2024"), Currency: "EUR"},
+		{Service: "d", Price: 1, User_ID: newUser(t, d), Start: "06-2023", End: end("12-2023"), Currency: "GBP"},
+	} {
+		create(t, d, s)
+	}
+
+	for _, r := range []subs.FXRate{
+		{From: "USD", To: "EUR", Month: "01-2024", Rate: 900000},
+		{From: "USD", To: "EUR", Month: "03-2024", Rate: 950000},
+		{From: "RUB", To: "EUR", Month: "01-2023", Rate: 10000},
+	} {
+		if err := d.SetRate(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	period := subs.Sub{Start: "01-2024", End: end("04-2024")}
+
+	// without a currency prices are summed as they are
+	sum, err := d.Sum(ctx, period)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 10*4+333*2+5 {
+		t.Errorf("expected raw sum: %v, got %v", 10*4+333*2+5, sum)
+	}
+
+	// a: 9 + 9 + 9.5 + 9.5, b: 3.33 * 2, c: 5, rounded once
+	eur := period
+	eur.Currency = "EUR"
+	sum, err = d.Sum(ctx, eur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 49 {
+		t.Errorf("expected converted sum: 49, got %v", sum)
+	}
+
+	check := func(filter subs.Sub, group_by string, expected ...subs.SumGroup) {
+		t.Helper()
+
+		groups, err := d.SumGroups(ctx, filter, group_by)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(groups) != len(expected) {
+			t.Fatalf("%v by %v: expected %v, got %v", filter, group_by, expected, groups)
+		}
+		for i := range groups {
+			if groups[i] != expected[i] {
+				t.Fatalf("%v by %v: expected %v, got %v", filter, group_by, expected, groups)
+			}
+		}
+	}
+
+	group := func(g string, sum subs.Money) subs.SumGroup {
+		return subs.SumGroup{Group: g, Sum: sum}
+	}
+
+	// every group is rounded half up on its own
+	check(eur, "month", group("01-2024", 14), group("02-2024", 12), group("03-2024", 13), group("04-2024", 10))
+	check(eur, "service_name", group("a", 37), group("b", 7), group("c", 5))
+
+	// the first month missing a rate is reported
+	for _, tc := range []struct {
+		filter   subs.Sub
+		expected subs.RateError
+	}{
+		{subs.Sub{Start: "01-2023", End: end("12-2023"), Currency: "EUR"}, subs.RateError{From: "GBP", To: "EUR", Month: "06-2023"}},
+		{subs.Sub{Start: "01-2024", End: end("02-2024"), Currency: "USD"}, subs.RateError{From: "EUR", To: "USD", Month: "01-2024"}},
+		{subs.Sub{Start: "10-2023", End: end("01-2024"), Currency: "EUR"}, subs.RateError{From: "GBP", To: "EUR", Month: "10-2023"}},
+	} {
+		var rerr *subs.RateError
+
+		_, err := d.Sum(ctx, tc.filter)
+		if !errors.As(err, &rerr) || *rerr != tc.expected {
+			t.Errorf("%v: expected %v, got %v", tc.filter, &tc.expected, err)
+		}
+
+		_, err = d.SumGroups(ctx, tc.filter, "month")
+		if !errors.As(err, &rerr) || *rerr != tc.expected {
+			t.Errorf("%v by month: expected %v, got %v", tc.filter, &tc.expected, err)
+		}
+	}
+
+	// a sum in the currency of every sub needs no rate
+	sum, err = d.Sum(ctx, subs.Sub{Start: "02-2024", End: end("04-2024"), Service: "a", Currency: "USD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 30 {
+		t.Errorf("expected sum: 30, got %v", sum)
+	}
+}
+
+func testBillingPeriods(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+
+	user := newUser(t, d)
+	for _, s := range []subs.Sub{
+		{Service: "monthly", Price: 100, User_ID: user, Start: "01-2024"},
+		{Service: "quarterly", Price: 1000, User_ID: user, Start: "02-2024", Billing_Period: "quarterly", Billing_Interval: 1, Anchor: "2024-02-29"},
+		{Service: "yearly", Price: 10000, User_ID: user, Start: "03-2024", End: end("12-2025"), Billing_Period: "yearly", Billing_Interval: 1, Anchor: "2024-03-15"},
+		{Service: "weekly", Price: 1, User_ID: user, Start: "07-2024", End: end("08-2024"), Billing_Period: "weekly", Billing_Interval: 2, Anchor: "2024-07-01"},
+	} {
+		id := create(t, d, s)
+
+		got, err := d.Read(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareSubs(t, s, got)
+	}
+
+	for _, tc := range []struct {
+		filter   subs.Sub
+		expected subs.Money
+	}{
+		// charges in July and August 2024 on every other Monday from July 1st
+		{subs.Sub{Start: "07-2024", End: end("08-2024"), Service: "weekly"}, 5},
+		// February, May, August and November 2024, then February 2025
+		{subs.Sub{Start: "01-2024", End: end("02-2025"), Service: "quarterly"}, 5000},
+		{subs.Sub{Start: "03-2024", End: end("05-2024"), Service: "quarterly"}, 1000},
+		// March 2024 and March 2025 only, the sub ends before March 2026
+		{subs.Sub{Start: "01-2024", End: end("12-2030"), Service: "yearly"}, 20000},
+		{subs.Sub{Start: "04-2024", End: end("02-2025"), Service: "yearly"}, 0},
+		{subs.Sub{Start: "01-2024", End: end("03-2024")}, 300 + 1000 + 10000},
+	} {
+		sum, err := d.Sum(ctx, tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum != tc.expected {
+			t.Errorf("%v: expected %v, got %v", tc.filter, tc.expected, sum)
+		}
+	}
+
+	groups, err := d.SumGroups(ctx, subs.Sub{Start: "06-2024", End: end("08-2024")}, "month")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []subs.SumGroup{{Group: "06-2024", Sum: 100}, {Group: "07-2024", Sum: 103}, {Group: "08-2024", Sum: 1102}}
+	if len(groups) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, groups)
+	}
+	for i := range groups {
+		if groups[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, groups)
+		}
+	}
+
+	// only months with a charge need a rate
+	if err := d.SetRate(ctx, subs.FXRate{From: "RUB", To: "EUR", Month: "03-2024", Rate: 10000}); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := d.Sum(ctx, subs.Sub{Start: "01-2024", End: end("12-2025"), Service: "yearly", Currency: "EUR"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 200 {
+		t.Errorf("expected converted sum: 200, got %v", sum)
+	}
+
+	// patching the billing fields changes the charges
+	page, err := d.List(ctx, subs.ListQuery{Service: "monthly"})
+	if err != nil || len(page.Subs) != 1 {
+		t.Fatalf("expected the monthly sub, got %v, %v", page.Subs, err)
+	}
+
+	period, interval := "yearly", 1
+	if _, err := d.Patch(ctx, page.Subs[0].ID, subs.SubPatch{Billing_Period: &period, Billing_Interval: &interval}, 0); err != nil {
+		t.Fatal(err)
+	}
+	sum, err = d.Sum(ctx, subs.Sub{Start: "01-2024", End: end("12-2025"), Service: "monthly"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 200 {
+		t.Errorf("expected patched sum: 200, got %v", sum)
+	}
+}
+
+func testDayDates(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+
+	user := newUser(t, d)
+	ids := make(map[string]string)
+	for _, tc := range []struct {
+		sub      subs.Sub
+		expected subs.Sub
+	}{
+		// dates covering whole months read back as months
+		{subs.Sub{Service: "a", Price: 3100, User_ID: user, Start: "2024-07-01", End: end("2024-09-30")}, subs.Sub{Start: "07-2024", End: end("09-2024")}},
+		{subs.Sub{Service: "b", Price: 3100, User_ID: user, Start: "2024-07-20"}, subs.Sub{Start: "2024-07-20"}},
+		{subs.Sub{Service: "c", Price: 3100, User_ID: user, Start: "06-2024", End: end("2024-09-10")}, subs.Sub{Start: "06-2024", End: end("2024-09-10")}},
+		{subs.Sub{Service: "d", Price: 3100, User_ID: user, Start: "2024-07-05", End: end("2024-07-25")}, subs.Sub{Start: "2024-07-05", End: end("2024-07-25")}},
+	} {
+		id := create(t, d, tc.sub)
+		ids[tc.sub.Service] = id
+
+		got, err := d.Read(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := tc.sub
+		expected.Start, expected.End = tc.expected.Start, tc.expected.End
+		compareSubs(t, expected, got)
+	}
+
+	// a start inside the last month of a list period is active in it
+	page, err := d.List(ctx, subs.ListQuery{To: "07-2024", Sort: "start_date"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var services []string
+	for _, sub := range page.Subs {
+		services = append(services, sub.Service)
+	}
+	if strings.Join(services, ",") != "c,a,d,b" {
+		t.Errorf("expected c,a,d,b by start day, got %v", services)
+	}
+
+	// so are ends inside the first month
+	page, err = d.List(ctx, subs.ListQuery{From: "09-2024"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Subs) != 3 {
+		t.Errorf("expected 3 subs active from 09-2024, got %v", page.Subs)
+	}
+
+	// a cursor at a start day resumes after it
+	page, err = d.List(ctx, subs.ListQuery{Sort: "start_date", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err = d.List(ctx, subs.ListQuery{Sort: "start_date", After: page.Next_Cursor})
+	if err != nil || len(page.Subs) != 2 || page.Subs[0].Service != "d" {
+		t.Errorf("expected d and b after the cursor, got %v, %v", page.Subs, err)
+	}
+
+	for _, tc := range []struct {
+		filter   subs.Sub
+		expected subs.Money
+	}{
+		// July 20th to 31st is 12 of 31 days
+		{subs.Sub{Start: "07-2024", End: end("07-2024"), Service: "b"}, 1200},
+		{subs.Sub{Start: "07-2024", End: end("08-2024"), Service: "b"}, 1200 + 3100},
+		// September 1st to 10th is 10 of 30 days
+		{subs.Sub{Start: "01-2024", End: end("12-2024"), Service: "c"}, 3*3100 + 1033},
+		// July 5th to 25th is 21 of 31 days, billed in July
+		{subs.Sub{Start: "07-2024", End: end("07-2024"), Service: "d"}, 2100},
+		{subs.Sub{Start: "08-2024", End: end("08-2024"), Service: "d"}, 0},
+		{subs.Sub{Start: "09-2024", End: end("09-2024")}, 3100 + 3100 + 1033},
+	} {
+		sum, err := d.Sum(ctx, tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum != tc.expected {
+			t.Errorf("%v: expected %v, got %v", tc.filter, tc.expected, sum)
+		}
+	}
+
+	groups, err := d.SumGroups(ctx, subs.Sub{Start: "07-2024", End: end("09-2024"), User_ID: user}, "month")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []subs.SumGroup{{Group: "07-2024", Sum: 3100 + 1200 + 3100 + 2100}, {Group: "08-2024", Sum: 3 * 3100}, {Group: "09-2024", Sum: 3100 + 3100 + 1033}}
+	if len(groups) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, groups)
+	}
+	for i := range groups {
+		if groups[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, groups)
+		}
+	}
+
+	// prorated charges are converted at the rate of their month
+	if err := d.SetRate(ctx, subs.FXRate{From: "RUB", To: "EUR", Month: "07-2024", Rate: 10000}); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := d.Sum(ctx, subs.Sub{Start: "07-2024", End: end("07-2024"), Service: "d", Currency: "EUR"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 21 {
+		t.Errorf("expected converted sum: 21, got %v", sum)
+	}
+
+	// patched days are stored like created ones
+	start := "2024-07-01"
+	if _, err := d.Patch(ctx, ids["b"], subs.SubPatch{Start: &start}, 0); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.Read(ctx, ids["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Start != "07-2024" {
+		t.Errorf("expected start 07-2024, got %v", got.Start)
+	}
+}
+
+func testPrices(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+
+	user := newUser(t, d)
+	a := create(t, d, subs.Sub{Service: "a", Price: 1000, User_ID: user, Start: "01-2024"})
+	b := create(t, d, subs.Sub{Service: "b", Price: 3100, User_ID: user, Start: "2024-07-20"})
+
+	for _, p := range []struct {
+		id    string
+		price subs.SubPrice
+	}{
+		{a, subs.SubPrice{Effective_From: "07-2024", Price: 1500}},
+		{a, subs.SubPrice{Effective_From: "04-2024", Price: 1200}},
+		{b, subs.SubPrice{Effective_From: "07-2024", Price: 6200}},
+	} {
+		if err := d.SetPrice(ctx, p.id, p.price); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// setting a price of the same month replaces it
+	if err := d.SetPrice(ctx, a, subs.SubPrice{Effective_From: "07-2024", Price: 1400}); err != nil {
+		t.Fatal(err)
+	}
+
+	prices, err := d.ListPrices(ctx, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(prices) != "[{04-2024 12.00} {07-2024 14.00}]" {
+		t.Errorf("unexpected prices: %v", prices)
+	}
+
+	check := func(filter subs.Sub, expected subs.Money) {
+		t.Helper()
+
+		sum, err := d.Sum(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum != expected {
+			t.Errorf("%v: expected %v, got %v", filter, expected, sum)
+		}
+	}
+
+	check(subs.Sub{Start: "01-2024", End: end("12-2024"), Service: "a"}, 3*1000+3*1200+6*1400)
+	check(subs.Sub{Start: "05-2024", End: end("08-2024"), Service: "a"}, 2*1200+2*1400)
+	// a prorated charge is prorated from the price of its month, 12 of 31 days
+	check(subs.Sub{Start: "07-2024", End: end("08-2024"), Service: "b"}, 2400+6200)
+
+	groups, err := d.SumGroups(ctx, subs.Sub{Start: "03-2024", End: end("04-2024"), Service: "a"}, "month")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(groups) != "[{03-2024 10.00} {04-2024 12.00}]" {
+		t.Errorf("unexpected groups: %v", groups)
+	}
+
+	if err := d.SetRate(ctx, subs.FXRate{From: "RUB", To: "EUR", Month: "01-2024", Rate: 10000}); err != nil {
+		t.Fatal(err)
+	}
+	check(subs.Sub{Start: "06-2024", End: end("07-2024"), Service: "a", Currency: "EUR"}, 12+14)
+
+	// the price of the sub itself only applies before its first scheduled one
+	price := subs.Money(900)
+	if _, err := d.Patch(ctx, a, subs.SubPatch{Price: &price}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeletePrice(ctx, a, "04-2024"); err != nil {
+		t.Fatal(err)
+	}
+	check(subs.Sub{Start: "01-2024", End: end("12-2024"), Service: "a"}, 6*900+6*1400)
+
+	if err := d.DeletePrice(ctx, a, "04-2024"); err != subs.ErrNotFound {
+		t.Errorf("delete missing: expected %v, got %v", subs.ErrNotFound, err)
+	}
+
+	missing := uuid.NewString()
+	if err := d.SetPrice(ctx, missing, subs.SubPrice{Effective_From: "01-2024", Price: 1}); err != subs.ErrNotFound {
+		t.Errorf("set on missing sub: expected %v, got %v", subs.ErrNotFound, err)
+	}
+	if err := d.DeletePrice(ctx, missing, "01-2024"); err != subs.ErrNotFound {
+		t.Errorf("delete on missing sub: expected %v, got %v", subs.ErrNotFound, err)
+	}
+	if _, err := d.ListPrices(ctx, missing); err != subs.ErrNotFound {
+		t.Errorf("list on missing sub: expected %v, got %v", subs.ErrNotFound, err)
+	}
+
+	// prices go away with their sub
+	if err := d.Delete(ctx, a, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Batch(ctx, []subs.BatchOp{{Op: subs.BatchDelete, ID: b}}, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{a, b} {
+		if _, err := d.ListPrices(ctx, id); err != subs.ErrNotFound {
+			t.Errorf("list after delete: expected %v, got %v", subs.ErrNotFound, err)
+		}
+	}
+}
+
+func testPauses(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+
+	user := newUser(t, d)
+	a := create(t, d, subs.Sub{Service: "a", Price: 1000, User_ID: user, Start: "01-2024"})
+	b := create(t, d, subs.Sub{Service: "b", Price: 12000, User_ID: user, Start: "01-2024", Billing_Period: "yearly", Billing_Interval: 1, Anchor: "2024-03-15"})
+	c := create(t, d, subs.Sub{Service: "c", Price: 3100, User_ID: user, Start: "2024-07-20"})
+
+	pause := func(id string, start string, end string, version int) string {
+		t.Helper()
+
+		pause_id, v, err := d.AddPause(ctx, id, subs.Pause{Start: start, End: end})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != version {
+			t.Errorf("pause %v..%v: expected version %v, got %v", start, end, version, v)
+		}
+		return pause_id
+	}
+
+	check := func(filter subs.Sub, expected subs.Money) {
+		t.Helper()
+
+		sum, err := d.Sum(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum != expected {
+			t.Errorf("%v: expected %v, got %v", filter, expected, sum)
+		}
+	}
+
+	summer := pause(a, "07-2024", "08-2024", 2)
+	check(subs.Sub{Start: "01-2024", End: end("12-2024"), Service: "a"}, 10*1000)
+
+	// overlapping pauses skip each paused month once
+	autumn := pause(a, "08-2024", "09-2024", 3)
+	check(subs.Sub{Start: "01-2024", End: end("12-2024"), Service: "a"}, 9*1000)
+
+	sub, err := d.Read(ctx, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []subs.Pause{{ID: summer, Start: "07-2024", End: "08-2024"}, {ID: autumn, Start: "08-2024", End: "09-2024"}}
+	if fmt.Sprint(sub.Pauses) != fmt.Sprint(expected) || sub.Version != 3 {
+		t.Errorf("expected pauses %v at version 3, got %v at %v", expected, sub.Pauses, sub.Version)
+	}
+
+	groups, err := d.SumGroups(ctx, subs.Sub{Start: "06-2024", End: end("10-2024"), Service: "a"}, "month")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(groups) != "[{06-2024 10.00} {07-2024 0.00} {08-2024 0.00} {09-2024 0.00} {10-2024 10.00}]" {
+		t.Errorf("unexpected groups: %v", groups)
+	}
+
+	if err := d.SetRate(ctx, subs.FXRate{From: "RUB", To: "EUR", Month: "01-2024", Rate: 10000}); err != nil {
+		t.Fatal(err)
+	}
+	check(subs.Sub{Start: "06-2024", End: end("09-2024"), Service: "a", Currency: "EUR"}, 10)
+
+	// a pause skips the charges in its months, prorated ones included
+	pause(b, "03-2024", "03-2024", 2)
+	check(subs.Sub{Start: "01-2024", End: end("12-2025"), Service: "b"}, 12000)
+	pause(c, "07-2024", "07-2024", 2)
+	check(subs.Sub{Start: "07-2024", End: end("08-2024"), Service: "c"}, 3100)
+
+	// a price scheduled inside a pause applies once it ends
+	if err := d.SetPrice(ctx, a, subs.SubPrice{Effective_From: "08-2024", Price: 2000}); err != nil {
+		t.Fatal(err)
+	}
+	check(subs.Sub{Start: "01-2024", End: end("12-2024"), Service: "a"}, 6*1000+3*2000)
+
+	// pauses are kept by updates and ignored in written subs
+	updated := subs.Sub{Service: "a", Price: 1000, User_ID: user, Start: "01-2024", Pauses: []subs.Pause{{ID: uuid.NewString(), Start: "01-2024", End: "12-2024"}}}
+	if _, err := d.Update(ctx, a, updated, 0); err != nil {
+		t.Fatal(err)
+	}
+	sub, err = d.Read(ctx, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(sub.Pauses) != fmt.Sprint(expected) {
+		t.Errorf("expected pauses %v after update, got %v", expected, sub.Pauses)
+	}
+
+	version, err := d.DeletePause(ctx, a, summer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != sub.Version+1 {
+		t.Errorf("expected version %v, got %v", sub.Version+1, version)
+	}
+	check(subs.Sub{Start: "01-2024", End: end("12-2024"), Service: "a"}, 7*1000+3*2000)
+
+	if _, err := d.DeletePause(ctx, a, summer); err != subs.ErrNotFound {
+		t.Errorf("delete missing: expected %v, got %v", subs.ErrNotFound, err)
+	}
+	if _, err := d.DeletePause(ctx, b, autumn); err != subs.ErrNotFound {
+		t.Errorf("delete of another sub: expected %v, got %v", subs.ErrNotFound, err)
+	}
+	if _, _, err := d.AddPause(ctx, uuid.NewString(), subs.Pause{Start: "01-2024", End: "01-2024"}); err != subs.ErrNotFound {
+		t.Errorf("add on missing sub: expected %v, got %v", subs.ErrNotFound, err)
+	}
+}
+
+func testTrials(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+
+	user := newUser(t, d)
+	a := create(t, d, subs.Sub{Service: "a", Price: 1000, User_ID: user, Start: "01-2024", Trial_Months: 2})
+	b := create(t, d, subs.Sub{Service: "b", Price: 3100, User_ID: user, Start: "2024-01-31", Trial_Months: 1, Intro_Price: 1000, Intro_Months: 2})
+	create(t, d, subs.Sub{Service: "c", Price: 1000, User_ID: user, Start: "01-2024", End: end("02-2024"), Trial_Months: 3})
+	create(t, d, subs.Sub{Service: "d", Price: 1000, User_ID: newUser(t, d), Start: "01-2024"})
+
+	check := func(filter subs.Sub, expected subs.Money) {
+		t.Helper()
+
+		sum, err := d.Sum(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum != expected {
+			t.Errorf("%v: expected %v, got %v", filter, expected, sum)
+		}
+	}
+
+	sub, err := d.Read(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Trial_Months != 1 || sub.Intro_Price != 1000 || sub.Intro_Months != 2 {
+		t.Errorf("expected trial and intro fields, got %v", sub)
+	}
+
+	// charges on the first of the month, a trial from January 31st lasts until
+	// February 28th and the intro months until April 29th
+	check(subs.Sub{Start: "01-2024", End: end("12-2024"), Service: "a"}, 10*1000)
+	check(subs.Sub{Start: "01-2024", End: end("12-2024"), Service: "b"}, 2*1000+8*3100)
+	check(subs.Sub{Start: "01-2024", End: end("12-2024"), Service: "c"}, 0)
+
+	groups, err := d.SumGroups(ctx, subs.Sub{Start: "02-2024", End: end("05-2024"), Service: "b"}, "month")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(groups) != "[{02-2024 0.00} {03-2024 10.00} {04-2024 10.00} {05-2024 31.00}]" {
+		t.Errorf("unexpected groups: %v", groups)
+	}
+
+	trials := func(user_id string, from string, to string) string {
+		t.Helper()
+
+		list, err := d.Trials(ctx, user_id, from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, trial := range list {
+			got = append(got, trial.Sub.ID+" "+trial.Trial_End)
+		}
+		return fmt.Sprint(got)
+	}
+
+	if got, expected := trials("", "2024-01-01", "2024-03-31"), fmt.Sprint([]string{b + " 2024-02-28", a + " 2024-02-29"}); got != expected {
+		t.Errorf("expected trials %v, got %v", expected, got)
+	}
+	if got, expected := trials(user, "2024-02-29", "2024-02-29"), fmt.Sprint([]string{a + " 2024-02-29"}); got != expected {
+		t.Errorf("expected trials %v, got %v", expected, got)
+	}
+	if got := trials(uuid.NewString(), "2024-01-01", "2024-03-31"); got != "[]" {
+		t.Errorf("expected no trials of another user, got %v", got)
+	}
+	if got := trials("", "2024-03-01", "2024-12-31"); got != "[]" {
+		t.Errorf("expected no trials ending later, got %v", got)
+	}
+
+	no_trial := 0
+	if _, err := d.Patch(ctx, a, subs.SubPatch{Trial_Months: &no_trial}, 0); err != nil {
+		t.Fatal(err)
+	}
+	check(subs.Sub{Start: "01-2024", End: end("12-2024"), Service: "a"}, 12*1000)
+	if got, expected := trials("", "2024-01-01", "2024-03-31"), fmt.Sprint([]string{b + " 2024-02-28"}); got != expected {
+		t.Errorf("expected trials %v after patch, got %v", expected, got)
+	}
+}
+
+func testMembers(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+
+	owner, a, b := newUser(t, d), newUser(t, d), newUser(t, d)
+	x := create(t, d, subs.Sub{Service: "x", Price: 1000, User_ID: owner, Start: "01-2024"})
+	y := create(t, d, subs.Sub{Service: "y", Price: 500, User_ID: a, Start: "01-2024"})
+	z := create(t, d, subs.Sub{Service: "z", Price: 999, User_ID: owner, Start: "01-2024", End: end("01-2024")})
+
+	set := func(id string, member subs.Member) {
+		t.Helper()
+
+		if err := d.SetMember(ctx, id, member); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(filter subs.Sub, expected subs.Money) {
+		t.Helper()
+
+		sum, err := d.Sum(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum != expected {
+			t.Errorf("%v: expected %v, got %v", filter, expected, sum)
+		}
+	}
+
+	year := subs.Sub{Start: "01-2024", End: end("12-2024")}
+	user := func(user_id string, service string) subs.Sub {
+		filter := year
+		filter.User_ID, filter.Service = user_id, service
+		return filter
+	}
+
+	// a fixed 3.00 and 50% of each 10.00 charge, the owner pays the rest
+	set(x, subs.Member{User_ID: a, Percent: 50})
+	set(x, subs.Member{User_ID: b, Amount: 300})
+	check(user(owner, "x"), 12*200)
+	check(user(a, ""), 12*500+12*500)
+	check(user(b, ""), 12*300)
+	check(user("", "x"), 12*1000)
+
+	members, err := d.ListMembers(ctx, x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []subs.Member{{User_ID: a, Percent: 50}, {User_ID: b, Amount: 300}}
+	if b < a {
+		expected[0], expected[1] = expected[1], expected[0]
+	}
+	if fmt.Sprint(members) != fmt.Sprint(expected) {
+		t.Errorf("expected members %v, got %v", expected, members)
+	}
+
+	groups, err := d.SumGroups(ctx, user("", "x"), "user_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sums := make(map[string]subs.Money)
+	for _, g := range groups {
+		sums[g.Group] = g.Sum
+	}
+	if len(groups) != 3 || sums[owner] != 12*200 || sums[a] != 12*500 || sums[b] != 12*300 {
+		t.Errorf("unexpected user groups: %v", groups)
+	}
+
+	groups, err = d.SumGroups(ctx, subs.Sub{Start: "01-2024", End: end("02-2024"), User_ID: a}, "service_name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(groups) != "[{x 10.00} {y 10.00}]" {
+		t.Errorf("unexpected service groups: %v", groups)
+	}
+
+	if err := d.SetRate(ctx, subs.FXRate{From: "RUB", To: "EUR", Month: "01-2024", Rate: 10000}); err != nil {
+		t.Fatal(err)
+	}
+	converted := user(b, "")
+	converted.Currency = "EUR"
+	check(converted, 36)
+
+	// 50% of 9.99 rounds half up, a fixed share above the charge leaves
+	// nothing to the others
+	set(z, subs.Member{User_ID: a, Percent: 50})
+	check(user(a, "z"), 500)
+	check(user(owner, "z"), 499)
+	set(z, subs.Member{User_ID: b, Amount: 2000})
+	check(user(b, "z"), 999)
+	check(user(a, "z"), 0)
+	check(user(owner, "z"), 0)
+
+	list := func(user_id string) []string {
+		t.Helper()
+
+		page, err := d.List(ctx, subs.ListQuery{User_ID: user_id, Sort: "service_name"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var services []string
+		for _, sub := range page.Subs {
+			services = append(services, sub.Service)
+		}
+		return services
+	}
+	if got := fmt.Sprint(list(a)); got != "[x y z]" {
+		t.Errorf("expected the subs a participates in, got %v", got)
+	}
+	if got := fmt.Sprint(list(b)); got != "[x z]" {
+		t.Errorf("expected the subs b participates in, got %v", got)
+	}
+
+	if err := d.DeleteMember(ctx, x, b); err != nil {
+		t.Fatal(err)
+	}
+	check(user(owner, "x"), 12*500)
+	check(user(b, "x"), 0)
+	if err := d.DeleteMember(ctx, x, b); err != subs.ErrNotFound {
+		t.Errorf("delete missing: expected %v, got %v", subs.ErrNotFound, err)
+	}
+
+	// members go with their sub
+	if err := d.Delete(ctx, z, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(list(b)); got != "[]" {
+		t.Errorf("expected no subs of b, got %v", got)
+	}
+
+	missing := uuid.NewString()
+	if err := d.SetMember(ctx, missing, subs.Member{User_ID: a, Percent: 10}); err != subs.ErrNotFound {
+		t.Errorf("set on missing sub: expected %v, got %v", subs.ErrNotFound, err)
+	}
+	if err := d.SetMember(ctx, y, subs.Member{User_ID: missing, Percent: 10}); err != subs.ErrUnknownUser {
+		t.Errorf("set of unknown user: expected %v, got %v", subs.ErrUnknownUser, err)
+	}
+	if _, err := d.ListMembers(ctx, missing); err != subs.ErrNotFound {
+		t.Errorf("list of missing sub: expected %v, got %v", subs.ErrNotFound, err)
+	}
+	if members, err := d.ListMembers(ctx, y); err != nil || len(members) != 0 {
+		t.Errorf("expected no members, got %v, %v", members, err)
+	}
+}
+
+func testServices(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+
+	id, err := d.CreateService(ctx, subs.Service{Name: " Netflix ", Aliases: []string{"NFLX", "netflix"}, Default_Price: 79900, Category: "video"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// names are trimmed, aliases repeating the name dropped
+	svc, err := d.ReadService(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := subs.Service{ID: id, Name: "Netflix", Aliases: []string{"NFLX"}, Default_Price: 79900, Currency: "RUB", Category: "video"}
+	if fmt.Sprint(svc) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, svc)
+	}
+
+	// names and aliases are unique across the catalog, whatever their case
+	for _, other := range []subs.Service{{Name: "NETFLIX"}, {Name: "nflx"}, {Name: "Kino", Aliases: []string{" netflix"}}} {
+		if _, err := d.CreateService(ctx, other); err != subs.ErrServiceConflict {
+			t.Errorf("%v: expected ErrServiceConflict, got %v", other, err)
+		}
+	}
+
+	kino, err := d.CreateService(ctx, subs.Service{Name: "Kino"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UpdateService(ctx, kino, subs.Service{Name: "Kino", Aliases: []string{"nflx"}}); err != subs.ErrServiceConflict {
+		t.Errorf("expected ErrServiceConflict, got %v", err)
+	}
+
+	// an update frees the names it drops
+	if err := d.UpdateService(ctx, id, subs.Service{Name: "Netflix", Category: "streaming"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UpdateService(ctx, kino, subs.Service{Name: "Kino", Aliases: []string{"nflx"}}); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+
+	services, err := d.ListServices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 || services[0].ID != kino || services[1].ID != id || services[1].Category != "streaming" || len(services[1].Aliases) != 0 {
+		t.Errorf("unexpected services: %v", services)
+	}
+
+	if err := d.DeleteService(ctx, kino); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteService(ctx, kino); err != subs.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := d.ReadService(ctx, kino); err != subs.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := d.UpdateService(ctx, kino, subs.Service{Name: "Kino"}); err != subs.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := d.CreateService(ctx, subs.Service{Name: "NFLX"}); err != nil {
+		t.Errorf("expected the names of a deleted service free, got %v", err)
+	}
+
+	// the sum service filter matches names case-insensitively
+	user := newUser(t, d)
+	create(t, d, subs.Sub{Service: "Netflix", Price: 100, User_ID: user, Start: "01-2024"})
+	create(t, d, subs.Sub{Service: "netflix", Price: 200, User_ID: user, Start: "01-2024"})
+	create(t, d, subs.Sub{Service: "NETFLIX ", Price: 400, User_ID: user, Start: "01-2024"})
+	create(t, d, subs.Sub{Service: "Kino", Price: 800, User_ID: user, Start: "01-2024"})
+
+	for _, service := range []string{"Netflix", "nEtFlIx", " netflix"} {
+		sum, err := d.Sum(ctx, subs.Sub{Start: "01-2024", End: end("01-2024"), User_ID: user, Service: service})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum != 700 {
+			t.Errorf("%q: expected 700, got %v", service, sum)
+		}
+	}
+
+	groups, err := d.SumGroups(ctx, subs.Sub{Start: "01-2024", End: end("01-2024"), Service: "NETFLIX"}, "month")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(groups) != "[{01-2024 7.00}]" {
+		t.Errorf("unexpected month groups: %v", groups)
+	}
+
+	// catalog writes rename the subs of their names and aliases, a renamed
+	// entry takes along the subs of its old name
+	tv := create(t, d, subs.Sub{Service: " tv ", Price: 100, User_ID: user, Start: "01-2024"})
+	music := create(t, d, subs.Sub{Service: "MUSIC", Price: 100, User_ID: user, Start: "01-2024", Category: "audio"})
+	other := create(t, d, subs.Sub{Service: "Kino", Price: 100, User_ID: user, Start: "01-2024"})
+
+	// so are budgets, unless their user has two of the names
+	both := newUser(t, d)
+	for _, budget := range []subs.Budget{
+		{User_ID: user, Monthly_Limit: 100, Currency: "RUB", Service: "tv"},
+		{User_ID: both, Monthly_Limit: 100, Currency: "RUB", Service: "TV"},
+		{User_ID: both, Monthly_Limit: 100, Currency: "RUB", Service: "Music"},
+	} {
+		if _, err := d.CreateBudget(ctx, budget); err != nil {
+			t.Fatal(err)
+		}
+	}
+	budgetNames := func(user string) string {
+		t.Helper()
+
+		budgets, err := d.ListBudgets(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, budget := range budgets {
+			names = append(names, budget.Service)
+		}
+		return strings.Join(names, ",")
+	}
+
+	plus, err := d.CreateService(ctx, subs.Service{Name: "TV+", Aliases: []string{"tv", "music"}, Category: "video"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []subs.Sub{
+		{ID: tv, Service: "TV+", Category: "video", Version: 2},
+		{ID: music, Service: "TV+", Category: "audio", Version: 2},
+		{ID: other, Service: "Kino", Version: 1},
+	} {
+		sub, err := d.Read(ctx, expected.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sub.Service != expected.Service || sub.Category != expected.Category || sub.Version != expected.Version {
+			t.Errorf("expected %v %q %q version %v, got %q %q version %v", expected.ID, expected.Service, expected.Category, expected.Version, sub.Service, sub.Category, sub.Version)
+		}
+	}
+	if names := budgetNames(user); names != "TV+" {
+		t.Errorf("expected budget of TV+, got %v", names)
+	}
+	if names := budgetNames(both); names != "Music,TV" {
+		t.Errorf("expected budgets of Music,TV, got %v", names)
+	}
+
+	if err := d.UpdateService(ctx, plus, subs.Service{Name: "Apple TV", Category: "video"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{tv, music} {
+		sub, err := d.Read(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sub.Service != "Apple TV" || sub.Version != 3 {
+			t.Errorf("%v: expected Apple TV version 3, got %q version %v", id, sub.Service, sub.Version)
+		}
+	}
+	if names := budgetNames(user); names != "Apple TV" {
+		t.Errorf("expected budget of Apple TV, got %v", names)
+	}
+}
+
+func testTags(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+
+	user := newUser(t, d)
+	a := subs.Sub{Service: "a", Price: 100, User_ID: user, Start: "01-2024", Category: "video", Tags: []string{"hd", " family", "hd"}}
+	id := create(t, d, a)
+	create(t, d, subs.Sub{Service: "b", Price: 200, User_ID: user, Start: "01-2024", Category: "music", Tags: []string{"family"}})
+	create(t, d, subs.Sub{Service: "c", Price: 400, User_ID: user, Start: "01-2024"})
+
+	// tags are read back trimmed and sorted without repeats
+	got, err := d.Read(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Tags = []string{"family", "hd"}
+	compareSubs(t, a, got)
+
+	list := func(q subs.ListQuery, expected string) {
+		t.Helper()
+
+		q.Sort = "service_name"
+		page, err := d.List(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, sub := range page.Subs {
+			got = append(got, sub.Service)
+		}
+		if fmt.Sprint(got) != expected {
+			t.Errorf("%+v: expected %v, got %v", q, expected, got)
+		}
+	}
+
+	list(subs.ListQuery{Tags: []string{"family"}}, "[a b]")
+	list(subs.ListQuery{Tags: []string{"hd", "none"}}, "[a]")
+	list(subs.ListQuery{Tags: []string{"family", "hd"}, AllTags: true}, "[a]")
+	list(subs.ListQuery{Tags: []string{"hd", "none"}, AllTags: true}, "[]")
+	list(subs.ListQuery{Category: "music"}, "[b]")
+	list(subs.ListQuery{Category: "music", Tags: []string{"hd"}}, "[]")
+
+	check := func(filter subs.Sub, expected subs.Money) {
+		t.Helper()
+
+		filter.Start, filter.End = "01-2024", end("01-2024")
+		sum, err := d.Sum(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum != expected {
+			t.Errorf("%v: expected %v, got %v", filter, expected, sum)
+		}
+	}
+
+	check(subs.Sub{}, 700)
+	check(subs.Sub{Tags: []string{"family"}}, 300)
+	check(subs.Sub{Tags: []string{"family", "hd"}, All_Tags: true}, 100)
+	check(subs.Sub{Category: "video"}, 100)
+	check(subs.Sub{Category: "music", User_ID: user, Tags: []string{"family"}}, 200)
+
+	groups := func(group_by string, expected string) {
+		t.Helper()
+
+		groups, err := d.SumGroups(ctx, subs.Sub{Start: "01-2024", End: end("01-2024")}, group_by)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(groups) != expected {
+			t.Errorf("%v: expected %v, got %v", group_by, expected, groups)
+		}
+	}
+
+	// a sub counts in the group of each of its tags
+	groups("category", "[{ 4.00} {music 2.00} {video 1.00}]")
+	groups("tag", "[{ 4.00} {family 3.00} {hd 1.00}]")
+
+	tags := []string{"hd"}
+	category := ""
+	if _, err := d.Patch(ctx, id, subs.SubPatch{Tags: &tags, Category: &category}, 0); err != nil {
+		t.Fatal(err)
+	}
+	a.Tags, a.Category = tags, category
+
+	got, err = d.Read(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareSubs(t, a, got)
+	check(subs.Sub{Tags: []string{"family"}}, 200)
+}
+
+func testUsers(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+
+	user := subs.User{ID: uuid.NewString(), Display_Name: "user", Email: "user@example.com", Default_Currency: "USD", Timezone: "Europe/Moscow"}
+	if id, err := d.CreateUser(ctx, user); err != nil || id != user.ID {
+		t.Fatalf("expected user %v, got %v, %v", user.ID, id, err)
+	}
+	if _, err := d.CreateUser(ctx, user); err != subs.ErrUserConflict {
+		t.Errorf("expected %v, got %v", subs.ErrUserConflict, err)
+	}
+
+	got, err := d.ReadUser(ctx, user.ID)
+	if err != nil || got != user {
+		t.Errorf("expected user %v, got %v, %v", user, got, err)
+	}
+
+	user.Display_Name = "renamed"
+	if err := d.UpdateUser(ctx, user.ID, user); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := d.ReadUser(ctx, user.ID); got != user {
+		t.Errorf("expected user %v, got %v", user, got)
+	}
+
+	missing := uuid.NewString()
+	if _, err := d.ReadUser(ctx, missing); err != subs.ErrNotFound {
+		t.Errorf("expected %v, got %v", subs.ErrNotFound, err)
+	}
+	if err := d.UpdateUser(ctx, missing, user); err != subs.ErrNotFound {
+		t.Errorf("expected %v, got %v", subs.ErrNotFound, err)
+	}
+	if err := d.DeleteUser(ctx, missing, true); err != subs.ErrNotFound {
+		t.Errorf("expected %v, got %v", subs.ErrNotFound, err)
+	}
+
+	// writes of subs of unknown users fail
+	s := subs.Sub{Service: "a", Price: 100, User_ID: missing, Start: "01-2024", Currency: "RUB"}
+	if _, err := d.Create(ctx, s); err != subs.ErrUnknownUser {
+		t.Errorf("expected %v, got %v", subs.ErrUnknownUser, err)
+	}
+	s.User_ID = user.ID
+	id := create(t, d, s)
+	s.User_ID = missing
+	if _, err := d.Update(ctx, id, s, 0); err != subs.ErrUnknownUser {
+		t.Errorf("expected %v, got %v", subs.ErrUnknownUser, err)
+	}
+	if _, err := d.Patch(ctx, id, subs.SubPatch{User_ID: &missing}, 0); err != subs.ErrUnknownUser {
+		t.Errorf("expected %v, got %v", subs.ErrUnknownUser, err)
+	}
+
+	results, err := d.Batch(ctx, []subs.BatchOp{
+		{Op: subs.BatchCreate, Sub: s},
+		{Op: subs.BatchUpdate, ID: id, Sub: s},
+		{Op: subs.BatchUpdate, ID: uuid.NewString(), Sub: s},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err != subs.ErrUnknownUser || results[1].Err != subs.ErrUnknownUser || results[2].Err != subs.ErrNotFound {
+		t.Errorf("expected unknown users and a missing sub, got %v", results)
+	}
+
+	// a user with subs or shares is deleted only with them
+	other := newUser(t, d)
+	shared := create(t, d, subs.Sub{Service: "b", Price: 100, User_ID: other, Start: "01-2024"})
+	if err := d.SetMember(ctx, shared, subs.Member{User_ID: user.ID, Percent: 50}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetPrice(ctx, id, subs.SubPrice{Effective_From: "02-2024", Price: 200}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.DeleteUser(ctx, user.ID, false); err != subs.ErrUserInUse {
+		t.Errorf("expected %v, got %v", subs.ErrUserInUse, err)
+	}
+	if err := d.DeleteUser(ctx, user.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.ReadUser(ctx, user.ID); err != subs.ErrNotFound {
+		t.Errorf("expected %v, got %v", subs.ErrNotFound, err)
+	}
+	if _, err := d.Read(ctx, id); err != subs.ErrNotFound {
+		t.Errorf("expected %v, got %v", subs.ErrNotFound, err)
+	}
+	if members, err := d.ListMembers(ctx, shared); err != nil || len(members) != 0 {
+		t.Errorf("expected no members, got %v, %v", members, err)
+	}
+
+	users, err := d.ListUsers(ctx)
+	if err != nil || len(users) != 1 || users[0].ID != other {
+		t.Errorf("expected users [%v], got %v, %v", other, users, err)
+	}
+
+	// without subs or shares a user is deleted either way
+	if err := d.Delete(ctx, shared, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteUser(ctx, other, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testBudgets(t *testing.T, d subs.DB) {
+
+	ctx := context.Background()
+
+	user := newUser(t, d)
+	budgets := []subs.Budget{
+		{User_ID: user, Monthly_Limit: 1000, Currency: "RUB"},
+		{User_ID: user, Monthly_Limit: 200, Currency: "USD", Service: " Netflix "},
+		{User_ID: user, Monthly_Limit: 500, Currency: "RUB", Category: "video"},
+	}
+	for i, budget := range budgets {
+		id, err := d.CreateBudget(ctx, budget)
+		if err != nil {
+			t.Fatal(err)
+		}
+		budgets[i].ID = id
+	}
+	budgets[1].Service = "Netflix"
+
+	// one budget per category or service name key
+	for _, budget := range []subs.Budget{
+		{User_ID: user, Monthly_Limit: 1, Currency: "RUB"},
+		{User_ID: user, Monthly_Limit: 1, Currency: "RUB", Category: "video"},
+		{User_ID: user, Monthly_Limit: 1, Currency: "RUB", Service: "netflix"},
+	} {
+		if _, err := d.CreateBudget(ctx, budget); err != subs.ErrBudgetConflict {
+			t.Errorf("%v: expected %v, got %v", budget, subs.ErrBudgetConflict, err)
+		}
+	}
+	if _, err := d.CreateBudget(ctx, subs.Budget{User_ID: uuid.NewString(), Monthly_Limit: 1, Currency: "RUB"}); err != subs.ErrNotFound {
+		t.Errorf("expected %v, got %v", subs.ErrNotFound, err)
+	}
+
+	got, err := d.ListBudgets(ctx, user)
+	if err != nil || !slices.Equal(got, budgets) {
+		t.Errorf("expected budgets %v, got %v, %v", budgets, got, err)
+	}
+
+	budgets[2].Monthly_Limit = 700
+	budgets[2].Category = "music"
+	if err := d.UpdateBudget(ctx, budgets[2]); err != nil {
+		t.Fatal(err)
+	}
+	conflict := budgets[2]
+	conflict.Category = ""
+	if err := d.UpdateBudget(ctx, conflict); err != subs.ErrBudgetConflict {
+		t.Errorf("expected %v, got %v", subs.ErrBudgetConflict, err)
+	}
+
+	// budgets belong to their user
+	other := newUser(t, d)
+	foreign := budgets[2]
+	foreign.User_ID = other
+	if err := d.UpdateBudget(ctx, foreign); err != subs.ErrNotFound {
+		t.Errorf("expected %v, got %v", subs.ErrNotFound, err)
+	}
+	if err := d.DeleteBudget(ctx, other, budgets[2].ID); err != subs.ErrNotFound {
+		t.Errorf("expected %v, got %v", subs.ErrNotFound, err)
+	}
+	if got, err := d.ListBudgets(ctx, other); err != nil || len(got) != 0 {
+		t.Errorf("expected no budgets, got %v, %v", got, err)
+	}
+
+	// without a user the budgets of every user are listed
+	if _, err := d.CreateBudget(ctx, subs.Budget{User_ID: other, Monthly_Limit: 1, Currency: "RUB"}); err != nil {
+		t.Fatal(err)
+	}
+	all, err := d.ListBudgets(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := map[string]int{}
+	for _, budget := range all {
+		users[budget.User_ID]++
+	}
+	if users[user] != 3 || users[other] != 1 {
+		t.Errorf("expected 3 budgets of %v and 1 of %v, got %v", user, other, all)
+	}
+
+	if err := d.DeleteBudget(ctx, user, budgets[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteBudget(ctx, user, budgets[0].ID); err != subs.ErrNotFound {
+		t.Errorf("expected %v, got %v", subs.ErrNotFound, err)
+	}
+
+	got, err = d.ListBudgets(ctx, user)
+	if expected := budgets[1:]; err != nil || !slices.Equal(got, expected) {
+		t.Errorf("expected budgets %v, got %v, %v", expected, got, err)
+	}
+
+	// deleting a user deletes their budgets
+	if err := d.DeleteUser(ctx, user, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.ListBudgets(ctx, user); err != nil || len(got) != 0 {
+		t.Errorf("expected no budgets, got %v, %v", got, err)
+	}
+}
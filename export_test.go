@@ -0,0 +1,9 @@
+package subs
+
+// test helpers shared with the external subs_test package
+
+var StartPostgres = startPostgres
+
+func NewMockDB() *MockDB {
+	return &MockDB{MemDB: MemDB{db: make(map[string]Sub)}}
+}
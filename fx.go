@@ -0,0 +1,324 @@
+package subs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/text/currency"
+)
+
+// rates are stored as integer millionths of the target currency per unit of
+// the source currency, so conversions are exact in SQL and in Go alike
+const rateScale = 1_000_000
+const rateDecimals = 6
+
+// upper bound of a rate, keeps rate times price far from overflowing
+const maxRate = 1_000_000_000 * rateScale
+
+// Rate is an exchange rate in millionths, it is a decimal string in JSON
+type Rate int64
+
+// FXRate converts From into To for the months from Month on, until the next
+// rate of the pair
+type FXRate struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Month string `json:"month"`
+	Rate  Rate   `json:"rate"`
+}
+
+// RateError reports a conversion with no rate effective for one of its months
+type RateError struct {
+	From  string
+	To    string
+	Month string
+}
+
+func (e *RateError) Error() string {
+	return fmt.Sprintf("no fx rate from %v to %v at %v", e.From, e.To, e.Month)
+}
+
+func validateCurrency(code string) error {
+
+	// ParseISO is case insensitive, stored codes are upper case only
+	if u, err := currency.ParseISO(code); err != nil || u.String() != code {
+		return errors.New("invalid currency")
+	}
+
+	return nil
+}
+
+// parseRate reads a positive decimal with at most rateDecimals fractional digits
+func parseRate(s string) (Rate, error) {
+
+	r, err := parseDecimal(s, rateDecimals)
+	if err != nil || r <= 0 || r > maxRate {
+		return 0, errors.New("invalid rate")
+	}
+
+	return Rate(r), nil
+}
+
+func (r Rate) String() string {
+
+	s := fmt.Sprintf("%d.%06d", r/rateScale, r%rateScale)
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+// UnmarshalJSON takes a decimal string or number, a number is read from its
+// text so it never goes through a float
+func (r *Rate) UnmarshalJSON(b []byte) error {
+
+	s := string(b)
+	if strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+	}
+
+	v, err := parseRate(s)
+	if err != nil {
+		return err
+	}
+
+	*r = v
+	return nil
+}
+
+type ratePair struct {
+	from string
+	to   string
+}
+
+// rateTable holds the rates of the Go backends, ordered by month per pair
+type rateTable map[ratePair][]FXRate
+
+func (t rateTable) set(rate FXRate) {
+
+	pair := ratePair{rate.From, rate.To}
+	rates := t[pair]
+
+	i := sort.Search(len(rates), func(i int) bool { return monthIndex(rates[i].Month) >= monthIndex(rate.Month) })
+	if i < len(rates) && rates[i].Month == rate.Month {
+		rates[i] = rate
+		return
+	}
+
+	t[pair] = slices.Insert(rates, i, rate)
+}
+
+func (t rateTable) delete(from string, to string, month string) bool {
+
+	pair := ratePair{from, to}
+	rates := t[pair]
+
+	i := sort.Search(len(rates), func(i int) bool { return monthIndex(rates[i].Month) >= monthIndex(month) })
+	if i == len(rates) || rates[i].Month != month {
+		return false
+	}
+
+	t[pair] = slices.Delete(rates, i, i+1)
+	if len(t[pair]) == 0 {
+		delete(t, pair)
+	}
+
+	return true
+}
+
+// lookup mirrors the fx_rate SQL function, the latest rate of the pair at or
+// before month and an exact 1 between equal currencies
+func (t rateTable) lookup(from string, to string, month int) (Rate, bool) {
+
+	if from == to {
+		return rateScale, true
+	}
+
+	rates := t[ratePair{from, to}]
+	i := sort.Search(len(rates), func(i int) bool { return monthIndex(rates[i].Month) > month })
+	if i == 0 {
+		return 0, false
+	}
+
+	return rates[i-1].Rate, true
+}
+
+// list returns the rates of a pair filter ordered by from, to and month,
+// empty from or to don't filter
+func (t rateTable) list(from string, to string) []FXRate {
+
+	var list []FXRate
+	for pair, rates := range t {
+		if (from == "" || pair.from == from) && (to == "" || pair.to == to) {
+			list = append(list, rates...)
+		}
+	}
+
+	sort.Slice(list, func(i int, j int) bool {
+		a, b := list[i], list[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return monthIndex(a.Month) < monthIndex(b.Month)
+	})
+
+	return list
+}
+
+// convertedSum rounds a sum of price times rate millionths half up, like
+// round() on the numeric sums in SQL
+func convertedSum(millionths *big.Int) Money {
+
+	v := new(big.Int).Add(millionths, big.NewInt(rateScale/2))
+	return Money(v.Quo(v, big.NewInt(rateScale)).Int64())
+}
+
+func parseRatePath(r *http.Request) (FXRate, error) {
+
+	vars := mux.Vars(r)
+	rate := FXRate{From: vars["from"], To: vars["to"], Month: vars["month"]}
+
+	if err := validateCurrency(rate.From); err != nil {
+		return rate, errors.New("invalid from currency")
+	}
+	if err := validateCurrency(rate.To); err != nil {
+		return rate, errors.New("invalid to currency")
+	}
+	if rate.From == rate.To {
+		return rate, errors.New("same currencies")
+	}
+	if err := validateDate(rate.Month); err != nil {
+		return rate, errors.New("invalid month")
+	}
+
+	return rate, nil
+}
+
+func setRateHandler(w http.ResponseWriter, r *http.Request) {
+
+	rate, err := parseRatePath(r)
+	if err != nil {
+		logger.Printf("set rate: resp 400: %v; req %v", err, r.URL.Path)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		Rate *Rate `json:"rate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Rate == nil {
+		logger.Printf("set rate: resp 400: invalid rate %v; req %v", err, r.URL.Path)
+		http.Error(w, "invalid request: invalid rate", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	rate.Rate = *body.Rate
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	if err := db.SetRate(ctx, rate); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("set rate: resp 504: %v; valid req %v", err, rate)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("set rate: resp 500: %v; valid req %v", err, rate)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rate)
+	logger.Printf("set rate: resp 200; req %v", rate)
+}
+
+func deleteRateHandler(w http.ResponseWriter, r *http.Request) {
+
+	rate, err := parseRatePath(r)
+	if err != nil {
+		logger.Printf("delete rate: resp 400: %v; req %v", err, r.URL.Path)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	if err := db.DeleteRate(ctx, rate.From, rate.To, rate.Month); err != nil {
+		if err == ErrNotFound {
+			logger.Printf("delete rate: resp 404: %v; req %v", err, r.URL.Path)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("delete rate: resp 504: %v; valid req %v", err, r.URL.Path)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("delete rate: resp 500: %v; valid req %v", err, r.URL.Path)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Printf("delete rate: resp 204; req %v", r.URL.Path)
+}
+
+func listRatesHandler(w http.ResponseWriter, r *http.Request) {
+
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+
+	for _, code := range []string{from, to} {
+		if code == "" {
+			continue
+		}
+		if err := validateCurrency(code); err != nil {
+			logger.Printf("list rates: resp 400: %v; req %v", err, r.URL.RawQuery)
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	rates, err := db.ListRates(ctx, from, to)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("list rates: resp 504: %v; valid req %v", err, r.URL.RawQuery)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("list rates: resp 500: %v; valid req %v", err, r.URL.RawQuery)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	if rates == nil {
+		rates = []FXRate{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]FXRate{"rates": rates})
+	logger.Printf("list rates: resp 200 with %v entries; req %v", len(rates), r.URL.RawQuery)
+}
@@ -0,0 +1,174 @@
+package subs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestParseRate(t *testing.T) {
+
+	for _, tc := range []struct {
+		s        string
+		expected Rate
+	}{
+		{"1", 1_000000},
+		{"0.5", 500000},
+		{"90.123456", 90_123456},
+		{"0.000001", 1},
+		{"1000000000", maxRate},
+	} {
+		r, err := parseRate(tc.s)
+		if err != nil || r != tc.expected {
+			t.Errorf("%v: expected %v, got %v, %v", tc.s, tc.expected, r, err)
+		}
+		if r.String() != strings.TrimSuffix(tc.s, ".0") {
+			t.Errorf("%v: unexpected string %v", tc.s, r)
+		}
+	}
+
+	for _, s := range []string{"", "0", "0.0000001", "-1", "-0.5", "+1", "1.+5", "1.-5", ".5", "1e3", "abc", "1000000000.1"} {
+		if _, err := parseRate(s); err == nil {
+			t.Errorf("%q: expected err, got nil", s)
+		}
+	}
+}
+
+func TestRateHandlers(t *testing.T) {
+
+	h := newHandlerTest(t)
+	server, do := h.server, h.do
+
+	list := func(query string) (int, []FXRate) {
+		t.Helper()
+
+		resp, err := http.Get(server.URL + "/fx-rates" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var res struct {
+			Rates []FXRate `json:"rates"`
+		}
+		json.NewDecoder(resp.Body).Decode(&res)
+
+		return resp.StatusCode, res.Rates
+	}
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, tc := range []struct{ path, body string }{
+			{"/fx-rates/usd/EUR/01-2024", `{"rate": "0.9"}`},
+			{"/fx-rates/USD/XYZ/01-2024", `{"rate": "0.9"}`},
+			{"/fx-rates/USD/USD/01-2024", `{"rate": "0.9"}`},
+			{"/fx-rates/USD/EUR/2024-01", `{"rate": "0.9"}`},
+			{"/fx-rates/USD/EUR/01-2024", `{"rate": "-0.9"}`},
+			{"/fx-rates/USD/EUR/01-2024", `{"rate": 0}`},
+			{"/fx-rates/USD/EUR/01-2024", `{}`},
+		} {
+			if status, _ := do("PUT", tc.path, tc.body); status != 400 {
+				t.Errorf("%v %v: expected status: 400, got %v", tc.path, tc.body, status)
+			}
+		}
+
+		if status, _ := list("?from=usd"); status != 400 {
+			t.Errorf("expected status: 400, got %v", status)
+		}
+	})
+
+	t.Run("set", func(t *testing.T) {
+		for _, tc := range []struct{ path, body string }{
+			{"/fx-rates/USD/EUR/03-2024", `{"rate": "0.95"}`},
+			{"/fx-rates/USD/EUR/01-2024", `{"rate": 0.9}`},
+			{"/fx-rates/RUB/EUR/01-2024", `{"rate": "0.01"}`},
+		} {
+			if status, _ := do("PUT", tc.path, tc.body); status != 200 {
+				t.Errorf("%v %v: expected status: 200, got %v", tc.path, tc.body, status)
+			}
+		}
+
+		status, rates := list("?from=USD&to=EUR")
+		if status != 200 {
+			t.Fatalf("expected status: 200, got %v", status)
+		}
+		if fmt.Sprint(rates) != "[{USD EUR 01-2024 0.9} {USD EUR 03-2024 0.95}]" {
+			t.Errorf("unexpected rates: %v", rates)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if status, _ := do("DELETE", "/fx-rates/USD/EUR/03-2024", ""); status != 204 {
+			t.Errorf("expected status: 204, got %v", status)
+		}
+		if status, _ := do("DELETE", "/fx-rates/USD/EUR/03-2024", ""); status != 404 {
+			t.Errorf("expected status: 404, got %v", status)
+		}
+
+		if _, rates := list(""); len(rates) != 2 {
+			t.Errorf("expected 2 rates, got %v", rates)
+		}
+	})
+}
+
+func TestSumCurrency(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m, server := h.m, h.server
+
+	end := "08-2024"
+	for _, s := range []Sub{
+		{ID: uuid.NewString(), Service: "a", Price: 1000, User_ID: uuid.NewString(), Start: "07-2024", Currency: "USD"},
+		{ID: uuid.NewString(), Service: "b", Price: 50000, User_ID: uuid.NewString(), Start: "07-2024", End: &end, Currency: "RUB"},
+	} {
+		m.db[s.ID] = s
+	}
+	m.rates = rateTable{
+		{"USD", "EUR"}: {{From: "USD", To: "EUR", Month: "07-2024", Rate: 900000}},
+		{"RUB", "EUR"}: {{From: "RUB", To: "EUR", Month: "08-2024", Rate: 10000}},
+	}
+
+	get := func(query string) (int, string) {
+		t.Helper()
+
+		resp, err := http.Get(server.URL + "/subs/sum?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.StatusCode, strings.TrimSpace(string(b))
+	}
+
+	for _, query := range []string{"start_date=07-2024&end_date=09-2024&currency=eur", "start_date=07-2024&end_date=01-2200&currency=EUR"} {
+		if status, _ := get(query); status != 400 {
+			t.Errorf("%v: expected status: 400, got %v", query, status)
+		}
+	}
+
+	for _, tc := range []struct {
+		query    string
+		status   int
+		expected string
+	}{
+		{"start_date=07-2024&end_date=09-2024", 200, `{"sum":"1030.00"}`},
+		{"start_date=08-2024&end_date=09-2024&currency=EUR", 200, `{"sum":"23.00"}`},
+		{"start_date=08-2024&end_date=09-2024&currency=EUR&group_by=service_name", 200, `{"sum":"23.00","groups":[{"group":"a","sum":"18.00"},{"group":"b","sum":"5.00"}]}`},
+		{"start_date=07-2024&end_date=09-2024&currency=EUR", 422, "no fx rate from RUB to EUR at 07-2024"},
+		{"start_date=07-2024&end_date=09-2024&currency=EUR&group_by=month", 422, "no fx rate from RUB to EUR at 07-2024"},
+	} {
+		status, body := get(tc.query)
+		if status != tc.status || body != tc.expected {
+			t.Errorf("%v: expected %v %v, got %v %v", tc.query, tc.status, tc.expected, status, body)
+		}
+	}
+}
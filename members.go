@@ -0,0 +1,299 @@
+package subs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Member shares the charges of a sub with its owner, either Percent of each
+// charge or a fixed Amount of it in the currency of the sub
+type Member struct {
+	User_ID string `json:"user_id"`
+	Percent int    `json:"percent,omitempty"`
+	Amount  Money  `json:"amount,omitempty"`
+}
+
+func validateShare(member Member) error {
+
+	if member.Percent != 0 && member.Amount != 0 {
+		return errors.New("both percent and amount")
+	}
+
+	if member.Percent < 0 || member.Percent > 100 {
+		return errors.New("invalid percent")
+	}
+
+	if member.Amount < 0 {
+		return errors.New("invalid amount")
+	}
+
+	if member.Amount > maxPrice {
+		return errors.New("amount too large")
+	}
+
+	if member.Percent == 0 && member.Amount == 0 {
+		return errors.New("missing percent or amount")
+	}
+
+	return nil
+}
+
+// memberTable holds the members of the Go backends, ordered by user id per
+// sub id
+type memberTable map[string][]Member
+
+func (t memberTable) set(id string, member Member) {
+
+	members := t[id]
+
+	i := sort.Search(len(members), func(i int) bool { return members[i].User_ID >= member.User_ID })
+	if i < len(members) && members[i].User_ID == member.User_ID {
+		members[i] = member
+		return
+	}
+
+	t[id] = slices.Insert(members, i, member)
+}
+
+func (t memberTable) delete(id string, user_id string) bool {
+
+	i := slices.IndexFunc(t[id], func(m Member) bool { return m.User_ID == user_id })
+	if i < 0 {
+		return false
+	}
+
+	t[id] = slices.Delete(t[id], i, i+1)
+	if len(t[id]) == 0 {
+		delete(t, id)
+	}
+
+	return true
+}
+
+func (t memberTable) has(id string, user_id string) bool {
+	return slices.ContainsFunc(t[id], func(m Member) bool { return m.User_ID == user_id })
+}
+
+// share is the part of a charge paid by a user
+type share struct {
+	user_id string
+	amount  Money
+}
+
+// splitCharge mirrors the charge_shares SQL function. Fixed amounts are taken
+// from the charge first, then percentages of it rounded half up, each cut to
+// what is left in user id order. The owner pays the rest.
+func splitCharge(amount Money, owner string, members []Member) []share {
+
+	left := amount
+	shares := []share{{user_id: owner}}
+	for _, fixed := range []bool{true, false} {
+		for _, m := range members {
+			if (m.Percent == 0) != fixed {
+				continue
+			}
+
+			part := m.Amount
+			if !fixed {
+				part = prorate(amount, m.Percent, 100)
+			}
+			part = min(part, left)
+			left -= part
+
+			shares = append(shares, share{user_id: m.User_ID, amount: part})
+		}
+	}
+	shares[0].amount = left
+
+	return shares
+}
+
+// chargeShares splits the charges of sub in the [from, to] month indexes
+// between its owner and members, keeping the shares of user_id unless it is
+// empty. Without members the owner pays every charge.
+func chargeShares(sub Sub, from int, to int, members []Member, user_id string) []share {
+
+	var shares []share
+	for _, run := range subChargeRuns(sub, from, to) {
+		if run.count == 0 {
+			continue
+		}
+		for _, s := range splitCharge(run.amount, sub.User_ID, members) {
+			if user_id != "" && s.user_id != user_id {
+				continue
+			}
+			shares = append(shares, share{user_id: s.user_id, amount: Money(run.count) * s.amount})
+		}
+	}
+
+	return shares
+}
+
+func parseMemberPath(r *http.Request) (string, string, error) {
+
+	vars := mux.Vars(r)
+	for _, v := range []string{vars["id"], vars["user_id"]} {
+		if err := uuid.Validate(v); err != nil {
+			return "", "", err
+		}
+	}
+
+	return vars["id"], vars["user_id"], nil
+}
+
+func setMemberHandler(w http.ResponseWriter, r *http.Request) {
+
+	id, user_id, err := parseMemberPath(r)
+	if err != nil {
+		logger.Printf("set member: resp 400: %v; req %v", err, r.URL.Path)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var member Member
+	if err := json.NewDecoder(r.Body).Decode(&member); err != nil {
+		logger.Printf("set member: resp 400: %v; req %v", err, r.URL.Path)
+		http.Error(w, "invalid request: json error", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	member.User_ID = user_id
+	if err := validateShare(member); err != nil {
+		logger.Printf("set member: resp 400: %v; req %v %v", err, id, member)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	breaches, err := checkBudgetWrite(w, ctx, id, func(c *chargedSub) { c.members.set(id, member) })
+	if err == nil {
+		err = db.SetMember(ctx, id, member)
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			logger.Printf("set member: resp 404; valid req %v %v", id, member)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if err == ErrUnknownUser {
+			logger.Printf("set member: resp 400: %v; valid req %v %v", err, id, member)
+			http.Error(w, "invalid request: unknown user", http.StatusBadRequest)
+			return
+		}
+
+		if err == ErrOverBudget {
+			logger.Printf("set member: resp 409: %v; valid req %v %v", breaches, id, member)
+			http.Error(w, "over budget", http.StatusConflict)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("set member: resp 504: %v; valid req %v %v", err, id, member)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("set member: resp 500: %v; valid req %v %v", err, id, member)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(member)
+	logger.Printf("set member: resp 200; req %v %v", id, member)
+}
+
+func deleteMemberHandler(w http.ResponseWriter, r *http.Request) {
+
+	id, user_id, err := parseMemberPath(r)
+	if err != nil {
+		logger.Printf("delete member: resp 400: %v; req %v", err, r.URL.Path)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	breaches, err := checkBudgetWrite(w, ctx, id, func(c *chargedSub) { c.members.delete(id, user_id) })
+	if err == nil {
+		err = db.DeleteMember(ctx, id, user_id)
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			logger.Printf("delete member: resp 404: %v; req %v", err, r.URL.Path)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if err == ErrOverBudget {
+			logger.Printf("delete member: resp 409: %v; valid req %v", breaches, r.URL.Path)
+			http.Error(w, "over budget", http.StatusConflict)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("delete member: resp 504: %v; valid req %v", err, r.URL.Path)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("delete member: resp 500: %v; valid req %v", err, r.URL.Path)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Printf("delete member: resp 204; req %v", r.URL.Path)
+}
+
+func listMembersHandler(w http.ResponseWriter, r *http.Request) {
+
+	id := mux.Vars(r)["id"]
+	if err := uuid.Validate(id); err != nil {
+		logger.Printf("list members: resp 400: %v; req %v", err, id)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	members, err := db.ListMembers(ctx, id)
+	if err != nil {
+		if err == ErrNotFound {
+			logger.Printf("list members: resp 404; valid req %v", id)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("list members: resp 504: %v; valid req %v", err, id)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("list members: resp 500: %v; valid req %v", err, id)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	if members == nil {
+		members = []Member{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]Member{"members": members})
+	logger.Printf("list members: resp 200 with %v entries; req %v", len(members), id)
+}
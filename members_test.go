@@ -0,0 +1,133 @@
+package subs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSplitCharge(t *testing.T) {
+
+	for _, tc := range []struct {
+		amount   Money
+		members  []Member
+		expected string
+	}{
+		{1000, nil, "[{o 1000}]"},
+		{1000, []Member{{User_ID: "a", Percent: 50}, {User_ID: "b", Amount: 300}}, "[{o 200} {b 300} {a 500}]"},
+		// percentages round half up
+		{999, []Member{{User_ID: "a", Percent: 50}}, "[{o 499} {a 500}]"},
+		{1, []Member{{User_ID: "a", Percent: 33}, {User_ID: "b", Percent: 33}}, "[{o 1} {a 0} {b 0}]"},
+		// shares are cut to what is left in user id order
+		{1000, []Member{{User_ID: "a", Amount: 600}, {User_ID: "b", Amount: 600}}, "[{o 0} {a 600} {b 400}]"},
+		{1000, []Member{{User_ID: "a", Percent: 100}, {User_ID: "b", Percent: 100}}, "[{o 0} {a 1000} {b 0}]"},
+		{0, []Member{{User_ID: "a", Amount: 300}}, "[{o 0} {a 0}]"},
+	} {
+		if got := fmt.Sprint(splitCharge(tc.amount, "o", tc.members)); got != tc.expected {
+			t.Errorf("%v of %v: expected %v, got %v", tc.members, tc.amount, tc.expected, got)
+		}
+	}
+}
+
+func TestValidateShare(t *testing.T) {
+
+	for _, m := range []Member{{Percent: 1}, {Percent: 100}, {Amount: 1}, {Amount: maxPrice}} {
+		if err := validateShare(m); err != nil {
+			t.Errorf("%v: expected nil, got %v", m, err)
+		}
+	}
+
+	for _, m := range []Member{{}, {Percent: -1}, {Percent: 101}, {Amount: -1}, {Amount: maxPrice + 1}, {Percent: 50, Amount: 100}} {
+		if err := validateShare(m); err == nil {
+			t.Errorf("%v: expected err, got nil", m)
+		}
+	}
+}
+
+func TestMemberHandlers(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m := h.m
+
+	owner, member := addUser(t, m), addUser(t, m)
+	id, err := m.Create(context.Background(), Sub{Service: "a", Price: 1000, User_ID: owner, Start: "01-2024"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := h.do
+
+	path := "/subs/" + id + "/members/" + member
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, tc := range []struct{ path, body string }{
+			{"/subs/abc/members/" + member, `{"percent": 50}`},
+			{"/subs/" + id + "/members/abc", `{"percent": 50}`},
+			{path, `{}`},
+			{path, `{"percent": 101}`},
+			{path, `{"percent": 50, "amount": "1.00"}`},
+			{path, `{"amount": "-1.00"}`},
+			{path, `{"percent": `},
+			{"/subs/" + id + "/members/" + uuid.NewString(), `{"percent": 50}`},
+		} {
+			if status, _ := do("PUT", tc.path, tc.body); status != 400 {
+				t.Errorf("%v %v: expected status: 400, got %v", tc.path, tc.body, status)
+			}
+		}
+	})
+
+	t.Run("set", func(t *testing.T) {
+		status, body := do("PUT", path, `{"amount": "4.00"}`)
+		if status != 200 {
+			t.Fatalf("expected status: 200, got %v %v", status, body)
+		}
+		var got Member
+		if err := json.Unmarshal([]byte(body), &got); err != nil || got != (Member{User_ID: member, Amount: 400}) {
+			t.Errorf("unexpected member: %v, %v", body, err)
+		}
+
+		if status, body := do("GET", "/subs/sum?start_date=01-2024&end_date=12-2024&user_id="+member, ""); status != 200 || body != `{"sum":"48.00"}` {
+			t.Errorf("expected sum: 48.00, got %v %v", status, body)
+		}
+		if status, body := do("GET", "/subs/sum?start_date=01-2024&end_date=12-2024&user_id="+owner, ""); status != 200 || body != `{"sum":"72.00"}` {
+			t.Errorf("expected sum: 72.00, got %v %v", status, body)
+		}
+
+		status, body = do("GET", "/subs?user_id="+member, "")
+		if status != 200 || !strings.Contains(body, id) {
+			t.Errorf("expected sub %v listed, got %v %v", id, status, body)
+		}
+
+		status, body = do("GET", "/subs/"+id+"/members", "")
+		if status != 200 || body != `{"members":[{"user_id":"`+member+`","amount":"4.00"}]}` {
+			t.Errorf("unexpected members: %v %v", status, body)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if status, _ := do("DELETE", path, ""); status != 204 {
+			t.Errorf("expected status: 204, got %v", status)
+		}
+		if status, _ := do("DELETE", path, ""); status != 404 {
+			t.Errorf("expected status: 404, got %v", status)
+		}
+
+		status, body := do("GET", "/subs/"+id+"/members", "")
+		if status != 200 || body != `{"members":[]}` {
+			t.Errorf("expected no members, got %v %v", status, body)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		if status, _ := do("PUT", "/subs/"+uuid.NewString()+"/members/"+member, `{"percent": 50}`); status != 404 {
+			t.Errorf("expected status: 404, got %v", status)
+		}
+		if status, _ := do("GET", "/subs/"+uuid.NewString()+"/members", ""); status != 404 {
+			t.Errorf("expected status: 404, got %v", status)
+		}
+	})
+}
@@ -0,0 +1,1522 @@
+package subs
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MemDB keeps subscriptions in memory and answers queries with the same
+// semantics as the postgres schema. With a snapshot path every write is
+// persisted to that JSON file, which is loaded back on startup.
+// Idempotency keys are short-lived and kept out of the snapshot.
+type MemDB struct {
+	mu       sync.RWMutex
+	db       map[string]Sub
+	rates    rateTable
+	prices   priceTable
+	pauses   pauseTable
+	members  memberTable
+	services map[string]Service
+	users    map[string]User
+	budgets  map[string]Budget
+	keys     map[string]memKey
+	path     string
+}
+
+// memSnapshot is the snapshot file, older snapshots are a bare array of subs
+type memSnapshot struct {
+	Subs     []Sub                 `json:"subs"`
+	Rates    []FXRate              `json:"fx_rates"`
+	Prices   map[string][]SubPrice `json:"sub_prices,omitempty"`
+	Pauses   map[string][]Pause    `json:"sub_pauses,omitempty"`
+	Members  map[string][]Member   `json:"sub_members,omitempty"`
+	Services []Service             `json:"services,omitempty"`
+	Users    []User                `json:"users,omitempty"`
+	Budgets  []Budget              `json:"budgets,omitempty"`
+}
+
+type memKey struct {
+	rec     IdempotencyRecord
+	expires time.Time
+}
+
+func NewMemDB(path string) (*MemDB, error) {
+
+	m := &MemDB{db: make(map[string]Sub), rates: make(rateTable), prices: make(priceTable), pauses: make(pauseTable), members: make(memberTable), services: make(map[string]Service), users: make(map[string]User), budgets: make(map[string]Budget), keys: make(map[string]memKey), path: path}
+	if path == "" {
+		return m, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snap memSnapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		if err := json.Unmarshal(b, &snap.Subs); err != nil {
+			return nil, err
+		}
+	}
+	for _, sub := range snap.Subs {
+		// snapshots older than tags have none
+		sub.Tags = normalizeTags(sub.Tags)
+		m.db[sub.ID] = sub
+	}
+	for _, rate := range snap.Rates {
+		m.rates.set(rate)
+	}
+	for id, prices := range snap.Prices {
+		for _, price := range prices {
+			m.prices.set(id, price)
+		}
+	}
+	for id, pauses := range snap.Pauses {
+		for _, pause := range pauses {
+			m.pauses.add(id, pause)
+		}
+	}
+	for id, members := range snap.Members {
+		for _, member := range members {
+			m.members.set(id, member)
+		}
+	}
+	for _, svc := range snap.Services {
+		m.services[svc.ID] = svc
+	}
+	for _, user := range snap.Users {
+		m.users[user.ID] = user
+	}
+	// snapshots older than users get one per user id of their subs, like
+	// the postgres migration adding them
+	if snap.Users == nil {
+		for _, sub := range m.db {
+			m.users[sub.User_ID] = normalizeUser(User{ID: sub.User_ID})
+		}
+	}
+	// and older than members being users one per member
+	for _, members := range m.members {
+		for _, member := range members {
+			if _, ok := m.users[member.User_ID]; !ok {
+				m.users[member.User_ID] = normalizeUser(User{ID: member.User_ID})
+			}
+		}
+	}
+	for _, budget := range snap.Budgets {
+		m.budgets[budget.ID] = budget
+	}
+
+	return m, nil
+}
+
+// save writes the snapshot, callers must hold the write lock
+func (m *MemDB) save() error {
+
+	if m.path == "" {
+		return nil
+	}
+
+	snap := memSnapshot{
+		Subs:     slices.SortedFunc(maps.Values(m.db), func(a Sub, b Sub) int { return cmp.Compare(a.ID, b.ID) }),
+		Rates:    m.rates.list("", ""),
+		Prices:   m.prices,
+		Pauses:   m.pauses,
+		Members:  m.members,
+		Services: slices.SortedFunc(maps.Values(m.services), compareServices),
+		Users:    slices.SortedFunc(maps.Values(m.users), compareUsers),
+		Budgets:  slices.SortedFunc(maps.Values(m.budgets), func(a Budget, b Budget) int { return cmp.Compare(a.ID, b.ID) }),
+	}
+
+	b, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// replace the file atomically so a crash never leaves a partial snapshot
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), filepath.Base(m.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), m.path)
+}
+
+// memSub is sub as the map stores it, normalized and without the pauses kept
+// in their own table
+func memSub(sub Sub) Sub {
+
+	sub = normalizeSub(sub)
+	sub.Pauses = nil
+
+	return sub
+}
+
+func (m *MemDB) Create(ctx context.Context, sub Sub) (string, error) {
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sub = memSub(sub)
+	if _, ok := m.users[sub.User_ID]; !ok {
+		return "", ErrUnknownUser
+	}
+
+	sub.ID = uuid.NewString()
+	sub.Version = 1
+	m.db[sub.ID] = sub
+
+	if err := m.save(); err != nil {
+		delete(m.db, sub.ID)
+		return "", err
+	}
+
+	return sub.ID, nil
+}
+
+func (m *MemDB) Read(ctx context.Context, id string) (Sub, error) {
+
+	if err := ctx.Err(); err != nil {
+		return Sub{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sub, ok := m.db[id]
+	if !ok {
+		return Sub{}, ErrNotFound
+	}
+	sub.Pauses = slices.Clone(m.pauses[id])
+
+	return sub, nil
+}
+
+// write replaces a sub by the result of change, callers must hold the write lock
+func (m *MemDB) write(id string, version int, change func(Sub) Sub) (int, error) {
+
+	old, ok := m.db[id]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	if version != 0 && old.Version != version {
+		return 0, ErrVersionMismatch
+	}
+
+	sub := change(old)
+	if _, ok := m.users[sub.User_ID]; !ok {
+		return 0, ErrUnknownUser
+	}
+
+	sub.ID = id
+	sub.Version = old.Version + 1
+	m.db[id] = sub
+
+	if err := m.save(); err != nil {
+		m.db[id] = old
+		return 0, err
+	}
+
+	return sub.Version, nil
+}
+
+func (m *MemDB) Update(ctx context.Context, id string, sub Sub, version int) (int, error) {
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.write(id, version, func(Sub) Sub { return memSub(sub) })
+}
+
+func (m *MemDB) Patch(ctx context.Context, id string, patch SubPatch, version int) (int, error) {
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if patch.Empty() {
+		sub, ok := m.db[id]
+		if !ok {
+			return 0, ErrNotFound
+		}
+		if version != 0 && sub.Version != version {
+			return 0, ErrVersionMismatch
+		}
+		return sub.Version, nil
+	}
+
+	return m.write(id, version, func(old Sub) Sub { return memSub(applyPatch(old, patch)) })
+}
+
+func (m *MemDB) Delete(ctx context.Context, id string, version int) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.db[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if version != 0 && old.Version != version {
+		return ErrVersionMismatch
+	}
+	old_prices, old_pauses, old_members := maps.Clone(m.prices), maps.Clone(m.pauses), maps.Clone(m.members)
+	delete(m.db, id)
+	delete(m.prices, id)
+	delete(m.pauses, id)
+	delete(m.members, id)
+
+	if err := m.save(); err != nil {
+		m.db[id] = old
+		m.prices, m.pauses, m.members = old_prices, old_pauses, old_members
+		return err
+	}
+
+	return nil
+}
+
+func (m *MemDB) List(ctx context.Context, q ListQuery) (SubPage, error) {
+
+	if err := ctx.Err(); err != nil {
+		return SubPage{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return listSubs(m.db, m.members, q)
+}
+
+// Iter lists page by page so the lock isn't held while the caller consumes subs
+func (m *MemDB) Iter(ctx context.Context, q ListQuery) iter.Seq2[Sub, error] {
+	return iterPages(ctx, m.List, q)
+}
+
+func (m *MemDB) Sum(ctx context.Context, filter Sub) (Money, error) {
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sums, err := sumCharges(maps.Values(m.db), filter, "", m.rates, m.prices, m.pauses, m.members)
+	if err != nil {
+		return 0, err
+	}
+
+	return sums[""], nil
+}
+
+func (m *MemDB) SumGroups(ctx context.Context, filter Sub, group_by string) ([]SumGroup, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sums, err := sumCharges(maps.Values(m.db), filter, group_by, m.rates, m.prices, m.pauses, m.members)
+	if err != nil {
+		return nil, err
+	}
+
+	return sortedGroups(sums, group_by), nil
+}
+
+// Batch applies ops to the map and writes the snapshot once, a failed batch
+// restores the map as it was
+func (m *MemDB) Batch(ctx context.Context, ops []BatchOp, atomic bool) ([]BatchResult, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old := maps.Clone(m.db)
+	old_prices, old_pauses, old_members := maps.Clone(m.prices), maps.Clone(m.pauses), maps.Clone(m.members)
+	results := make([]BatchResult, len(ops))
+	failed := false
+	for i, op := range ops {
+
+		cur, ok := m.db[op.ID]
+		if op.Op != BatchCreate && !ok {
+			results[i].Err = ErrNotFound
+		} else if op.Op != BatchCreate && op.Version != 0 && cur.Version != op.Version {
+			results[i].Err = ErrVersionMismatch
+		} else if _, ok := m.users[op.Sub.User_ID]; op.Op != BatchDelete && !ok {
+			results[i].Err = ErrUnknownUser
+		}
+		if results[i].Err != nil {
+			failed = true
+			if atomic {
+				break
+			}
+			continue
+		}
+
+		switch op.Op {
+		case BatchCreate:
+			sub := memSub(op.Sub)
+			sub.ID = uuid.NewString()
+			sub.Version = 1
+			m.db[sub.ID] = sub
+			results[i] = BatchResult{ID: sub.ID, Version: 1}
+		case BatchUpdate:
+			sub := memSub(op.Sub)
+			sub.ID = op.ID
+			sub.Version = cur.Version + 1
+			m.db[sub.ID] = sub
+			results[i] = BatchResult{ID: sub.ID, Version: sub.Version}
+		case BatchDelete:
+			delete(m.db, op.ID)
+			delete(m.prices, op.ID)
+			delete(m.pauses, op.ID)
+			delete(m.members, op.ID)
+			results[i] = BatchResult{ID: op.ID}
+		default:
+			m.db, m.prices, m.pauses, m.members = old, old_prices, old_pauses, old_members
+			return nil, fmt.Errorf("unknown batch op %q", op.Op)
+		}
+	}
+
+	if atomic && failed {
+		m.db, m.prices, m.pauses, m.members = old, old_prices, old_pauses, old_members
+		abortBatch(results)
+		return results, nil
+	}
+
+	if err := m.save(); err != nil {
+		m.db, m.prices, m.pauses, m.members = old, old_prices, old_pauses, old_members
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func (m *MemDB) ReserveKey(ctx context.Context, key string, hash string, ttl time.Duration) (IdempotencyRecord, bool, error) {
+
+	if err := ctx.Err(); err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.keys == nil {
+		m.keys = make(map[string]memKey)
+	}
+
+	now := time.Now()
+	maps.DeleteFunc(m.keys, func(_ string, k memKey) bool { return !k.expires.After(now) })
+
+	if k, ok := m.keys[key]; ok {
+		return k.rec, true, nil
+	}
+
+	m.keys[key] = memKey{rec: IdempotencyRecord{Hash: hash}, expires: now.Add(ttl)}
+
+	return IdempotencyRecord{}, false, nil
+}
+
+func (m *MemDB) CompleteKey(ctx context.Context, key string, status int, body []byte) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k, ok := m.keys[key]
+	if !ok {
+		return ErrNotFound
+	}
+
+	k.rec.Status = status
+	k.rec.Body = slices.Clone(body)
+	m.keys[key] = k
+
+	return nil
+}
+
+func (m *MemDB) ReleaseKey(ctx context.Context, key string) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.keys, key)
+
+	return nil
+}
+
+func (m *MemDB) SetRate(ctx context.Context, rate FXRate) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.rates == nil {
+		m.rates = make(rateTable)
+	}
+
+	old := slices.Clone(m.rates[ratePair{rate.From, rate.To}])
+	m.rates.set(rate)
+
+	if err := m.save(); err != nil {
+		m.rates[ratePair{rate.From, rate.To}] = old
+		return err
+	}
+
+	return nil
+}
+
+func (m *MemDB) DeleteRate(ctx context.Context, from string, to string, month string) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old := slices.Clone(m.rates[ratePair{from, to}])
+	if !m.rates.delete(from, to, month) {
+		return ErrNotFound
+	}
+
+	if err := m.save(); err != nil {
+		m.rates[ratePair{from, to}] = old
+		return err
+	}
+
+	return nil
+}
+
+func (m *MemDB) ListRates(ctx context.Context, from string, to string) ([]FXRate, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.rates.list(from, to), nil
+}
+
+func (m *MemDB) AddPause(ctx context.Context, id string, pause Pause) (string, int, error) {
+
+	if err := ctx.Err(); err != nil {
+		return "", 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.db[id]
+	if !ok {
+		return "", 0, ErrNotFound
+	}
+
+	if m.pauses == nil {
+		m.pauses = make(pauseTable)
+	}
+
+	pause.ID = uuid.NewString()
+	old_pauses := slices.Clone(m.pauses[id])
+	m.pauses.add(id, pause)
+	sub := old
+	sub.Version++
+	m.db[id] = sub
+
+	if err := m.save(); err != nil {
+		m.db[id] = old
+		m.pauses[id] = old_pauses
+		return "", 0, err
+	}
+
+	return pause.ID, sub.Version, nil
+}
+
+func (m *MemDB) DeletePause(ctx context.Context, id string, pause_id string) (int, error) {
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.db[id]
+	if !ok {
+		return 0, ErrNotFound
+	}
+
+	old_pauses := slices.Clone(m.pauses[id])
+	if !m.pauses.delete(id, pause_id) {
+		return 0, ErrNotFound
+	}
+	sub := old
+	sub.Version++
+	m.db[id] = sub
+
+	if err := m.save(); err != nil {
+		m.db[id] = old
+		m.pauses[id] = old_pauses
+		return 0, err
+	}
+
+	return sub.Version, nil
+}
+
+func (m *MemDB) SetPrice(ctx context.Context, id string, price SubPrice) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.db[id]; !ok {
+		return ErrNotFound
+	}
+
+	if m.prices == nil {
+		m.prices = make(priceTable)
+	}
+
+	old := slices.Clone(m.prices[id])
+	m.prices.set(id, price)
+
+	if err := m.save(); err != nil {
+		m.prices[id] = old
+		return err
+	}
+
+	return nil
+}
+
+func (m *MemDB) DeletePrice(ctx context.Context, id string, month string) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.db[id]; !ok {
+		return ErrNotFound
+	}
+
+	old := slices.Clone(m.prices[id])
+	if !m.prices.delete(id, month) {
+		return ErrNotFound
+	}
+
+	if err := m.save(); err != nil {
+		m.prices[id] = old
+		return err
+	}
+
+	return nil
+}
+
+func (m *MemDB) ListPrices(ctx context.Context, id string) ([]SubPrice, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.db[id]; !ok {
+		return nil, ErrNotFound
+	}
+
+	return slices.Clone(m.prices[id]), nil
+}
+
+func (m *MemDB) SetMember(ctx context.Context, id string, member Member) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.db[id]; !ok {
+		return ErrNotFound
+	}
+	if _, ok := m.users[member.User_ID]; !ok {
+		return ErrUnknownUser
+	}
+
+	if m.members == nil {
+		m.members = make(memberTable)
+	}
+
+	old := slices.Clone(m.members[id])
+	m.members.set(id, member)
+
+	if err := m.save(); err != nil {
+		m.members[id] = old
+		return err
+	}
+
+	return nil
+}
+
+func (m *MemDB) DeleteMember(ctx context.Context, id string, user_id string) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.db[id]; !ok {
+		return ErrNotFound
+	}
+
+	old := slices.Clone(m.members[id])
+	if !m.members.delete(id, user_id) {
+		return ErrNotFound
+	}
+
+	if err := m.save(); err != nil {
+		m.members[id] = old
+		return err
+	}
+
+	return nil
+}
+
+func (m *MemDB) ListMembers(ctx context.Context, id string) ([]Member, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.db[id]; !ok {
+		return nil, ErrNotFound
+	}
+
+	return slices.Clone(m.members[id]), nil
+}
+
+// serviceConflict reports whether a key of svc belongs to another service,
+// callers must hold the lock
+func (m *MemDB) serviceConflict(svc Service) bool {
+
+	for _, other := range m.services {
+		if other.ID == svc.ID {
+			continue
+		}
+		for _, key := range serviceKeys(svc) {
+			if slices.Contains(serviceKeys(other), key) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// renameService resolves the subs of keys to svc like serviceCatalog.resolve,
+// bumping their versions, and renames the budgets of keys. It returns the
+// subs and budgets it replaced, callers must hold the write lock.
+func (m *MemDB) renameService(svc Service, keys []string) (map[string]Sub, map[string]Budget) {
+
+	old := make(map[string]Sub)
+	for id, sub := range m.db {
+		if !slices.Contains(keys, serviceKey(sub.Service)) {
+			continue
+		}
+		if sub.Service == svc.Name && (sub.Category != "" || svc.Category == "") {
+			continue
+		}
+
+		old[id] = sub
+		sub.Service = svc.Name
+		if sub.Category == "" {
+			sub.Category = svc.Category
+		}
+		sub.Version++
+		m.db[id] = sub
+	}
+
+	old_budgets := make(map[string]Budget)
+	for id, budget := range m.budgets {
+		if budget.Service == svc.Name || !slices.Contains(keys, serviceKey(budget.Service)) {
+			continue
+		}
+		taken := false
+		for _, other := range m.budgets {
+			if other.ID != id && other.User_ID == budget.User_ID && slices.Contains(keys, serviceKey(other.Service)) {
+				taken = true
+			}
+		}
+		if !taken {
+			old_budgets[id] = budget
+		}
+	}
+	for id, budget := range old_budgets {
+		budget.Service = svc.Name
+		m.budgets[id] = budget
+	}
+
+	return old, old_budgets
+}
+
+func (m *MemDB) CreateService(ctx context.Context, svc Service) (string, error) {
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.services == nil {
+		m.services = make(map[string]Service)
+	}
+
+	svc = normalizeService(svc)
+	svc.ID = uuid.NewString()
+	if m.serviceConflict(svc) {
+		return "", ErrServiceConflict
+	}
+
+	m.services[svc.ID] = svc
+	renamed, budgets := m.renameService(svc, renameKeys(svc, ""))
+
+	if err := m.save(); err != nil {
+		delete(m.services, svc.ID)
+		maps.Copy(m.db, renamed)
+		maps.Copy(m.budgets, budgets)
+		return "", err
+	}
+
+	return svc.ID, nil
+}
+
+func (m *MemDB) ReadService(ctx context.Context, id string) (Service, error) {
+
+	if err := ctx.Err(); err != nil {
+		return Service{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	svc, ok := m.services[id]
+	if !ok {
+		return Service{}, ErrNotFound
+	}
+
+	return svc, nil
+}
+
+func (m *MemDB) UpdateService(ctx context.Context, id string, svc Service) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.services[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	svc = normalizeService(svc)
+	svc.ID = id
+	if m.serviceConflict(svc) {
+		return ErrServiceConflict
+	}
+
+	m.services[id] = svc
+	renamed, budgets := m.renameService(svc, renameKeys(svc, old.Name))
+
+	if err := m.save(); err != nil {
+		m.services[id] = old
+		maps.Copy(m.db, renamed)
+		maps.Copy(m.budgets, budgets)
+		return err
+	}
+
+	return nil
+}
+
+func (m *MemDB) DeleteService(ctx context.Context, id string) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.services[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	delete(m.services, id)
+
+	if err := m.save(); err != nil {
+		m.services[id] = old
+		return err
+	}
+
+	return nil
+}
+
+func (m *MemDB) ListServices(ctx context.Context) ([]Service, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return slices.SortedFunc(maps.Values(m.services), compareServices), nil
+}
+
+func (m *MemDB) CreateUser(ctx context.Context, user User) (string, error) {
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.users == nil {
+		m.users = make(map[string]User)
+	}
+
+	user = normalizeUser(user)
+	if user.ID == "" {
+		user.ID = uuid.NewString()
+	}
+	if _, ok := m.users[user.ID]; ok {
+		return "", ErrUserConflict
+	}
+
+	m.users[user.ID] = user
+
+	if err := m.save(); err != nil {
+		delete(m.users, user.ID)
+		return "", err
+	}
+
+	return user.ID, nil
+}
+
+func (m *MemDB) ReadUser(ctx context.Context, id string) (User, error) {
+
+	if err := ctx.Err(); err != nil {
+		return User{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+
+	return user, nil
+}
+
+func (m *MemDB) UpdateUser(ctx context.Context, id string, user User) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	user = normalizeUser(user)
+	user.ID = id
+	m.users[id] = user
+
+	if err := m.save(); err != nil {
+		m.users[id] = old
+		return err
+	}
+
+	return nil
+}
+
+func (m *MemDB) DeleteUser(ctx context.Context, id string, cascade bool) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	var owned, shared []string
+	for sub_id, sub := range m.db {
+		if sub.User_ID == id {
+			owned = append(owned, sub_id)
+		}
+	}
+	for sub_id := range m.members {
+		if m.members.has(sub_id, id) {
+			shared = append(shared, sub_id)
+		}
+	}
+	if !cascade && len(owned)+len(shared) > 0 {
+		return ErrUserInUse
+	}
+
+	old := maps.Clone(m.db)
+	old_prices, old_pauses, old_members := maps.Clone(m.prices), maps.Clone(m.pauses), maps.Clone(m.members)
+	for _, sub_id := range owned {
+		delete(m.db, sub_id)
+		delete(m.prices, sub_id)
+		delete(m.pauses, sub_id)
+		delete(m.members, sub_id)
+	}
+	for _, sub_id := range shared {
+		// the old table keeps the slice the delete shifts
+		m.members[sub_id] = slices.Clone(m.members[sub_id])
+		m.members.delete(sub_id, id)
+	}
+	delete(m.users, id)
+	old_budgets := maps.Clone(m.budgets)
+	maps.DeleteFunc(m.budgets, func(_ string, budget Budget) bool { return budget.User_ID == id })
+
+	if err := m.save(); err != nil {
+		m.db, m.prices, m.pauses, m.members, m.budgets = old, old_prices, old_pauses, old_members, old_budgets
+		m.users[id] = user
+		return err
+	}
+
+	return nil
+}
+
+func (m *MemDB) ListUsers(ctx context.Context) ([]User, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return slices.SortedFunc(maps.Values(m.users), compareUsers), nil
+}
+
+// budgetConflict tells whether another budget has the scope of budget,
+// callers must hold the lock
+func (m *MemDB) budgetConflict(budget Budget) bool {
+
+	for _, other := range m.budgets {
+		if other.ID != budget.ID && sameBudgetScope(other, budget) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *MemDB) CreateBudget(ctx context.Context, budget Budget) (string, error) {
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.budgets == nil {
+		m.budgets = make(map[string]Budget)
+	}
+
+	if _, ok := m.users[budget.User_ID]; !ok {
+		return "", ErrNotFound
+	}
+
+	budget = normalizeBudget(budget)
+	budget.ID = uuid.NewString()
+	if m.budgetConflict(budget) {
+		return "", ErrBudgetConflict
+	}
+
+	m.budgets[budget.ID] = budget
+
+	if err := m.save(); err != nil {
+		delete(m.budgets, budget.ID)
+		return "", err
+	}
+
+	return budget.ID, nil
+}
+
+func (m *MemDB) UpdateBudget(ctx context.Context, budget Budget) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.budgets[budget.ID]
+	if !ok || old.User_ID != budget.User_ID {
+		return ErrNotFound
+	}
+
+	budget = normalizeBudget(budget)
+	if m.budgetConflict(budget) {
+		return ErrBudgetConflict
+	}
+
+	m.budgets[budget.ID] = budget
+
+	if err := m.save(); err != nil {
+		m.budgets[budget.ID] = old
+		return err
+	}
+
+	return nil
+}
+
+func (m *MemDB) DeleteBudget(ctx context.Context, user_id string, id string) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.budgets[id]
+	if !ok || old.User_ID != user_id {
+		return ErrNotFound
+	}
+
+	delete(m.budgets, id)
+
+	if err := m.save(); err != nil {
+		m.budgets[id] = old
+		return err
+	}
+
+	return nil
+}
+
+func (m *MemDB) ListBudgets(ctx context.Context, user_id string) ([]Budget, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var budgets []Budget
+	for _, budget := range m.budgets {
+		if user_id == "" || budget.User_ID == user_id {
+			budgets = append(budgets, budget)
+		}
+	}
+	slices.SortFunc(budgets, compareBudgets)
+
+	return budgets, nil
+}
+
+func (m *MemDB) Trials(ctx context.Context, user_id string, from string, to string) ([]Trial, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var subs []Sub
+	for _, sub := range m.db {
+		if user_id == "" || sub.User_ID == user_id {
+			subs = append(subs, sub)
+		}
+	}
+
+	return endingTrials(subs, from, to), nil
+}
+
+func (m *MemDB) Close() error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.save()
+}
+
+func compareBySortKey(a Sub, b Sub, key string) int {
+
+	var c int
+	switch key {
+	case "service_name":
+		c = cmp.Compare(a.Service, b.Service)
+	case "price":
+		c = cmp.Compare(a.Price, b.Price)
+	case "start_date":
+		c = cmp.Compare(startDay(a.Start), startDay(b.Start))
+	}
+	if c != 0 {
+		return c
+	}
+
+	return cmp.Compare(a.ID, b.ID)
+}
+
+func matchListQuery(sub Sub, members memberTable, q ListQuery) bool {
+
+	if q.User_ID != "" && sub.User_ID != q.User_ID && !members.has(sub.ID, q.User_ID) {
+		return false
+	}
+	if q.Service != "" && sub.Service != q.Service {
+		return false
+	}
+	if q.From != "" && sub.End != nil && monthIndex(*sub.End) < monthIndex(q.From) {
+		return false
+	}
+	if q.To != "" && monthIndex(sub.Start) > monthIndex(q.To) {
+		return false
+	}
+	if q.MinPrice != nil && sub.Price < *q.MinPrice {
+		return false
+	}
+	if q.MaxPrice != nil && sub.Price > *q.MaxPrice {
+		return false
+	}
+	if q.Category != "" && sub.Category != q.Category {
+		return false
+	}
+	if !matchTags(sub.Tags, q.Tags, q.AllTags) {
+		return false
+	}
+
+	return true
+}
+
+// listSubs applies a ListQuery to an unordered set of subscriptions and
+// their members
+func listSubs(db map[string]Sub, members memberTable, q ListQuery) (SubPage, error) {
+
+	key, desc := sortKey(q.Sort)
+	compare := func(a Sub, b Sub) int {
+		if desc {
+			return compareBySortKey(b, a, key)
+		}
+		return compareBySortKey(a, b, key)
+	}
+
+	var last Sub
+	if q.After != "" {
+		c, err := decodeCursor(q.Sort, q.After)
+		if err != nil {
+			return SubPage{}, err
+		}
+
+		last.ID = c.ID
+		switch key {
+		case "service_name":
+			last.Service = c.Key
+		case "price":
+			p, _ := strconv.ParseInt(c.Key, 10, 64)
+			last.Price = Money(p)
+		case "start_date":
+			last.Start = c.Key
+		}
+	}
+
+	var subs []Sub
+	for _, sub := range db {
+		if !matchListQuery(sub, members, q) {
+			continue
+		}
+		if q.After != "" && compare(sub, last) <= 0 {
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	slices.SortFunc(subs, compare)
+
+	page := SubPage{Subs: subs}
+	if q.Limit > 0 && len(subs) > q.Limit {
+		page.Subs = subs[:q.Limit]
+		page.Next_Cursor = encodeCursor(q.Sort, page.Subs[q.Limit-1])
+	}
+
+	return page, nil
+}
+
+// iterPages turns keyset pages of list into a sequence of q, fetching the
+// next page only once the previous one is consumed
+func iterPages(ctx context.Context, list func(context.Context, ListQuery) (SubPage, error), q ListQuery) iter.Seq2[Sub, error] {
+
+	return func(yield func(Sub, error) bool) {
+
+		left := q.Limit
+		for {
+			page := q
+			page.Limit = maxListLimit
+			if left > 0 {
+				page.Limit = min(left, maxListLimit)
+			}
+
+			p, err := list(ctx, page)
+			if err != nil {
+				yield(Sub{}, err)
+				return
+			}
+
+			for _, sub := range p.Subs {
+				if !yield(sub, nil) {
+					return
+				}
+			}
+
+			if left > 0 {
+				left -= len(p.Subs)
+				if left <= 0 {
+					return
+				}
+			}
+			if p.Next_Cursor == "" {
+				return
+			}
+			q.After = p.Next_Cursor
+		}
+	}
+}
+
+// sumCharges mirrors the sum_in_period and sub_charges SQL queries, it sums
+// the charges of the subs matching filter per group, all in the "" group
+// without group_by. Each span of the scheduled prices of a sub is charged at
+// its price, paused months are not charged. Charges are split between the
+// members of a sub for a filter user or user groups. With a filter currency
+// every charge of a sub is converted at the rate effective in its month, the
+// sum of each group is rounded once.
+func sumCharges(subs iter.Seq[Sub], filter Sub, group_by string, rates rateTable, prices priceTable, pauses pauseTable, members memberTable) (map[string]Money, error) {
+
+	from := monthIndex(filter.Start)
+	to := monthIndex(*filter.End)
+
+	sums := make(map[string]Money)
+	if group_by == "month" {
+		for i := from; i <= to; i++ {
+			sums[monthDate(i)] = 0
+		}
+	}
+
+	converted := make(map[string]*big.Int)
+	var missing *RateError
+	var missingMonth int
+
+	for sub := range subs {
+
+		if filter.User_ID != "" && sub.User_ID != filter.User_ID && !members.has(sub.ID, filter.User_ID) {
+			continue
+		}
+		if filter.Service != "" && serviceKey(sub.Service) != serviceKey(filter.Service) {
+			continue
+		}
+		if filter.Category != "" && sub.Category != filter.Category {
+			continue
+		}
+		if !matchTags(sub.Tags, filter.Tags, filter.All_Tags) {
+			continue
+		}
+
+		// other groups take whole charges, whoever pays them
+		shared := members[sub.ID]
+		if filter.User_ID == "" && group_by != "user_id" {
+			shared = nil
+		}
+
+		for _, span := range chargeSpans(sub, prices[sub.ID], pauses[sub.ID], from, to) {
+
+			charges, _ := subCharges(span.sub, span.from, span.to)
+			if charges == 0 {
+				continue
+			}
+			start, end := activeMonths(span.sub, span.from, span.to)
+
+			if filter.Currency == "" && group_by != "month" {
+				for _, s := range chargeShares(span.sub, span.from, span.to, shared, filter.User_ID) {
+					for _, group := range chargeGroups(sub, s.user_id, start, group_by) {
+						sums[group] += s.amount
+					}
+				}
+				continue
+			}
+
+			for i := start; i <= end; i++ {
+				shares := chargeShares(span.sub, i, i, shared, filter.User_ID)
+				if len(shares) == 0 {
+					continue
+				}
+
+				if filter.Currency == "" {
+					for _, s := range shares {
+						for _, group := range chargeGroups(sub, s.user_id, i, group_by) {
+							sums[group] += s.amount
+						}
+					}
+					continue
+				}
+
+				rate, ok := rates.lookup(sub.Currency, filter.Currency, i)
+				if !ok {
+					// report the earliest month without a rate, then the first currency
+					if missing == nil || i < missingMonth || i == missingMonth && sub.Currency < missing.From {
+						missing = &RateError{From: sub.Currency, To: filter.Currency, Month: monthDate(i)}
+						missingMonth = i
+					}
+					break
+				}
+
+				for _, s := range shares {
+					for _, group := range chargeGroups(sub, s.user_id, i, group_by) {
+						if converted[group] == nil {
+							converted[group] = new(big.Int)
+						}
+						converted[group].Add(converted[group], new(big.Int).Mul(big.NewInt(int64(s.amount)), big.NewInt(int64(rate))))
+					}
+				}
+			}
+		}
+	}
+
+	if missing != nil {
+		return nil, missing
+	}
+
+	for group, millionths := range converted {
+		sums[group] = convertedSum(millionths)
+	}
+
+	return sums, nil
+}
+
+// chargeGroups are the group_by values of the shares of user_id in the
+// charges of sub in the month index
+func chargeGroups(sub Sub, user_id string, month int, group_by string) []string {
+
+	switch group_by {
+	case "service_name":
+		return []string{sub.Service}
+	case "user_id":
+		return []string{user_id}
+	case "month":
+		return []string{monthDate(month)}
+	case "category":
+		return []string{sub.Category}
+	case "tag":
+		return tagGroups(sub.Tags)
+	}
+
+	return []string{""}
+}
+
+// sortedGroups orders the sums of sumCharges like the SQL queries, months
+// chronologically and other groups bytewise
+func sortedGroups(sums map[string]Money, group_by string) []SumGroup {
+
+	groups := make([]SumGroup, 0, len(sums))
+	for group, sum := range sums {
+		groups = append(groups, SumGroup{Group: group, Sum: sum})
+	}
+
+	slices.SortFunc(groups, func(a SumGroup, b SumGroup) int {
+		if group_by == "month" {
+			return cmp.Compare(monthIndex(a.Group), monthIndex(b.Group))
+		}
+		return cmp.Compare(a.Group, b.Group)
+	})
+
+	return groups
+}
@@ -0,0 +1,170 @@
+package subs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMemDBSnapshot(t *testing.T) {
+
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "subs.json")
+
+	m, err := NewMemDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := normalizeUser(User{ID: uuid.NewString(), Display_Name: "user", Email: "user@example.com"})
+	if _, err := m.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	s := Sub{
+		Service: "service",
+		Price:   400,
+		User_ID: user.ID,
+		Start:   "07-2024",
+		End:     func() *string { s := "09-2024"; return &s }(),
+	}
+
+	id, err := m.Create(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rate := FXRate{From: "USD", To: "RUB", Month: "01-2024", Rate: 90_500000}
+	if err := m.SetRate(ctx, rate); err != nil {
+		t.Fatal(err)
+	}
+	price := SubPrice{Effective_From: "08-2024", Price: 500}
+	if err := m.SetPrice(ctx, id, price); err != nil {
+		t.Fatal(err)
+	}
+	id2, err := m.Create(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetPrice(ctx, id2, price); err != nil {
+		t.Fatal(err)
+	}
+	pause_id, _, err := m.AddPause(ctx, id, Pause{Start: "08-2024", End: "08-2024"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.AddPause(ctx, id2, Pause{Start: "08-2024", End: "08-2024"}); err != nil {
+		t.Fatal(err)
+	}
+	member := Member{User_ID: user.ID, Percent: 50}
+	for _, id := range []string{id, id2} {
+		if err := m.SetMember(ctx, id, member); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Delete(ctx, id2, 0); err != nil {
+		t.Fatal(err)
+	}
+	service_id, err := m.CreateService(ctx, Service{Name: "a", Aliases: []string{"b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	budget := Budget{User_ID: user.ID, Monthly_Limit: 1000, Currency: "RUB", Category: "video"}
+	if budget.ID, err = m.CreateBudget(ctx, budget); err != nil {
+		t.Fatal(err)
+	}
+
+	// no Close, every write is already persisted
+	m2, err := NewMemDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := m2.Read(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareSubs(t, s, got)
+	if len(got.Pauses) != 1 || got.Pauses[0].ID != pause_id {
+		t.Errorf("expected pause %v, got %v", pause_id, got.Pauses)
+	}
+
+	if _, err := m2.Read(ctx, id2); err != ErrNotFound {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+
+	rates, err := m2.ListRates(ctx, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rates) != 1 || rates[0] != rate {
+		t.Errorf("expected rates: [%v], got %v", rate, rates)
+	}
+
+	prices, err := m2.ListPrices(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prices) != 1 || prices[0] != price {
+		t.Errorf("expected prices: [%v], got %v", price, prices)
+	}
+	if len(m2.prices) != 1 || len(m2.pauses) != 1 {
+		t.Errorf("expected the prices and pauses of 1 sub, got %v and %v", m2.prices, m2.pauses)
+	}
+
+	members, err := m2.ListMembers(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0] != member || len(m2.members) != 1 {
+		t.Errorf("expected members: [%v] of 1 sub, got %v and %v", member, members, m2.members)
+	}
+
+	services, err := m2.ListServices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].ID != service_id || len(services[0].Aliases) != 1 {
+		t.Errorf("expected service %v, got %v", service_id, services)
+	}
+
+	if got, err := m2.ReadUser(ctx, user.ID); err != nil || got != user {
+		t.Errorf("expected user %v, got %v, %v", user, got, err)
+	}
+
+	if budgets, err := m2.ListBudgets(ctx, user.ID); err != nil || len(budgets) != 1 || budgets[0] != budget {
+		t.Errorf("expected budgets: [%v], got %v, %v", budget, budgets, err)
+	}
+}
+
+func TestMemDBLegacySnapshot(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "subs.json")
+
+	// snapshots were a bare array of subs in whole rubles
+	id, user := uuid.NewString(), uuid.NewString()
+	legacy := `[{"sub_id": "` + id + `", "service_name": "service", "price": 400, "user_id": "` + user + `", "start_date": "07-2024", "end_date": null, "version": 1}]`
+	if err := os.WriteFile(path, []byte(legacy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewMemDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := m.Read(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Currency != defaultCurrency || got.Price != 400*moneyScale {
+		t.Errorf("unexpected legacy sub: %v", got)
+	}
+
+	// snapshots before users get one for every user_id of their subs
+	if u, err := m.ReadUser(context.Background(), user); err != nil || u.Default_Currency != defaultCurrency {
+		t.Errorf("expected user %v, got %v, %v", user, u, err)
+	}
+}
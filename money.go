@@ -0,0 +1,103 @@
+package subs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// amounts are stored in minor units, hundredths of the currency unit
+const moneyScale = 100
+const moneyDecimals = 2
+
+// upper bound of a price, a sum of the longest period over thousands of subs
+// at this price still fits in a BIGINT
+const maxPrice = 1_000_000_000 * moneyScale
+
+// Money is an amount in minor units, it is an exact decimal string in JSON
+type Money int64
+
+// parseDecimal reads an unsigned decimal with at most decimals fractional
+// digits as an integer of 10^decimals units
+func parseDecimal(s string, decimals int) (int64, error) {
+
+	digits := func(s string) bool {
+		return strings.Trim(s, "0123456789") == ""
+	}
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" || len(frac) > decimals || !digits(whole) || !digits(frac) {
+		return 0, errors.New("invalid decimal")
+	}
+
+	scale := int64(math.Pow10(decimals))
+
+	w, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || w > math.MaxInt64/scale {
+		return 0, errors.New("decimal out of range")
+	}
+
+	var f int64
+	if frac != "" {
+		f, _ = strconv.ParseInt(frac+strings.Repeat("0", decimals-len(frac)), 10, 64)
+	}
+
+	if w*scale > math.MaxInt64-f {
+		return 0, errors.New("decimal out of range")
+	}
+
+	return w*scale + f, nil
+}
+
+// parseMoney reads a decimal amount with at most moneyDecimals fractional digits
+func parseMoney(s string) (Money, error) {
+
+	v, err := parseDecimal(s, moneyDecimals)
+	if err != nil {
+		return 0, errors.New("invalid amount")
+	}
+
+	return Money(v), nil
+}
+
+func (m Money) String() string {
+
+	sign := ""
+	v := int64(m)
+	if v < 0 {
+		sign = "-"
+	}
+
+	// the remainder keeps the sign of v
+	return fmt.Sprintf("%s%d.%02d", sign, max(v, -v)/moneyScale, max(v%moneyScale, -(v%moneyScale)))
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+// UnmarshalJSON takes a decimal string or number, a number is read from its
+// text so 9.99 never goes through a float. null is a no-op, like for an int.
+func (m *Money) UnmarshalJSON(b []byte) error {
+
+	s := string(b)
+	if s == "null" {
+		return nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+	}
+
+	v, err := parseMoney(s)
+	if err != nil {
+		return err
+	}
+
+	*m = v
+	return nil
+}
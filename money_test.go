@@ -0,0 +1,44 @@
+package subs
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMoney(t *testing.T) {
+
+	for _, tc := range []struct {
+		in       string
+		expected Money
+		out      string
+	}{
+		{`"9.99"`, 999, `"9.99"`},
+		{`"9.9"`, 990, `"9.90"`},
+		{`"400"`, 40000, `"400.00"`},
+		{`400`, 40000, `"400.00"`},
+		{`0.05`, 5, `"0.05"`},
+		{`"0"`, 0, `"0.00"`},
+		{`"92233720368547758.07"`, 1<<63 - 1, `"92233720368547758.07"`},
+	} {
+		var m Money
+		if err := json.Unmarshal([]byte(tc.in), &m); err != nil || m != tc.expected {
+			t.Errorf("%v: expected %v, got %d, %v", tc.in, tc.expected, m, err)
+		}
+
+		b, err := json.Marshal(m)
+		if err != nil || string(b) != tc.out {
+			t.Errorf("%v: expected %v, got %s, %v", tc.in, tc.out, b, err)
+		}
+	}
+
+	for _, in := range []string{`"9.999"`, `"-1"`, `-1`, `"+1"`, `".5"`, `"1e3"`, `1e3`, `"abc"`, `true`, `"92233720368547758.08"`} {
+		var m Money
+		if err := json.Unmarshal([]byte(in), &m); err == nil {
+			t.Errorf("%v: expected err, got %d", in, m)
+		}
+	}
+
+	if s := Money(-1050).String(); s != "-10.50" {
+		t.Errorf("expected -10.50, got %v", s)
+	}
+}
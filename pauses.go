@@ -0,0 +1,203 @@
+package subs
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Pause stops the charges of a sub in the months from Start to End, both
+// MM-YYYY and included. Pauses may overlap.
+type Pause struct {
+	ID    string `json:"pause_id"`
+	Start string `json:"start_date"`
+	End   string `json:"end_date"`
+}
+
+func validatePause(pause Pause) error {
+
+	if err := validateDate(pause.Start); err != nil {
+		return errors.New("invalid start period")
+	}
+
+	if err := validateDate(pause.End); err != nil {
+		return errors.New("invalid end period")
+	}
+
+	if monthIndex(pause.End) < monthIndex(pause.Start) {
+		return errors.New("end period before start period")
+	}
+
+	return nil
+}
+
+// pauseTable holds the pauses of the Go backends, ordered by start and id per
+// sub id
+type pauseTable map[string][]Pause
+
+func (t pauseTable) add(id string, pause Pause) {
+
+	t[id] = append(t[id], pause)
+	slices.SortFunc(t[id], comparePauses)
+}
+
+func (t pauseTable) delete(id string, pause_id string) bool {
+
+	i := slices.IndexFunc(t[id], func(p Pause) bool { return p.ID == pause_id })
+	if i < 0 {
+		return false
+	}
+
+	t[id] = slices.Delete(t[id], i, i+1)
+	if len(t[id]) == 0 {
+		delete(t, id)
+	}
+
+	return true
+}
+
+// comparePauses orders pauses like the SQL queries, by start month then id
+func comparePauses(a Pause, b Pause) int {
+
+	if c := cmp.Compare(monthIndex(a.Start), monthIndex(b.Start)); c != 0 {
+		return c
+	}
+
+	return cmp.Compare(a.ID, b.ID)
+}
+
+// chargeSpans mirrors the sub_charge_spans SQL function, the priceSpans of
+// sub inside [from, to] without the months of its pauses. A run of charged
+// months resumes after the latest pause end so far, as pauses may overlap.
+func chargeSpans(sub Sub, prices []SubPrice, pauses []Pause, from int, to int) []priceSpan {
+
+	pauses = slices.SortedFunc(slices.Values(pauses), comparePauses)
+
+	var spans []priceSpan
+	resume := from
+	for _, pause := range pauses {
+		spans = append(spans, priceSpans(sub, prices, resume, min(monthIndex(pause.Start)-1, to))...)
+		resume = max(resume, monthIndex(pause.End)+1)
+	}
+
+	return append(spans, priceSpans(sub, prices, resume, to)...)
+}
+
+func addPauseHandler(w http.ResponseWriter, r *http.Request) {
+
+	id := mux.Vars(r)["id"]
+	if err := uuid.Validate(id); err != nil {
+		logger.Printf("add pause: resp 400: %v; req %v", err, id)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var pause Pause
+	if err := json.NewDecoder(r.Body).Decode(&pause); err != nil {
+		logger.Printf("add pause: resp 400: %v; req %v", err, id)
+		http.Error(w, "invalid request: json error", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validatePause(pause); err != nil {
+		logger.Printf("add pause: resp 400: %v; req %v %v", err, id, pause)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	breaches, err := checkBudgetWrite(w, ctx, id, func(c *chargedSub) { c.pauses.add(id, pause) })
+	var pause_id string
+	var version int
+	if err == nil {
+		pause_id, version, err = db.AddPause(ctx, id, pause)
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			logger.Printf("add pause: resp 404; valid req %v %v", id, pause)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if err == ErrOverBudget {
+			logger.Printf("add pause: resp 409: %v; valid req %v %v", breaches, id, pause)
+			http.Error(w, "over budget", http.StatusConflict)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("add pause: resp 504: %v; valid req %v %v", err, id, pause)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("add pause: resp 500: %v; valid req %v %v", err, id, pause)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	pause.ID = pause_id
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(version))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(pause)
+	logger.Printf("add pause: resp 201 with %v; req %v", pause, id)
+}
+
+func deletePauseHandler(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	id, pause_id := vars["id"], vars["pause_id"]
+	for _, v := range []string{id, pause_id} {
+		if err := uuid.Validate(v); err != nil {
+			logger.Printf("delete pause: resp 400: %v; req %v", err, r.URL.Path)
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	breaches, err := checkBudgetWrite(w, ctx, id, func(c *chargedSub) { c.pauses.delete(id, pause_id) })
+	var version int
+	if err == nil {
+		version, err = db.DeletePause(ctx, id, pause_id)
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			logger.Printf("delete pause: resp 404: %v; req %v", err, r.URL.Path)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if err == ErrOverBudget {
+			logger.Printf("delete pause: resp 409: %v; valid req %v", breaches, r.URL.Path)
+			http.Error(w, "over budget", http.StatusConflict)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("delete pause: resp 504: %v; valid req %v", err, r.URL.Path)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("delete pause: resp 500: %v; valid req %v", err, r.URL.Path)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", etag(version))
+	w.WriteHeader(http.StatusNoContent)
+	logger.Printf("delete pause: resp 204; req %v", r.URL.Path)
+}
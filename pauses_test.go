@@ -0,0 +1,117 @@
+package subs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestChargeSpans(t *testing.T) {
+
+	sub := Sub{Price: 100}
+	prices := []SubPrice{{"06-2024", 200}}
+
+	for _, tc := range []struct {
+		pauses   []Pause
+		expected string
+	}{
+		{nil, "[01-2024..05-2024 1.00 06-2024..12-2024 2.00]"},
+		{[]Pause{{"", "03-2024", "04-2024"}}, "[01-2024..02-2024 1.00 05-2024..05-2024 1.00 06-2024..12-2024 2.00]"},
+		// a pause across a price change
+		{[]Pause{{"", "05-2024", "07-2024"}}, "[01-2024..04-2024 1.00 08-2024..12-2024 2.00]"},
+		// overlapping and nested pauses, in any order
+		{[]Pause{{"", "08-2024", "09-2024"}, {"", "02-2024", "10-2024"}, {"", "03-2024", "03-2024"}}, "[01-2024..01-2024 1.00 11-2024..12-2024 2.00]"},
+		// pauses outside the period
+		{[]Pause{{"", "01-2023", "01-2024"}, {"", "12-2024", "06-2025"}}, "[02-2024..05-2024 1.00 06-2024..11-2024 2.00]"},
+		{[]Pause{{"", "01-2020", "01-2030"}}, "[]"},
+	} {
+		var spans []string
+		for _, span := range chargeSpans(sub, prices, tc.pauses, monthIndex("01-2024"), monthIndex("12-2024")) {
+			spans = append(spans, fmt.Sprintf("%v..%v %v", monthDate(span.from), monthDate(span.to), span.sub.Price))
+		}
+		if got := fmt.Sprint(spans); got != tc.expected {
+			t.Errorf("%v: expected %v, got %v", tc.pauses, tc.expected, got)
+		}
+	}
+}
+
+func TestPauseHandlers(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m := h.m
+
+	id, err := m.Create(context.Background(), Sub{Service: "a", Price: 1000, User_ID: addUser(t, m), Start: "01-2024"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := h.send
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, tc := range []struct{ path, body string }{
+			{"/subs/abc/pauses", `{"start_date": "07-2024", "end_date": "08-2024"}`},
+			{"/subs/" + id + "/pauses", `{"start_date": "2024-07-01", "end_date": "08-2024"}`},
+			{"/subs/" + id + "/pauses", `{"start_date": "07-2024"}`},
+			{"/subs/" + id + "/pauses", `{"start_date": "07-2024", "end_date": "06-2024"}`},
+			{"/subs/" + id + "/pauses", `{"start_date": "07-2024",`},
+		} {
+			if resp, _ := do("POST", tc.path, tc.body); resp.StatusCode != 400 {
+				t.Errorf("%v %v: expected status: 400, got %v", tc.path, tc.body, resp.StatusCode)
+			}
+		}
+
+		if resp, _ := do("DELETE", "/subs/"+id+"/pauses/abc", ""); resp.StatusCode != 400 {
+			t.Errorf("expected status: 400, got %v", resp.StatusCode)
+		}
+	})
+
+	var pause Pause
+	t.Run("add", func(t *testing.T) {
+		resp, body := do("POST", "/subs/"+id+"/pauses", `{"start_date": "07-2024", "end_date": "08-2024"}`)
+		if resp.StatusCode != 201 || resp.Header.Get("ETag") != etag(2) {
+			t.Fatalf("expected status: 201 with ETag %v, got %v %v", etag(2), resp.StatusCode, resp.Header.Get("ETag"))
+		}
+		if err := json.Unmarshal([]byte(body), &pause); err != nil || uuid.Validate(pause.ID) != nil || pause.Start != "07-2024" || pause.End != "08-2024" {
+			t.Fatalf("unexpected pause: %v, %v", body, err)
+		}
+
+		resp, body = do("GET", "/subs/"+id, "")
+		var sub Sub
+		if err := json.Unmarshal([]byte(body), &sub); err != nil || resp.StatusCode != 200 {
+			t.Fatalf("expected status: 200, got %v %v", resp.StatusCode, body)
+		}
+		if len(sub.Pauses) != 1 || sub.Pauses[0] != pause {
+			t.Errorf("expected pauses: [%v], got %v", pause, sub.Pauses)
+		}
+
+		resp, body = do("GET", "/subs/sum?start_date=01-2024&end_date=12-2024&service_name=a", "")
+		if resp.StatusCode != 200 || body != `{"sum":"100.00"}` {
+			t.Errorf("expected sum: 100.00, got %v %v", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		resp, _ := do("DELETE", "/subs/"+id+"/pauses/"+pause.ID, "")
+		if resp.StatusCode != 204 || resp.Header.Get("ETag") != etag(3) {
+			t.Errorf("expected status: 204 with ETag %v, got %v %v", etag(3), resp.StatusCode, resp.Header.Get("ETag"))
+		}
+		if resp, _ := do("DELETE", "/subs/"+id+"/pauses/"+pause.ID, ""); resp.StatusCode != 404 {
+			t.Errorf("expected status: 404, got %v", resp.StatusCode)
+		}
+
+		resp, body := do("GET", "/subs/"+id, "")
+		if resp.StatusCode != 200 || strings.Contains(body, "pauses") {
+			t.Errorf("expected no pauses, got %v %v", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		if resp, _ := do("POST", "/subs/"+uuid.NewString()+"/pauses", `{"start_date": "07-2024", "end_date": "08-2024"}`); resp.StatusCode != 404 {
+			t.Errorf("expected status: 404, got %v", resp.StatusCode)
+		}
+	})
+}
@@ -2,119 +2,510 @@ package subs
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// a batch with at least this many creates inserts them with a single COPY
+const pgxCopyMinRows = 32
+
+// dates covering whole months are read back as MM-YYYY, like canonicalDate
+const pgxSubColumns = "sub_id, service_name, price, user_id, " +
+	"CASE WHEN EXTRACT(DAY FROM start_date)=1 THEN to_char(start_date, 'MM-YYYY') ELSE to_char(start_date, 'YYYY-MM-DD') END, " +
+	"CASE WHEN EXTRACT(DAY FROM end_date + 1)=1 THEN to_char(end_date, 'MM-YYYY') ELSE to_char(end_date, 'YYYY-MM-DD') END, currency, billing_period, billing_interval, to_char(anchor_date, 'YYYY-MM-DD'), " +
+	"trial_months, intro_price, intro_months, category, tags, version"
+
+// PoolConfig tunes the PGXDB connection pool, zero values keep pgxpool defaults
+type PoolConfig struct {
+	MinConns          int32
+	MaxConns          int32
+	MaxConnIdleTime   time.Duration
+	MaxConnLifetime   time.Duration
+	HealthCheckPeriod time.Duration
+}
+
+// PGXDB is safe for concurrent use, every query acquires its own pooled connection
 type PGXDB struct {
-	conn *pgx.Conn
+	conn *pgxpool.Pool
 }
 
-func NewPGXDB(conn_str string) (*PGXDB, error) {
+func NewPGXDB(conn_str string, pool PoolConfig) (*PGXDB, error) {
+
+	cfg, err := pgxpool.ParseConfig(conn_str)
+	if err != nil {
+		return nil, err
+	}
+
+	if pool.MinConns > 0 {
+		cfg.MinConns = pool.MinConns
+	}
+	if pool.MaxConns > 0 {
+		cfg.MaxConns = pool.MaxConns
+	}
+	if pool.MaxConnIdleTime > 0 {
+		cfg.MaxConnIdleTime = pool.MaxConnIdleTime
+	}
+	if pool.MaxConnLifetime > 0 {
+		cfg.MaxConnLifetime = pool.MaxConnLifetime
+	}
+	if pool.HealthCheckPeriod > 0 {
+		cfg.HealthCheckPeriod = pool.HealthCheckPeriod
+	}
 
-	conn, err := pgx.Connect(context.Background(), conn_str)
+	conn, err := pgxpool.NewWithConfig(context.Background(), cfg)
 	if err != nil {
 		return nil, err
 	}
 
+	// pool connects lazily, fail early on a bad connection string
+	if err := conn.Ping(context.Background()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
 	return &PGXDB{conn: conn}, nil
 }
 
-func (db *PGXDB) Create(sub Sub) (string, error) {
+func scanPGXSub(row pgx.Row) (Sub, error) {
 
-	id := uuid.NewString()
-	_, err := db.conn.Exec(context.Background(),
-		"INSERT INTO subs (sub_id, service_name, price, user_id, start_date, end_date) VALUES ($1, $2, $3, $4, to_date($5, 'MM-YYYY'), to_date($6, 'MM-YYYY'))",
-		id, sub.Service, sub.Price, sub.User_ID, sub.Start, sub.End)
+	var sub Sub
+	err := row.Scan(&sub.ID, &sub.Service, &sub.Price, &sub.User_ID, &sub.Start, &sub.End, &sub.Currency, &sub.Billing_Period, &sub.Billing_Interval, &sub.Anchor,
+		&sub.Trial_Months, &sub.Intro_Price, &sub.Intro_Months, &sub.Category, &sub.Tags, &sub.Version)
+
+	return sub, err
+}
+
+// pgxQuerier is either the pool or a transaction of PGXDB.Batch
+type pgxQuerier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// pgxVersionError tells apart the reasons a conditional write matched no row
+func pgxVersionError(ctx context.Context, q pgxQuerier, id string) error {
+
+	var version int
+	err := q.QueryRow(ctx, "SELECT version FROM subs WHERE sub_id=$1", id).Scan(&version)
+	if err == pgx.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return ErrVersionMismatch
+}
+
+// pgxUnknownUserError fails an update to an unknown user like an update of a
+// missing or stale sub first, as the foreign key would
+func pgxUnknownUserError(ctx context.Context, q pgxQuerier, id string, version int) error {
+
+	var cur int
+	err := q.QueryRow(ctx, "SELECT version FROM subs WHERE sub_id=$1", id).Scan(&cur)
+	if err == pgx.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if version != 0 && cur != version {
+		return ErrVersionMismatch
+	}
+
+	return ErrUnknownUser
+}
+
+// pgxUserError maps the foreign key violation of subs_user_id_fkey to
+// ErrUnknownUser
+func pgxUserError(err error) error {
+
+	var pgerr *pgconn.PgError
+	if errors.As(err, &pgerr) && pgerr.Code == "23503" {
+		return ErrUnknownUser
+	}
+
+	return err
+}
+
+func pgxInsert(ctx context.Context, q pgxQuerier, id string, sub Sub) error {
+
+	sub = normalizeSub(sub)
+	_, err := q.Exec(ctx,
+		"INSERT INTO subs (sub_id, service_name, price, user_id, start_date, end_date, currency, billing_period, billing_interval, anchor_date, trial_months, intro_price, intro_months, category, tags) VALUES ($1, $2, $3, $4, to_date($5, 'YYYY-MM-DD'), to_date($6, 'YYYY-MM-DD'), $7, $8, $9, to_date($10, 'YYYY-MM-DD'), $11, $12, $13, $14, $15)",
+		id, sub.Service, sub.Price, sub.User_ID, isoDay(sub.Start, false), pgxEndDate(sub.End), sub.Currency, sub.Billing_Period, sub.Billing_Interval, sub.Anchor, sub.Trial_Months, sub.Intro_Price, sub.Intro_Months,
+		sub.Category, sub.Tags)
+
+	return pgxUserError(err)
+}
+
+func pgxUpdate(ctx context.Context, q pgxQuerier, id string, sub Sub, version int) (int, error) {
+
+	sub = normalizeSub(sub)
+	err := q.QueryRow(ctx,
+		"UPDATE subs SET service_name=$1, price=$2, user_id=$3, start_date=to_date($4, 'YYYY-MM-DD'), end_date=to_date($5, 'YYYY-MM-DD'), currency=$6, billing_period=$7, billing_interval=$8, anchor_date=to_date($9, 'YYYY-MM-DD'), trial_months=$10, intro_price=$11, intro_months=$12, category=$13, tags=$14, version=version+1 WHERE sub_id=$15 AND ($16::integer=0 OR version=$16) RETURNING version",
+		sub.Service, sub.Price, sub.User_ID, isoDay(sub.Start, false), pgxEndDate(sub.End), sub.Currency, sub.Billing_Period, sub.Billing_Interval, sub.Anchor, sub.Trial_Months, sub.Intro_Price, sub.Intro_Months,
+		sub.Category, sub.Tags, id, version).Scan(&version)
+
+	if err == pgx.ErrNoRows {
+		return 0, pgxVersionError(ctx, q, id)
+	}
+	if err != nil {
+		return 0, pgxUserError(err)
+	}
+
+	return version, nil
+}
+
+func pgxDelete(ctx context.Context, q pgxQuerier, id string, version int) error {
+
+	tag, err := q.Exec(ctx,
+		"DELETE FROM subs WHERE sub_id=$1 AND ($2::integer=0 OR version=$2)", id, version)
 
 	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return pgxVersionError(ctx, q, id)
+	}
+
+	return nil
+}
+
+func (db *PGXDB) Create(ctx context.Context, sub Sub) (string, error) {
+
+	id := uuid.NewString()
+	if err := pgxInsert(ctx, db.conn, id, sub); err != nil {
 		return "", err
 	}
 
 	return id, nil
 }
 
-func (db *PGXDB) Read(id string) (Sub, error) {
+func (db *PGXDB) Read(ctx context.Context, id string) (Sub, error) {
 
-	var sub Sub
-	err := db.conn.QueryRow(context.Background(),
-		"SELECT sub_id, service_name, price, user_id, to_char(start_date, 'MM-YYYY'), to_char(end_date, 'MM-YYYY') FROM subs WHERE sub_id=$1", id).
-		Scan(&sub.ID, &sub.Service, &sub.Price, &sub.User_ID, &sub.Start, &sub.End)
+	sub, err := scanPGXSub(db.conn.QueryRow(ctx,
+		"SELECT "+pgxSubColumns+" FROM subs WHERE sub_id=$1", id))
 
 	if err == pgx.ErrNoRows {
 		return Sub{}, ErrNotFound
 	}
+	if err != nil {
+		return Sub{}, err
+	}
 
-	return sub, err
+	rows, err := db.conn.Query(ctx,
+		"SELECT pause_id::text, to_char(start_date, 'MM-YYYY'), to_char(end_date, 'MM-YYYY') FROM sub_pauses WHERE sub_id=$1 ORDER BY start_date, pause_id",
+		id)
+	if err != nil {
+		return Sub{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pause Pause
+		if err := rows.Scan(&pause.ID, &pause.Start, &pause.End); err != nil {
+			return Sub{}, err
+		}
+		sub.Pauses = append(sub.Pauses, pause)
+	}
+
+	return sub, rows.Err()
 }
 
-func (db *PGXDB) Update(id string, sub Sub) error {
+func (db *PGXDB) Update(ctx context.Context, id string, sub Sub, version int) (int, error) {
+	return pgxUpdate(ctx, db.conn, id, sub, version)
+}
 
-	tag, err := db.conn.Exec(context.Background(),
-		"UPDATE subs SET service_name=$1, price=$2, user_id=$3, start_date=to_date($4, 'MM-YYYY'), end_date=to_date($5, 'MM-YYYY') WHERE sub_id=$6",
-		sub.Service, sub.Price, sub.User_ID, sub.Start, sub.End, id)
+// Patch writes only the patched columns in a single UPDATE
+func (db *PGXDB) Patch(ctx context.Context, id string, patch SubPatch, version int) (int, error) {
 
-	if tag.RowsAffected() == 0 {
-		return ErrNotFound
+	var sets []string
+	var args []any
+	param := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
 	}
 
-	return err
+	if patch.Service != nil {
+		sets = append(sets, "service_name="+param(*patch.Service))
+	}
+	if patch.Price != nil {
+		sets = append(sets, "price="+param(*patch.Price))
+	}
+	if patch.User_ID != nil {
+		sets = append(sets, "user_id="+param(*patch.User_ID))
+	}
+	if patch.Start != nil {
+		sets = append(sets, "start_date=to_date("+param(isoDay(*patch.Start, false))+", 'YYYY-MM-DD')")
+	}
+	if patch.SetEnd {
+		sets = append(sets, "end_date=to_date("+param(pgxEndDate(patch.End))+", 'YYYY-MM-DD')")
+	}
+	if patch.Currency != nil {
+		sets = append(sets, "currency="+param(*patch.Currency))
+	}
+	if patch.Billing_Period != nil {
+		sets = append(sets, "billing_period="+param(*patch.Billing_Period))
+	}
+	if patch.Billing_Interval != nil {
+		sets = append(sets, "billing_interval="+param(*patch.Billing_Interval))
+	}
+	if patch.Anchor != nil {
+		sets = append(sets, "anchor_date=to_date("+param(*patch.Anchor)+", 'YYYY-MM-DD')")
+	}
+	if patch.Trial_Months != nil {
+		sets = append(sets, "trial_months="+param(*patch.Trial_Months))
+	}
+	if patch.Intro_Price != nil {
+		sets = append(sets, "intro_price="+param(*patch.Intro_Price))
+	}
+	if patch.Intro_Months != nil {
+		sets = append(sets, "intro_months="+param(*patch.Intro_Months))
+	}
+	if patch.Category != nil {
+		sets = append(sets, "category="+param(*patch.Category))
+	}
+	if patch.Tags != nil {
+		sets = append(sets, "tags="+param(*patch.Tags))
+	}
+
+	if len(sets) == 0 {
+		sub, err := db.Read(ctx, id)
+		if err == nil && version != 0 && sub.Version != version {
+			return 0, ErrVersionMismatch
+		}
+		return sub.Version, err
+	}
+
+	where := " WHERE sub_id=" + param(id)
+	if version != 0 {
+		where += " AND version=" + param(version)
+	}
+
+	err := db.conn.QueryRow(ctx,
+		"UPDATE subs SET "+strings.Join(sets, ", ")+", version=version+1"+where+" RETURNING version", args...).Scan(&version)
+
+	if err == pgx.ErrNoRows {
+		return 0, pgxVersionError(ctx, db.conn, id)
+	}
+	if err != nil {
+		return 0, pgxUserError(err)
+	}
+
+	return version, nil
 }
 
-func (db *PGXDB) Delete(id string) error {
+func (db *PGXDB) Delete(ctx context.Context, id string, version int) error {
+	return pgxDelete(ctx, db.conn, id, version)
+}
 
-	tag, err := db.conn.Exec(context.Background(),
-		"DELETE FROM subs WHERE sub_id=$1", id)
+// pgxListQuery builds the SELECT of a ListQuery, limit <= 0 selects every row
+func pgxListQuery(q ListQuery, limit int) (string, []any, error) {
 
-	if tag.RowsAffected() == 0 {
-		return ErrNotFound
+	var conds []string
+	var args []any
+	param := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
 	}
 
-	return err
+	if q.User_ID != "" {
+		user_id := param(q.User_ID)
+		conds = append(conds, "(user_id="+user_id+" OR sub_id IN (SELECT sub_id FROM sub_members WHERE user_id="+user_id+"))")
+	}
+	if q.Service != "" {
+		conds = append(conds, "service_name="+param(q.Service))
+	}
+	if q.Category != "" {
+		conds = append(conds, "category="+param(q.Category))
+	}
+	if len(q.Tags) > 0 && q.AllTags {
+		conds = append(conds, "tags @> "+param(q.Tags)+"::varchar[]")
+	}
+	if len(q.Tags) > 0 && !q.AllTags {
+		conds = append(conds, "tags && "+param(q.Tags)+"::varchar[]")
+	}
+	if q.From != "" {
+		conds = append(conds, "(end_date IS NULL OR end_date>=to_date("+param(q.From)+", 'MM-YYYY'))")
+	}
+	if q.To != "" {
+		conds = append(conds, "start_date<=to_date("+param(isoDay(q.To, true))+", 'YYYY-MM-DD')")
+	}
+	if q.MinPrice != nil {
+		conds = append(conds, "price>="+param(*q.MinPrice))
+	}
+	if q.MaxPrice != nil {
+		conds = append(conds, "price<="+param(*q.MaxPrice))
+	}
+
+	key, desc := sortKey(q.Sort)
+	op, dir := ">", "ASC"
+	if desc {
+		op, dir = "<", "DESC"
+	}
+
+	// names order bytewise like compareBySortKey, not by the database
+	// collation
+	order := key
+	if key == "service_name" {
+		order = `service_name COLLATE "C"`
+	}
+
+	if q.After != "" {
+		c, err := decodeCursor(q.Sort, q.After)
+		if err != nil {
+			return "", nil, err
+		}
+
+		switch key {
+		case "sub_id":
+			conds = append(conds, fmt.Sprintf("sub_id%s%s::uuid", op, param(c.ID)))
+		case "price":
+			v, _ := strconv.ParseInt(c.Key, 10, 64)
+			conds = append(conds, fmt.Sprintf("(price, sub_id)%s(%s::bigint, %s::uuid)", op, param(v), param(c.ID)))
+		case "start_date":
+			conds = append(conds, fmt.Sprintf("(start_date, sub_id)%s(to_date(%s, 'YYYY-MM-DD'), %s::uuid)", op, param(isoDay(c.Key, false)), param(c.ID)))
+		default:
+			conds = append(conds, fmt.Sprintf("(%s, sub_id)%s(%s::text, %s::uuid)", order, op, param(c.Key), param(c.ID)))
+		}
+	}
+
+	sql := "SELECT " + pgxSubColumns + " FROM subs"
+	if len(conds) > 0 {
+		sql += " WHERE " + strings.Join(conds, " AND ")
+	}
+	sql += fmt.Sprintf(" ORDER BY %s %s, sub_id %s", order, dir, dir)
+	if limit > 0 {
+		sql += " LIMIT " + param(limit)
+	}
+
+	return sql, args, nil
 }
 
-func (db *PGXDB) List() ([]Sub, error) {
+func (db *PGXDB) List(ctx context.Context, q ListQuery) (SubPage, error) {
 
-	rows, err := db.conn.Query(context.Background(),
-		"SELECT sub_id, service_name, price, user_id, to_char(start_date, 'MM-YYYY'), to_char(end_date, 'MM-YYYY') FROM subs")
+	// fetch one extra row to know if there is a next page
+	limit := q.Limit
+	if limit > 0 {
+		limit++
+	}
 
+	sql, args, err := pgxListQuery(q, limit)
 	if err != nil {
-		return nil, err
+		return SubPage{}, err
+	}
+
+	rows, err := db.conn.Query(ctx, sql, args...)
+	if err != nil {
+		return SubPage{}, err
 	}
 	defer rows.Close()
 
-	var ss []Sub
+	var page SubPage
 	for rows.Next() {
-		var sub Sub
-		if err := rows.Scan(&sub.ID, &sub.Service, &sub.Price, &sub.User_ID, &sub.Start, &sub.End); err != nil {
-			return nil, err
+		sub, err := scanPGXSub(rows)
+		if err != nil {
+			return SubPage{}, err
 		}
-		ss = append(ss, sub)
+		page.Subs = append(page.Subs, sub)
+	}
+	if err := rows.Err(); err != nil {
+		return SubPage{}, err
 	}
 
-	return ss, nil
+	if q.Limit > 0 && len(page.Subs) > q.Limit {
+		page.Subs = page.Subs[:q.Limit]
+		page.Next_Cursor = encodeCursor(q.Sort, page.Subs[q.Limit-1])
+	}
+
+	return page, nil
+}
+
+// Iter streams the rows of a single query, holding its connection until the
+// caller stops
+func (db *PGXDB) Iter(ctx context.Context, q ListQuery) iter.Seq2[Sub, error] {
+
+	return func(yield func(Sub, error) bool) {
+
+		sql, args, err := pgxListQuery(q, q.Limit)
+		if err != nil {
+			yield(Sub{}, err)
+			return
+		}
+
+		rows, err := db.conn.Query(ctx, sql, args...)
+		if err != nil {
+			yield(Sub{}, err)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			sub, err := scanPGXSub(rows)
+			if err != nil {
+				yield(Sub{}, err)
+				return
+			}
+			if !yield(sub, nil) {
+				return
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			yield(Sub{}, err)
+		}
+	}
 }
 
-func (db *PGXDB) Sum(filter Sub) (int, error) {
+// pgxSumArgs are the period and filter arguments of the sum functions in
+// order, NULL doesn't filter
+func pgxSumArgs(filter Sub) []any {
 
 	var user_id any
 	var service_name any
+	var category any
+	var tags any
 
-	if filter.User_ID == "" {
-		user_id = nil
-	} else {
+	if filter.User_ID != "" {
 		user_id = filter.User_ID
 	}
-	if filter.Service == "" {
-		service_name = nil
-	} else {
+	if filter.Service != "" {
 		service_name = filter.Service
 	}
+	if filter.Category != "" {
+		category = filter.Category
+	}
+	if len(filter.Tags) > 0 {
+		tags = filter.Tags
+	}
+
+	return []any{filter.Start, filter.End, user_id, service_name, category, tags, filter.All_Tags}
+}
+
+func (db *PGXDB) Sum(ctx context.Context, filter Sub) (Money, error) {
+
+	if filter.Currency != "" {
+		groups, err := db.SumGroups(ctx, filter, "")
+		if err != nil {
+			return 0, err
+		}
+		return groups[0].Sum, nil
+	}
 
-	var sum int
-	err := db.conn.QueryRow(context.Background(),
-		"SELECT sum_in_period(to_date($1, 'MM-YYYY'), to_date($2, 'MM-YYYY'), $3, $4)", filter.Start, filter.End, user_id, service_name).Scan(&sum)
+	var sum Money
+	err := db.conn.QueryRow(ctx,
+		"SELECT sum_in_period(to_date($1, 'MM-YYYY'), to_date($2, 'MM-YYYY'), $3, $4, $5, $6, $7)", pgxSumArgs(filter)...).Scan(&sum)
 	if err != nil {
 		return 0, err
 	}
@@ -122,6 +513,914 @@ func (db *PGXDB) Sum(filter Sub) (int, error) {
 	return sum, nil
 }
 
+// pgxChargesSum aggregates the price column of sub_charges rows, with a
+// currency in $8 every row is converted at its month rate and each sum is
+// rounded once
+func pgxChargesSum(filter Sub, prefix string) string {
+
+	if filter.Currency == "" {
+		return "SUM(" + prefix + "price)::bigint"
+	}
+
+	return fmt.Sprintf("round(SUM(%[1]sprice::numeric * fx_rate(%[1]scurrency, $8, %[1]smonth)) / %d)::bigint", prefix, rateScale)
+}
+
+// SumGroups aggregates the monthly rows of sub_charges, service names,
+// categories and tags are ordered bytewise like the other backends do. Group
+// "" is the single total of a converted Sum.
+func (db *PGXDB) SumGroups(ctx context.Context, filter Sub, group_by string) ([]SumGroup, error) {
+
+	const charges = "sub_charges(to_date($1, 'MM-YYYY'), to_date($2, 'MM-YYYY'), $3, $4, $5, $6, $7)"
+
+	var sql string
+	switch group_by {
+	case "":
+		sql = "SELECT '', COALESCE(" + pgxChargesSum(filter, "") + ", 0) FROM " + charges
+	case "service_name":
+		sql = "SELECT service_name, " + pgxChargesSum(filter, "") + " FROM " + charges + " GROUP BY service_name ORDER BY service_name COLLATE \"C\""
+	case "category":
+		sql = "SELECT category, " + pgxChargesSum(filter, "") + " FROM " + charges + " GROUP BY category ORDER BY category COLLATE \"C\""
+	case "tag":
+		// a charge counts in the group of each tag, or in group "" without any
+		sql = "SELECT t, " + pgxChargesSum(filter, "") + " FROM " + charges +
+			" CROSS JOIN LATERAL unnest(CASE WHEN cardinality(tags)=0 THEN ARRAY['']::varchar[] ELSE tags END) AS t GROUP BY t ORDER BY t COLLATE \"C\""
+	case "user_id":
+		sql = "SELECT user_id::text, " + pgxChargesSum(filter, "") + " FROM " + charges + " GROUP BY user_id ORDER BY user_id"
+	case "month":
+		sql = "SELECT to_char(m, 'MM-YYYY'), COALESCE(" + pgxChargesSum(filter, "c.") + ", 0) FROM generate_series(to_date($1, 'MM-YYYY')::timestamp, to_date($2, 'MM-YYYY')::timestamp, INTERVAL '1 month') AS m" +
+			" LEFT JOIN " + charges + " AS c ON c.month=m::date GROUP BY m ORDER BY m"
+	default:
+		return nil, fmt.Errorf("unknown sum group %q", group_by)
+	}
+
+	args := pgxSumArgs(filter)
+
+	var q pgxQuerier = db.conn
+	if filter.Currency != "" {
+		args = append(args, filter.Currency)
+
+		// the rates checked for gaps must be the rates summed
+		tx, err := db.conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback(ctx)
+		q = tx
+
+		var rerr RateError
+		err = tx.QueryRow(ctx,
+			"SELECT currency, to_char(month, 'MM-YYYY') FROM "+charges+" WHERE fx_rate(currency, $8, month) IS NULL ORDER BY month, currency LIMIT 1",
+			args...).Scan(&rerr.From, &rerr.Month)
+		if err == nil {
+			rerr.To = filter.Currency
+			return nil, &rerr
+		}
+		if err != pgx.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	rows, err := q.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []SumGroup
+	for rows.Next() {
+		var g SumGroup
+		if err := rows.Scan(&g.Group, &g.Sum); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+
+	return groups, rows.Err()
+}
+
+func (db *PGXDB) SetRate(ctx context.Context, rate FXRate) error {
+
+	_, err := db.conn.Exec(ctx,
+		"INSERT INTO fx_rates (from_currency, to_currency, month, rate) VALUES ($1, $2, to_date($3, 'MM-YYYY'), $4) ON CONFLICT (from_currency, to_currency, month) DO UPDATE SET rate=EXCLUDED.rate",
+		rate.From, rate.To, rate.Month, int64(rate.Rate))
+
+	return err
+}
+
+func (db *PGXDB) DeleteRate(ctx context.Context, from string, to string, month string) error {
+
+	tag, err := db.conn.Exec(ctx,
+		"DELETE FROM fx_rates WHERE from_currency=$1 AND to_currency=$2 AND month=to_date($3, 'MM-YYYY')", from, to, month)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (db *PGXDB) ListRates(ctx context.Context, from string, to string) ([]FXRate, error) {
+
+	rows, err := db.conn.Query(ctx,
+		"SELECT from_currency, to_currency, to_char(month, 'MM-YYYY'), rate FROM fx_rates WHERE ($1='' OR from_currency=$1) AND ($2='' OR to_currency=$2) ORDER BY from_currency, to_currency, month",
+		from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rates []FXRate
+	for rows.Next() {
+		var rate FXRate
+		var r int64
+		if err := rows.Scan(&rate.From, &rate.To, &rate.Month, &r); err != nil {
+			return nil, err
+		}
+		rate.Rate = Rate(r)
+		rates = append(rates, rate)
+	}
+
+	return rates, rows.Err()
+}
+
+// AddPause bumps the version and inserts the pause in a single statement
+func (db *PGXDB) AddPause(ctx context.Context, id string, pause Pause) (string, int, error) {
+
+	pause.ID = uuid.NewString()
+
+	var version int
+	err := db.conn.QueryRow(ctx,
+		"WITH s AS (UPDATE subs SET version=version+1 WHERE sub_id=$1 RETURNING sub_id, version),"+
+			" p AS (INSERT INTO sub_pauses (pause_id, sub_id, start_date, end_date) SELECT $2, sub_id, to_date($3, 'YYYY-MM-DD'), to_date($4, 'YYYY-MM-DD') FROM s)"+
+			" SELECT version FROM s",
+		id, pause.ID, isoDay(pause.Start, false), isoDay(pause.End, true)).Scan(&version)
+	if err == pgx.ErrNoRows {
+		return "", 0, ErrNotFound
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	return pause.ID, version, nil
+}
+
+func (db *PGXDB) DeletePause(ctx context.Context, id string, pause_id string) (int, error) {
+
+	var version int
+	err := db.conn.QueryRow(ctx,
+		"WITH p AS (DELETE FROM sub_pauses WHERE sub_id=$1 AND pause_id=$2 RETURNING sub_id)"+
+			" UPDATE subs SET version=version+1 WHERE sub_id IN (SELECT sub_id FROM p) RETURNING version",
+		id, pause_id).Scan(&version)
+	if err == pgx.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func (db *PGXDB) SetPrice(ctx context.Context, id string, price SubPrice) error {
+
+	tag, err := db.conn.Exec(ctx,
+		"INSERT INTO sub_prices (sub_id, effective_from, price) SELECT $1, to_date($2, 'MM-YYYY'), $3 WHERE EXISTS (SELECT 1 FROM subs WHERE sub_id=$1) ON CONFLICT (sub_id, effective_from) DO UPDATE SET price=EXCLUDED.price",
+		id, price.Effective_From, int64(price.Price))
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (db *PGXDB) DeletePrice(ctx context.Context, id string, month string) error {
+
+	tag, err := db.conn.Exec(ctx,
+		"DELETE FROM sub_prices WHERE sub_id=$1 AND effective_from=to_date($2, 'MM-YYYY')", id, month)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (db *PGXDB) SetMember(ctx context.Context, id string, member Member) error {
+
+	tag, err := db.conn.Exec(ctx,
+		"INSERT INTO sub_members (sub_id, user_id, percent, amount) SELECT $1, $2, $3, $4 WHERE EXISTS (SELECT 1 FROM subs WHERE sub_id=$1) ON CONFLICT (sub_id, user_id) DO UPDATE SET percent=EXCLUDED.percent, amount=EXCLUDED.amount",
+		id, member.User_ID, member.Percent, int64(member.Amount))
+	if err != nil {
+		return pgxUserError(err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (db *PGXDB) DeleteMember(ctx context.Context, id string, user_id string) error {
+
+	tag, err := db.conn.Exec(ctx,
+		"DELETE FROM sub_members WHERE sub_id=$1 AND user_id=$2", id, user_id)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// ListMembers reads the members along with the sub like ListPrices
+func (db *PGXDB) ListMembers(ctx context.Context, id string) ([]Member, error) {
+
+	rows, err := db.conn.Query(ctx,
+		"SELECT m.user_id::text, m.percent, m.amount FROM subs s LEFT JOIN sub_members m ON m.sub_id=s.sub_id WHERE s.sub_id=$1 ORDER BY m.user_id",
+		id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := false
+	var members []Member
+	for rows.Next() {
+		found = true
+
+		var user_id *string
+		var percent *int
+		var amount *int64
+		if err := rows.Scan(&user_id, &percent, &amount); err != nil {
+			return nil, err
+		}
+		if user_id != nil {
+			members = append(members, Member{User_ID: *user_id, Percent: *percent, Amount: Money(*amount)})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, ErrNotFound
+	}
+
+	return members, nil
+}
+
+const pgxServiceColumns = "service_id::text, name, aliases, default_price, currency, category"
+
+func scanPGXService(row pgx.Row) (Service, error) {
+
+	var svc Service
+	err := row.Scan(&svc.ID, &svc.Name, &svc.Aliases, &svc.Default_Price, &svc.Currency, &svc.Category)
+	return svc, err
+}
+
+// pgxSetServiceNames replaces the keys of svc in service_names, a key held by
+// another service fails the unique constraint with ErrServiceConflict
+func pgxSetServiceNames(ctx context.Context, tx pgx.Tx, svc Service) error {
+
+	if _, err := tx.Exec(ctx, "DELETE FROM service_names WHERE service_id=$1", svc.ID); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(ctx,
+		"INSERT INTO service_names (name_key, service_id) SELECT DISTINCT unnest($1::text[]), $2", serviceKeys(svc), svc.ID)
+
+	var pgerr *pgconn.PgError
+	if errors.As(err, &pgerr) && pgerr.Code == "23505" {
+		return ErrServiceConflict
+	}
+
+	return err
+}
+
+// pgxRenameService resolves the subs of keys to svc like
+// serviceCatalog.resolve, bumping their versions, and renames the budgets of
+// keys
+func pgxRenameService(ctx context.Context, tx pgx.Tx, svc Service, keys []string) error {
+
+	_, err := tx.Exec(ctx,
+		"UPDATE subs SET service_name=$1, category=CASE WHEN category='' THEN $2 ELSE category END, version=version+1"+
+			" WHERE lower(btrim(service_name))=ANY($3::text[]) AND (service_name<>$1 OR (category='' AND $2<>''))",
+		svc.Name, svc.Category, keys)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx,
+		"UPDATE budgets b SET service_name=$1 WHERE lower(btrim(service_name))=ANY($2::text[]) AND service_name<>$1"+
+			" AND NOT EXISTS (SELECT 1 FROM budgets o WHERE o.user_id=b.user_id AND o.budget_id<>b.budget_id AND lower(btrim(o.service_name))=ANY($2::text[]))",
+		svc.Name, keys)
+
+	return err
+}
+
+func (db *PGXDB) CreateService(ctx context.Context, svc Service) (string, error) {
+
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	svc = normalizeService(svc)
+	svc.ID = uuid.NewString()
+
+	_, err = tx.Exec(ctx,
+		"INSERT INTO services (service_id, name, aliases, default_price, currency, category) VALUES ($1, $2, $3, $4, $5, $6)",
+		svc.ID, svc.Name, svc.Aliases, int64(svc.Default_Price), svc.Currency, svc.Category)
+	if err != nil {
+		return "", err
+	}
+
+	if err := pgxSetServiceNames(ctx, tx, svc); err != nil {
+		return "", err
+	}
+
+	if err := pgxRenameService(ctx, tx, svc, renameKeys(svc, "")); err != nil {
+		return "", err
+	}
+
+	return svc.ID, tx.Commit(ctx)
+}
+
+func (db *PGXDB) ReadService(ctx context.Context, id string) (Service, error) {
+
+	svc, err := scanPGXService(db.conn.QueryRow(ctx,
+		"SELECT "+pgxServiceColumns+" FROM services WHERE service_id=$1", id))
+	if err == pgx.ErrNoRows {
+		return Service{}, ErrNotFound
+	}
+
+	return svc, err
+}
+
+func (db *PGXDB) UpdateService(ctx context.Context, id string, svc Service) error {
+
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	svc = normalizeService(svc)
+	svc.ID = id
+
+	var old_name string
+	err = tx.QueryRow(ctx, "SELECT name FROM services WHERE service_id=$1 FOR UPDATE", id).Scan(&old_name)
+	if err == pgx.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx,
+		"UPDATE services SET name=$1, aliases=$2, default_price=$3, currency=$4, category=$5 WHERE service_id=$6",
+		svc.Name, svc.Aliases, int64(svc.Default_Price), svc.Currency, svc.Category, id)
+	if err != nil {
+		return err
+	}
+
+	if err := pgxSetServiceNames(ctx, tx, svc); err != nil {
+		return err
+	}
+
+	if err := pgxRenameService(ctx, tx, svc, renameKeys(svc, old_name)); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (db *PGXDB) DeleteService(ctx context.Context, id string) error {
+
+	tag, err := db.conn.Exec(ctx, "DELETE FROM services WHERE service_id=$1", id)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (db *PGXDB) ListServices(ctx context.Context) ([]Service, error) {
+
+	rows, err := db.conn.Query(ctx,
+		"SELECT "+pgxServiceColumns+" FROM services ORDER BY name COLLATE \"C\", service_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var services []Service
+	for rows.Next() {
+		svc, err := scanPGXService(rows)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, svc)
+	}
+
+	return services, rows.Err()
+}
+
+const pgxUserColumns = "user_id::text, display_name, email, default_currency, timezone"
+
+func scanPGXUser(row pgx.Row) (User, error) {
+
+	var user User
+	err := row.Scan(&user.ID, &user.Display_Name, &user.Email, &user.Default_Currency, &user.Timezone)
+
+	return user, err
+}
+
+func (db *PGXDB) CreateUser(ctx context.Context, user User) (string, error) {
+
+	user = normalizeUser(user)
+	if user.ID == "" {
+		user.ID = uuid.NewString()
+	}
+
+	tag, err := db.conn.Exec(ctx,
+		"INSERT INTO users (user_id, display_name, email, default_currency, timezone) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (user_id) DO NOTHING",
+		user.ID, user.Display_Name, user.Email, user.Default_Currency, user.Timezone)
+	if err != nil {
+		return "", err
+	}
+	if tag.RowsAffected() == 0 {
+		return "", ErrUserConflict
+	}
+
+	return user.ID, nil
+}
+
+func (db *PGXDB) ReadUser(ctx context.Context, id string) (User, error) {
+
+	user, err := scanPGXUser(db.conn.QueryRow(ctx,
+		"SELECT "+pgxUserColumns+" FROM users WHERE user_id=$1", id))
+	if err == pgx.ErrNoRows {
+		return User{}, ErrNotFound
+	}
+
+	return user, err
+}
+
+func (db *PGXDB) UpdateUser(ctx context.Context, id string, user User) error {
+
+	user = normalizeUser(user)
+	tag, err := db.conn.Exec(ctx,
+		"UPDATE users SET display_name=$1, email=$2, default_currency=$3, timezone=$4 WHERE user_id=$5",
+		user.Display_Name, user.Email, user.Default_Currency, user.Timezone, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// DeleteUser locks the user before looking for their subs and shares, so no
+// sub of theirs is written in between. The foreign key restricts the delete
+// of a user with subs, a cascading delete removes them first.
+func (db *PGXDB) DeleteUser(ctx context.Context, id string, cascade bool) error {
+
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var used bool
+	err = tx.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM subs WHERE user_id=$1) OR EXISTS (SELECT 1 FROM sub_members WHERE user_id=$1) FROM users WHERE user_id=$1 FOR UPDATE",
+		id).Scan(&used)
+	if err == pgx.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if used && !cascade {
+		return ErrUserInUse
+	}
+
+	if used {
+		if _, err := tx.Exec(ctx, "DELETE FROM sub_members WHERE user_id=$1", id); err != nil {
+			return err
+		}
+		// prices, pauses and members of the subs cascade
+		if _, err := tx.Exec(ctx, "DELETE FROM subs WHERE user_id=$1", id); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM users WHERE user_id=$1", id); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (db *PGXDB) ListUsers(ctx context.Context) ([]User, error) {
+
+	rows, err := db.conn.Query(ctx,
+		"SELECT "+pgxUserColumns+" FROM users ORDER BY user_id::text")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		user, err := scanPGXUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+const pgxBudgetColumns = "budget_id::text, user_id::text, monthly_limit, currency, category, service_name"
+
+func scanPGXBudget(row pgx.Row) (Budget, error) {
+
+	var budget Budget
+	err := row.Scan(&budget.ID, &budget.User_ID, &budget.Monthly_Limit, &budget.Currency, &budget.Category, &budget.Service)
+
+	return budget, err
+}
+
+// pgxBudgetError maps the foreign key of budgets to ErrNotFound and the
+// budgets_scope index to ErrBudgetConflict
+func pgxBudgetError(err error) error {
+
+	var pgerr *pgconn.PgError
+	if errors.As(err, &pgerr) && pgerr.Code == "23503" {
+		return ErrNotFound
+	}
+	if errors.As(err, &pgerr) && pgerr.Code == "23505" {
+		return ErrBudgetConflict
+	}
+
+	return err
+}
+
+func (db *PGXDB) CreateBudget(ctx context.Context, budget Budget) (string, error) {
+
+	budget = normalizeBudget(budget)
+	budget.ID = uuid.NewString()
+
+	_, err := db.conn.Exec(ctx,
+		"INSERT INTO budgets (budget_id, user_id, monthly_limit, currency, category, service_name) VALUES ($1, $2, $3, $4, $5, $6)",
+		budget.ID, budget.User_ID, int64(budget.Monthly_Limit), budget.Currency, budget.Category, budget.Service)
+	if err != nil {
+		return "", pgxBudgetError(err)
+	}
+
+	return budget.ID, nil
+}
+
+func (db *PGXDB) UpdateBudget(ctx context.Context, budget Budget) error {
+
+	budget = normalizeBudget(budget)
+	tag, err := db.conn.Exec(ctx,
+		"UPDATE budgets SET monthly_limit=$1, currency=$2, category=$3, service_name=$4 WHERE budget_id=$5 AND user_id=$6",
+		int64(budget.Monthly_Limit), budget.Currency, budget.Category, budget.Service, budget.ID, budget.User_ID)
+	if err != nil {
+		return pgxBudgetError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (db *PGXDB) DeleteBudget(ctx context.Context, user_id string, id string) error {
+
+	tag, err := db.conn.Exec(ctx, "DELETE FROM budgets WHERE budget_id=$1 AND user_id=$2", id, user_id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// ListBudgets orders by the bytes of category and service name, like
+// compareBudgets
+func (db *PGXDB) ListBudgets(ctx context.Context, user_id string) ([]Budget, error) {
+
+	rows, err := db.conn.Query(ctx,
+		"SELECT "+pgxBudgetColumns+" FROM budgets WHERE ($1='' OR user_id::text=$1) ORDER BY category COLLATE \"C\", service_name COLLATE \"C\", budget_id::text", user_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var budgets []Budget
+	for rows.Next() {
+		budget, err := scanPGXBudget(rows)
+		if err != nil {
+			return nil, err
+		}
+		budgets = append(budgets, budget)
+	}
+
+	return budgets, rows.Err()
+}
+
+// Trials takes the last trial day as the day before the start date plus the
+// trial months, like sub_phases
+func (db *PGXDB) Trials(ctx context.Context, user_id string, from string, to string) ([]Trial, error) {
+
+	rows, err := db.conn.Query(ctx,
+		"SELECT "+pgxSubColumns+" FROM subs CROSS JOIN LATERAL (SELECT (start_date + make_interval(months => trial_months))::date - 1 AS trial_end) t "+
+			"WHERE trial_months>0 AND ($1='' OR user_id::text=$1) AND t.trial_end BETWEEN to_date($2, 'YYYY-MM-DD') AND to_date($3, 'YYYY-MM-DD') "+
+			"AND (end_date IS NULL OR end_date>t.trial_end) ORDER BY t.trial_end, sub_id",
+		user_id, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var trials []Trial
+	for rows.Next() {
+		sub, err := scanPGXSub(rows)
+		if err != nil {
+			return nil, err
+		}
+		day, _ := trialEnd(sub)
+		trials = append(trials, Trial{Sub: sub, Trial_End: dayDate(day)})
+	}
+
+	return trials, rows.Err()
+}
+
+// ListPrices reads the prices along with the sub, so a sub without prices
+// is told apart from a missing one
+func (db *PGXDB) ListPrices(ctx context.Context, id string) ([]SubPrice, error) {
+
+	rows, err := db.conn.Query(ctx,
+		"SELECT to_char(p.effective_from, 'MM-YYYY'), p.price FROM subs s LEFT JOIN sub_prices p ON p.sub_id=s.sub_id WHERE s.sub_id=$1 ORDER BY p.effective_from",
+		id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := false
+	var prices []SubPrice
+	for rows.Next() {
+		found = true
+
+		var month *string
+		var price *int64
+		if err := rows.Scan(&month, &price); err != nil {
+			return nil, err
+		}
+		if month != nil {
+			prices = append(prices, SubPrice{Effective_From: *month, Price: Money(*price)})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, ErrNotFound
+	}
+
+	return prices, nil
+}
+
+// pgxEndDate stores the end date of a sub as its last day
+func pgxEndDate(date *string) *string {
+
+	if date == nil {
+		return nil
+	}
+
+	d := isoDay(*date, true)
+	return &d
+}
+
+// pgxDate parses a sub start or end date into its first or last day for
+// COPY, which can't use to_date
+func pgxDate(date *string, end bool) any {
+
+	if date == nil {
+		return nil
+	}
+
+	t, _ := time.Parse(time.DateOnly, isoDay(*date, end))
+	return t
+}
+
+// pgxBatchUsers locks the users the creates and updates of a batch write
+// against deletes and returns those that exist, checked up front as a foreign
+// key violation would abort the transaction of the batch
+func pgxBatchUsers(ctx context.Context, tx pgx.Tx, ops []BatchOp) (map[string]bool, error) {
+
+	var ids []string
+	for _, op := range ops {
+		if op.Op != BatchDelete {
+			ids = append(ids, op.Sub.User_ID)
+		}
+	}
+
+	rows, err := tx.Query(ctx,
+		"SELECT user_id::text FROM users WHERE user_id = ANY($1::uuid[]) FOR KEY SHARE", ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		users[id] = true
+	}
+
+	return users, rows.Err()
+}
+
+// Batch runs in a single transaction, a large number of creates is copied in
+// before the other ops as no op of a batch can refer to a sub it creates
+func (db *PGXDB) Batch(ctx context.Context, ops []BatchOp, atomic bool) ([]BatchResult, error) {
+
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	users, err := pgxBatchUsers(ctx, tx, ops)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchResult, len(ops))
+
+	var rows [][]any
+	for i, op := range ops {
+		if op.Op == BatchCreate && users[op.Sub.User_ID] {
+			results[i] = BatchResult{ID: uuid.NewString(), Version: 1}
+			sub := normalizeSub(op.Sub)
+			anchor, _ := time.Parse(time.DateOnly, sub.Anchor)
+			rows = append(rows, []any{results[i].ID, sub.Service, sub.Price, sub.User_ID, pgxDate(&sub.Start, false), pgxDate(sub.End, true), sub.Currency, sub.Billing_Period, sub.Billing_Interval, anchor,
+				sub.Trial_Months, sub.Intro_Price, sub.Intro_Months, sub.Category, sub.Tags})
+		}
+	}
+
+	copied := len(rows) >= pgxCopyMinRows
+	if copied {
+		_, err := tx.CopyFrom(ctx, pgx.Identifier{"subs"},
+			[]string{"sub_id", "service_name", "price", "user_id", "start_date", "end_date", "currency", "billing_period", "billing_interval", "anchor_date", "trial_months", "intro_price", "intro_months", "category", "tags"},
+			pgx.CopyFromRows(rows))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	failed := false
+	for i, op := range ops {
+
+		var err error
+		switch op.Op {
+		case BatchCreate:
+			if !users[op.Sub.User_ID] {
+				err = ErrUnknownUser
+			} else if copied {
+				continue
+			} else {
+				err = pgxInsert(ctx, tx, results[i].ID, op.Sub)
+			}
+		case BatchUpdate:
+			results[i].ID = op.ID
+			if !users[op.Sub.User_ID] {
+				err = pgxUnknownUserError(ctx, tx, op.ID, op.Version)
+			} else {
+				results[i].Version, err = pgxUpdate(ctx, tx, op.ID, op.Sub, op.Version)
+			}
+		case BatchDelete:
+			results[i].ID = op.ID
+			err = pgxDelete(ctx, tx, op.ID, op.Version)
+		default:
+			return nil, fmt.Errorf("unknown batch op %q", op.Op)
+		}
+
+		if err == ErrNotFound || err == ErrVersionMismatch || err == ErrUnknownUser {
+			results[i] = BatchResult{Err: err}
+			failed = true
+			if atomic {
+				break
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if atomic && failed {
+		abortBatch(results)
+		return results, nil
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func (db *PGXDB) ReserveKey(ctx context.Context, key string, hash string, ttl time.Duration) (IdempotencyRecord, bool, error) {
+
+	// expired keys are dropped lazily, reusing one starts over
+	if _, err := db.conn.Exec(ctx, "DELETE FROM idempotency_keys WHERE expires_at<=now()"); err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+
+	tag, err := db.conn.Exec(ctx,
+		"INSERT INTO idempotency_keys (key, hash, expires_at) VALUES ($1, $2, now() + make_interval(secs => $3)) ON CONFLICT (key) DO NOTHING",
+		key, hash, ttl.Seconds())
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	if tag.RowsAffected() == 1 {
+		return IdempotencyRecord{}, false, nil
+	}
+
+	var rec IdempotencyRecord
+	err = db.conn.QueryRow(ctx,
+		"SELECT hash, status, body FROM idempotency_keys WHERE key=$1", key).Scan(&rec.Hash, &rec.Status, &rec.Body)
+
+	if err == pgx.ErrNoRows {
+		// released between the insert and the select, the other request is still settling
+		return IdempotencyRecord{Hash: hash}, true, nil
+	}
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+
+	return rec, true, nil
+}
+
+func (db *PGXDB) CompleteKey(ctx context.Context, key string, status int, body []byte) error {
+
+	tag, err := db.conn.Exec(ctx,
+		"UPDATE idempotency_keys SET status=$1, body=$2 WHERE key=$3", status, body, key)
+
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (db *PGXDB) ReleaseKey(ctx context.Context, key string) error {
+
+	_, err := db.conn.Exec(ctx, "DELETE FROM idempotency_keys WHERE key=$1", key)
+
+	return err
+}
+
 func (db *PGXDB) Close() error {
-	return db.conn.Close(context.Background())
+	db.conn.Close()
+	return nil
 }
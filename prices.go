@@ -0,0 +1,259 @@
+package subs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// SubPrice is a scheduled price of a sub, charged from the month
+// Effective_From on until its next price. The Price of the sub itself is
+// charged before its first one.
+type SubPrice struct {
+	Effective_From string `json:"effective_from"`
+	Price          Money  `json:"price"`
+}
+
+// priceTable holds the scheduled prices of the Go backends, ordered by month
+// per sub id
+type priceTable map[string][]SubPrice
+
+func (t priceTable) set(id string, price SubPrice) {
+
+	prices := t[id]
+
+	i := sort.Search(len(prices), func(i int) bool {
+		return monthIndex(prices[i].Effective_From) >= monthIndex(price.Effective_From)
+	})
+	if i < len(prices) && prices[i].Effective_From == price.Effective_From {
+		prices[i] = price
+		return
+	}
+
+	t[id] = slices.Insert(prices, i, price)
+}
+
+func (t priceTable) delete(id string, month string) bool {
+
+	prices := t[id]
+
+	i := sort.Search(len(prices), func(i int) bool { return monthIndex(prices[i].Effective_From) >= monthIndex(month) })
+	if i == len(prices) || prices[i].Effective_From != month {
+		return false
+	}
+
+	t[id] = slices.Delete(prices, i, i+1)
+	if len(t[id]) == 0 {
+		delete(t, id)
+	}
+
+	return true
+}
+
+// priceSpan is a run of months of a sub charged at one price, sub has that
+// price
+type priceSpan struct {
+	sub      Sub
+	from, to int
+}
+
+// priceSpans mirrors the sub_price_spans SQL function, it splits the [from,
+// to] month indexes into the spans of the prices of sub in order, prices
+// being ordered by month
+func priceSpans(sub Sub, prices []SubPrice, from int, to int) []priceSpan {
+
+	var spans []priceSpan
+	for i := -1; i < len(prices); i++ {
+		span := priceSpan{sub: sub, from: from, to: to}
+		if i >= 0 {
+			span.sub.Price = prices[i].Price
+			span.from = max(monthIndex(prices[i].Effective_From), from)
+		}
+		if i+1 < len(prices) {
+			span.to = min(monthIndex(prices[i+1].Effective_From)-1, to)
+		}
+		if span.from <= span.to {
+			spans = append(spans, span)
+		}
+	}
+
+	return spans
+}
+
+func validatePrice(price Money) error {
+
+	if price < 0 {
+		return errors.New("invalid price")
+	}
+
+	if price > maxPrice {
+		return errors.New("price too large")
+	}
+
+	return nil
+}
+
+func parsePricePath(r *http.Request) (string, string, error) {
+
+	vars := mux.Vars(r)
+	if err := uuid.Validate(vars["id"]); err != nil {
+		return "", "", err
+	}
+	if err := validateDate(vars["month"]); err != nil {
+		return "", "", errors.New("invalid month")
+	}
+
+	return vars["id"], vars["month"], nil
+}
+
+func setPriceHandler(w http.ResponseWriter, r *http.Request) {
+
+	id, month, err := parsePricePath(r)
+	if err != nil {
+		logger.Printf("set price: resp 400: %v; req %v", err, r.URL.Path)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		Price *Money `json:"price"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Price == nil {
+		logger.Printf("set price: resp 400: invalid price %v; req %v", err, r.URL.Path)
+		http.Error(w, "invalid request: invalid price", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	price := SubPrice{Effective_From: month, Price: *body.Price}
+	if err := validatePrice(price.Price); err != nil {
+		logger.Printf("set price: resp 400: %v; req %v", err, r.URL.Path)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	breaches, err := checkBudgetWrite(w, ctx, id, func(c *chargedSub) { c.prices.set(id, price) })
+	if err == nil {
+		err = db.SetPrice(ctx, id, price)
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			logger.Printf("set price: resp 404; valid req %v %v", id, price)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if err == ErrOverBudget {
+			logger.Printf("set price: resp 409: %v; valid req %v %v", breaches, id, price)
+			http.Error(w, "over budget", http.StatusConflict)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("set price: resp 504: %v; valid req %v %v", err, id, price)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("set price: resp 500: %v; valid req %v %v", err, id, price)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(price)
+	logger.Printf("set price: resp 200; req %v %v", id, price)
+}
+
+func deletePriceHandler(w http.ResponseWriter, r *http.Request) {
+
+	id, month, err := parsePricePath(r)
+	if err != nil {
+		logger.Printf("delete price: resp 400: %v; req %v", err, r.URL.Path)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	breaches, err := checkBudgetWrite(w, ctx, id, func(c *chargedSub) { c.prices.delete(id, month) })
+	if err == nil {
+		err = db.DeletePrice(ctx, id, month)
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			logger.Printf("delete price: resp 404: %v; req %v", err, r.URL.Path)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if err == ErrOverBudget {
+			logger.Printf("delete price: resp 409: %v; valid req %v", breaches, r.URL.Path)
+			http.Error(w, "over budget", http.StatusConflict)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("delete price: resp 504: %v; valid req %v", err, r.URL.Path)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("delete price: resp 500: %v; valid req %v", err, r.URL.Path)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Printf("delete price: resp 204; req %v", r.URL.Path)
+}
+
+func listPricesHandler(w http.ResponseWriter, r *http.Request) {
+
+	id := mux.Vars(r)["id"]
+	if err := uuid.Validate(id); err != nil {
+		logger.Printf("list prices: resp 400: %v; req %v", err, id)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	prices, err := db.ListPrices(ctx, id)
+	if err != nil {
+		if err == ErrNotFound {
+			logger.Printf("list prices: resp 404; valid req %v", id)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("list prices: resp 504: %v; valid req %v", err, id)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("list prices: resp 500: %v; valid req %v", err, id)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	if prices == nil {
+		prices = []SubPrice{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]SubPrice{"prices": prices})
+	logger.Printf("list prices: resp 200 with %v entries; req %v", len(prices), id)
+}
@@ -0,0 +1,125 @@
+package subs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestPriceSpans(t *testing.T) {
+
+	sub := Sub{Price: 100}
+	prices := []SubPrice{{"03-2024", 200}, {"06-2024", 300}}
+
+	for _, tc := range []struct {
+		from, to string
+		expected string
+	}{
+		{"01-2024", "12-2024", "[01-2024..02-2024 1.00 03-2024..05-2024 2.00 06-2024..12-2024 3.00]"},
+		{"04-2024", "05-2024", "[04-2024..05-2024 2.00]"},
+		{"05-2024", "07-2024", "[05-2024..05-2024 2.00 06-2024..07-2024 3.00]"},
+		{"01-2023", "02-2023", "[01-2023..02-2023 1.00]"},
+		{"01-2025", "02-2025", "[01-2025..02-2025 3.00]"},
+	} {
+		var spans []string
+		for _, span := range priceSpans(sub, prices, monthIndex(tc.from), monthIndex(tc.to)) {
+			spans = append(spans, fmt.Sprintf("%v..%v %v", monthDate(span.from), monthDate(span.to), span.sub.Price))
+		}
+		if got := fmt.Sprint(spans); got != tc.expected {
+			t.Errorf("%v..%v: expected %v, got %v", tc.from, tc.to, tc.expected, got)
+		}
+	}
+
+	if spans := priceSpans(sub, nil, 1, 2); len(spans) != 1 || spans[0].sub.Price != 100 {
+		t.Errorf("expected a single span at the sub price, got %v", spans)
+	}
+}
+
+func TestPriceHandlers(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m := h.m
+
+	id, err := m.Create(context.Background(), Sub{Service: "a", Price: 1000, User_ID: addUser(t, m), Start: "01-2024"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := h.do
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, tc := range []struct{ path, body string }{
+			{"/subs/abc/prices/04-2024", `{"price": "12"}`},
+			{"/subs/" + id + "/prices/2024-04", `{"price": "12"}`},
+			{"/subs/" + id + "/prices/13-2024", `{"price": "12"}`},
+			{"/subs/" + id + "/prices/04-2024", `{"price": "-12"}`},
+			{"/subs/" + id + "/prices/04-2024", `{"price": "1000000000.01"}`},
+			{"/subs/" + id + "/prices/04-2024", `{"price": "1.001"}`},
+			{"/subs/" + id + "/prices/04-2024", `{}`},
+		} {
+			if status, _ := do("PUT", tc.path, tc.body); status != 400 {
+				t.Errorf("%v %v: expected status: 400, got %v", tc.path, tc.body, status)
+			}
+		}
+
+		if status, _ := do("GET", "/subs/abc/prices", ""); status != 400 {
+			t.Errorf("expected status: 400, got %v", status)
+		}
+		if status, _ := do("DELETE", "/subs/"+id+"/prices/2024", ""); status != 400 {
+			t.Errorf("expected status: 400, got %v", status)
+		}
+	})
+
+	t.Run("set", func(t *testing.T) {
+		for _, tc := range []struct{ month, body, expected string }{
+			{"07-2024", `{"price": "15"}`, `{"effective_from":"07-2024","price":"15.00"}`},
+			{"04-2024", `{"price": 12.5}`, `{"effective_from":"04-2024","price":"12.50"}`},
+		} {
+			status, body := do("PUT", "/subs/"+id+"/prices/"+tc.month, tc.body)
+			if status != 200 || body != tc.expected {
+				t.Errorf("%v %v: expected 200 %v, got %v %v", tc.month, tc.body, tc.expected, status, body)
+			}
+		}
+
+		status, body := do("GET", "/subs/"+id+"/prices", "")
+		if status != 200 {
+			t.Fatalf("expected status: 200, got %v", status)
+		}
+		var res struct {
+			Prices []SubPrice `json:"prices"`
+		}
+		if err := json.Unmarshal([]byte(body), &res); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(res.Prices) != "[{04-2024 12.50} {07-2024 15.00}]" {
+			t.Errorf("unexpected prices: %v", res.Prices)
+		}
+
+		status, body = do("GET", "/subs/sum?start_date=03-2024&end_date=07-2024&service_name=a", "")
+		if status != 200 || body != `{"sum":"62.50"}` {
+			t.Errorf("expected sum: 62.50, got %v %v", status, body)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if status, _ := do("DELETE", "/subs/"+id+"/prices/04-2024", ""); status != 204 {
+			t.Errorf("expected status: 204, got %v", status)
+		}
+		if status, _ := do("DELETE", "/subs/"+id+"/prices/04-2024", ""); status != 404 {
+			t.Errorf("expected status: 404, got %v", status)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		missing := "/subs/" + uuid.NewString() + "/prices"
+		if status, _ := do("PUT", missing+"/04-2024", `{"price": "12"}`); status != 404 {
+			t.Errorf("expected status: 404, got %v", status)
+		}
+		if status, _ := do("GET", missing, ""); status != 404 {
+			t.Errorf("expected status: 404, got %v", status)
+		}
+	})
+}
@@ -0,0 +1,423 @@
+package subs
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+var ErrServiceConflict = errors.New("service name taken")
+
+// upper bound of service names, aliases and categories, like service_name
+const maxServiceNameLen = 255
+
+// Service is a catalog entry. Service names of subs matching its Name or one
+// of its Aliases are stored as its Name, with its Category unless they have
+// one, and so are those of subs stored before the entry.
+//
+// Default_Price is its usual price in Currency, for clients filling in new
+// subs.
+type Service struct {
+	ID            string   `json:"service_id"`
+	Name          string   `json:"name"`
+	Aliases       []string `json:"aliases"`
+	Default_Price Money    `json:"default_price"`
+	Currency      string   `json:"currency"`
+	Category      string   `json:"category"`
+}
+
+// serviceKey mirrors lower(btrim()) in SQL, service names are matched by
+// their keys
+func serviceKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// normalizeService trims the names of svc and drops aliases repeating its name
+// or another alias, a missing currency defaults to defaultCurrency
+func normalizeService(svc Service) Service {
+
+	svc.Name = strings.TrimSpace(svc.Name)
+	svc.Category = strings.TrimSpace(svc.Category)
+
+	seen := map[string]bool{serviceKey(svc.Name): true}
+	aliases := []string{}
+	for _, alias := range svc.Aliases {
+		alias = strings.TrimSpace(alias)
+		if alias != "" && seen[serviceKey(alias)] {
+			continue
+		}
+		seen[serviceKey(alias)] = true
+		aliases = append(aliases, alias)
+	}
+	svc.Aliases = aliases
+
+	if svc.Currency == "" {
+		svc.Currency = defaultCurrency
+	}
+
+	return svc
+}
+
+func validateService(svc Service) error {
+
+	if svc.Name == "" {
+		return errors.New("empty name")
+	}
+
+	if len(svc.Name) > maxServiceNameLen {
+		return errors.New("name too long")
+	}
+
+	for _, alias := range svc.Aliases {
+		if alias == "" {
+			return errors.New("empty alias")
+		}
+		if len(alias) > maxServiceNameLen {
+			return errors.New("alias too long")
+		}
+	}
+
+	if svc.Default_Price < 0 {
+		return errors.New("invalid default price")
+	}
+
+	if svc.Default_Price > maxPrice {
+		return errors.New("default price too large")
+	}
+
+	if err := validateCurrency(svc.Currency); err != nil {
+		return err
+	}
+
+	if len(svc.Category) > maxServiceNameLen {
+		return errors.New("category too long")
+	}
+
+	return nil
+}
+
+// serviceKeys are the keys of the name and aliases of svc, no two services
+// share one
+func serviceKeys(svc Service) []string {
+
+	keys := []string{serviceKey(svc.Name)}
+	for _, alias := range svc.Aliases {
+		keys = append(keys, serviceKey(alias))
+	}
+
+	return keys
+}
+
+// renameKeys are the keys of the service names of the subs svc resolves once
+// it replaced an entry of old_name, a renamed entry takes along the subs of
+// its old name. Catalog writes rename these subs and the budgets of these
+// names, so that sums and lists find them under the name of their entry. A
+// budget is kept as is while its user has another one of these names. A sub
+// written during the catalog write may keep the name it resolved before.
+func renameKeys(svc Service, old_name string) []string {
+
+	keys := serviceKeys(svc)
+	if old_name != "" {
+		keys = append(keys, serviceKey(old_name))
+	}
+
+	return keys
+}
+
+// compareServices orders services by name bytewise, then by id
+func compareServices(a Service, b Service) int {
+
+	if c := cmp.Compare(a.Name, b.Name); c != 0 {
+		return c
+	}
+
+	return cmp.Compare(a.ID, b.ID)
+}
+
+// serviceCatalog maps the serviceKeys of every service to it
+type serviceCatalog map[string]Service
+
+func newServiceCatalog(services []Service) serviceCatalog {
+
+	catalog := make(serviceCatalog)
+	for _, svc := range services {
+		for _, key := range serviceKeys(svc) {
+			catalog[key] = svc
+		}
+	}
+
+	return catalog
+}
+
+// resolve names sub after the catalog entry of its free-text service name
+// and fills in the category of the entry, without an entry the name is only
+// trimmed
+func (c serviceCatalog) resolve(sub Sub) Sub {
+
+	svc, ok := c[serviceKey(sub.Service)]
+	if !ok {
+		sub.Service = strings.TrimSpace(sub.Service)
+		return sub
+	}
+
+	sub.Service = svc.Name
+	if sub.Category == "" {
+		sub.Category = svc.Category
+	}
+
+	return sub
+}
+
+func readCatalog(ctx context.Context) (serviceCatalog, error) {
+
+	services, err := db.ListServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return newServiceCatalog(services), nil
+}
+
+// resolveServices resolves subs against the catalog, reading it once
+func resolveServices(ctx context.Context, subs ...*Sub) error {
+
+	catalog, err := readCatalog(ctx)
+	if err != nil {
+		return err
+	}
+
+	catalog.resolveAll(subs...)
+	return nil
+}
+
+func (c serviceCatalog) resolveAll(subs ...*Sub) {
+
+	for _, sub := range subs {
+		*sub = c.resolve(*sub)
+	}
+}
+
+// resolveFilterService sets the service of a sum filter to the name of the
+// service_id entry, or resolves its free-text name. Without the entry it
+// fails with ErrNotFound.
+func resolveFilterService(ctx context.Context, filter *Sub, service_id string) error {
+
+	if service_id == "" {
+		services, err := db.ListServices(ctx)
+		if err != nil {
+			return err
+		}
+		filter.Service = newServiceCatalog(services).resolve(Sub{Service: filter.Service}).Service
+		return nil
+	}
+
+	svc, err := db.ReadService(ctx, service_id)
+	if err != nil {
+		return err
+	}
+	filter.Service = svc.Name
+
+	return nil
+}
+
+func decodeService(r *http.Request) (Service, error) {
+
+	var svc Service
+	if err := json.NewDecoder(r.Body).Decode(&svc); err != nil {
+		return svc, errors.New("json error")
+	}
+	defer r.Body.Close()
+
+	svc = normalizeService(svc)
+	return svc, validateService(svc)
+}
+
+func createServiceHandler(w http.ResponseWriter, r *http.Request) {
+
+	svc, err := decodeService(r)
+	if err != nil {
+		logger.Printf("create service: resp 400: %v; req %v", err, svc)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	svc.ID, err = db.CreateService(ctx, svc)
+	if err != nil {
+		if err == ErrServiceConflict {
+			logger.Printf("create service: resp 409; valid req %v", svc)
+			http.Error(w, "service name taken", http.StatusConflict)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("create service: resp 504: %v; valid req %v", err, svc)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("create service: resp 500: %v; valid req %v", err, svc)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"service_id": svc.ID})
+	logger.Printf("create service: resp 201 with %v; req %v", svc.ID, svc)
+}
+
+func readServiceHandler(w http.ResponseWriter, r *http.Request) {
+
+	id := mux.Vars(r)["id"]
+	if err := uuid.Validate(id); err != nil {
+		logger.Printf("read service: resp 400: %v; req %v", err, id)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	svc, err := db.ReadService(ctx, id)
+	if err != nil {
+		if err == ErrNotFound {
+			logger.Printf("read service: resp 404; valid req %v", id)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("read service: resp 504: %v; valid req %v", err, id)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("read service: resp 500: %v; valid req %v", err, id)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(svc)
+	logger.Printf("read service: resp 200 with %v; req %v", svc, id)
+}
+
+func updateServiceHandler(w http.ResponseWriter, r *http.Request) {
+
+	id := mux.Vars(r)["id"]
+	if err := uuid.Validate(id); err != nil {
+		logger.Printf("update service: resp 400: %v; req %v", err, id)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	svc, err := decodeService(r)
+	if err != nil {
+		logger.Printf("update service: resp 400: %v; req %v, %v", err, id, svc)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	svc.ID = id
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	if err := db.UpdateService(ctx, id, svc); err != nil {
+		if err == ErrNotFound {
+			logger.Printf("update service: resp 404; valid req %v", id)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if err == ErrServiceConflict {
+			logger.Printf("update service: resp 409; valid req %v, %v", id, svc)
+			http.Error(w, "service name taken", http.StatusConflict)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("update service: resp 504: %v; valid req %v, %v", err, id, svc)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("update service: resp 500: %v; valid req %v, %v", err, id, svc)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(svc)
+	logger.Printf("update service: resp 200; req %v, %v", id, svc)
+}
+
+// deleteServiceHandler removes a catalog entry, subs keep the name it gave them
+func deleteServiceHandler(w http.ResponseWriter, r *http.Request) {
+
+	id := mux.Vars(r)["id"]
+	if err := uuid.Validate(id); err != nil {
+		logger.Printf("delete service: resp 400: %v; req %v", err, id)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	if err := db.DeleteService(ctx, id); err != nil {
+		if err == ErrNotFound {
+			logger.Printf("delete service: resp 404; valid req %v", id)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("delete service: resp 504: %v; valid req %v", err, id)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("delete service: resp 500: %v; valid req %v", err, id)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Printf("delete service: resp 204; req %v", id)
+}
+
+func listServicesHandler(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	services, err := db.ListServices(ctx)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("list services: resp 504: %v", err)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("list services: resp 500: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	if services == nil {
+		services = []Service{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]Service{"services": services})
+	logger.Printf("list services: resp 200 with %v entries", len(services))
+}
@@ -0,0 +1,172 @@
+package subs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestValidateService(t *testing.T) {
+
+	svc := normalizeService(Service{Name: " a ", Aliases: []string{"A", " b", "B", "c"}, Category: " video "})
+	if fmt.Sprint(svc) != fmt.Sprint(Service{Name: "a", Aliases: []string{"b", "c"}, Currency: "RUB", Category: "video"}) {
+		t.Errorf("unexpected normalized service: %v", svc)
+	}
+
+	for _, svc := range []Service{{Name: "a"}, {Name: "a", Default_Price: maxPrice}, {Name: strings.Repeat("a", maxServiceNameLen)}} {
+		if err := validateService(normalizeService(svc)); err != nil {
+			t.Errorf("%v: expected nil, got %v", svc, err)
+		}
+	}
+
+	for _, svc := range []Service{
+		{},
+		{Name: " "},
+		{Name: strings.Repeat("a", maxServiceNameLen+1)},
+		{Name: "a", Aliases: []string{" "}},
+		{Name: "a", Aliases: []string{strings.Repeat("b", maxServiceNameLen+1)}},
+		{Name: "a", Default_Price: -1},
+		{Name: "a", Default_Price: maxPrice + 1},
+		{Name: "a", Currency: "rub"},
+		{Name: "a", Category: strings.Repeat("c", maxServiceNameLen+1)},
+	} {
+		if err := validateService(normalizeService(svc)); err == nil {
+			t.Errorf("%v: expected err, got nil", svc)
+		}
+	}
+}
+
+func TestServiceCatalog(t *testing.T) {
+
+	catalog := newServiceCatalog([]Service{{Name: "Netflix", Aliases: []string{"NFLX"}, Category: "video"}, {Name: "Kino"}})
+
+	for _, tc := range []struct {
+		sub      Sub
+		expected string
+	}{
+		{Sub{Service: "Netflix"}, "Netflix video"},
+		{Sub{Service: "netflix"}, "Netflix video"},
+		{Sub{Service: "NETFLIX "}, "Netflix video"},
+		{Sub{Service: "nflx", Category: "films"}, "Netflix films"},
+		{Sub{Service: "kino"}, "Kino "},
+		{Sub{Service: " Other "}, "Other "},
+	} {
+		sub := catalog.resolve(tc.sub)
+		if got := sub.Service + " " + sub.Category; got != tc.expected {
+			t.Errorf("%v: expected %q, got %q", tc.sub, tc.expected, got)
+		}
+	}
+}
+
+func TestServiceHandlers(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m, do := h.m, h.do
+
+	var id string
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, body := range []string{`{}`, `{"name": " "}`, `{"name": "a", "aliases": [""]}`, `{"name": "a", "default_price": "-1.00"}`, `{"name": `} {
+			if status, _ := do("POST", "/services", body); status != 400 {
+				t.Errorf("%v: expected status: 400, got %v", body, status)
+			}
+		}
+		if status, _ := do("GET", "/services/abc", ""); status != 400 {
+			t.Errorf("expected status: 400, got %v", status)
+		}
+	})
+
+	t.Run("create", func(t *testing.T) {
+		status, body := do("POST", "/services", `{"name": "Netflix", "aliases": ["NFLX"], "default_price": "799.00", "category": "video"}`)
+		if status != 201 {
+			t.Fatalf("expected status: 201, got %v %v", status, body)
+		}
+		var created map[string]string
+		if err := json.Unmarshal([]byte(body), &created); err != nil || uuid.Validate(created["service_id"]) != nil {
+			t.Fatalf("unexpected body: %v, %v", body, err)
+		}
+		id = created["service_id"]
+
+		if status, _ := do("POST", "/services", `{"name": "nflx"}`); status != 409 {
+			t.Errorf("expected status: 409, got %v", status)
+		}
+
+		status, body = do("GET", "/services/"+id, "")
+		expected := `{"service_id":"` + id + `","name":"Netflix","aliases":["NFLX"],"default_price":"799.00","currency":"RUB","category":"video"}`
+		if status != 200 || body != expected {
+			t.Errorf("expected %v, got %v %v", expected, status, body)
+		}
+	})
+
+	t.Run("resolve", func(t *testing.T) {
+		user := addUser(t, m)
+		for _, name := range []string{"netflix", "NFLX ", "Netflix"} {
+			status, body := do("POST", "/subs", `{"service_name": "`+name+`", "price": "1.00", "user_id": "`+user+`", "start_date": "01-2024"}`)
+			if status != 201 {
+				t.Fatalf("expected status: 201, got %v %v", status, body)
+			}
+		}
+		if status, _ := do("POST", "/subs", `{"service_name": "Kino ", "price": "1.00", "user_id": "`+user+`", "start_date": "01-2024"}`); status != 201 {
+			t.Fatalf("expected status: 201, got %v", status)
+		}
+
+		status, body := do("GET", "/subs/sum?start_date=01-2024&end_date=01-2024&group_by=service_name&user_id="+user, "")
+		if status != 200 || !strings.Contains(body, `{"group":"Kino","sum":"1.00"},{"group":"Netflix","sum":"3.00"}`) {
+			t.Errorf("expected every alias stored as Netflix, got %v %v", status, body)
+		}
+
+		for _, query := range []string{"service_id=" + id, "service_name=nflx", "service_name=NETFLIX"} {
+			status, body := do("GET", "/subs/sum?start_date=01-2024&end_date=01-2024&user_id="+user+"&"+query, "")
+			if status != 200 || body != `{"sum":"3.00"}` {
+				t.Errorf("%v: expected sum: 3.00, got %v %v", query, status, body)
+			}
+		}
+	})
+
+	t.Run("sum filter", func(t *testing.T) {
+		for _, tc := range []struct {
+			query  string
+			status int
+		}{
+			{"&service_id=abc", 400},
+			{"&service_id=" + id + "&service_name=Netflix", 400},
+			{"&service_id=" + uuid.NewString(), 404},
+		} {
+			if status, _ := do("GET", "/subs/sum?start_date=01-2024&end_date=01-2024"+tc.query, ""); status != tc.status {
+				t.Errorf("%v: expected status: %v, got %v", tc.query, tc.status, status)
+			}
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		status, body := do("PUT", "/services/"+id, `{"name": "Netflix", "aliases": ["nflx", "NETFLIX"]}`)
+		if status != 200 || !strings.Contains(body, `"aliases":["nflx"]`) {
+			t.Errorf("expected status: 200, got %v %v", status, body)
+		}
+		if status, _ := do("PUT", "/services/"+uuid.NewString(), `{"name": "a"}`); status != 404 {
+			t.Errorf("expected status: 404, got %v", status)
+		}
+
+		status, body = do("GET", "/services", "")
+		if status != 200 || !strings.HasPrefix(body, `{"services":[{"service_id":"`+id+`"`) {
+			t.Errorf("unexpected services: %v %v", status, body)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if status, _ := do("DELETE", "/services/"+id, ""); status != 204 {
+			t.Errorf("expected status: 204, got %v", status)
+		}
+		if status, _ := do("DELETE", "/services/"+id, ""); status != 404 {
+			t.Errorf("expected status: 404, got %v", status)
+		}
+
+		status, body := do("GET", "/services", "")
+		if status != 200 || body != `{"services":[]}` {
+			t.Errorf("expected no services, got %v %v", status, body)
+		}
+	})
+}
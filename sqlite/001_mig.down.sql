@@ -0,0 +1 @@
+DROP TABLE IF EXISTS subs;
\ No newline at end of file
@@ -0,0 +1,13 @@
+CREATE TABLE subs (
+    sub_id TEXT PRIMARY KEY,
+    service_name TEXT NOT NULL,
+    price INTEGER NOT NULL,
+    user_id TEXT NOT NULL,
+    start_date TEXT NOT NULL, -- YYYY-MM-DD, compares as text
+    end_date TEXT
+);
+
+CREATE INDEX subs_user_id_idx ON subs (user_id);
+CREATE INDEX subs_service_name_idx ON subs (service_name, sub_id);
+CREATE INDEX subs_price_idx ON subs (price, sub_id);
+CREATE INDEX subs_start_date_idx ON subs (start_date, sub_id);
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE subs DROP COLUMN version;
\ No newline at end of file
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS fx_rates;
+
+ALTER TABLE subs DROP COLUMN currency;
\ No newline at end of file
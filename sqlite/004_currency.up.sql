@@ -0,0 +1,10 @@
+ALTER TABLE subs ADD COLUMN currency TEXT NOT NULL DEFAULT 'RUB';
+
+-- rate is in millionths, month is the first day of the month it takes effect
+CREATE TABLE IF NOT EXISTS fx_rates (
+    from_currency TEXT NOT NULL,
+    to_currency TEXT NOT NULL,
+    month TEXT NOT NULL,
+    rate INTEGER NOT NULL,
+    PRIMARY KEY (from_currency, to_currency, month)
+);
\ No newline at end of file
@@ -0,0 +1 @@
+UPDATE subs SET price = CAST(round(price / 100.0) AS INTEGER);
\ No newline at end of file
@@ -0,0 +1,2 @@
+-- prices were whole currency units, they are minor units from now on
+UPDATE subs SET price = price * 100;
\ No newline at end of file
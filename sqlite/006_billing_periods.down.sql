@@ -0,0 +1,3 @@
+ALTER TABLE subs DROP COLUMN anchor_date;
+ALTER TABLE subs DROP COLUMN billing_interval;
+ALTER TABLE subs DROP COLUMN billing_period;
\ No newline at end of file
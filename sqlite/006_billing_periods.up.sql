@@ -0,0 +1,7 @@
+-- anchor_date is the YYYY-MM-DD date charges are counted from, existing
+-- subs charge monthly on the first day of their start month
+ALTER TABLE subs ADD COLUMN billing_period TEXT NOT NULL DEFAULT 'monthly';
+ALTER TABLE subs ADD COLUMN billing_interval INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE subs ADD COLUMN anchor_date TEXT;
+
+UPDATE subs SET anchor_date = start_date;
\ No newline at end of file
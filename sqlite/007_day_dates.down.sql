@@ -0,0 +1 @@
+UPDATE subs SET start_date = date(start_date, 'start of month'), end_date = date(end_date, 'start of month');
\ No newline at end of file
@@ -0,0 +1,3 @@
+-- start and end dates keep their day, an end date is the last day of a sub.
+-- Month ends were stored as the first day of their month.
+UPDATE subs SET end_date = date(end_date, '+1 month', '-1 day') WHERE end_date IS NOT NULL;
\ No newline at end of file
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS sub_prices_delete;
+
+DROP TABLE IF EXISTS sub_prices;
\ No newline at end of file
@@ -0,0 +1,13 @@
+-- a scheduled price of a sub from the first day of month effective_from on,
+-- deleted with the sub as the connection leaves foreign keys off
+CREATE TABLE IF NOT EXISTS sub_prices (
+    sub_id TEXT NOT NULL,
+    effective_from TEXT NOT NULL,
+    price INTEGER NOT NULL,
+    PRIMARY KEY (sub_id, effective_from)
+);
+
+CREATE TRIGGER IF NOT EXISTS sub_prices_delete AFTER DELETE ON subs
+BEGIN
+    DELETE FROM sub_prices WHERE sub_id = OLD.sub_id;
+END;
\ No newline at end of file
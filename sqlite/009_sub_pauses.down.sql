@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS sub_pauses_delete;
+
+DROP TABLE IF EXISTS sub_pauses;
\ No newline at end of file
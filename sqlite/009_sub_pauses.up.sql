@@ -0,0 +1,15 @@
+-- a pause of a sub from the first day of month start_date to the last day of
+-- month end_date, deleted with the sub like its prices
+CREATE TABLE IF NOT EXISTS sub_pauses (
+    pause_id TEXT PRIMARY KEY,
+    sub_id TEXT NOT NULL,
+    start_date TEXT NOT NULL,
+    end_date TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS sub_pauses_sub_id ON sub_pauses (sub_id);
+
+CREATE TRIGGER IF NOT EXISTS sub_pauses_delete AFTER DELETE ON subs
+BEGIN
+    DELETE FROM sub_pauses WHERE sub_id = OLD.sub_id;
+END;
\ No newline at end of file
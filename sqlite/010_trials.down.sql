@@ -0,0 +1,3 @@
+ALTER TABLE subs DROP COLUMN intro_months;
+ALTER TABLE subs DROP COLUMN intro_price;
+ALTER TABLE subs DROP COLUMN trial_months;
\ No newline at end of file
@@ -0,0 +1,5 @@
+-- months of a free trial from the start date, then months charged at
+-- intro_price, both counted from the start day
+ALTER TABLE subs ADD COLUMN trial_months INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE subs ADD COLUMN intro_price INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE subs ADD COLUMN intro_months INTEGER NOT NULL DEFAULT 0;
\ No newline at end of file
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS sub_members_delete;
+
+DROP TABLE IF EXISTS sub_members;
\ No newline at end of file
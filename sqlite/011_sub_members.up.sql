@@ -0,0 +1,16 @@
+-- a member sharing the charges of a sub, by percent or a fixed amount,
+-- deleted with the sub like its prices
+CREATE TABLE IF NOT EXISTS sub_members (
+    sub_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    percent INTEGER NOT NULL DEFAULT 0,
+    amount INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (sub_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS sub_members_user_id ON sub_members (user_id);
+
+CREATE TRIGGER IF NOT EXISTS sub_members_delete AFTER DELETE ON subs
+BEGIN
+    DELETE FROM sub_members WHERE sub_id = OLD.sub_id;
+END;
\ No newline at end of file
@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS service_names_delete;
+
+DROP TABLE IF EXISTS service_names;
+
+DROP TABLE IF EXISTS services;
\ No newline at end of file
@@ -0,0 +1,22 @@
+-- the service catalog, service_names holds the serviceKey of the name and
+-- every alias of a service so no two services share one
+CREATE TABLE IF NOT EXISTS services (
+    service_id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    aliases TEXT NOT NULL DEFAULT '[]',
+    default_price INTEGER NOT NULL DEFAULT 0,
+    currency TEXT NOT NULL DEFAULT 'RUB',
+    category TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS service_names (
+    name_key TEXT PRIMARY KEY,
+    service_id TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS service_names_service_id ON service_names (service_id);
+
+CREATE TRIGGER IF NOT EXISTS service_names_delete AFTER DELETE ON services
+BEGIN
+    DELETE FROM service_names WHERE service_id = OLD.service_id;
+END;
\ No newline at end of file
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS subs_category;
+
+ALTER TABLE subs DROP COLUMN tags;
+ALTER TABLE subs DROP COLUMN category;
\ No newline at end of file
@@ -0,0 +1,5 @@
+-- free-form labels of a sub, tags are a sorted JSON array of strings
+ALTER TABLE subs ADD COLUMN category TEXT NOT NULL DEFAULT '';
+ALTER TABLE subs ADD COLUMN tags TEXT NOT NULL DEFAULT '[]';
+
+CREATE INDEX IF NOT EXISTS subs_category ON subs (category);
\ No newline at end of file
@@ -0,0 +1,7 @@
+DROP TRIGGER IF EXISTS users_delete;
+
+DROP TRIGGER IF EXISTS subs_user_update;
+
+DROP TRIGGER IF EXISTS subs_user_insert;
+
+DROP TABLE IF EXISTS users;
\ No newline at end of file
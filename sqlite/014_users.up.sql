@@ -0,0 +1,30 @@
+-- users owning subs, triggers stand in for a foreign key on subs.user_id as
+-- sqlite can't add one to an existing table. Every user id already in use
+-- becomes a user.
+CREATE TABLE IF NOT EXISTS users (
+    user_id TEXT PRIMARY KEY,
+    display_name TEXT NOT NULL DEFAULT '',
+    email TEXT NOT NULL DEFAULT '',
+    default_currency TEXT NOT NULL DEFAULT 'RUB',
+    timezone TEXT NOT NULL DEFAULT 'UTC'
+);
+
+INSERT OR IGNORE INTO users (user_id) SELECT DISTINCT user_id FROM subs;
+
+CREATE TRIGGER IF NOT EXISTS subs_user_insert BEFORE INSERT ON subs
+WHEN NOT EXISTS (SELECT 1 FROM users WHERE user_id = NEW.user_id)
+BEGIN
+    SELECT RAISE(ABORT, 'unknown user');
+END;
+
+CREATE TRIGGER IF NOT EXISTS subs_user_update BEFORE UPDATE OF user_id ON subs
+WHEN NOT EXISTS (SELECT 1 FROM users WHERE user_id = NEW.user_id)
+BEGIN
+    SELECT RAISE(ABORT, 'unknown user');
+END;
+
+CREATE TRIGGER IF NOT EXISTS users_delete BEFORE DELETE ON users
+WHEN EXISTS (SELECT 1 FROM subs WHERE user_id = OLD.user_id)
+BEGIN
+    SELECT RAISE(ABORT, 'user has subscriptions');
+END;
\ No newline at end of file
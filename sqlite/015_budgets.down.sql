@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS budgets_delete;
+
+DROP TABLE IF EXISTS budgets;
\ No newline at end of file
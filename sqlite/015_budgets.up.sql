@@ -0,0 +1,17 @@
+-- monthly spend limits of users, at most one per category or service name
+-- and one of all their spend. They go with their user.
+CREATE TABLE IF NOT EXISTS budgets (
+    budget_id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    monthly_limit INTEGER NOT NULL,
+    currency TEXT NOT NULL DEFAULT 'RUB',
+    category TEXT NOT NULL DEFAULT '',
+    service_name TEXT NOT NULL DEFAULT ''
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS budgets_scope ON budgets (user_id, category, service_name COLLATE service_key);
+
+CREATE TRIGGER IF NOT EXISTS budgets_delete AFTER DELETE ON users
+BEGIN
+    DELETE FROM budgets WHERE user_id = OLD.user_id;
+END;
\ No newline at end of file
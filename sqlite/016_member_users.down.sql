@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS users_delete_members;
+
+DROP TRIGGER IF EXISTS sub_members_user_update;
+
+DROP TRIGGER IF EXISTS sub_members_user_insert;
\ No newline at end of file
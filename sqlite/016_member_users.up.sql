@@ -0,0 +1,22 @@
+-- members are users too, triggers stand in for a foreign key on
+-- sub_members.user_id like on subs.user_id, a user sharing subs counts as
+-- having them. Every member id without a user becomes one.
+INSERT OR IGNORE INTO users (user_id) SELECT DISTINCT user_id FROM sub_members;
+
+CREATE TRIGGER IF NOT EXISTS sub_members_user_insert BEFORE INSERT ON sub_members
+WHEN NOT EXISTS (SELECT 1 FROM users WHERE user_id = NEW.user_id)
+BEGIN
+    SELECT RAISE(ABORT, 'unknown user');
+END;
+
+CREATE TRIGGER IF NOT EXISTS sub_members_user_update BEFORE UPDATE OF user_id ON sub_members
+WHEN NOT EXISTS (SELECT 1 FROM users WHERE user_id = NEW.user_id)
+BEGIN
+    SELECT RAISE(ABORT, 'unknown user');
+END;
+
+CREATE TRIGGER IF NOT EXISTS users_delete_members BEFORE DELETE ON users
+WHEN EXISTS (SELECT 1 FROM sub_members WHERE user_id = OLD.user_id)
+BEGIN
+    SELECT RAISE(ABORT, 'user has subscriptions');
+END;
\ No newline at end of file
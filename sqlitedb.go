@@ -0,0 +1,1425 @@
+package subs
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/sqlite"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/google/uuid"
+	moderncsqlite "modernc.org/sqlite"
+)
+
+//go:embed sqlite/*.sql
+var sqliteMigrations embed.FS
+
+// dates covering whole months are read back as MM-YYYY, like canonicalDate
+const sqliteSubColumns = "sub_id, service_name, price, user_id, " +
+	"CASE WHEN strftime('%d', start_date)='01' THEN strftime('%m-%Y', start_date) ELSE start_date END, " +
+	"CASE WHEN strftime('%d', end_date, '+1 day')='01' THEN strftime('%m-%Y', end_date) ELSE end_date END, currency, billing_period, billing_interval, anchor_date, " +
+	"trial_months, intro_price, intro_months, category, tags, version"
+
+// service filters of sums compare serviceKeys, like lower(btrim()) does in
+// the postgres sum functions
+func init() {
+	moderncsqlite.MustRegisterCollationUtf8("service_key", func(a string, b string) int {
+		return strings.Compare(serviceKey(a), serviceKey(b))
+	})
+}
+
+// SQLiteDB stores subscriptions in a single sqlite file, migrations are
+// embedded and applied on open
+type SQLiteDB struct {
+	conn *sql.DB
+}
+
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite serializes writers anyway, and a ":memory:" database lives in a single connection
+	conn.SetMaxOpenConns(1)
+
+	if err := migrateSQLite(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &SQLiteDB{conn: conn}, nil
+}
+
+func migrateSQLite(conn *sql.DB) error {
+
+	src, err := iofs.New(sqliteMigrations, "sqlite")
+	if err != nil {
+		return err
+	}
+
+	driver, err := sqlite.WithInstance(conn, &sqlite.Config{})
+	if err != nil {
+		return err
+	}
+
+	mig, err := migrate.NewWithInstance("iofs", src, "sqlite", driver)
+	if err != nil {
+		return err
+	}
+
+	if err := mig.Up(); err != nil && err != migrate.ErrNoChange {
+		return err
+	}
+
+	return nil
+}
+
+// sqliteDate converts MM-YYYY to the stored YYYY-MM-DD form
+func sqliteDate(date string) string {
+	return date[3:] + "-" + date[:2] + "-01"
+}
+
+// sqliteEndDate stores the end date of a sub as its last day
+func sqliteEndDate(date *string) *string {
+
+	if date == nil {
+		return nil
+	}
+
+	d := isoDay(*date, true)
+	return &d
+}
+
+func scanSQLiteSub(row interface{ Scan(...any) error }) (Sub, error) {
+
+	var sub Sub
+	var tags string
+	err := row.Scan(&sub.ID, &sub.Service, &sub.Price, &sub.User_ID, &sub.Start, &sub.End, &sub.Currency, &sub.Billing_Period, &sub.Billing_Interval, &sub.Anchor,
+		&sub.Trial_Months, &sub.Intro_Price, &sub.Intro_Months, &sub.Category, &tags, &sub.Version)
+	if err != nil {
+		return sub, err
+	}
+
+	return sub, json.Unmarshal([]byte(tags), &sub.Tags)
+}
+
+// sqliteTags stores tags as a JSON array
+func sqliteTags(tags []string) string {
+
+	b, _ := json.Marshal(normalizeTags(tags))
+	return string(b)
+}
+
+// sqliteQuerier is either the connection or a transaction of SQLiteDB.Batch
+type sqliteQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// sqliteVersionError tells apart the reasons a conditional write matched no row
+func sqliteVersionError(ctx context.Context, q sqliteQuerier, id string) error {
+
+	var version int
+	err := q.QueryRowContext(ctx, "SELECT version FROM subs WHERE sub_id=?", id).Scan(&version)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return ErrVersionMismatch
+}
+
+// sqliteUserError maps the abort of the subs_user triggers to ErrUnknownUser
+func sqliteUserError(err error) error {
+
+	if err != nil && strings.Contains(err.Error(), "unknown user") {
+		return ErrUnknownUser
+	}
+
+	return err
+}
+
+func sqliteInsert(ctx context.Context, q sqliteQuerier, id string, sub Sub) error {
+
+	sub = normalizeSub(sub)
+	_, err := q.ExecContext(ctx,
+		"INSERT INTO subs (sub_id, service_name, price, user_id, start_date, end_date, currency, billing_period, billing_interval, anchor_date, trial_months, intro_price, intro_months, category, tags) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		id, sub.Service, sub.Price, sub.User_ID, isoDay(sub.Start, false), sqliteEndDate(sub.End), sub.Currency, sub.Billing_Period, sub.Billing_Interval, sub.Anchor, sub.Trial_Months, sub.Intro_Price, sub.Intro_Months,
+		sub.Category, sqliteTags(sub.Tags))
+
+	return sqliteUserError(err)
+}
+
+func sqliteUpdate(ctx context.Context, q sqliteQuerier, id string, sub Sub, version int) (int, error) {
+
+	sub = normalizeSub(sub)
+	err := q.QueryRowContext(ctx,
+		"UPDATE subs SET service_name=?, price=?, user_id=?, start_date=?, end_date=?, currency=?, billing_period=?, billing_interval=?, anchor_date=?, trial_months=?, intro_price=?, intro_months=?, category=?, tags=?, version=version+1 WHERE sub_id=? AND (?=0 OR version=?) RETURNING version",
+		sub.Service, sub.Price, sub.User_ID, isoDay(sub.Start, false), sqliteEndDate(sub.End), sub.Currency, sub.Billing_Period, sub.Billing_Interval, sub.Anchor, sub.Trial_Months, sub.Intro_Price, sub.Intro_Months,
+		sub.Category, sqliteTags(sub.Tags), id, version, version).Scan(&version)
+
+	if err == sql.ErrNoRows {
+		return 0, sqliteVersionError(ctx, q, id)
+	}
+	if err != nil {
+		return 0, sqliteUserError(err)
+	}
+
+	return version, nil
+}
+
+func sqliteDelete(ctx context.Context, q sqliteQuerier, id string, version int) error {
+
+	res, err := q.ExecContext(ctx,
+		"DELETE FROM subs WHERE sub_id=? AND (?=0 OR version=?)", id, version, version)
+
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sqliteVersionError(ctx, q, id)
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) Create(ctx context.Context, sub Sub) (string, error) {
+
+	id := uuid.NewString()
+	if err := sqliteInsert(ctx, db.conn, id, sub); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+func (db *SQLiteDB) Read(ctx context.Context, id string) (Sub, error) {
+
+	sub, err := scanSQLiteSub(db.conn.QueryRowContext(ctx,
+		"SELECT "+sqliteSubColumns+" FROM subs WHERE sub_id=?", id))
+
+	if err == sql.ErrNoRows {
+		return Sub{}, ErrNotFound
+	}
+	if err != nil {
+		return Sub{}, err
+	}
+
+	pauses, err := db.pauses(ctx, "p.sub_id=?", id)
+	if err != nil {
+		return Sub{}, err
+	}
+	sub.Pauses = pauses[id]
+
+	return sub, nil
+}
+
+func (db *SQLiteDB) Update(ctx context.Context, id string, sub Sub, version int) (int, error) {
+	return sqliteUpdate(ctx, db.conn, id, sub, version)
+}
+
+// Patch writes only the patched columns in a single UPDATE
+func (db *SQLiteDB) Patch(ctx context.Context, id string, patch SubPatch, version int) (int, error) {
+
+	var sets []string
+	var args []any
+
+	if patch.Service != nil {
+		sets = append(sets, "service_name=?")
+		args = append(args, *patch.Service)
+	}
+	if patch.Price != nil {
+		sets = append(sets, "price=?")
+		args = append(args, *patch.Price)
+	}
+	if patch.User_ID != nil {
+		sets = append(sets, "user_id=?")
+		args = append(args, *patch.User_ID)
+	}
+	if patch.Start != nil {
+		sets = append(sets, "start_date=?")
+		args = append(args, isoDay(*patch.Start, false))
+	}
+	if patch.SetEnd {
+		sets = append(sets, "end_date=?")
+		args = append(args, sqliteEndDate(patch.End))
+	}
+	if patch.Currency != nil {
+		sets = append(sets, "currency=?")
+		args = append(args, *patch.Currency)
+	}
+	if patch.Billing_Period != nil {
+		sets = append(sets, "billing_period=?")
+		args = append(args, *patch.Billing_Period)
+	}
+	if patch.Billing_Interval != nil {
+		sets = append(sets, "billing_interval=?")
+		args = append(args, *patch.Billing_Interval)
+	}
+	if patch.Anchor != nil {
+		sets = append(sets, "anchor_date=?")
+		args = append(args, *patch.Anchor)
+	}
+	if patch.Trial_Months != nil {
+		sets = append(sets, "trial_months=?")
+		args = append(args, *patch.Trial_Months)
+	}
+	if patch.Intro_Price != nil {
+		sets = append(sets, "intro_price=?")
+		args = append(args, *patch.Intro_Price)
+	}
+	if patch.Intro_Months != nil {
+		sets = append(sets, "intro_months=?")
+		args = append(args, *patch.Intro_Months)
+	}
+	if patch.Category != nil {
+		sets = append(sets, "category=?")
+		args = append(args, *patch.Category)
+	}
+	if patch.Tags != nil {
+		sets = append(sets, "tags=?")
+		args = append(args, sqliteTags(*patch.Tags))
+	}
+
+	if len(sets) == 0 {
+		sub, err := db.Read(ctx, id)
+		if err == nil && version != 0 && sub.Version != version {
+			return 0, ErrVersionMismatch
+		}
+		return sub.Version, err
+	}
+
+	err := db.conn.QueryRowContext(ctx,
+		"UPDATE subs SET "+strings.Join(sets, ", ")+", version=version+1 WHERE sub_id=? AND (?=0 OR version=?) RETURNING version",
+		append(args, id, version, version)...).Scan(&version)
+
+	if err == sql.ErrNoRows {
+		return 0, sqliteVersionError(ctx, db.conn, id)
+	}
+	if err != nil {
+		return 0, sqliteUserError(err)
+	}
+
+	return version, nil
+}
+
+func (db *SQLiteDB) Delete(ctx context.Context, id string, version int) error {
+	return sqliteDelete(ctx, db.conn, id, version)
+}
+
+func (db *SQLiteDB) List(ctx context.Context, q ListQuery) (SubPage, error) {
+
+	var conds []string
+	var args []any
+
+	if q.User_ID != "" {
+		conds = append(conds, "(user_id=? OR sub_id IN (SELECT sub_id FROM sub_members WHERE user_id=?))")
+		args = append(args, q.User_ID, q.User_ID)
+	}
+	if q.Service != "" {
+		conds = append(conds, "service_name=?")
+		args = append(args, q.Service)
+	}
+	if q.Category != "" {
+		conds = append(conds, "category=?")
+		args = append(args, q.Category)
+	}
+	if len(q.Tags) > 0 && q.AllTags {
+		conds = append(conds, "NOT EXISTS (SELECT 1 FROM json_each(?) f WHERE f.value NOT IN (SELECT value FROM json_each(tags)))")
+		args = append(args, sqliteTags(q.Tags))
+	}
+	if len(q.Tags) > 0 && !q.AllTags {
+		conds = append(conds, "EXISTS (SELECT 1 FROM json_each(tags) t WHERE t.value IN (SELECT value FROM json_each(?)))")
+		args = append(args, sqliteTags(q.Tags))
+	}
+	if q.From != "" {
+		conds = append(conds, "(end_date IS NULL OR end_date>=?)")
+		args = append(args, sqliteDate(q.From))
+	}
+	if q.To != "" {
+		conds = append(conds, "start_date<=?")
+		args = append(args, isoDay(q.To, true))
+	}
+	if q.MinPrice != nil {
+		conds = append(conds, "price>=?")
+		args = append(args, *q.MinPrice)
+	}
+	if q.MaxPrice != nil {
+		conds = append(conds, "price<=?")
+		args = append(args, *q.MaxPrice)
+	}
+
+	key, desc := sortKey(q.Sort)
+	op, dir := ">", "ASC"
+	if desc {
+		op, dir = "<", "DESC"
+	}
+
+	if q.After != "" {
+		c, err := decodeCursor(q.Sort, q.After)
+		if err != nil {
+			return SubPage{}, err
+		}
+
+		switch key {
+		case "sub_id":
+			conds = append(conds, "sub_id"+op+"?")
+			args = append(args, c.ID)
+		case "price":
+			v, _ := strconv.Atoi(c.Key)
+			conds = append(conds, "(price, sub_id)"+op+"(?, ?)")
+			args = append(args, v, c.ID)
+		case "start_date":
+			conds = append(conds, "(start_date, sub_id)"+op+"(?, ?)")
+			args = append(args, isoDay(c.Key, false), c.ID)
+		default:
+			conds = append(conds, "("+key+", sub_id)"+op+"(?, ?)")
+			args = append(args, c.Key, c.ID)
+		}
+	}
+
+	query := "SELECT " + sqliteSubColumns + " FROM subs"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, sub_id %s", key, dir, dir)
+	if q.Limit > 0 {
+		// fetch one extra row to know if there is a next page
+		query += " LIMIT ?"
+		args = append(args, q.Limit+1)
+	}
+
+	rows, err := db.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return SubPage{}, err
+	}
+	defer rows.Close()
+
+	var page SubPage
+	for rows.Next() {
+		sub, err := scanSQLiteSub(rows)
+		if err != nil {
+			return SubPage{}, err
+		}
+		page.Subs = append(page.Subs, sub)
+	}
+	if err := rows.Err(); err != nil {
+		return SubPage{}, err
+	}
+
+	if q.Limit > 0 && len(page.Subs) > q.Limit {
+		page.Subs = page.Subs[:q.Limit]
+		page.Next_Cursor = encodeCursor(q.Sort, page.Subs[q.Limit-1])
+	}
+
+	return page, nil
+}
+
+// Iter lists page by page, holding the single connection for a whole stream
+// would block every other query until the caller is done
+func (db *SQLiteDB) Iter(ctx context.Context, q ListQuery) iter.Seq2[Sub, error] {
+	return iterPages(ctx, db.List, q)
+}
+
+// sqliteSumFilter matches the subs s of the user, service, user and service
+// arguments of a sum filter, a user owns or is a member of them
+const sqliteSumFilter = "(?='' OR s.user_id=? OR s.sub_id IN (SELECT sub_id FROM sub_members WHERE user_id=?)) AND (?='' OR s.service_name=? COLLATE service_key)"
+
+// overlapping selects the subs of filter active in its period, sums are
+// counted from them in Go as sqlite has no procedural equivalent of the
+// postgres sum functions
+func (db *SQLiteDB) overlapping(ctx context.Context, filter Sub) ([]Sub, error) {
+
+	rows, err := db.conn.QueryContext(ctx,
+		"SELECT "+sqliteSubColumns+" FROM subs s WHERE "+sqliteSumFilter+" AND start_date<=? AND (end_date IS NULL OR end_date>=?)",
+		filter.User_ID, filter.User_ID, filter.User_ID, filter.Service, filter.Service, isoDay(*filter.End, true), sqliteDate(filter.Start))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []Sub
+	for rows.Next() {
+		sub, err := scanSQLiteSub(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+
+	return subs, rows.Err()
+}
+
+// rates loads the rates into the currency of filter, none are needed
+// without one
+func (db *SQLiteDB) rates(ctx context.Context, filter Sub) (rateTable, error) {
+
+	if filter.Currency == "" {
+		return nil, nil
+	}
+
+	list, err := db.ListRates(ctx, "", filter.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	rates := make(rateTable)
+	for _, rate := range list {
+		rates.set(rate)
+	}
+
+	return rates, nil
+}
+
+// pauses loads the pauses of the subs matching cond
+func (db *SQLiteDB) pauses(ctx context.Context, cond string, args ...any) (pauseTable, error) {
+
+	rows, err := db.conn.QueryContext(ctx,
+		"SELECT p.sub_id, p.pause_id, strftime('%m-%Y', p.start_date), strftime('%m-%Y', p.end_date) FROM sub_pauses p JOIN subs s ON s.sub_id=p.sub_id WHERE "+cond,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pauses := make(pauseTable)
+	for rows.Next() {
+		var id string
+		var pause Pause
+		if err := rows.Scan(&id, &pause.ID, &pause.Start, &pause.End); err != nil {
+			return nil, err
+		}
+		pauses.add(id, pause)
+	}
+
+	return pauses, rows.Err()
+}
+
+// prices loads the scheduled prices of the subs of filter
+func (db *SQLiteDB) prices(ctx context.Context, filter Sub) (priceTable, error) {
+
+	rows, err := db.conn.QueryContext(ctx,
+		"SELECT p.sub_id, strftime('%m-%Y', p.effective_from), p.price FROM sub_prices p JOIN subs s ON s.sub_id=p.sub_id WHERE "+sqliteSumFilter,
+		filter.User_ID, filter.User_ID, filter.User_ID, filter.Service, filter.Service)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prices := make(priceTable)
+	for rows.Next() {
+		var id string
+		var price SubPrice
+		if err := rows.Scan(&id, &price.Effective_From, &price.Price); err != nil {
+			return nil, err
+		}
+		prices.set(id, price)
+	}
+
+	return prices, rows.Err()
+}
+
+// members loads the members of the subs of filter
+func (db *SQLiteDB) members(ctx context.Context, filter Sub) (memberTable, error) {
+
+	rows, err := db.conn.QueryContext(ctx,
+		"SELECT m.sub_id, m.user_id, m.percent, m.amount FROM sub_members m JOIN subs s ON s.sub_id=m.sub_id WHERE "+sqliteSumFilter,
+		filter.User_ID, filter.User_ID, filter.User_ID, filter.Service, filter.Service)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make(memberTable)
+	for rows.Next() {
+		var id string
+		var member Member
+		if err := rows.Scan(&id, &member.User_ID, &member.Percent, &member.Amount); err != nil {
+			return nil, err
+		}
+		members.set(id, member)
+	}
+
+	return members, rows.Err()
+}
+
+func (db *SQLiteDB) Sum(ctx context.Context, filter Sub) (Money, error) {
+
+	sums, err := db.SumGroups(ctx, filter, "")
+	if err != nil {
+		return 0, err
+	}
+
+	var sum Money
+	for _, g := range sums {
+		sum += g.Sum
+	}
+
+	return sum, nil
+}
+
+func (db *SQLiteDB) SumGroups(ctx context.Context, filter Sub, group_by string) ([]SumGroup, error) {
+
+	subs, err := db.overlapping(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	rates, err := db.rates(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	prices, err := db.prices(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	pauses, err := db.pauses(ctx, sqliteSumFilter, filter.User_ID, filter.User_ID, filter.User_ID, filter.Service, filter.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := db.members(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	sums, err := sumCharges(slices.Values(subs), filter, group_by, rates, prices, pauses, members)
+	if err != nil {
+		return nil, err
+	}
+
+	return sortedGroups(sums, group_by), nil
+}
+
+// Batch runs in a single transaction, which also holds the only connection
+func (db *SQLiteDB) Batch(ctx context.Context, ops []BatchOp, atomic bool) ([]BatchResult, error) {
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results := make([]BatchResult, len(ops))
+	failed := false
+	for i, op := range ops {
+
+		var err error
+		switch op.Op {
+		case BatchCreate:
+			results[i] = BatchResult{ID: uuid.NewString(), Version: 1}
+			err = sqliteInsert(ctx, tx, results[i].ID, op.Sub)
+		case BatchUpdate:
+			results[i].ID = op.ID
+			results[i].Version, err = sqliteUpdate(ctx, tx, op.ID, op.Sub, op.Version)
+		case BatchDelete:
+			results[i].ID = op.ID
+			err = sqliteDelete(ctx, tx, op.ID, op.Version)
+		default:
+			return nil, fmt.Errorf("unknown batch op %q", op.Op)
+		}
+
+		if err == ErrNotFound || err == ErrVersionMismatch || err == ErrUnknownUser {
+			results[i] = BatchResult{Err: err}
+			failed = true
+			if atomic {
+				break
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if atomic && failed {
+		abortBatch(results)
+		return results, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// ReserveKey keeps expiry times as unix nanoseconds, taken from the Go clock
+func (db *SQLiteDB) ReserveKey(ctx context.Context, key string, hash string, ttl time.Duration) (IdempotencyRecord, bool, error) {
+
+	now := time.Now()
+
+	// expired keys are dropped lazily, reusing one starts over
+	if _, err := db.conn.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at<=?", now.UnixNano()); err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+
+	res, err := db.conn.ExecContext(ctx,
+		"INSERT INTO idempotency_keys (key, hash, expires_at) VALUES (?, ?, ?) ON CONFLICT (key) DO NOTHING",
+		key, hash, now.Add(ttl).UnixNano())
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return IdempotencyRecord{}, false, nil
+	}
+
+	var rec IdempotencyRecord
+	err = db.conn.QueryRowContext(ctx,
+		"SELECT hash, status, body FROM idempotency_keys WHERE key=?", key).Scan(&rec.Hash, &rec.Status, &rec.Body)
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+
+	return rec, true, nil
+}
+
+func (db *SQLiteDB) CompleteKey(ctx context.Context, key string, status int, body []byte) error {
+
+	res, err := db.conn.ExecContext(ctx,
+		"UPDATE idempotency_keys SET status=?, body=? WHERE key=?", status, body, key)
+
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) ReleaseKey(ctx context.Context, key string) error {
+
+	_, err := db.conn.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE key=?", key)
+
+	return err
+}
+
+func (db *SQLiteDB) SetRate(ctx context.Context, rate FXRate) error {
+
+	_, err := db.conn.ExecContext(ctx,
+		"INSERT INTO fx_rates (from_currency, to_currency, month, rate) VALUES (?, ?, ?, ?) ON CONFLICT (from_currency, to_currency, month) DO UPDATE SET rate=excluded.rate",
+		rate.From, rate.To, sqliteDate(rate.Month), int64(rate.Rate))
+
+	return err
+}
+
+func (db *SQLiteDB) DeleteRate(ctx context.Context, from string, to string, month string) error {
+
+	res, err := db.conn.ExecContext(ctx,
+		"DELETE FROM fx_rates WHERE from_currency=? AND to_currency=? AND month=?", from, to, sqliteDate(month))
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) ListRates(ctx context.Context, from string, to string) ([]FXRate, error) {
+
+	rows, err := db.conn.QueryContext(ctx,
+		"SELECT from_currency, to_currency, strftime('%m-%Y', month), rate FROM fx_rates WHERE (?='' OR from_currency=?) AND (?='' OR to_currency=?) ORDER BY from_currency, to_currency, month",
+		from, from, to, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rates []FXRate
+	for rows.Next() {
+		var rate FXRate
+		if err := rows.Scan(&rate.From, &rate.To, &rate.Month, &rate.Rate); err != nil {
+			return nil, err
+		}
+		rates = append(rates, rate)
+	}
+
+	return rates, rows.Err()
+}
+
+// AddPause bumps the version and inserts the pause in one transaction
+func (db *SQLiteDB) AddPause(ctx context.Context, id string, pause Pause) (string, int, error) {
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	defer tx.Rollback()
+
+	var version int
+	err = tx.QueryRowContext(ctx, "UPDATE subs SET version=version+1 WHERE sub_id=? RETURNING version", id).Scan(&version)
+	if err == sql.ErrNoRows {
+		return "", 0, ErrNotFound
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	pause.ID = uuid.NewString()
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO sub_pauses (pause_id, sub_id, start_date, end_date) VALUES (?, ?, ?, ?)",
+		pause.ID, id, isoDay(pause.Start, false), isoDay(pause.End, true))
+	if err != nil {
+		return "", 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", 0, err
+	}
+
+	return pause.ID, version, nil
+}
+
+func (db *SQLiteDB) DeletePause(ctx context.Context, id string, pause_id string) (int, error) {
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM sub_pauses WHERE sub_id=? AND pause_id=?", id, pause_id)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, ErrNotFound
+	}
+
+	var version int
+	if err := tx.QueryRowContext(ctx, "UPDATE subs SET version=version+1 WHERE sub_id=? RETURNING version", id).Scan(&version); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// subExists turns a read of the prices of a sub that matched no row into
+// ErrNotFound when the sub is missing
+func (db *SQLiteDB) subExists(ctx context.Context, id string) error {
+
+	var exists bool
+	if err := db.conn.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM subs WHERE sub_id=?)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) SetPrice(ctx context.Context, id string, price SubPrice) error {
+
+	// the WHERE clause also tells the upsert clause apart from a join constraint
+	res, err := db.conn.ExecContext(ctx,
+		"INSERT INTO sub_prices (sub_id, effective_from, price) SELECT ?, ?, ? WHERE EXISTS (SELECT 1 FROM subs WHERE sub_id=?) ON CONFLICT (sub_id, effective_from) DO UPDATE SET price=excluded.price",
+		id, sqliteDate(price.Effective_From), int64(price.Price), id)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) DeletePrice(ctx context.Context, id string, month string) error {
+
+	res, err := db.conn.ExecContext(ctx,
+		"DELETE FROM sub_prices WHERE sub_id=? AND effective_from=?", id, sqliteDate(month))
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) ListPrices(ctx context.Context, id string) ([]SubPrice, error) {
+
+	rows, err := db.conn.QueryContext(ctx,
+		"SELECT strftime('%m-%Y', effective_from), price FROM sub_prices WHERE sub_id=? ORDER BY effective_from", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var prices []SubPrice
+	for rows.Next() {
+		var price SubPrice
+		if err := rows.Scan(&price.Effective_From, &price.Price); err != nil {
+			return nil, err
+		}
+		prices = append(prices, price)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(prices) == 0 {
+		if err := db.subExists(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	return prices, nil
+}
+
+func (db *SQLiteDB) SetMember(ctx context.Context, id string, member Member) error {
+
+	res, err := db.conn.ExecContext(ctx,
+		"INSERT INTO sub_members (sub_id, user_id, percent, amount) SELECT ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM subs WHERE sub_id=?) ON CONFLICT (sub_id, user_id) DO UPDATE SET percent=excluded.percent, amount=excluded.amount",
+		id, member.User_ID, member.Percent, int64(member.Amount), id)
+	if err != nil {
+		return sqliteUserError(err)
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) DeleteMember(ctx context.Context, id string, user_id string) error {
+
+	res, err := db.conn.ExecContext(ctx,
+		"DELETE FROM sub_members WHERE sub_id=? AND user_id=?", id, user_id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) ListMembers(ctx context.Context, id string) ([]Member, error) {
+
+	rows, err := db.conn.QueryContext(ctx,
+		"SELECT user_id, percent, amount FROM sub_members WHERE sub_id=? ORDER BY user_id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []Member
+	for rows.Next() {
+		var member Member
+		if err := rows.Scan(&member.User_ID, &member.Percent, &member.Amount); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(members) == 0 {
+		if err := db.subExists(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	return members, nil
+}
+
+const sqliteServiceColumns = "service_id, name, aliases, default_price, currency, category"
+
+func scanSQLiteService(row interface{ Scan(...any) error }) (Service, error) {
+
+	var svc Service
+	var aliases string
+	if err := row.Scan(&svc.ID, &svc.Name, &aliases, &svc.Default_Price, &svc.Currency, &svc.Category); err != nil {
+		return svc, err
+	}
+
+	return svc, json.Unmarshal([]byte(aliases), &svc.Aliases)
+}
+
+// setServiceNames replaces the keys of svc in service_names, failing with
+// ErrServiceConflict when another service holds one
+func setServiceNames(ctx context.Context, tx *sql.Tx, svc Service) error {
+
+	keys, _ := json.Marshal(serviceKeys(svc))
+
+	var taken bool
+	err := tx.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM service_names WHERE name_key IN (SELECT value FROM json_each(?)) AND service_id<>?)", string(keys), svc.ID).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrServiceConflict
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM service_names WHERE service_id=?", svc.ID); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO service_names (name_key, service_id) SELECT DISTINCT value, ? FROM json_each(?)", svc.ID, string(keys))
+
+	return err
+}
+
+// renameService resolves the subs of keys to svc like serviceCatalog.resolve,
+// bumping their versions, and renames the budgets of keys
+func renameService(ctx context.Context, tx *sql.Tx, svc Service, keys []string) error {
+
+	list, _ := json.Marshal(keys)
+	_, err := tx.ExecContext(ctx,
+		"UPDATE subs SET service_name=?, category=CASE WHEN category='' THEN ? ELSE category END, version=version+1"+
+			" WHERE service_name COLLATE service_key IN (SELECT value FROM json_each(?)) AND (service_name<>? OR (category='' AND ?<>''))",
+		svc.Name, svc.Category, string(list), svc.Name, svc.Category)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE budgets SET service_name=? WHERE service_name COLLATE service_key IN (SELECT value FROM json_each(?)) AND service_name<>?"+
+			" AND NOT EXISTS (SELECT 1 FROM budgets o WHERE o.user_id=budgets.user_id AND o.budget_id<>budgets.budget_id AND o.service_name COLLATE service_key IN (SELECT value FROM json_each(?)))",
+		svc.Name, string(list), svc.Name, string(list))
+
+	return err
+}
+
+func (db *SQLiteDB) CreateService(ctx context.Context, svc Service) (string, error) {
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	svc = normalizeService(svc)
+	svc.ID = uuid.NewString()
+	aliases, _ := json.Marshal(svc.Aliases)
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO services ("+sqliteServiceColumns+") VALUES (?, ?, ?, ?, ?, ?)",
+		svc.ID, svc.Name, string(aliases), int64(svc.Default_Price), svc.Currency, svc.Category)
+	if err != nil {
+		return "", err
+	}
+
+	if err := setServiceNames(ctx, tx, svc); err != nil {
+		return "", err
+	}
+
+	if err := renameService(ctx, tx, svc, renameKeys(svc, "")); err != nil {
+		return "", err
+	}
+
+	return svc.ID, tx.Commit()
+}
+
+func (db *SQLiteDB) ReadService(ctx context.Context, id string) (Service, error) {
+
+	svc, err := scanSQLiteService(db.conn.QueryRowContext(ctx,
+		"SELECT "+sqliteServiceColumns+" FROM services WHERE service_id=?", id))
+	if err == sql.ErrNoRows {
+		return Service{}, ErrNotFound
+	}
+
+	return svc, err
+}
+
+func (db *SQLiteDB) UpdateService(ctx context.Context, id string, svc Service) error {
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	svc = normalizeService(svc)
+	svc.ID = id
+	aliases, _ := json.Marshal(svc.Aliases)
+
+	var old_name string
+	err = tx.QueryRowContext(ctx, "SELECT name FROM services WHERE service_id=?", id).Scan(&old_name)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE services SET name=?, aliases=?, default_price=?, currency=?, category=? WHERE service_id=?",
+		svc.Name, string(aliases), int64(svc.Default_Price), svc.Currency, svc.Category, id)
+	if err != nil {
+		return err
+	}
+
+	if err := setServiceNames(ctx, tx, svc); err != nil {
+		return err
+	}
+
+	if err := renameService(ctx, tx, svc, renameKeys(svc, old_name)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) DeleteService(ctx context.Context, id string) error {
+
+	res, err := db.conn.ExecContext(ctx, "DELETE FROM services WHERE service_id=?", id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) ListServices(ctx context.Context) ([]Service, error) {
+
+	rows, err := db.conn.QueryContext(ctx,
+		"SELECT "+sqliteServiceColumns+" FROM services ORDER BY name, service_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var services []Service
+	for rows.Next() {
+		svc, err := scanSQLiteService(rows)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, svc)
+	}
+
+	return services, rows.Err()
+}
+
+const sqliteUserColumns = "user_id, display_name, email, default_currency, timezone"
+
+func scanSQLiteUser(row interface{ Scan(...any) error }) (User, error) {
+
+	var user User
+	err := row.Scan(&user.ID, &user.Display_Name, &user.Email, &user.Default_Currency, &user.Timezone)
+
+	return user, err
+}
+
+func (db *SQLiteDB) CreateUser(ctx context.Context, user User) (string, error) {
+
+	user = normalizeUser(user)
+	if user.ID == "" {
+		user.ID = uuid.NewString()
+	}
+
+	res, err := db.conn.ExecContext(ctx,
+		"INSERT INTO users ("+sqliteUserColumns+") VALUES (?, ?, ?, ?, ?) ON CONFLICT (user_id) DO NOTHING",
+		user.ID, user.Display_Name, user.Email, user.Default_Currency, user.Timezone)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", ErrUserConflict
+	}
+
+	return user.ID, nil
+}
+
+func (db *SQLiteDB) ReadUser(ctx context.Context, id string) (User, error) {
+
+	user, err := scanSQLiteUser(db.conn.QueryRowContext(ctx,
+		"SELECT "+sqliteUserColumns+" FROM users WHERE user_id=?", id))
+	if err == sql.ErrNoRows {
+		return User{}, ErrNotFound
+	}
+
+	return user, err
+}
+
+func (db *SQLiteDB) UpdateUser(ctx context.Context, id string, user User) error {
+
+	user = normalizeUser(user)
+	res, err := db.conn.ExecContext(ctx,
+		"UPDATE users SET display_name=?, email=?, default_currency=?, timezone=? WHERE user_id=?",
+		user.Display_Name, user.Email, user.Default_Currency, user.Timezone, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// DeleteUser deletes the subs and shares of a cascading delete before the
+// user, the users_delete trigger refuses it while they own subs
+func (db *SQLiteDB) DeleteUser(ctx context.Context, id string, cascade bool) error {
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists, used bool
+	err = tx.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM users WHERE user_id=?), EXISTS (SELECT 1 FROM subs WHERE user_id=?) OR EXISTS (SELECT 1 FROM sub_members WHERE user_id=?)",
+		id, id, id).Scan(&exists, &used)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	if used && !cascade {
+		return ErrUserInUse
+	}
+
+	if used {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM sub_members WHERE user_id=?", id); err != nil {
+			return err
+		}
+		// the delete triggers of subs remove their prices, pauses and members
+		if _, err := tx.ExecContext(ctx, "DELETE FROM subs WHERE user_id=?", id); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM users WHERE user_id=?", id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) ListUsers(ctx context.Context) ([]User, error) {
+
+	rows, err := db.conn.QueryContext(ctx,
+		"SELECT "+sqliteUserColumns+" FROM users ORDER BY user_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		user, err := scanSQLiteUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+const sqliteBudgetColumns = "budget_id, user_id, monthly_limit, currency, category, service_name"
+
+func scanSQLiteBudget(row interface{ Scan(...any) error }) (Budget, error) {
+
+	var budget Budget
+	err := row.Scan(&budget.ID, &budget.User_ID, &budget.Monthly_Limit, &budget.Currency, &budget.Category, &budget.Service)
+
+	return budget, err
+}
+
+// sqliteBudgetConflict fails with ErrBudgetConflict when another budget of the
+// user has the scope of budget, like the budgets_scope index would
+func sqliteBudgetConflict(ctx context.Context, tx *sql.Tx, budget Budget) error {
+
+	var taken bool
+	err := tx.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM budgets WHERE user_id=? AND category=? AND service_name=? COLLATE service_key AND budget_id<>?)",
+		budget.User_ID, budget.Category, budget.Service, budget.ID).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrBudgetConflict
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) CreateBudget(ctx context.Context, budget Budget) (string, error) {
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	budget = normalizeBudget(budget)
+	budget.ID = uuid.NewString()
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE user_id=?)", budget.User_ID).Scan(&exists); err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", ErrNotFound
+	}
+
+	if err := sqliteBudgetConflict(ctx, tx, budget); err != nil {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO budgets ("+sqliteBudgetColumns+") VALUES (?, ?, ?, ?, ?, ?)",
+		budget.ID, budget.User_ID, int64(budget.Monthly_Limit), budget.Currency, budget.Category, budget.Service)
+	if err != nil {
+		return "", err
+	}
+
+	return budget.ID, tx.Commit()
+}
+
+func (db *SQLiteDB) UpdateBudget(ctx context.Context, budget Budget) error {
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	budget = normalizeBudget(budget)
+	if err := sqliteBudgetConflict(ctx, tx, budget); err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx,
+		"UPDATE budgets SET monthly_limit=?, currency=?, category=?, service_name=? WHERE budget_id=? AND user_id=?",
+		int64(budget.Monthly_Limit), budget.Currency, budget.Category, budget.Service, budget.ID, budget.User_ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) DeleteBudget(ctx context.Context, user_id string, id string) error {
+
+	res, err := db.conn.ExecContext(ctx, "DELETE FROM budgets WHERE budget_id=? AND user_id=?", id, user_id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) ListBudgets(ctx context.Context, user_id string) ([]Budget, error) {
+
+	rows, err := db.conn.QueryContext(ctx,
+		"SELECT "+sqliteBudgetColumns+" FROM budgets WHERE (?='' OR user_id=?) ORDER BY category, service_name, budget_id", user_id, user_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var budgets []Budget
+	for rows.Next() {
+		budget, err := scanSQLiteBudget(rows)
+		if err != nil {
+			return nil, err
+		}
+		budgets = append(budgets, budget)
+	}
+
+	return budgets, rows.Err()
+}
+
+// Trials selects the subs with a trial and filters their trial ends in Go, as
+// sqlite overflows month ends when adding months to a date
+func (db *SQLiteDB) Trials(ctx context.Context, user_id string, from string, to string) ([]Trial, error) {
+
+	rows, err := db.conn.QueryContext(ctx,
+		"SELECT "+sqliteSubColumns+" FROM subs WHERE trial_months>0 AND (?='' OR user_id=?) AND start_date<=?",
+		user_id, user_id, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []Sub
+	for rows.Next() {
+		sub, err := scanSQLiteSub(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return endingTrials(subs, from, to), nil
+}
+
+func (db *SQLiteDB) Close() error {
+	return db.conn.Close()
+}
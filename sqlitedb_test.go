@@ -0,0 +1,24 @@
+package subs
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteDBReopen(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "subs.db")
+
+	d, err := NewSQLiteDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	// migrations already applied
+	d, err = NewSQLiteDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+}
@@ -2,11 +2,18 @@ package subs
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"iter"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
@@ -21,26 +28,322 @@ import (
 var db DB
 var logger *log.Logger = log.Default()
 
+// upper bound for db calls of a single request, exceeding it responds with 504
+var queryTimeout = 5 * time.Second
+
+// how long the first response to a request with an Idempotency-Key is replayed
+var idempotencyTTL = 24 * time.Hour
+
 var ErrNotFound = errors.New("not found in db")
+var ErrVersionMismatch = errors.New("version mismatch")
+
+const maxIdempotencyKeyLen = 255
+
+const defaultListLimit = 100
+const maxListLimit = 1000
 
+// streamed responses are flushed every this many rows
+const streamFlushRows = 100
+
+// Versioned writes fail with ErrVersionMismatch unless version is 0 or current.
 type DB interface {
-	Create(sub Sub) (string, error)
-	Read(id string) (Sub, error)
-	Update(id string, sub Sub) error
-	Delete(id string) error
-	List() ([]Sub, error)
-	Sum(filter Sub) (int, error)
+	Create(ctx context.Context, sub Sub) (string, error)
+	Read(ctx context.Context, id string) (Sub, error)
+	Update(ctx context.Context, id string, sub Sub, version int) (int, error)
+	Patch(ctx context.Context, id string, patch SubPatch, version int) (int, error)
+	Delete(ctx context.Context, id string, version int) error
+	List(ctx context.Context, q ListQuery) (SubPage, error)
+	// Iter yields the subs of q in order, an error ends it.
+	Iter(ctx context.Context, q ListQuery) iter.Seq2[Sub, error]
+	// Sum adds up the charges of filter like sumCharges.
+	Sum(ctx context.Context, filter Sub) (Money, error)
+	// SumGroups splits Sum by a sumGroupBy dimension, ordered by group.
+	SumGroups(ctx context.Context, filter Sub, group_by string) ([]SumGroup, error)
+
+	// Batch applies ops in one transaction, reporting errors per op.
+	Batch(ctx context.Context, ops []BatchOp, atomic bool) ([]BatchResult, error)
+
+	// ReserveKey returns the unexpired record of a key with true, or reserves it.
+	ReserveKey(ctx context.Context, key string, hash string, ttl time.Duration) (IdempotencyRecord, bool, error)
+	CompleteKey(ctx context.Context, key string, status int, body []byte) error
+	ReleaseKey(ctx context.Context, key string) error
+
+	// SetRate adds or replaces the rate of a pair from its month on.
+	SetRate(ctx context.Context, rate FXRate) error
+	DeleteRate(ctx context.Context, from string, to string, month string) error
+	ListRates(ctx context.Context, from string, to string) ([]FXRate, error)
+
+	// Trials lists the subs whose trial ends from from to to, by that day.
+	Trials(ctx context.Context, user_id string, from string, to string) ([]Trial, error)
+
+	// AddPause and DeletePause return the new version of the sub.
+	AddPause(ctx context.Context, id string, pause Pause) (string, int, error)
+	DeletePause(ctx context.Context, id string, pause_id string) (int, error)
+
+	// SetPrice replaces the price of the same month, ListPrices orders by month.
+	SetPrice(ctx context.Context, id string, price SubPrice) error
+	DeletePrice(ctx context.Context, id string, month string) error
+	ListPrices(ctx context.Context, id string) ([]SubPrice, error)
+
+	// SetMember adds or replaces a share, ListMembers orders by user id.
+	SetMember(ctx context.Context, id string, member Member) error
+	DeleteMember(ctx context.Context, id string, user_id string) error
+	ListMembers(ctx context.Context, id string) ([]Member, error)
+
+	// Service writes fail with ErrServiceConflict on a name key of another entry.
+	CreateService(ctx context.Context, svc Service) (string, error)
+	ReadService(ctx context.Context, id string) (Service, error)
+	UpdateService(ctx context.Context, id string, svc Service) error
+	DeleteService(ctx context.Context, id string) error
+	ListServices(ctx context.Context) ([]Service, error)
+
+	// DeleteUser fails with ErrUserInUse while the user has subs, unless cascade.
+	CreateUser(ctx context.Context, user User) (string, error)
+	ReadUser(ctx context.Context, id string) (User, error)
+	UpdateUser(ctx context.Context, id string, user User) error
+	DeleteUser(ctx context.Context, id string, cascade bool) error
+	ListUsers(ctx context.Context) ([]User, error)
+
+	// Budget writes fail with ErrBudgetConflict on a taken scope, ListBudgets of "" lists all.
+	CreateBudget(ctx context.Context, budget Budget) (string, error)
+	UpdateBudget(ctx context.Context, budget Budget) error
+	DeleteBudget(ctx context.Context, user_id string, id string) error
+	ListBudgets(ctx context.Context, user_id string) ([]Budget, error)
 
 	Close() error
 }
 
+// IdempotencyRecord is the first response to a request with an Idempotency-Key,
+// Hash fingerprints that request. Status is 0 while the request is in progress.
+type IdempotencyRecord struct {
+	Hash   string
+	Status int
+	Body   []byte
+}
+
 type Sub struct {
-	ID      string  `json:"sub_id"`
-	Service string  `json:"service_name"`
-	Price   int     `json:"price"`
-	User_ID string  `json:"user_id"`
-	Start   string  `json:"start_date"`
-	End     *string `json:"end_date"`
+	ID       string  `json:"sub_id"`
+	Service  string  `json:"service_name"`
+	Price    Money   `json:"price"`
+	User_ID  string  `json:"user_id"`
+	Start    string  `json:"start_date"`
+	End      *string `json:"end_date"`
+	Currency string  `json:"currency"`
+
+	Billing_Period   string `json:"billing_period"`
+	Billing_Interval int    `json:"billing_interval"`
+	Anchor           string `json:"anchor_date"`
+
+	Trial_Months int   `json:"trial_months"`
+	Intro_Price  Money `json:"intro_price"`
+	Intro_Months int   `json:"intro_months"`
+
+	Category string   `json:"category"`
+	Tags     []string `json:"tags"`
+
+	// All_Tags only applies to a filter, which then matches the subs with
+	// every one of its Tags instead of any
+	All_Tags bool `json:"-"`
+
+	// Pauses are only read by DB.Read and written on their own
+	Pauses []Pause `json:"pauses,omitempty"`
+
+	Version int `json:"version"`
+}
+
+// prices without a currency predate multi-currency support, they were all in rubles
+const defaultCurrency = "RUB"
+
+// UnmarshalJSON defaults a missing or empty currency to defaultCurrency and
+// normalizes the dates and billing fields
+func (s *Sub) UnmarshalJSON(b []byte) error {
+
+	type plain Sub
+	var v plain
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	if v.Currency == "" {
+		v.Currency = defaultCurrency
+	}
+
+	*s = normalizeSub(Sub(v))
+	return nil
+}
+
+// normalizeSub writes the dates and tags of sub in their canonical form and
+// fills in its billing defaults
+func normalizeSub(sub Sub) Sub {
+
+	sub.Category = strings.TrimSpace(sub.Category)
+	sub.Tags = normalizeTags(sub.Tags)
+
+	sub.Start = canonicalDate(sub.Start, false)
+	if sub.End != nil {
+		end := canonicalDate(*sub.End, true)
+		sub.End = &end
+	}
+
+	return withBillingDefaults(sub)
+}
+
+// SubPatch is a parsed JSON merge patch, nil fields are left unchanged.
+// End is only written when SetEnd is true, a nil End then reopens the sub.
+type SubPatch struct {
+	Service  *string
+	Price    *Money
+	User_ID  *string
+	Start    *string
+	End      *string
+	SetEnd   bool
+	Currency *string
+
+	Billing_Period   *string
+	Billing_Interval *int
+	Anchor           *string
+
+	Trial_Months *int
+	Intro_Price  *Money
+	Intro_Months *int
+
+	Category *string
+	Tags     *[]string
+}
+
+func (p SubPatch) Empty() bool {
+	return p.Service == nil && p.Price == nil && p.User_ID == nil && p.Start == nil && !p.SetEnd && p.Currency == nil &&
+		p.Billing_Period == nil && p.Billing_Interval == nil && p.Anchor == nil &&
+		p.Trial_Months == nil && p.Intro_Price == nil && p.Intro_Months == nil &&
+		p.Category == nil && p.Tags == nil
+}
+
+// ListQuery filters a subscription listing. Empty fields don't filter,
+// User_ID selects the subscriptions a user owns or is a member of, From and
+// To select subscriptions active at any point in the period. Tags selects
+// the subscriptions with any of them, or all of them with AllTags.
+// Sort is a sort key optionally prefixed with "-" for descending order,
+// After is a cursor returned in a previous SubPage. Limit <= 0 means no limit.
+type ListQuery struct {
+	User_ID  string
+	Service  string
+	From     string
+	To       string
+	MinPrice *Money
+	MaxPrice *Money
+	Category string
+	Tags     []string
+	AllTags  bool
+	Sort     string
+	Limit    int
+	After    string
+}
+
+type SubPage struct {
+	Subs        []Sub  `json:"subs"`
+	Next_Cursor string `json:"next_cursor,omitempty"`
+}
+
+// SumGroup is the sum of a single service, user, MM-YYYY month, category or
+// tag
+type SumGroup struct {
+	Group string `json:"group"`
+	Sum   Money  `json:"sum"`
+}
+
+var sumGroupBy = map[string]bool{
+	"service_name": true,
+	"user_id":      true,
+	"month":        true,
+	"category":     true,
+	"tag":          true,
+}
+
+// upper bound of the period of a sum grouped by month, one group per month
+const maxSumMonths = 1200
+
+// keyset pagination position: sort key value and id of the last returned sub
+type cursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   string `json:"id"`
+}
+
+var sortKeys = map[string]bool{
+	"sub_id":       true,
+	"service_name": true,
+	"price":        true,
+	"start_date":   true,
+}
+
+func sortKey(sort string) (string, bool) {
+
+	if sort == "" {
+		return "sub_id", false
+	}
+
+	if key, ok := strings.CutPrefix(sort, "-"); ok {
+		return key, true
+	}
+
+	return sort, false
+}
+
+func subSortValue(sub Sub, key string) string {
+
+	switch key {
+	case "service_name":
+		return sub.Service
+	case "price":
+		return strconv.FormatInt(int64(sub.Price), 10)
+	case "start_date":
+		return sub.Start
+	}
+
+	return sub.ID
+}
+
+func encodeCursor(sort string, last Sub) string {
+
+	key, _ := sortKey(sort)
+	b, _ := json.Marshal(cursor{Sort: sort, Key: subSortValue(last, key), ID: last.ID})
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(sort string, s string) (cursor, error) {
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, err
+	}
+
+	var c cursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return cursor{}, err
+	}
+
+	if c.Sort != sort {
+		return cursor{}, errors.New("cursor sort mismatch")
+	}
+
+	if err := uuid.Validate(c.ID); err != nil {
+		return cursor{}, err
+	}
+
+	key, _ := sortKey(sort)
+	switch key {
+	case "price":
+		if _, err := strconv.ParseInt(c.Key, 10, 64); err != nil {
+			return cursor{}, err
+		}
+	case "start_date":
+		if err := validateSubDate(c.Key); err != nil {
+			return cursor{}, err
+		}
+	}
+
+	return c, nil
 }
 
 func (s Sub) String() string {
@@ -56,6 +359,33 @@ func (s Sub) String() string {
 		str += ", End: " + *s.End
 	}
 
+	if s.Currency != "" {
+		str += ", Currency: " + s.Currency
+	}
+
+	if s.Billing_Period != "" {
+		str += fmt.Sprintf(", Billing: %v x%v from %v", s.Billing_Period, s.Billing_Interval, s.Anchor)
+	}
+
+	if s.Trial_Months != 0 {
+		str += fmt.Sprintf(", Trial: %v months", s.Trial_Months)
+	}
+
+	if s.Intro_Months != 0 {
+		str += fmt.Sprintf(", Intro: %v for %v months", s.Intro_Price, s.Intro_Months)
+	}
+
+	if s.Category != "" {
+		str += ", Category: " + s.Category
+	}
+
+	if len(s.Tags) != 0 {
+		str += fmt.Sprintf(", Tags: %v", s.Tags)
+		if s.All_Tags {
+			str += " (all)"
+		}
+	}
+
 	str += "}"
 
 	return str
@@ -85,9 +415,100 @@ func validateDate(date string) error {
 	return nil
 }
 
+// validateDay checks a YYYY-MM-DD date in the years of MM-YYYY dates
+func validateDay(date string) error {
+
+	t, err := time.Parse(time.DateOnly, date)
+	if err != nil || t.Year() < 1970 {
+		return errors.New("invalid date string")
+	}
+
+	return nil
+}
+
+// validateSubDate accepts the start or end of a sub as a MM-YYYY month or a
+// YYYY-MM-DD day
+func validateSubDate(date string) error {
+
+	if len(date) == len(time.DateOnly) {
+		return validateDay(date)
+	}
+
+	return validateDate(date)
+}
+
+// monthIndex maps a valid MM-YYYY or YYYY-MM-DD date to a month count for
+// comparisons
+func monthIndex(date string) int {
+
+	if len(date) == len(time.DateOnly) {
+		y, _ := strconv.Atoi(date[:4])
+		m, _ := strconv.Atoi(date[5:7])
+		return y*12 + m - 1
+	}
+
+	m, _ := strconv.Atoi(date[:2])
+	y, _ := strconv.Atoi(date[3:])
+
+	return y*12 + m - 1
+}
+
+// startDay is the dayIndex of a valid sub start date, the first day of a month
+func startDay(date string) int {
+
+	if len(date) == len(time.DateOnly) {
+		t, _ := time.Parse(time.DateOnly, date)
+		return dayIndex(t)
+	}
+
+	return monthDay(monthIndex(date))
+}
+
+// endDay is the dayIndex of a valid sub end date, the last day of a month
+func endDay(date string) int {
+
+	if len(date) == len(time.DateOnly) {
+		return startDay(date)
+	}
+
+	return monthDay(monthIndex(date)+1) - 1
+}
+
+// isoDay is the YYYY-MM-DD day of a valid sub start or end date
+func isoDay(date string, end bool) string {
+
+	if end {
+		return dayDate(endDay(date))
+	}
+
+	return dayDate(startDay(date))
+}
+
+// canonicalDate writes a sub start or end date as a MM-YYYY month when it
+// falls on the first or last day of the month, so dates are stored and read
+// back alike whichever form a client sent. Invalid dates are left as they are.
+func canonicalDate(date string, end bool) string {
+
+	if validateDay(date) != nil {
+		return date
+	}
+
+	day, month := startDay(date), monthIndex(date)
+	if !end && day == monthDay(month) || end && day == monthDay(month+1)-1 {
+		return monthDate(month)
+	}
+
+	return date
+}
+
+// monthDate is the MM-YYYY date of a monthIndex
+func monthDate(index int) string {
+	return fmt.Sprintf("%02d-%04d", index%12+1, index/12)
+}
+
 func validateSub(sub Sub) error {
 
-	if sub.Service == "" {
+	if strings.TrimSpace(sub.Service) == "" {
 		return errors.New("empty service name")
 	}
 
@@ -95,23 +516,203 @@ func validateSub(sub Sub) error {
 		return errors.New("invalid price")
 	}
 
+	if sub.Price > maxPrice {
+		return errors.New("price too large")
+	}
+
 	if err := uuid.Validate(sub.User_ID); err != nil {
 		return fmt.Errorf("invalid user id: %w", err)
 	}
 
-	if err := validateDate(sub.Start); err != nil {
+	if err := validateSubDate(sub.Start); err != nil {
 		return errors.New("invalid start period")
 	}
 
 	if sub.End != nil {
-		if err := validateDate(*sub.End); err != nil {
+		if err := validateSubDate(*sub.End); err != nil {
 			return errors.New("invalid end period")
 		}
 	}
 
+	if err := validateCurrency(sub.Currency); err != nil {
+		return err
+	}
+
+	if err := validateBilling(sub); err != nil {
+		return err
+	}
+
+	if err := validatePromo(sub); err != nil {
+		return err
+	}
+
+	if err := validateLabels(sub.Category, sub.Tags); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// parseMergePatch reads an RFC 7386 merge patch of a Sub
+func parseMergePatch(body []byte) (SubPatch, error) {
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return SubPatch{}, errors.New("json error")
+	}
+
+	var p SubPatch
+	for name, raw := range fields {
+
+		null := string(raw) == "null"
+		if null && name != "end_date" {
+			return SubPatch{}, fmt.Errorf("%v can't be removed", name)
+		}
+
+		var err error
+		switch name {
+		case "service_name":
+			err = json.Unmarshal(raw, &p.Service)
+		case "price":
+			err = json.Unmarshal(raw, &p.Price)
+		case "user_id":
+			err = json.Unmarshal(raw, &p.User_ID)
+		case "start_date":
+			err = json.Unmarshal(raw, &p.Start)
+			if err == nil {
+				*p.Start = canonicalDate(*p.Start, false)
+			}
+		case "end_date":
+			p.SetEnd = true
+			err = json.Unmarshal(raw, &p.End)
+			if err == nil && p.End != nil {
+				*p.End = canonicalDate(*p.End, true)
+			}
+		case "currency":
+			err = json.Unmarshal(raw, &p.Currency)
+		case "billing_period":
+			err = json.Unmarshal(raw, &p.Billing_Period)
+		case "billing_interval":
+			err = json.Unmarshal(raw, &p.Billing_Interval)
+		case "anchor_date":
+			err = json.Unmarshal(raw, &p.Anchor)
+		case "trial_months":
+			err = json.Unmarshal(raw, &p.Trial_Months)
+		case "intro_price":
+			err = json.Unmarshal(raw, &p.Intro_Price)
+		case "intro_months":
+			err = json.Unmarshal(raw, &p.Intro_Months)
+		case "category":
+			err = json.Unmarshal(raw, &p.Category)
+			if err == nil {
+				*p.Category = strings.TrimSpace(*p.Category)
+			}
+		case "tags":
+			err = json.Unmarshal(raw, &p.Tags)
+			if err == nil {
+				*p.Tags = normalizeTags(*p.Tags)
+			}
+		default:
+			return SubPatch{}, fmt.Errorf("unknown field %v", name)
+		}
+		if err != nil {
+			return SubPatch{}, fmt.Errorf("invalid %v", name)
+		}
+	}
+
+	return p, nil
+}
+
+func applyPatch(sub Sub, p SubPatch) Sub {
+
+	if p.Service != nil {
+		sub.Service = *p.Service
+	}
+	if p.Price != nil {
+		sub.Price = *p.Price
+	}
+	if p.User_ID != nil {
+		sub.User_ID = *p.User_ID
+	}
+	if p.Start != nil {
+		sub.Start = *p.Start
+	}
+	if p.SetEnd {
+		sub.End = p.End
+	}
+	if p.Currency != nil {
+		sub.Currency = *p.Currency
+	}
+	if p.Billing_Period != nil {
+		sub.Billing_Period = *p.Billing_Period
+	}
+	if p.Billing_Interval != nil {
+		sub.Billing_Interval = *p.Billing_Interval
+	}
+	if p.Anchor != nil {
+		sub.Anchor = *p.Anchor
+	}
+	if p.Trial_Months != nil {
+		sub.Trial_Months = *p.Trial_Months
+	}
+	if p.Intro_Price != nil {
+		sub.Intro_Price = *p.Intro_Price
+	}
+	if p.Intro_Months != nil {
+		sub.Intro_Months = *p.Intro_Months
+	}
+	if p.Category != nil {
+		sub.Category = *p.Category
+	}
+	if p.Tags != nil {
+		sub.Tags = *p.Tags
+	}
+
+	return sub
+}
+
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// matchETag reports if an If-Match or If-None-Match header lists the version.
+// If-None-Match compares weakly and so ignores the W/ prefix.
+func matchETag(header string, version int, weak bool) bool {
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ifMatchVersion resolves the If-Match header of a write to the version it is
+// conditioned on, 0 without the header
+func ifMatchVersion(ctx context.Context, r *http.Request, id string) (int, error) {
+
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return 0, nil
+	}
+
+	sub, err := db.Read(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	if !matchETag(header, sub.Version, false) {
+		return 0, ErrVersionMismatch
+	}
+
+	return sub.Version, nil
+}
+
 func validateFilter(filter Sub) error {
 
 	if filter.User_ID != "" {
@@ -132,9 +733,169 @@ func validateFilter(filter Sub) error {
 		return errors.New("invalid end period")
 	}
 
+	if filter.Currency != "" {
+		if err := validateCurrency(filter.Currency); err != nil {
+			return err
+		}
+	}
+
+	if err := validateLabels(filter.Category, filter.Tags); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func parseListQuery(v url.Values) (ListQuery, error) {
+
+	q := ListQuery{
+		User_ID:  v.Get("user_id"),
+		Service:  v.Get("service_name"),
+		From:     v.Get("from"),
+		To:       v.Get("to"),
+		Category: v.Get("category"),
+		Sort:     v.Get("sort"),
+		Limit:    defaultListLimit,
+		After:    v.Get("after"),
+	}
+
+	var err error
+	if q.Tags, q.AllTags, err = parseTagFilter(v); err != nil {
+		return q, err
+	}
+
+	if s := v.Get("min_price"); s != "" {
+		p, err := parseMoney(s)
+		if err != nil {
+			return q, errors.New("invalid min price")
+		}
+		q.MinPrice = &p
+	}
+
+	if s := v.Get("max_price"); s != "" {
+		p, err := parseMoney(s)
+		if err != nil {
+			return q, errors.New("invalid max price")
+		}
+		q.MaxPrice = &p
+	}
+
+	if s := v.Get("limit"); s != "" {
+		l, err := strconv.Atoi(s)
+		if err != nil {
+			return q, errors.New("invalid limit")
+		}
+		q.Limit = l
+	}
+
+	return q, validateListQuery(q)
+}
+
+func validateListQuery(q ListQuery) error {
+
+	if q.User_ID != "" {
+		if err := uuid.Validate(q.User_ID); err != nil {
+			return fmt.Errorf("invalid user id: %w", err)
+		}
+	}
+
+	if q.From != "" {
+		if err := validateDate(q.From); err != nil {
+			return errors.New("invalid from period")
+		}
+	}
+
+	if q.To != "" {
+		if err := validateDate(q.To); err != nil {
+			return errors.New("invalid to period")
+		}
+	}
+
+	if q.From != "" && q.To != "" && monthIndex(q.From) > monthIndex(q.To) {
+		return errors.New("invalid period")
+	}
+
+	if q.MinPrice != nil && *q.MinPrice < 0 {
+		return errors.New("invalid min price")
+	}
+
+	if q.MaxPrice != nil && *q.MaxPrice < 0 {
+		return errors.New("invalid max price")
+	}
+
+	if q.MinPrice != nil && q.MaxPrice != nil && *q.MinPrice > *q.MaxPrice {
+		return errors.New("invalid price range")
+	}
+
+	if err := validateLabels(q.Category, q.Tags); err != nil {
+		return err
+	}
+
+	if key, _ := sortKey(q.Sort); !sortKeys[key] {
+		return errors.New("invalid sort")
+	}
+
+	if q.Limit < 1 || q.Limit > maxListLimit {
+		return errors.New("invalid limit")
+	}
+
+	if q.After != "" {
+		if _, err := decodeCursor(q.Sort, q.After); err != nil {
+			return errors.New("invalid cursor")
+		}
+	}
+
 	return nil
 }
 
+// requestHash fingerprints a decoded request body, so that formatting
+// differences don't count as a different request for the same idempotency key
+func requestHash(req any) string {
+
+	b, _ := json.Marshal(req)
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// replayResponse answers a request whose idempotency key is already reserved
+func replayResponse(w http.ResponseWriter, op string, key string, hash string, rec IdempotencyRecord) {
+
+	if rec.Hash != hash {
+		logger.Printf("%s: resp 422: idempotency key %v reused with a different request", op, key)
+		http.Error(w, "idempotency key reused with a different request", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if rec.Status == 0 {
+		logger.Printf("%s: resp 409: idempotency key %v in progress", op, key)
+		http.Error(w, "request with this idempotency key in progress", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	// only creates complete keys, and a created sub is at version 1
+	if rec.Status == http.StatusCreated {
+		w.Header().Set("ETag", etag(1))
+	}
+	w.WriteHeader(rec.Status)
+	w.Write(rec.Body)
+	logger.Printf("%s: resp %d replayed for idempotency key %v", op, rec.Status, key)
+}
+
+// releaseKey drops the reservation of a failed request, even after its own
+// context ran out, so the client can retry with the same key
+func releaseKey(op string, r *http.Request, key string) {
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), queryTimeout)
+	defer cancel()
+
+	if err := db.ReleaseKey(ctx, key); err != nil {
+		logger.Printf("%s: idempotency key %v not released: %v", op, key, err)
+	}
+}
+
 func createHandler(w http.ResponseWriter, r *http.Request) {
 
 	var sub Sub
@@ -151,16 +912,94 @@ func createHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, err := db.Create(sub)
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > maxIdempotencyKeyLen {
+		logger.Printf("create: resp 400: idempotency key too long; req %v", sub)
+		http.Error(w, "invalid request: idempotency key too long", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	var hash string
+	if key != "" {
+		hash = requestHash(sub)
+		rec, found, err := db.ReserveKey(ctx, key, hash, idempotencyTTL)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				logger.Printf("create: resp 504: %v; valid req %v", err, sub)
+				http.Error(w, "timeout", http.StatusGatewayTimeout)
+				return
+			}
+
+			logger.Printf("create: resp 500: %v; valid req %v", err, sub)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+
+		if found {
+			replayResponse(w, "create", key, hash, rec)
+			return
+		}
+	}
+
+	err := resolveServices(ctx, &sub)
+	var breaches []BudgetBreach
+	if err == nil {
+		breaches, err = checkBudgets(ctx, sub, "")
+		budgetWarnings(w, breaches)
+	}
+	if err == nil && budgetStrict && len(breaches) > 0 {
+		err = ErrOverBudget
+	}
+	var id string
+	if err == nil {
+		id, err = db.Create(ctx, sub)
+	}
 	if err != nil {
+		if key != "" {
+			releaseKey("create", r, key)
+		}
+
+		if err == ErrUnknownUser {
+			logger.Printf("create: resp 400: %v; valid req %v", err, sub)
+			http.Error(w, "invalid request: unknown user", http.StatusBadRequest)
+			return
+		}
+
+		if err == ErrOverBudget {
+			logger.Printf("create: resp 409: %v; valid req %v", breaches, sub)
+			http.Error(w, "over budget", http.StatusConflict)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("create: resp 504: %v; valid req %v", err, sub)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
 		logger.Printf("create: resp 500: %v; valid req %v", err, sub)
 		http.Error(w, "server error", http.StatusInternalServerError)
 		return
 	}
 
+	body, _ := json.Marshal(map[string]string{"sub_id": id})
+	body = append(body, '\n')
+
+	if key != "" {
+		// the sub is already created, an unsaved response leaves the key
+		// pending until it expires so retries can't create a duplicate
+		if err := db.CompleteKey(ctx, key, http.StatusCreated, body); err != nil {
+			logger.Printf("create: idempotency key %v not saved: %v", key, err)
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(1))
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"sub_id": id})
+	w.Write(body)
 	logger.Printf("create: resp 201 with %v; req %v", id, sub)
 }
 
@@ -173,7 +1012,10 @@ func readHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sub, err := db.Read(id)
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	sub, err := db.Read(ctx, id)
 	if err != nil {
 		if err == ErrNotFound {
 			logger.Printf("read: resp 404; valid req %v", id)
@@ -181,11 +1023,24 @@ func readHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("read: resp 504: %v; valid req %v", err, id)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
 		logger.Printf("read: resp 500: %v; valid req %v", err, id)
 		http.Error(w, "server error", http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("ETag", etag(sub.Version))
+	if header := r.Header.Get("If-None-Match"); header != "" && matchETag(header, sub.Version, true) {
+		w.WriteHeader(http.StatusNotModified)
+		logger.Printf("read: resp 304; req %v", id)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(sub)
 	logger.Printf("read: resp 200 with %v; req %v", sub, id)
@@ -214,21 +1069,188 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := db.Update(id, sub); err != nil {
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	version, err := ifMatchVersion(ctx, r, id)
+	if err == nil {
+		err = resolveServices(ctx, &sub)
+	}
+	var breaches []BudgetBreach
+	if err == nil {
+		breaches, err = checkBudgets(ctx, sub, id)
+		budgetWarnings(w, breaches)
+	}
+	if err == nil && budgetStrict && len(breaches) > 0 {
+		err = ErrOverBudget
+	}
+	if err == nil {
+		version, err = db.Update(ctx, id, sub, version)
+	}
+	if err != nil {
 		if err == ErrNotFound {
-			logger.Printf("read: resp 404; valid req %v", id)
+			logger.Printf("update: resp 404; valid req %v", id)
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
 
+		if err == ErrVersionMismatch {
+			logger.Printf("update: resp 412; valid req %v, %v", id, sub)
+			http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+
+		if err == ErrUnknownUser {
+			logger.Printf("update: resp 400: %v; valid req %v, %v", err, id, sub)
+			http.Error(w, "invalid request: unknown user", http.StatusBadRequest)
+			return
+		}
+
+		if err == ErrOverBudget {
+			logger.Printf("update: resp 409: %v; valid req %v, %v", breaches, id, sub)
+			http.Error(w, "over budget", http.StatusConflict)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("update: resp 504: %v; valid req %v, %v", err, id, sub)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
 		logger.Printf("update: resp 500: %v; valid req %v, %v", err, id, sub)
 		http.Error(w, "server error", http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("ETag", etag(version))
 	logger.Printf("update: resp 200; req %v, %v", id, sub)
 }
 
+func patchHandler(w http.ResponseWriter, r *http.Request) {
+
+	id := mux.Vars(r)["id"]
+	if err := uuid.Validate(id); err != nil {
+		logger.Printf("patch: resp 400: %v; req %v", err, id)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Printf("patch: resp 400: %v; req %v", err, id)
+		http.Error(w, "invalid request: body error", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	patch, err := parseMergePatch(body)
+	if err != nil {
+		logger.Printf("patch: resp 400: %v; req %v, %s", err, id, body)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	sub, err := db.Read(ctx, id)
+	if err != nil {
+		if err == ErrNotFound {
+			logger.Printf("patch: resp 404; valid req %v", id)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("patch: resp 504: %v; valid req %v", err, id)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("patch: resp 500: %v; valid req %v", err, id)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	var version int
+	if header := r.Header.Get("If-Match"); header != "" {
+		if !matchETag(header, sub.Version, false) {
+			logger.Printf("patch: resp 412; valid req %v, %s", id, body)
+			http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+		version = sub.Version
+	}
+
+	// validate the merged sub, the patch alone may miss required fields
+	sub = applyPatch(sub, patch)
+	if err := validateSub(sub); err != nil {
+		logger.Printf("patch: resp 400: %v; req %v, %s", err, id, body)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !patch.Empty() {
+		if patch.Service != nil {
+			err = resolveServices(ctx, &sub)
+			patch.Service = &sub.Service
+			patch.Category = &sub.Category
+		}
+		var breaches []BudgetBreach
+		if err == nil {
+			breaches, err = checkBudgets(ctx, sub, id)
+			budgetWarnings(w, breaches)
+		}
+		if err == nil && budgetStrict && len(breaches) > 0 {
+			err = ErrOverBudget
+		}
+		if err == nil {
+			sub.Version, err = db.Patch(ctx, id, patch, version)
+		}
+		if err != nil {
+			if err == ErrNotFound {
+				logger.Printf("patch: resp 404; valid req %v", id)
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+
+			if err == ErrVersionMismatch {
+				logger.Printf("patch: resp 412; valid req %v, %s", id, body)
+				http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+				return
+			}
+
+			if err == ErrUnknownUser {
+				logger.Printf("patch: resp 400: %v; valid req %v, %s", err, id, body)
+				http.Error(w, "invalid request: unknown user", http.StatusBadRequest)
+				return
+			}
+
+			if err == ErrOverBudget {
+				logger.Printf("patch: resp 409: %v; valid req %v, %s", breaches, id, body)
+				http.Error(w, "over budget", http.StatusConflict)
+				return
+			}
+
+			if errors.Is(err, context.DeadlineExceeded) {
+				logger.Printf("patch: resp 504: %v; valid req %v, %s", err, id, body)
+				http.Error(w, "timeout", http.StatusGatewayTimeout)
+				return
+			}
+
+			logger.Printf("patch: resp 500: %v; valid req %v, %s", err, id, body)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(sub.Version))
+	json.NewEncoder(w).Encode(sub)
+	logger.Printf("patch: resp 200 with %v; req %v, %s", sub, id, body)
+}
+
 func deleteHandler(w http.ResponseWriter, r *http.Request) {
 
 	id := mux.Vars(r)["id"]
@@ -238,13 +1260,32 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := db.Delete(id); err != nil {
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	version, err := ifMatchVersion(ctx, r, id)
+	if err == nil {
+		err = db.Delete(ctx, id, version)
+	}
+	if err != nil {
 		if err == ErrNotFound {
-			logger.Printf("read: resp 404; valid req %v", id)
+			logger.Printf("delete: resp 404; valid req %v", id)
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
 
+		if err == ErrVersionMismatch {
+			logger.Printf("delete: resp 412; valid req %v", id)
+			http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("delete: resp 504: %v; valid req %v", err, id)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
 		logger.Printf("delete: resp 500: %v; valid req %v", err, id)
 		http.Error(w, "server error", http.StatusInternalServerError)
 		return
@@ -254,18 +1295,138 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 	logger.Printf("delete: resp 204; req %v", id)
 }
 
+// streamContext bounds a stream by queryTimeout only until its first row, the
+// rest of it lasts as long as the request. Call started once the first row is in.
+func streamContext(parent context.Context) (ctx context.Context, started func(), cancel func()) {
+
+	ctx, cancel_cause := context.WithCancelCause(parent)
+	timer := time.AfterFunc(queryTimeout, func() { cancel_cause(context.DeadlineExceeded) })
+
+	started = func() { timer.Stop() }
+	cancel = func() {
+		timer.Stop()
+		cancel_cause(context.Canceled)
+	}
+
+	return ctx, started, cancel
+}
+
+// streamDeadline gives the writes of a stream up to each flush queryTimeout to
+// reach the client, so a stalled client fails them and ends the stream instead
+// of holding its db connection. Call extend on the first row and after every
+// flush, and reset once done as the connection may serve other requests.
+func streamDeadline(w http.ResponseWriter) (extend func(), reset func()) {
+
+	rc := http.NewResponseController(w)
+	extend = func() { rc.SetWriteDeadline(time.Now().Add(queryTimeout)) }
+	reset = func() { rc.SetWriteDeadline(time.Time{}) }
+
+	return extend, reset
+}
+
+// streamTimedOut tells if a stream failed waiting for its first row
+func streamTimedOut(ctx context.Context, err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(context.Cause(ctx), context.DeadlineExceeded)
+}
+
+// listStream writes the subs of q as newline delimited JSON straight from
+// db.Iter. After the first row an error can only end the stream, with an
+// error object as its last line.
+func listStream(w http.ResponseWriter, r *http.Request, q ListQuery) {
+
+	ctx, started, cancel := streamContext(r.Context())
+	defer cancel()
+	extend, reset := streamDeadline(w)
+	defer reset()
+
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	var rows int
+	for sub, err := range db.Iter(ctx, q) {
+
+		if err != nil && rows == 0 {
+			if streamTimedOut(ctx, err) {
+				logger.Printf("list: resp 504: %v; valid req %v", err, r.URL.RawQuery)
+				http.Error(w, "timeout", http.StatusGatewayTimeout)
+				return
+			}
+
+			logger.Printf("list: resp 500: %v; valid req %v", err, r.URL.RawQuery)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			enc.Encode(map[string]string{"error": "server error"})
+			logger.Printf("list: stream cut short after %v entries: %v; req %v", rows, err, r.URL.RawQuery)
+			return
+		}
+
+		if rows == 0 {
+			started()
+			extend()
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+
+		if err := enc.Encode(sub); err != nil {
+			logger.Printf("list: stream cut short after %v entries: %v; req %v", rows, err, r.URL.RawQuery)
+			return
+		}
+		rows++
+
+		if rows%streamFlushRows == 0 && flusher != nil {
+			flusher.Flush()
+			extend()
+		}
+	}
+
+	if rows == 0 {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	logger.Printf("list: resp 200 streamed %v entries; req %v", rows, r.URL.RawQuery)
+}
+
 func listHandler(w http.ResponseWriter, r *http.Request) {
 
-	subs, err := db.List()
+	q, err := parseListQuery(r.URL.Query())
 	if err != nil {
-		logger.Printf("list: resp 500: %v", err)
+		logger.Printf("list: resp 400: %v; req %v", err, r.URL.RawQuery)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// a stream has no pages, it is only limited on request
+	if strings.Contains(r.Header.Get("Accept"), "application/x-ndjson") {
+		if r.URL.Query().Get("limit") == "" {
+			q.Limit = 0
+		}
+		listStream(w, r, q)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	page, err := db.List(ctx, q)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("list: resp 504: %v; valid req %v", err, r.URL.RawQuery)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("list: resp 500: %v; valid req %v", err, r.URL.RawQuery)
 		http.Error(w, "server error", http.StatusInternalServerError)
 		return
 	}
 
+	if page.Subs == nil {
+		page.Subs = []Sub{}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(subs)
-	logger.Printf("list: resp 200 with %v entries", len(subs))
+	json.NewEncoder(w).Encode(page)
+	logger.Printf("list: resp 200 with %v entries; req %v", len(page.Subs), r.URL.RawQuery)
 }
 
 func sumHandler(w http.ResponseWriter, r *http.Request) {
@@ -274,40 +1435,210 @@ func sumHandler(w http.ResponseWriter, r *http.Request) {
 	end_date := r.URL.Query().Get("end_date")
 	user_id := r.URL.Query().Get("user_id")
 	service_name := r.URL.Query().Get("service_name")
+	service_id := r.URL.Query().Get("service_id")
+	currency := r.URL.Query().Get("currency")
 
 	filter := Sub{
-		Start:   start_date,
-		End:     &end_date,
-		User_ID: user_id,
-		Service: service_name,
+		Start:    start_date,
+		End:      &end_date,
+		User_ID:  user_id,
+		Service:  service_name,
+		Currency: currency,
+		Category: r.URL.Query().Get("category"),
 	}
+
+	var err error
+	if filter.Tags, filter.All_Tags, err = parseTagFilter(r.URL.Query()); err != nil {
+		logger.Printf("sum: resp 400: %v; req %v", err, filter)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	if err := validateFilter(filter); err != nil {
 		logger.Printf("sum: resp 400: %v; req %v", err, filter)
 		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	sum, err := db.Sum(filter)
+	// a conversion goes month by month, like month groups
+	if currency != "" && monthIndex(end_date)-monthIndex(start_date) >= maxSumMonths {
+		logger.Printf("sum: resp 400: period too long; req %v", filter)
+		http.Error(w, "invalid request: period too long", http.StatusBadRequest)
+		return
+	}
+
+	if service_id != "" {
+		if service_name != "" {
+			logger.Printf("sum: resp 400: both service id and name; req %v", filter)
+			http.Error(w, "invalid request: both service id and name", http.StatusBadRequest)
+			return
+		}
+		if err := uuid.Validate(service_id); err != nil {
+			logger.Printf("sum: resp 400: %v; req %v", err, filter)
+			http.Error(w, "invalid request: invalid service id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if service_id != "" || service_name != "" {
+		ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+		err := resolveFilterService(ctx, &filter, service_id)
+		cancel()
+		if err != nil {
+			if err == ErrNotFound {
+				logger.Printf("sum: resp 404: service %v not found", service_id)
+				http.Error(w, "service not found", http.StatusNotFound)
+				return
+			}
+
+			if errors.Is(err, context.DeadlineExceeded) {
+				logger.Printf("sum: resp 504: %v; valid req %v", err, filter)
+				http.Error(w, "timeout", http.StatusGatewayTimeout)
+				return
+			}
+
+			logger.Printf("sum: resp 500: %v; valid req %v", err, filter)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	group_by := r.URL.Query().Get("group_by")
+	if group_by != "" {
+		sumGroupsHandler(w, r, filter, group_by)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	sum, err := db.Sum(ctx, filter)
 	if err != nil {
+		var rerr *RateError
+		if errors.As(err, &rerr) {
+			logger.Printf("sum: resp 422: %v; valid req %v", err, filter)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("sum: resp 504: %v; valid req %v", err, filter)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
 		logger.Printf("sum: resp 500: %v; valid req %v", err, filter)
 		http.Error(w, "server error", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]int{"sum": sum})
+	json.NewEncoder(w).Encode(map[string]Money{"sum": sum})
 	logger.Printf("sum: resp 200 with %v; req %v", sum, filter)
 }
 
+// sumGroupsHandler responds with the sum of every group and their total
+func sumGroupsHandler(w http.ResponseWriter, r *http.Request, filter Sub, group_by string) {
+
+	if !sumGroupBy[group_by] {
+		logger.Printf("sum: resp 400: invalid group_by %v; req %v", group_by, filter)
+		http.Error(w, "invalid request: invalid group_by", http.StatusBadRequest)
+		return
+	}
+
+	if group_by == "month" && monthIndex(*filter.End)-monthIndex(filter.Start) >= maxSumMonths {
+		logger.Printf("sum: resp 400: period too long; req %v", filter)
+		http.Error(w, "invalid request: period too long", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	// subs with several tags count in several tag groups, but once in the sum
+	var sum Money
+	groups, err := db.SumGroups(ctx, filter, group_by)
+	if err == nil && group_by == "tag" {
+		sum, err = db.Sum(ctx, filter)
+	}
+	if err != nil {
+		var rerr *RateError
+		if errors.As(err, &rerr) {
+			logger.Printf("sum: resp 422: %v; valid req %v by %v", err, filter, group_by)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("sum: resp 504: %v; valid req %v by %v", err, filter, group_by)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("sum: resp 500: %v; valid req %v by %v", err, filter, group_by)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	if group_by != "tag" {
+		for _, g := range groups {
+			sum += g.Sum
+		}
+	}
+	if groups == nil {
+		groups = []SumGroup{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Sum    Money      `json:"sum"`
+		Groups []SumGroup `json:"groups"`
+	}{sum, groups})
+	logger.Printf("sum: resp 200 with %v in %v groups; req %v by %v", sum, len(groups), filter, group_by)
+}
+
 func newRouter() http.Handler {
 
 	r := mux.NewRouter()
 	r.HandleFunc("/subs/sum", sumHandler).Methods("GET")
+	r.HandleFunc("/subs/export", exportHandler).Methods("GET")
+	r.HandleFunc("/subs/import", importHandler).Methods("POST")
+	r.HandleFunc("/subs/trials", trialsHandler).Methods("GET")
 	r.HandleFunc("/subs", createHandler).Methods("POST")
+	r.HandleFunc("/subs:batch", batchHandler).Methods("POST")
 	r.HandleFunc("/subs/{id}", readHandler).Methods("GET")
 	r.HandleFunc("/subs/{id}", updateHandler).Methods("PUT")
+	r.HandleFunc("/subs/{id}", patchHandler).Methods("PATCH")
 	r.HandleFunc("/subs/{id}", deleteHandler).Methods("DELETE")
+	r.HandleFunc("/subs/{id}/pauses", addPauseHandler).Methods("POST")
+	r.HandleFunc("/subs/{id}/pauses/{pause_id}", deletePauseHandler).Methods("DELETE")
+	r.HandleFunc("/subs/{id}/prices", listPricesHandler).Methods("GET")
+	r.HandleFunc("/subs/{id}/prices/{month}", setPriceHandler).Methods("PUT")
+	r.HandleFunc("/subs/{id}/prices/{month}", deletePriceHandler).Methods("DELETE")
+	r.HandleFunc("/subs/{id}/members", listMembersHandler).Methods("GET")
+	r.HandleFunc("/subs/{id}/members/{user_id}", setMemberHandler).Methods("PUT")
+	r.HandleFunc("/subs/{id}/members/{user_id}", deleteMemberHandler).Methods("DELETE")
 	r.HandleFunc("/subs", listHandler).Methods("GET")
+	r.HandleFunc("/services", createServiceHandler).Methods("POST")
+	r.HandleFunc("/services", listServicesHandler).Methods("GET")
+	r.HandleFunc("/services/{id}", readServiceHandler).Methods("GET")
+	r.HandleFunc("/services/{id}", updateServiceHandler).Methods("PUT")
+	r.HandleFunc("/services/{id}", deleteServiceHandler).Methods("DELETE")
+	r.HandleFunc("/users", createUserHandler).Methods("POST")
+	r.HandleFunc("/users", listUsersHandler).Methods("GET")
+	r.HandleFunc("/users/{id}", readUserHandler).Methods("GET")
+	r.HandleFunc("/users/{id}", updateUserHandler).Methods("PUT")
+	r.HandleFunc("/users/{id}", deleteUserHandler).Methods("DELETE")
+	r.HandleFunc("/users/{id}/subs", userSubsHandler).Methods("GET")
+	r.HandleFunc("/users/{id}/spend", userSpendHandler).Methods("GET")
+	r.HandleFunc("/users/{id}/budgets", listBudgetsHandler).Methods("GET")
+	r.HandleFunc("/users/{id}/budgets", createBudgetHandler).Methods("POST")
+	r.HandleFunc("/users/{id}/budgets/evaluation", evaluateBudgetsHandler).Methods("GET")
+	r.HandleFunc("/users/{id}/budgets/{budget_id}", updateBudgetHandler).Methods("PUT")
+	r.HandleFunc("/users/{id}/budgets/{budget_id}", deleteBudgetHandler).Methods("DELETE")
+	r.HandleFunc("/fx-rates", listRatesHandler).Methods("GET")
+	r.HandleFunc("/fx-rates/{from}/{to}/{month}", setRateHandler).Methods("PUT")
+	r.HandleFunc("/fx-rates/{from}/{to}/{month}", deleteRateHandler).Methods("DELETE")
 
 	return r
 }
@@ -316,6 +1647,14 @@ func SetLogger(l *log.Logger) {
 	logger = l
 }
 
+func SetQueryTimeout(d time.Duration) {
+	queryTimeout = d
+}
+
+func SetIdempotencyTTL(d time.Duration) {
+	idempotencyTTL = d
+}
+
 func Start(database DB) {
 
 	db = database
@@ -327,9 +1666,14 @@ func Start(database DB) {
 	}).Methods("GET")
 	r.(*mux.Router).PathPrefix("/swagger/").Handler(httpSwagger.Handler(httpSwagger.URL("/swagger.yaml")))
 
+	// request contexts derive from base, so running queries are cancelled on shutdown
+	base, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+
 	server := http.Server{
-		Addr:    ":8080",
-		Handler: r,
+		Addr:        ":8080",
+		Handler:     r,
+		BaseContext: func(net.Listener) context.Context { return base },
 	}
 
 	go func() {
@@ -345,7 +1689,9 @@ func Start(database DB) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
-	if err := server.Shutdown(ctx); err != nil {
+	err := server.Shutdown(ctx)
+	cancelBase()
+	if err != nil {
 		logger.Fatalf("Shutdown error: %v", err)
 	}
 	if err := db.Close(); err != nil {
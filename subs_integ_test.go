@@ -4,7 +4,12 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,11 +17,11 @@ import (
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"github.com/google/uuid"
-	"github.com/jackc/pgx/v5"
 	"github.com/testcontainers/testcontainers-go"
 )
 
-func setupInteg(t *testing.T) {
+// startPostgres runs a migrated postgres container and returns its connection string
+func startPostgres(t *testing.T) string {
 
 	req := testcontainers.ContainerRequest{
 		Image: "postgres:17",
@@ -79,7 +84,14 @@ func setupInteg(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	conn, err := pgx.Connect(ctx, str)
+	return str
+}
+
+func setupInteg(t *testing.T) {
+
+	str := startPostgres(t)
+
+	pgxdb, err := NewPGXDB(str, PoolConfig{MinConns: 2, MaxConns: 8})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -90,7 +102,7 @@ func setupInteg(t *testing.T) {
 	}
 	SetLogger(log.New(file, "", log.LstdFlags))
 
-	db = &PGXDB{conn: conn}
+	db = pgxdb
 	go Start(db)
 	time.Sleep(time.Millisecond * 500)
 }
@@ -99,12 +111,32 @@ func TestInteg(t *testing.T) {
 
 	setupInteg(t)
 
-	server_url := "http://localhost:8080"
+	testInteg(t, "http://localhost:8080")
+}
+
+// TestIntegSQLite runs the TestInteg matrix against a sqlite file, no container needed
+func TestIntegSQLite(t *testing.T) {
+
+	sqlitedb, err := NewSQLiteDB(filepath.Join(t.TempDir(), "subs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlitedb.Close()
+
+	db = sqlitedb
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	testInteg(t, server.URL)
+}
+
+// testInteg expects an empty db behind the server
+func testInteg(t *testing.T, server_url string) {
 
 	s := Sub{
 		Service: "service",
 		Price:   400,
-		User_ID: uuid.NewString(),
+		User_ID: testCreateUserPayload(t, server_url),
 		Start:   "07-2024",
 		End:     func() *string { s := "09-2024"; return &s }(),
 	}
@@ -130,6 +162,17 @@ func TestInteg(t *testing.T) {
 		compareSubs(t, s2, testReadPayload(t, server_url, id))
 	})
 
+	t.Run("patch", func(t *testing.T) {
+		s2.Price = 500
+		s2.End = func() *string { s := "12-2024"; return &s }()
+		compareSubs(t, s2, testPatchPayload(t, server_url, id, `{"price": "5.00", "end_date": "12-2024"}`))
+		compareSubs(t, s2, testReadPayload(t, server_url, id))
+
+		s2.End = nil
+		testPatchPayload(t, server_url, id, `{"end_date": null}`)
+		compareSubs(t, s2, testReadPayload(t, server_url, id))
+	})
+
 	t.Run("delete", func(t *testing.T) {
 		testDeletePayload(t, server_url, id)
 	})
@@ -137,7 +180,7 @@ func TestInteg(t *testing.T) {
 	t.Run("list", func(t *testing.T) {
 
 		// list empty db
-		testListPayload(t, server_url)
+		testListPayload(t, server_url, "")
 
 		count := 5
 		var ids []string
@@ -145,7 +188,7 @@ func TestInteg(t *testing.T) {
 			ids = append(ids, testCreatePayload(t, server_url, s))
 		}
 
-		subs := testListPayload(t, server_url)
+		subs := testListPayload(t, server_url, "").Subs
 		if len(subs) != count {
 			t.Errorf("expected list count: %v, got %v", count, len(subs))
 		}
@@ -163,6 +206,29 @@ func TestInteg(t *testing.T) {
 				t.Errorf("not found sub with id: %v", id)
 			}
 		}
+
+		var paged []Sub
+		query := "?sort=-start_date&limit=2"
+		for range count {
+			page := testListPayload(t, server_url, query)
+			paged = append(paged, page.Subs...)
+			if page.Next_Cursor == "" {
+				break
+			}
+			query = "?sort=-start_date&limit=2&after=" + page.Next_Cursor
+		}
+		if len(paged) != count {
+			t.Errorf("expected paged count: %v, got %v", count, len(paged))
+		}
+
+		filtered := testListPayload(t, server_url, "?user_id="+s.User_ID+"&from=09-2024&to=12-2024&min_price=4.00&max_price=4").Subs
+		if len(filtered) != count {
+			t.Errorf("expected filtered count: %v, got %v", count, len(filtered))
+		}
+
+		if len(testListPayload(t, server_url, "?from=10-2024").Subs) != 0 {
+			t.Error("expected no subs active after end date")
+		}
 	})
 
 	t.Run("sum", func(t *testing.T) {
@@ -200,4 +266,78 @@ func TestInteg(t *testing.T) {
 			t.Errorf("expected sum: %v, got %v", expected, sum)
 		}
 	})
+	t.Run("concurrent", func(t *testing.T) {
+
+		filter := Sub{
+			Start: "07-2024",
+			End:   func() *string { s := "09-2024"; return &s }(),
+		}
+
+		// more workers than pooled connections to force waiting on the pool
+		var wg sync.WaitGroup
+		for range 32 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				s2 := s
+				s2.User_ID = testCreateUserPayload(t, server_url)
+				id := testCreatePayload(t, server_url, s2)
+				testReadPayload(t, server_url, id)
+
+				s2.Price = 700
+				testUpdatePayload(t, server_url, id, s2)
+				testListPayload(t, server_url, "?user_id="+s2.User_ID)
+
+				filter := filter
+				filter.User_ID = s2.User_ID
+				if sum := testSumPayload(t, server_url, filter); sum != s2.Price*3 {
+					t.Errorf("expected sum: %v, got %v", s2.Price*3, sum)
+				}
+
+				testDeletePayload(t, server_url, id)
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("batch", func(t *testing.T) {
+
+		// enough creates for a bulk insert
+		user := testCreateUserPayload(t, server_url)
+		var ops []string
+		for range 40 {
+			ops = append(ops, fmt.Sprintf(`{"op": "create", "sub": {"service_name": "batch", "price": 100, "user_id": "%v", "start_date": "07-2024"}}`, user))
+		}
+
+		resp, err := http.Post(server_url+"/subs:batch", "application/json",
+			strings.NewReader(`{"ops": [`+strings.Join(ops, ", ")+`]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			t.Fatalf("expected status: 200, got %v", resp.StatusCode)
+		}
+		if page := testListPayload(t, server_url, "?user_id="+user); len(page.Subs) != 40 {
+			t.Errorf("expected 40 subs, got %v", len(page.Subs))
+		}
+
+		// a failed op rolls the whole batch back
+		ops[0] = fmt.Sprintf(`{"op": "delete", "sub_id": "%v"}`, uuid.NewString())
+		resp, err = http.Post(server_url+"/subs:batch", "application/json",
+			strings.NewReader(`{"ops": [`+strings.Join(ops, ", ")+`]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 409 {
+			t.Fatalf("expected status: 409, got %v", resp.StatusCode)
+		}
+		if page := testListPayload(t, server_url, "?user_id="+user); len(page.Subs) != 40 {
+			t.Errorf("expected 40 subs, got %v", len(page.Subs))
+		}
+	})
 }
@@ -2,122 +2,453 @@ package subs
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"iter"
 	"net/http"
 	"net/http/httptest"
-	"strconv"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// MockDB is a MemDB with simulated query latency
 type MockDB struct {
-	db map[string]Sub
+	MemDB
+
+	// delay simulates a slow query, cut short by context cancellation
+	delay time.Duration
+
+	// queries counts the calls of DB methods, as round trips to a server
+	queries atomic.Int64
 }
 
-func (m *MockDB) Create(sub Sub) (string, error) {
+func (m *MockDB) wait(ctx context.Context) error {
 
-	id := uuid.NewString()
-	sub.ID = id
-	m.db[id] = sub
+	m.queries.Add(1)
 
-	return id, nil
+	select {
+	case <-time.After(m.delay):
+		return ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (m *MockDB) Read(id string) (Sub, error) {
+func (m *MockDB) Create(ctx context.Context, sub Sub) (string, error) {
 
-	sub, ok := m.db[id]
-	if !ok {
-		return Sub{}, ErrNotFound
+	if err := m.wait(ctx); err != nil {
+		return "", err
 	}
 
-	return sub, nil
+	return m.MemDB.Create(ctx, sub)
 }
 
-func (m *MockDB) Update(id string, sub Sub) error {
+func (m *MockDB) Read(ctx context.Context, id string) (Sub, error) {
 
-	if _, ok := m.db[id]; !ok {
-		return ErrNotFound
+	if err := m.wait(ctx); err != nil {
+		return Sub{}, err
 	}
-	m.db[id] = sub
 
-	return nil
+	return m.MemDB.Read(ctx, id)
 }
 
-func (m *MockDB) Delete(id string) error {
+func (m *MockDB) Update(ctx context.Context, id string, sub Sub, version int) (int, error) {
 
-	if _, ok := m.db[id]; !ok {
-		return ErrNotFound
+	if err := m.wait(ctx); err != nil {
+		return 0, err
 	}
-	delete(m.db, id)
 
-	return nil
+	return m.MemDB.Update(ctx, id, sub, version)
 }
 
-func (m *MockDB) List() ([]Sub, error) {
+func (m *MockDB) Patch(ctx context.Context, id string, patch SubPatch, version int) (int, error) {
 
-	var subs []Sub
-	for _, sub := range m.db {
-		subs = append(subs, sub)
+	if err := m.wait(ctx); err != nil {
+		return 0, err
 	}
 
-	return subs, nil
+	return m.MemDB.Patch(ctx, id, patch, version)
 }
 
-func (m *MockDB) Sum(filter Sub) (int, error) {
+func (m *MockDB) Delete(ctx context.Context, id string, version int) error {
 
-	var sum int
-	s := strings.Split(filter.Start, "-")
-	e := strings.Split(*filter.End, "-")
-	u := filter.User_ID
-	n := filter.Service
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
 
-	for _, sub := range m.db {
+	return m.MemDB.Delete(ctx, id, version)
+}
 
-		if u != "" && sub.User_ID != u {
-			continue
-		}
+func (m *MockDB) List(ctx context.Context, q ListQuery) (SubPage, error) {
 
-		if n != "" && sub.Service != n {
-			continue
-		}
+	if err := m.wait(ctx); err != nil {
+		return SubPage{}, err
+	}
 
-		ss := strings.Split(sub.Start, "-")
+	return m.MemDB.List(ctx, q)
+}
 
-		m1, _ := strconv.Atoi(s[0])
-		m3, _ := strconv.Atoi(e[0])
-		m2, _ := strconv.Atoi(ss[0])
+// Iter pages through MockDB.List, so every page is delayed
+func (m *MockDB) Iter(ctx context.Context, q ListQuery) iter.Seq2[Sub, error] {
+	return iterPages(ctx, m.List, q)
+}
 
-		if m1 >= m2 {
-			if sub.End != nil {
-				ee := strings.Split(*sub.End, "-")
-				m4, _ := strconv.Atoi(ee[0])
-				if m3 >= m4 {
-					sum += sub.Price * (m4 - m1 + 1)
-					continue
-				}
-			}
-			sum += sub.Price * (m3 - m1 + 1)
-		} else if m2 <= m3 {
-			if sub.End != nil {
-				ee := strings.Split(*sub.End, "-")
-				m4, _ := strconv.Atoi(ee[0])
-				if m3 >= m4 {
-					sum += sub.Price * (m4 - m2 + 1)
-					continue
-				}
-			}
-			sum += sub.Price * (m3 - m2 + 1)
-		}
+func (m *MockDB) Sum(ctx context.Context, filter Sub) (Money, error) {
+
+	if err := m.wait(ctx); err != nil {
+		return 0, err
+	}
+
+	return m.MemDB.Sum(ctx, filter)
+}
+
+func (m *MockDB) SumGroups(ctx context.Context, filter Sub, group_by string) ([]SumGroup, error) {
+
+	if err := m.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return m.MemDB.SumGroups(ctx, filter, group_by)
+}
+
+func (m *MockDB) Batch(ctx context.Context, ops []BatchOp, atomic bool) ([]BatchResult, error) {
+
+	if err := m.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return m.MemDB.Batch(ctx, ops, atomic)
+}
+
+func (m *MockDB) ReserveKey(ctx context.Context, key string, hash string, ttl time.Duration) (IdempotencyRecord, bool, error) {
+
+	if err := m.wait(ctx); err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+
+	return m.MemDB.ReserveKey(ctx, key, hash, ttl)
+}
+
+func (m *MockDB) CompleteKey(ctx context.Context, key string, status int, body []byte) error {
+
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+
+	return m.MemDB.CompleteKey(ctx, key, status, body)
+}
+
+func (m *MockDB) ReleaseKey(ctx context.Context, key string) error {
+
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+
+	return m.MemDB.ReleaseKey(ctx, key)
+}
+
+func (m *MockDB) SetRate(ctx context.Context, rate FXRate) error {
+
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+
+	return m.MemDB.SetRate(ctx, rate)
+}
+
+func (m *MockDB) DeleteRate(ctx context.Context, from string, to string, month string) error {
+
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+
+	return m.MemDB.DeleteRate(ctx, from, to, month)
+}
+
+func (m *MockDB) ListRates(ctx context.Context, from string, to string) ([]FXRate, error) {
+
+	if err := m.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return m.MemDB.ListRates(ctx, from, to)
+}
+
+func (m *MockDB) AddPause(ctx context.Context, id string, pause Pause) (string, int, error) {
+
+	if err := m.wait(ctx); err != nil {
+		return "", 0, err
+	}
+
+	return m.MemDB.AddPause(ctx, id, pause)
+}
+
+func (m *MockDB) DeletePause(ctx context.Context, id string, pause_id string) (int, error) {
+
+	if err := m.wait(ctx); err != nil {
+		return 0, err
+	}
+
+	return m.MemDB.DeletePause(ctx, id, pause_id)
+}
+
+func (m *MockDB) SetPrice(ctx context.Context, id string, price SubPrice) error {
+
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+
+	return m.MemDB.SetPrice(ctx, id, price)
+}
+
+func (m *MockDB) DeletePrice(ctx context.Context, id string, month string) error {
+
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+
+	return m.MemDB.DeletePrice(ctx, id, month)
+}
+
+func (m *MockDB) ListPrices(ctx context.Context, id string) ([]SubPrice, error) {
+
+	if err := m.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return m.MemDB.ListPrices(ctx, id)
+}
+
+func (m *MockDB) Trials(ctx context.Context, user_id string, from string, to string) ([]Trial, error) {
+
+	if err := m.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return m.MemDB.Trials(ctx, user_id, from, to)
+}
+
+func (m *MockDB) SetMember(ctx context.Context, id string, member Member) error {
+
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+
+	return m.MemDB.SetMember(ctx, id, member)
+}
+
+func (m *MockDB) DeleteMember(ctx context.Context, id string, user_id string) error {
+
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+
+	return m.MemDB.DeleteMember(ctx, id, user_id)
+}
+
+func (m *MockDB) ListMembers(ctx context.Context, id string) ([]Member, error) {
+
+	if err := m.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return m.MemDB.ListMembers(ctx, id)
+}
+
+func (m *MockDB) CreateService(ctx context.Context, svc Service) (string, error) {
+
+	if err := m.wait(ctx); err != nil {
+		return "", err
+	}
+
+	return m.MemDB.CreateService(ctx, svc)
+}
+
+func (m *MockDB) ReadService(ctx context.Context, id string) (Service, error) {
+
+	if err := m.wait(ctx); err != nil {
+		return Service{}, err
+	}
+
+	return m.MemDB.ReadService(ctx, id)
+}
+
+func (m *MockDB) UpdateService(ctx context.Context, id string, svc Service) error {
+
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+
+	return m.MemDB.UpdateService(ctx, id, svc)
+}
+
+func (m *MockDB) DeleteService(ctx context.Context, id string) error {
+
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+
+	return m.MemDB.DeleteService(ctx, id)
+}
+
+func (m *MockDB) ListServices(ctx context.Context) ([]Service, error) {
+
+	if err := m.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return m.MemDB.ListServices(ctx)
+}
+
+func (m *MockDB) CreateUser(ctx context.Context, user User) (string, error) {
+
+	if err := m.wait(ctx); err != nil {
+		return "", err
+	}
+
+	return m.MemDB.CreateUser(ctx, user)
+}
+
+func (m *MockDB) ReadUser(ctx context.Context, id string) (User, error) {
+
+	if err := m.wait(ctx); err != nil {
+		return User{}, err
+	}
+
+	return m.MemDB.ReadUser(ctx, id)
+}
+
+func (m *MockDB) UpdateUser(ctx context.Context, id string, user User) error {
+
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+
+	return m.MemDB.UpdateUser(ctx, id, user)
+}
+
+func (m *MockDB) DeleteUser(ctx context.Context, id string, cascade bool) error {
+
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+
+	return m.MemDB.DeleteUser(ctx, id, cascade)
+}
+
+func (m *MockDB) ListUsers(ctx context.Context) ([]User, error) {
+
+	if err := m.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return m.MemDB.ListUsers(ctx)
+}
+
+func (m *MockDB) CreateBudget(ctx context.Context, budget Budget) (string, error) {
+
+	if err := m.wait(ctx); err != nil {
+		return "", err
+	}
+
+	return m.MemDB.CreateBudget(ctx, budget)
+}
+
+func (m *MockDB) UpdateBudget(ctx context.Context, budget Budget) error {
+
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+
+	return m.MemDB.UpdateBudget(ctx, budget)
+}
+
+func (m *MockDB) DeleteBudget(ctx context.Context, user_id string, id string) error {
+
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+
+	return m.MemDB.DeleteBudget(ctx, user_id, id)
+}
+
+func (m *MockDB) ListBudgets(ctx context.Context, user_id string) ([]Budget, error) {
+
+	if err := m.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return m.MemDB.ListBudgets(ctx, user_id)
+}
+
+// addUser registers a user in m for the subs of a handler test
+func addUser(t *testing.T, m *MockDB) string {
+
+	t.Helper()
+
+	id, err := m.MemDB.CreateUser(context.Background(), User{Display_Name: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+// handlerTest serves the routes over a fresh MockDB for a handler test
+type handlerTest struct {
+	t      *testing.T
+	m      *MockDB
+	server *httptest.Server
+}
+
+func newHandlerTest(t *testing.T) *handlerTest {
+
+	m := &MockDB{}
+	m.db = make(map[string]Sub)
+	db = m
+
+	server := httptest.NewServer(newRouter())
+	t.Cleanup(server.Close)
+
+	return &handlerTest{t: t, m: m, server: server}
+}
+
+// send requests path, returning the response with its trimmed body
+func (h *handlerTest) send(method string, path string, body string) (*http.Response, string) {
+
+	h.t.Helper()
+
+	req, err := http.NewRequest(method, h.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.t.Fatal(err)
 	}
+	defer resp.Body.Close()
 
-	return sum, nil
+	b, _ := io.ReadAll(resp.Body)
+	return resp, strings.TrimSpace(string(b))
 }
 
-func (m *MockDB) Close() error {
-	return nil
+// do is send for the status and body only
+func (h *handlerTest) do(method string, path string, body string) (int, string) {
+
+	h.t.Helper()
+
+	resp, b := h.send(method, path, body)
+	return resp.StatusCode, b
 }
 
 func compareSubs(t *testing.T, s1 Sub, s2 Sub) {
@@ -136,19 +467,36 @@ func compareSubs(t *testing.T, s1 Sub, s2 Sub) {
 	if s1.Start != s2.Start {
 		t.Fatal("start not equal")
 	}
+	// subs built in tests leave the currency to its default
+	if cmp.Or(s1.Currency, defaultCurrency) != cmp.Or(s2.Currency, defaultCurrency) {
+		t.Fatal("currency not equal")
+	}
 	if (s1.End == nil && s2.End != nil) || (s1.End != nil && s2.End == nil) || (s1.End != nil && s2.End != nil && *s1.End != *s2.End) {
 		t.Fatal("end not equal")
 	}
+	// and so do they with billing
+	b1, b2 := withBillingDefaults(s1), withBillingDefaults(s2)
+	if b1.Billing_Period != b2.Billing_Period || b1.Billing_Interval != b2.Billing_Interval || b1.Anchor != b2.Anchor {
+		t.Fatal("billing not equal")
+	}
+	if s1.Category != s2.Category || !slices.Equal(normalizeTags(s1.Tags), normalizeTags(s2.Tags)) {
+		t.Fatal("labels not equal")
+	}
 }
 
 func TestValidateSub(t *testing.T) {
 
 	s := Sub{
-		Service: "service",
-		Price:   400,
-		User_ID: uuid.NewString(),
-		Start:   "07-2024",
-		End:     func() *string { s := "10-2024"; return &s }(),
+		Service:  "service",
+		Price:    400,
+		User_ID:  uuid.NewString(),
+		Start:    "07-2024",
+		End:      func() *string { s := "10-2024"; return &s }(),
+		Currency: "RUB",
+
+		Billing_Period:   "monthly",
+		Billing_Interval: 1,
+		Anchor:           "2024-07-01",
 	}
 
 	if err := validateSub(s); err != nil {
@@ -168,6 +516,22 @@ func TestValidateSub(t *testing.T) {
 
 	}
 
+	for _, date := range []string{"2024-07-20", "2024-02-29"} {
+		s3 := s
+		s3.Start, s3.End = date, &date
+		if err := validateSub(s3); err != nil {
+			t.Errorf("%v: expected nil, got %v", date, err)
+		}
+	}
+
+	for _, date := range []string{"2024-02-30", "1969-12-31", "2024-7-20", "20-07-2024"} {
+		s3 := s
+		s3.Start = date
+		if err := validateSub(s3); err == nil {
+			t.Errorf("%v: expected err, got nil", date)
+		}
+	}
+
 	s4 := s
 	s4.User_ID = "123"
 	if err := validateSub(s4); err == nil {
@@ -185,6 +549,66 @@ func TestValidateSub(t *testing.T) {
 	if err := validateSub(s6); err == nil {
 		t.Errorf("expected err, got nil")
 	}
+
+	s8 := s
+	s8.Price = maxPrice + 1
+	if err := validateSub(s8); err == nil {
+		t.Errorf("expected err, got nil")
+	}
+
+	for _, currency := range []string{"", "rub", "XYZ", "RUBL"} {
+		s7 := s
+		s7.Currency = currency
+		if err := validateSub(s7); err == nil {
+			t.Errorf("%q: expected err, got nil", currency)
+		}
+	}
+
+	for _, b := range []struct {
+		period   string
+		interval int
+		anchor   string
+	}{
+		{"", 1, "2024-07-01"},
+		{"daily", 1, "2024-07-01"},
+		{"yearly", 0, "2024-07-01"},
+		{"yearly", maxBillingInterval + 1, "2024-07-01"},
+		{"yearly", 1, ""},
+		{"yearly", 1, "2024-02-30"},
+		{"yearly", 1, "07-2024"},
+		{"yearly", 1, "1969-12-31"},
+	} {
+		s9 := s
+		s9.Billing_Period, s9.Billing_Interval, s9.Anchor = b.period, b.interval, b.anchor
+		if err := validateSub(s9); err == nil {
+			t.Errorf("%+v: expected err, got nil", b)
+		}
+	}
+
+	s10 := s
+	s10.Trial_Months, s10.Intro_Price, s10.Intro_Months = 1, 0, 3
+	if err := validateSub(s10); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+
+	for _, p := range []struct {
+		trial, intro int
+		price        Money
+	}{
+		{-1, 0, 0},
+		{maxPromoMonths + 1, 0, 0},
+		{0, -1, 0},
+		{0, maxPromoMonths + 1, 0},
+		{0, 3, -1},
+		{0, 3, maxPrice + 1},
+		{0, 0, 100},
+	} {
+		s11 := s
+		s11.Trial_Months, s11.Intro_Months, s11.Intro_Price = p.trial, p.intro, p.price
+		if err := validateSub(s11); err == nil {
+			t.Errorf("%+v: expected err, got nil", p)
+		}
+	}
 }
 
 func TestValidateFilter(t *testing.T) {
@@ -234,17 +658,13 @@ func testCreatePayload(t *testing.T, server_url string, s Sub) string {
 
 func TestCreateHandler(t *testing.T) {
 
-	var m MockDB
-	m.db = make(map[string]Sub)
-	db = &m
-
-	server := httptest.NewServer(newRouter())
-	defer server.Close()
+	h := newHandlerTest(t)
+	m, server := h.m, h.server
 
 	s := Sub{
 		Service: "service",
 		Price:   400,
-		User_ID: uuid.NewString(),
+		User_ID: addUser(t, m),
 		Start:   "07-2024",
 	}
 
@@ -311,12 +731,8 @@ func testReadPayload(t *testing.T, server_url string, sub_id string) Sub {
 
 func TestReadHandler(t *testing.T) {
 
-	var m MockDB
-	m.db = make(map[string]Sub)
-	db = &m
-
-	server := httptest.NewServer(newRouter())
-	defer server.Close()
+	h := newHandlerTest(t)
+	m, server := h.m, h.server
 
 	t.Run("malformed id", func(t *testing.T) {
 		resp, err := http.Get(server.URL + "/subs/" + "123")
@@ -378,12 +794,8 @@ func testUpdatePayload(t *testing.T, server_url string, sub_id string, s Sub) {
 
 func TestUpdateHandler(t *testing.T) {
 
-	var m MockDB
-	m.db = make(map[string]Sub)
-	db = &m
-
-	server := httptest.NewServer(newRouter())
-	defer server.Close()
+	h := newHandlerTest(t)
+	m, server := h.m, h.server
 
 	t.Run("malformed id", func(t *testing.T) {
 		req, err := http.NewRequest("PUT", server.URL+"/subs/"+"123", bytes.NewBuffer([]byte{}))
@@ -407,7 +819,7 @@ func TestUpdateHandler(t *testing.T) {
 		ID:      id,
 		Service: "service",
 		Price:   400,
-		User_ID: uuid.NewString(),
+		User_ID: addUser(t, m),
 		Start:   "07-2024",
 	}
 	m.db[id] = s
@@ -482,12 +894,13 @@ func TestUpdateHandler(t *testing.T) {
 	})
 }
 
-func testDeletePayload(t *testing.T, server_url string, sub_id string) {
+func testPatchPayload(t *testing.T, server_url string, sub_id string, patch string) Sub {
 
-	req, err := http.NewRequest("DELETE", server_url+"/subs/"+sub_id, bytes.NewBuffer([]byte{}))
+	req, err := http.NewRequest("PATCH", server_url+"/subs/"+sub_id, strings.NewReader(patch))
 	if err != nil {
 		t.Error(err)
 	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -495,19 +908,424 @@ func testDeletePayload(t *testing.T, server_url string, sub_id string) {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 204 {
-		t.Errorf("expected status: 204, got %v", resp.StatusCode)
+	if resp.StatusCode != 200 {
+		t.Errorf("expected status: 200, got: %v", resp.StatusCode)
+	}
+
+	var r Sub
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Error(err)
 	}
+
+	return r
 }
 
-func TestDeleteHandler(t *testing.T) {
+func TestPatchHandler(t *testing.T) {
 
-	var m MockDB
-	m.db = make(map[string]Sub)
-	db = &m
+	h := newHandlerTest(t)
+	m, server := h.m, h.server
 
-	server := httptest.NewServer(newRouter())
-	defer server.Close()
+	id := uuid.NewString()
+	s := Sub{
+		ID:       id,
+		Service:  "service",
+		Price:    400,
+		User_ID:  addUser(t, m),
+		Start:    "07-2024",
+		End:      func() *string { s := "10-2024"; return &s }(),
+		Currency: "RUB",
+
+		Billing_Period:   "monthly",
+		Billing_Interval: 1,
+		Anchor:           "2024-07-01",
+	}
+	m.db[id] = s
+
+	for _, tc := range []struct {
+		name   string
+		id     string
+		patch  string
+		status int
+	}{
+		{"malformed id", "123", `{"price": 500}`, 400},
+		{"empty", id, ``, 400},
+		{"not object", id, `[1]`, 400},
+		{"unknown field", id, `{"discount": 10}`, 400},
+		{"invalid currency", id, `{"currency": "eur"}`, 400},
+		{"remove required", id, `{"service_name": null}`, 400},
+		{"wrong type", id, `{"price": true}`, 400},
+		{"invalid precision", id, `{"price": "4.001"}`, 400},
+		{"invalid merge", id, `{"price": -1}`, 400},
+		{"invalid date", id, `{"end_date": "13-2024"}`, 400},
+		{"invalid billing period", id, `{"billing_period": "daily"}`, 400},
+		{"invalid billing interval", id, `{"billing_interval": 0}`, 400},
+		{"invalid anchor", id, `{"anchor_date": "07-2024"}`, 400},
+		{"wrong id", uuid.NewString(), `{"price": 500}`, 404},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("PATCH", server.URL+"/subs/"+tc.id, strings.NewReader(tc.patch))
+			if err != nil {
+				t.Error(err)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.status {
+				t.Errorf("expected status: %v, got %v", tc.status, resp.StatusCode)
+			}
+		})
+	}
+
+	compareSubs(t, s, m.db[id])
+
+	t.Run("payload", func(t *testing.T) {
+		s.Price = 500
+		compareSubs(t, s, testPatchPayload(t, server.URL, id, `{"price": "5.00"}`))
+		compareSubs(t, s, m.db[id])
+
+		s.End = nil
+		compareSubs(t, s, testPatchPayload(t, server.URL, id, `{"end_date": null}`))
+		compareSubs(t, s, m.db[id])
+
+		s.Service = "service_2"
+		s.End = func() *string { s := "12-2024"; return &s }()
+		compareSubs(t, s, testPatchPayload(t, server.URL, id, `{"service_name": "service_2", "end_date": "12-2024"}`))
+		compareSubs(t, s, m.db[id])
+
+		s.Currency = "EUR"
+		compareSubs(t, s, testPatchPayload(t, server.URL, id, `{"currency": "EUR"}`))
+		compareSubs(t, s, m.db[id])
+
+		s.Billing_Period, s.Billing_Interval, s.Anchor = "weekly", 2, "2024-07-03"
+		compareSubs(t, s, testPatchPayload(t, server.URL, id, `{"billing_period": "weekly", "billing_interval": 2, "anchor_date": "2024-07-03"}`))
+		compareSubs(t, s, m.db[id])
+
+		compareSubs(t, s, testPatchPayload(t, server.URL, id, `{}`))
+	})
+}
+
+func TestETags(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m, server := h.m, h.server
+
+	id := uuid.NewString()
+	s := Sub{
+		ID:      id,
+		Service: "service",
+		Price:   400,
+		User_ID: addUser(t, m),
+		Start:   "07-2024",
+		Version: 3,
+	}
+	m.db[id] = s
+
+	do := func(method string, header string, value string, body string) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest(method, server.URL+"/subs/"+id, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(header, value)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		return resp
+	}
+
+	put, _ := json.Marshal(s)
+
+	t.Run("read", func(t *testing.T) {
+		resp := do("GET", "If-None-Match", `"2"`, "")
+		if resp.StatusCode != 200 {
+			t.Errorf("expected status: 200, got %v", resp.StatusCode)
+		}
+		if etag := resp.Header.Get("ETag"); etag != `"3"` {
+			t.Errorf(`expected etag: "3", got %v`, etag)
+		}
+
+		for _, tag := range []string{`"3"`, `W/"3"`, `"1", "3"`, `*`} {
+			if resp := do("GET", "If-None-Match", tag, ""); resp.StatusCode != 304 {
+				t.Errorf("%v: expected status: 304, got %v", tag, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		for _, tc := range []struct{ method, body string }{{"PUT", string(put)}, {"PATCH", `{"price": 500}`}, {"DELETE", ""}} {
+			if resp := do(tc.method, "If-Match", `"2"`, tc.body); resp.StatusCode != 412 {
+				t.Errorf("%v: expected status: 412, got %v", tc.method, resp.StatusCode)
+			}
+			if resp := do(tc.method, "If-Match", `W/"3"`, tc.body); resp.StatusCode != 412 {
+				t.Errorf("%v weak: expected status: 412, got %v", tc.method, resp.StatusCode)
+			}
+		}
+		compareSubs(t, s, m.db[id])
+	})
+
+	t.Run("match", func(t *testing.T) {
+		resp := do("PUT", "If-Match", `"3"`, string(put))
+		if resp.StatusCode != 200 {
+			t.Errorf("expected status: 200, got %v", resp.StatusCode)
+		}
+		if etag := resp.Header.Get("ETag"); etag != `"4"` {
+			t.Errorf(`expected etag: "4", got %v`, etag)
+		}
+
+		resp = do("PATCH", "If-Match", `"1", "4"`, `{"price": 500}`)
+		if resp.StatusCode != 200 {
+			t.Errorf("expected status: 200, got %v", resp.StatusCode)
+		}
+		if etag := resp.Header.Get("ETag"); etag != `"5"` {
+			t.Errorf(`expected etag: "5", got %v`, etag)
+		}
+
+		if resp := do("DELETE", "If-Match", "*", ""); resp.StatusCode != 204 {
+			t.Errorf("expected status: 204, got %v", resp.StatusCode)
+		}
+		if resp := do("DELETE", "If-Match", "*", ""); resp.StatusCode != 404 {
+			t.Errorf("expected status: 404, got %v", resp.StatusCode)
+		}
+	})
+}
+
+func TestIdempotencyKey(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m, server := h.m, h.server
+
+	post := func(key string, body string) (*http.Response, string) {
+		t.Helper()
+
+		req, err := http.NewRequest("POST", server.URL+"/subs", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var b bytes.Buffer
+		b.ReadFrom(resp.Body)
+
+		return resp, b.String()
+	}
+
+	body := fmt.Sprintf(`{"service_name": "service", "price": 400, "user_id": "%v", "start_date": "07-2024"}`, addUser(t, m))
+	key := uuid.NewString()
+
+	resp, first := post(key, body)
+	if resp.StatusCode != 201 {
+		t.Fatalf("expected status: 201, got %v", resp.StatusCode)
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		// same request in another formatting
+		var v map[string]any
+		json.Unmarshal([]byte(body), &v)
+		compact, _ := json.Marshal(v)
+
+		resp, replayed := post(key, string(compact))
+		if resp.StatusCode != 201 {
+			t.Errorf("expected status: 201, got %v", resp.StatusCode)
+		}
+		if resp.Header.Get("Idempotent-Replayed") != "true" {
+			t.Error("expected Idempotent-Replayed header")
+		}
+		if resp.Header.Get("ETag") != etag(1) {
+			t.Errorf("expected ETag: %v, got %v", etag(1), resp.Header.Get("ETag"))
+		}
+		if replayed != first {
+			t.Errorf("expected body: %v, got %v", first, replayed)
+		}
+		if len(m.db) != 1 {
+			t.Errorf("expected 1 sub, got %v", len(m.db))
+		}
+	})
+
+	t.Run("different body", func(t *testing.T) {
+		resp, _ := post(key, strings.Replace(body, "400", "500", 1))
+		if resp.StatusCode != 422 {
+			t.Errorf("expected status: 422, got %v", resp.StatusCode)
+		}
+		if len(m.db) != 1 {
+			t.Errorf("expected 1 sub, got %v", len(m.db))
+		}
+	})
+
+	t.Run("in progress", func(t *testing.T) {
+		pending := uuid.NewString()
+		m.ReserveKey(context.Background(), pending, requestHash(Sub{}), time.Hour)
+
+		resp, _ := post(pending, `{}`)
+		if resp.StatusCode != 400 {
+			t.Errorf("invalid request: expected status: 400, got %v", resp.StatusCode)
+		}
+		resp, _ = post(pending, body)
+		if resp.StatusCode != 422 {
+			t.Errorf("expected status: 422, got %v", resp.StatusCode)
+		}
+
+		var sub Sub
+		json.Unmarshal([]byte(body), &sub)
+		m.ReleaseKey(context.Background(), pending)
+		m.ReserveKey(context.Background(), pending, requestHash(sub), time.Hour)
+
+		resp, _ = post(pending, body)
+		if resp.StatusCode != 409 {
+			t.Errorf("expected status: 409, got %v", resp.StatusCode)
+		}
+	})
+
+	t.Run("no key", func(t *testing.T) {
+		for range 2 {
+			if resp, _ := post("", body); resp.StatusCode != 201 {
+				t.Errorf("expected status: 201, got %v", resp.StatusCode)
+			}
+		}
+		if len(m.db) != 3 {
+			t.Errorf("expected 3 subs, got %v", len(m.db))
+		}
+	})
+
+	t.Run("long key", func(t *testing.T) {
+		if resp, _ := post(strings.Repeat("k", maxIdempotencyKeyLen+1), body); resp.StatusCode != 400 {
+			t.Errorf("expected status: 400, got %v", resp.StatusCode)
+		}
+	})
+
+	t.Run("failed create", func(t *testing.T) {
+		// a timed out request releases its key, the retry creates the sub
+		retry := uuid.NewString()
+		SetQueryTimeout(50 * time.Millisecond)
+		defer SetQueryTimeout(5 * time.Second)
+
+		m.delay = 30 * time.Millisecond
+		resp, _ := post(retry, body)
+		if resp.StatusCode != 504 {
+			t.Errorf("expected status: 504, got %v", resp.StatusCode)
+		}
+
+		m.delay = 0
+		resp, _ = post(retry, body)
+		if resp.StatusCode != 201 {
+			t.Errorf("retry: expected status: 201, got %v", resp.StatusCode)
+		}
+	})
+}
+
+func TestBatchHandler(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m, server := h.m, h.server
+
+	id := uuid.NewString()
+	s := Sub{ID: id, Service: "service", Price: 400, User_ID: addUser(t, m), Start: "07-2024", Version: 1}
+	m.db[id] = s
+
+	post := func(body string) (int, []batchItem) {
+		t.Helper()
+
+		resp, err := http.Post(server.URL+"/subs:batch", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var page struct {
+			Results []batchItem `json:"results"`
+		}
+		json.NewDecoder(resp.Body).Decode(&page)
+
+		return resp.StatusCode, page.Results
+	}
+
+	statuses := func(items []batchItem) []int {
+		var st []int
+		for _, item := range items {
+			st = append(st, item.Status)
+		}
+		return st
+	}
+
+	create := fmt.Sprintf(`{"op": "create", "sub": {"service_name": "new", "price": 100, "user_id": "%v", "start_date": "01-2025"}}`, s.User_ID)
+	update := fmt.Sprintf(`{"op": "update", "sub_id": "%v", "version": 1, "sub": {"service_name": "service", "price": 500, "user_id": "%v", "start_date": "07-2024"}}`, id, s.User_ID)
+	missing := fmt.Sprintf(`{"op": "delete", "sub_id": "%v"}`, uuid.NewString())
+	invalid := `{"op": "create", "sub": {"service_name": "", "price": 100}}`
+
+	for _, tc := range []struct {
+		name     string
+		body     string
+		status   int
+		statuses []int
+		subs     int
+	}{
+		{"malformed", `{"ops": [`, 400, nil, 1},
+		{"no ops", `{"ops": []}`, 400, nil, 1},
+		{"bad mode", `{"mode": "some", "ops": [` + create + `]}`, 400, nil, 1},
+		{"unknown op", `{"ops": [{"op": "upsert"}]}`, 400, []int{400}, 1},
+		{"atomic invalid", `{"ops": [` + create + `, ` + invalid + `]}`, 400, []int{424, 400}, 1},
+		{"atomic failed", `{"mode": "atomic", "ops": [` + create + `, ` + update + `, ` + missing + `]}`, 409, []int{424, 424, 404}, 1},
+		{"best effort", `{"mode": "best_effort", "ops": [` + create + `, ` + invalid + `, ` + update + `, ` + missing + `]}`, 207, []int{201, 400, 200, 404}, 2},
+		{"stale", `{"ops": [` + update + `]}`, 409, []int{412}, 2},
+		{"atomic", `{"ops": [` + create + `, ` + strings.Replace(update, `"version": 1`, `"version": 2`, 1) + `]}`, 200, []int{201, 200}, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			status, items := post(tc.body)
+			if status != tc.status {
+				t.Errorf("expected status: %v, got %v", tc.status, status)
+			}
+			if fmt.Sprint(statuses(items)) != fmt.Sprint(tc.statuses) {
+				t.Errorf("expected item statuses: %v, got %v", tc.statuses, statuses(items))
+			}
+			if len(m.db) != tc.subs {
+				t.Errorf("expected %v subs, got %v", tc.subs, len(m.db))
+			}
+		})
+	}
+
+	if v := m.db[id].Version; v != 3 {
+		t.Errorf("expected version: 3, got %v", v)
+	}
+}
+
+func testDeletePayload(t *testing.T, server_url string, sub_id string) {
+
+	req, err := http.NewRequest("DELETE", server_url+"/subs/"+sub_id, bytes.NewBuffer([]byte{}))
+	if err != nil {
+		t.Error(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 204 {
+		t.Errorf("expected status: 204, got %v", resp.StatusCode)
+	}
+}
+
+func TestDeleteHandler(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m, server := h.m, h.server
 
 	t.Run("malformed id", func(t *testing.T) {
 		req, err := http.NewRequest("DELETE", server.URL+"/subs/"+"123", bytes.NewBuffer([]byte{}))
@@ -560,9 +1378,9 @@ func TestDeleteHandler(t *testing.T) {
 	})
 }
 
-func testListPayload(t *testing.T, server_url string) []Sub {
+func testListPayload(t *testing.T, server_url string, query string) SubPage {
 
-	resp, err := http.Get(server_url + "/subs")
+	resp, err := http.Get(server_url + "/subs" + query)
 	if err != nil {
 		t.Error(err)
 	}
@@ -571,23 +1389,19 @@ func testListPayload(t *testing.T, server_url string) []Sub {
 		t.Errorf("expected status: 200, got: %v", resp.StatusCode)
 	}
 
-	var subs []Sub
-	if err := json.NewDecoder(resp.Body).Decode(&subs); err != nil {
+	var page SubPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
 		t.Error(err)
 	}
 	defer resp.Body.Close()
 
-	return subs
+	return page
 }
 
 func TestListHandler(t *testing.T) {
 
-	var m MockDB
-	m.db = make(map[string]Sub)
-	db = &m
-
-	server := httptest.NewServer(newRouter())
-	defer server.Close()
+	h := newHandlerTest(t)
+	m, server := h.m, h.server
 
 	id := uuid.NewString()
 	s := Sub{
@@ -609,12 +1423,213 @@ func TestListHandler(t *testing.T) {
 	}
 	m.db[id2] = s2
 
-	subs := testListPayload(t, server.URL)
-	compareSubs(t, s, subs[0])
-	compareSubs(t, s2, subs[1])
+	id3 := uuid.NewString()
+	s3 := Sub{
+		ID:      id3,
+		Service: "service_3",
+		Price:   200,
+		User_ID: uuid.NewString(),
+		Start:   "10-2023",
+		End:     func() *string { s := "03-2024"; return &s }(),
+	}
+	m.db[id3] = s3
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, query := range []string{"?user_id=123", "?from=13-2024", "?from=08-2024&to=07-2024", "?min_price=-1",
+			"?min_price=5&max_price=1", "?min_price=0.001", "?sort=user_id", "?limit=0", "?limit=abc", "?after=123"} {
+
+			resp, err := http.Get(server.URL + "/subs" + query)
+			if err != nil {
+				t.Error(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != 400 {
+				t.Errorf("%v: expected status: 400, got: %v", query, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("payload", func(t *testing.T) {
+		page := testListPayload(t, server.URL, "?sort=service_name")
+		if len(page.Subs) != 3 {
+			t.Fatalf("expected list count: 3, got %v", len(page.Subs))
+		}
+		compareSubs(t, s, page.Subs[0])
+		compareSubs(t, s2, page.Subs[1])
+		compareSubs(t, s3, page.Subs[2])
+
+		if page.Next_Cursor != "" {
+			t.Errorf("expected no cursor, got %v", page.Next_Cursor)
+		}
+	})
+
+	t.Run("filter", func(t *testing.T) {
+		page := testListPayload(t, server.URL, "?user_id="+s.User_ID+"&sort=-price")
+		if len(page.Subs) != 2 {
+			t.Fatalf("expected list count: 2, got %v", len(page.Subs))
+		}
+		compareSubs(t, s2, page.Subs[0])
+		compareSubs(t, s, page.Subs[1])
+
+		page = testListPayload(t, server.URL, "?from=01-2024&to=06-2024")
+		if len(page.Subs) != 1 {
+			t.Fatalf("expected list count: 1, got %v", len(page.Subs))
+		}
+		compareSubs(t, s3, page.Subs[0])
+
+		page = testListPayload(t, server.URL, "?min_price=3&max_price=5.00")
+		if len(page.Subs) != 1 {
+			t.Fatalf("expected list count: 1, got %v", len(page.Subs))
+		}
+		compareSubs(t, s, page.Subs[0])
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		var subs []Sub
+		query := "?sort=start_date&limit=2"
+		for range 3 {
+			page := testListPayload(t, server.URL, query)
+			subs = append(subs, page.Subs...)
+			if page.Next_Cursor == "" {
+				break
+			}
+			query = "?sort=start_date&limit=2&after=" + page.Next_Cursor
+		}
+
+		if len(subs) != 3 {
+			t.Fatalf("expected list count: 3, got %v", len(subs))
+		}
+		compareSubs(t, s3, subs[0])
+		if subs[1].ID > subs[2].ID {
+			t.Error("expected ties ordered by id")
+		}
+
+		resp, err := http.Get(server.URL + "/subs?sort=price&after=" + encodeCursor("start_date", s))
+		if err != nil {
+			t.Error(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 400 {
+			t.Errorf("expected status: 400 for cursor of another sort, got: %v", resp.StatusCode)
+		}
+	})
+}
+
+// failingWriter fails every write to the body, like a client gone mid-stream
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+
+	w.writes++
+	return 0, errors.New("broken pipe")
+}
+
+func TestListStreamClientGone(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m := h.m
+
+	for range maxListLimit + 5 {
+		id := uuid.NewString()
+		m.db[id] = Sub{ID: id, Service: "service", Price: 100, User_ID: uuid.NewString(), Start: "07-2024", Version: 1}
+	}
+
+	// failing writes end the stream instead of iterating the rest of it
+	for _, path := range []string{"/subs", "/subs/export"} {
+		w := &failingWriter{ResponseRecorder: httptest.NewRecorder()}
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", "application/x-ndjson")
+
+		newRouter().ServeHTTP(w, req)
+		if w.writes > streamFlushRows {
+			t.Errorf("%v: expected the stream to end on a failed write, got %v writes", path, w.writes)
+		}
+	}
+}
+
+func TestListStream(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m, server := h.m, h.server
+
+	user := uuid.NewString()
+
+	// more than a page of iterPages
+	const count = maxListLimit + 5
+	for i := range count {
+		id := uuid.NewString()
+		m.db[id] = Sub{ID: id, Service: "service", Price: Money(i), User_ID: user, Start: "07-2024", Version: 1}
+	}
+
+	stream := func(query string) (int, []Sub) {
+		t.Helper()
+
+		req, err := http.NewRequest("GET", server.URL+"/subs"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/x-ndjson")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			return resp.StatusCode, nil
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("expected content type: application/x-ndjson, got %v", ct)
+		}
+
+		var subs []Sub
+		dec := json.NewDecoder(resp.Body)
+		for dec.More() {
+			var sub Sub
+			if err := dec.Decode(&sub); err != nil {
+				t.Fatal(err)
+			}
+			subs = append(subs, sub)
+		}
+
+		return resp.StatusCode, subs
+	}
+
+	for _, tc := range []struct {
+		query    string
+		status   int
+		expected int
+	}{
+		{"", 200, count},
+		{"?sort=-price", 200, count},
+		{"?limit=10", 200, 10},
+		{"?min_price=10", 200, 5},
+		{"?service_name=none", 200, 0},
+		{"?limit=0", 400, 0},
+		{"?sort=user_id", 400, 0},
+	} {
+		status, subs := stream(tc.query)
+		if status != tc.status {
+			t.Errorf("%v: expected status: %v, got %v", tc.query, tc.status, status)
+		}
+		if len(subs) != tc.expected {
+			t.Errorf("%v: expected %v subs, got %v", tc.query, tc.expected, len(subs))
+		}
+	}
+
+	_, subs := stream("?sort=-price")
+	if subs[0].Price != count-1 || subs[0].User_ID != user || subs[count-1].Price != 0 {
+		t.Errorf("expected subs sorted by price descending, got %v ... %v", subs[0], subs[count-1])
+	}
 }
 
-func testSumPayload(t *testing.T, server_url string, s Sub) int {
+func testSumPayload(t *testing.T, server_url string, s Sub) Money {
 
 	query := fmt.Sprintf("/subs/sum?start_date=%v&end_date=%v", s.Start, *s.End)
 	if s.User_ID != "" {
@@ -634,7 +1649,7 @@ func testSumPayload(t *testing.T, server_url string, s Sub) int {
 	}
 
 	var r struct {
-		Sum int `json:"sum"`
+		Sum Money `json:"sum"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
 		t.Error(err)
@@ -646,12 +1661,8 @@ func testSumPayload(t *testing.T, server_url string, s Sub) int {
 
 func TestSumHandler(t *testing.T) {
 
-	var m MockDB
-	m.db = make(map[string]Sub)
-	db = &m
-
-	server := httptest.NewServer(newRouter())
-	defer server.Close()
+	h := newHandlerTest(t)
+	m, server := h.m, h.server
 
 	t.Run("malformed", func(t *testing.T) {
 		resp, err := http.Get(server.URL + "/subs/sum?user_id=123")
@@ -722,3 +1733,135 @@ func TestSumHandler(t *testing.T) {
 		}
 	})
 }
+
+func TestSumGroupsHandler(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m, server := h.m, h.server
+
+	user := uuid.NewString()
+	end := "09-2024"
+	for _, s := range []Sub{
+		{ID: uuid.NewString(), Service: "b", Price: 400, User_ID: user, Start: "07-2024"},
+		{ID: uuid.NewString(), Service: "a", Price: 100, User_ID: user, Start: "08-2024", End: &end},
+		{ID: uuid.NewString(), Service: "a", Price: 10, User_ID: uuid.NewString(), Start: "01-2020"},
+	} {
+		m.db[s.ID] = s
+	}
+
+	get := func(query string) (int, Money, []SumGroup) {
+		t.Helper()
+
+		resp, err := http.Get(server.URL + "/subs/sum?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var res struct {
+			Sum    Money      `json:"sum"`
+			Groups []SumGroup `json:"groups"`
+		}
+		json.NewDecoder(resp.Body).Decode(&res)
+
+		return resp.StatusCode, res.Sum, res.Groups
+	}
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, query := range []string{"start_date=07-2024&end_date=10-2024&group_by=price", "start_date=07-2024&end_date=01-2200&group_by=month"} {
+			if status, _, _ := get(query); status != 400 {
+				t.Errorf("%v: expected status: 400, got: %v", query, status)
+			}
+		}
+	})
+
+	for _, tc := range []struct {
+		query    string
+		sum      Money
+		expected string
+	}{
+		{"start_date=07-2024&end_date=10-2024&group_by=service_name", 400*4 + 100*2 + 10*4, "[{a 2.40} {b 16.00}]"},
+		{"start_date=07-2024&end_date=10-2024&group_by=month", 400*4 + 100*2 + 10*4, "[{07-2024 4.10} {08-2024 5.10} {09-2024 5.10} {10-2024 4.10}]"},
+		{"start_date=07-2024&end_date=10-2024&group_by=service_name&user_id=" + user, 400*4 + 100*2, "[{a 2.00} {b 16.00}]"},
+		{"start_date=07-2024&end_date=10-2024&group_by=user_id&service_name=none", 0, "[]"},
+	} {
+		status, sum, groups := get(tc.query)
+		if status != 200 {
+			t.Fatalf("%v: expected status: 200, got: %v", tc.query, status)
+		}
+		if sum != tc.sum {
+			t.Errorf("%v: expected sum: %v, got: %v", tc.query, tc.sum, sum)
+		}
+		if fmt.Sprint(groups) != tc.expected {
+			t.Errorf("%v: expected groups: %v, got: %v", tc.query, tc.expected, groups)
+		}
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m, server := h.m, h.server
+	m.delay = time.Second
+
+	SetQueryTimeout(10 * time.Millisecond)
+	defer SetQueryTimeout(5 * time.Second)
+
+	id := uuid.NewString()
+	m.db[id] = Sub{
+		ID:      id,
+		Service: "service",
+		Price:   400,
+		User_ID: uuid.NewString(),
+		Start:   "07-2024",
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		for _, path := range []string{"/subs/" + id, "/subs", "/subs/sum?start_date=07-2024&end_date=09-2024"} {
+
+			resp, err := http.Get(server.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != 504 {
+				t.Errorf("%v: expected status: 504, got: %v", path, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("stream timeout", func(t *testing.T) {
+		for _, path := range []string{"/subs", "/subs/export"} {
+
+			req, _ := http.NewRequest("GET", server.URL+path, nil)
+			req.Header.Set("Accept", "application/x-ndjson")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != 504 {
+				t.Errorf("%v: expected status: 504, got: %v", path, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+
+		start := time.Now()
+		if _, err := m.Read(ctx, id); err != context.Canceled {
+			t.Errorf("expected %v, got %v", context.Canceled, err)
+		}
+		if time.Since(start) >= m.delay {
+			t.Error("expected cancellation to cut the query short")
+		}
+	})
+}
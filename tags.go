@@ -0,0 +1,93 @@
+package subs
+
+import (
+	"errors"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// upper bounds of the tags of a sub and of a single tag
+const maxTags = 20
+const maxTagLen = 64
+
+// normalizeTags trims and sorts tags without repeats, never nil so that every
+// backend reads back the same empty list
+func normalizeTags(tags []string) []string {
+
+	list := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		list = append(list, strings.TrimSpace(tag))
+	}
+	slices.Sort(list)
+
+	return slices.Compact(list)
+}
+
+// validateLabels checks the category and normalized tags of a sub or filter
+func validateLabels(category string, tags []string) error {
+
+	if len(category) > maxServiceNameLen {
+		return errors.New("category too long")
+	}
+
+	if len(tags) > maxTags {
+		return errors.New("too many tags")
+	}
+
+	for _, tag := range tags {
+		// tags are listed comma separated in queries and exports
+		if tag == "" || len(tag) > maxTagLen || strings.Contains(tag, ",") {
+			return errors.New("invalid tag")
+		}
+	}
+
+	return nil
+}
+
+// matchTags reports whether the tags of a sub hold any of filter, or all of
+// them, an empty filter matches every sub
+func matchTags(tags []string, filter []string, all bool) bool {
+
+	if len(filter) == 0 {
+		return true
+	}
+
+	for _, tag := range filter {
+		if slices.Contains(tags, tag) != all {
+			return !all
+		}
+	}
+
+	return all
+}
+
+// parseTagFilter reads the comma separated tags and tag_match query
+// parameters, tag_match is "any" by default or "all"
+func parseTagFilter(v url.Values) ([]string, bool, error) {
+
+	var tags []string
+	if s := v.Get("tags"); s != "" {
+		tags = normalizeTags(strings.Split(s, ","))
+	}
+
+	switch v.Get("tag_match") {
+	case "", "any":
+		return tags, false, nil
+	case "all":
+		return tags, true, nil
+	}
+
+	return nil, false, errors.New("invalid tag_match")
+}
+
+// tagGroups are the group_by tag values of a sub, the sub counts in the group
+// of each of its tags or in group "" without any
+func tagGroups(tags []string) []string {
+
+	if len(tags) == 0 {
+		return []string{""}
+	}
+
+	return tags
+}
@@ -0,0 +1,165 @@
+package subs
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidateLabels(t *testing.T) {
+
+	if got := fmt.Sprint(normalizeTags([]string{" b", "a", "b ", "a"})); got != "[a b]" {
+		t.Errorf("unexpected normalized tags: %v", got)
+	}
+	if normalizeTags(nil) == nil {
+		t.Error("expected empty tags, got nil")
+	}
+
+	for _, tags := range [][]string{nil, {"a"}, {strings.Repeat("a", maxTagLen)}, make([]string, maxTags)} {
+		if len(tags) == maxTags {
+			for i := range tags {
+				tags[i] = fmt.Sprint(i)
+			}
+		}
+		if err := validateLabels("", tags); err != nil {
+			t.Errorf("%v: expected nil, got %v", tags, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		category string
+		tags     []string
+	}{
+		{strings.Repeat("c", maxServiceNameLen+1), nil},
+		{"", []string{""}},
+		{"", []string{"a,b"}},
+		{"", []string{strings.Repeat("a", maxTagLen+1)}},
+		{"", make([]string, maxTags+1)},
+	} {
+		if err := validateLabels(tc.category, tc.tags); err == nil {
+			t.Errorf("%v: expected err, got nil", tc)
+		}
+	}
+}
+
+func TestMatchTags(t *testing.T) {
+
+	tags := []string{"a", "b"}
+	for _, tc := range []struct {
+		filter   []string
+		all      bool
+		expected bool
+	}{
+		{nil, false, true},
+		{nil, true, true},
+		{[]string{"b", "c"}, false, true},
+		{[]string{"c"}, false, false},
+		{[]string{"a", "b"}, true, true},
+		{[]string{"b", "c"}, true, false},
+	} {
+		if got := matchTags(tags, tc.filter, tc.all); got != tc.expected {
+			t.Errorf("%v all %v: expected %v, got %v", tc.filter, tc.all, tc.expected, got)
+		}
+	}
+}
+
+func TestParseTagFilter(t *testing.T) {
+
+	for _, tc := range []struct {
+		query    string
+		expected string
+	}{
+		{"", "[] false"},
+		{"tags=b,a, b", "[a b] false"},
+		{"tags=a&tag_match=any", "[a] false"},
+		{"tags=a&tag_match=all", "[a] true"},
+	} {
+		v, _ := url.ParseQuery(tc.query)
+		tags, all, err := parseTagFilter(v)
+		if err != nil {
+			t.Errorf("%v: expected nil, got %v", tc.query, err)
+		}
+		if got := fmt.Sprint(tags, all); got != tc.expected {
+			t.Errorf("%v: expected %v, got %v", tc.query, tc.expected, got)
+		}
+	}
+
+	if _, _, err := parseTagFilter(url.Values{"tag_match": {"none"}}); err == nil {
+		t.Error("expected err, got nil")
+	}
+}
+
+func TestTagHandlers(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m, do := h.m, h.do
+
+	user := addUser(t, m)
+	for _, body := range []string{
+		`{"service_name": "a", "price": "1.00", "user_id": "` + user + `", "start_date": "01-2024", "category": "video", "tags": ["hd", "family"]}`,
+		`{"service_name": "b", "price": "2.00", "user_id": "` + user + `", "start_date": "01-2024", "category": "music", "tags": ["family"]}`,
+		`{"service_name": "c", "price": "4.00", "user_id": "` + user + `", "start_date": "01-2024"}`,
+	} {
+		if status, body := do("POST", "/subs", body); status != 201 {
+			t.Fatalf("expected status: 201, got %v %v", status, body)
+		}
+	}
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, body := range []string{
+			`{"service_name": "d", "price": "1.00", "user_id": "` + user + `", "start_date": "01-2024", "tags": [""]}`,
+			`{"service_name": "d", "price": "1.00", "user_id": "` + user + `", "start_date": "01-2024", "tags": ["a,b"]}`,
+			`{"service_name": "d", "price": "1.00", "user_id": "` + user + `", "start_date": "01-2024", "tags": "a"}`,
+		} {
+			if status, _ := do("POST", "/subs", body); status != 400 {
+				t.Errorf("%v: expected status: 400, got %v", body, status)
+			}
+		}
+		for _, path := range []string{"/subs?tag_match=some", "/subs/sum?start_date=01-2024&end_date=01-2024&tag_match=some", "/subs?tags=a,,b"} {
+			if status, _ := do("GET", path, ""); status != 400 {
+				t.Errorf("%v: expected status: 400, got %v", path, status)
+			}
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		for _, tc := range []struct {
+			query    string
+			expected []string
+		}{
+			{"tags=family", []string{`"a"`, `"b"`}},
+			{"tags=family,hd&tag_match=all", []string{`"a"`}},
+			{"category=music", []string{`"b"`}},
+		} {
+			status, body := do("GET", "/subs?sort=service_name&user_id="+user+"&"+tc.query, "")
+			if status != 200 || strings.Count(body, `"service_name"`) != len(tc.expected) {
+				t.Errorf("%v: expected %v, got %v %v", tc.query, tc.expected, status, body)
+			}
+			for _, service := range tc.expected {
+				if !strings.Contains(body, `"service_name":`+service) {
+					t.Errorf("%v: expected %v, got %v", tc.query, service, body)
+				}
+			}
+		}
+	})
+
+	t.Run("sum", func(t *testing.T) {
+		for _, tc := range []struct {
+			query    string
+			expected string
+		}{
+			{"tags=family", `{"sum":"3.00"}`},
+			{"tags=family,hd&tag_match=all", `{"sum":"1.00"}`},
+			{"category=video", `{"sum":"1.00"}`},
+			{"group_by=category", `{"sum":"7.00","groups":[{"group":"","sum":"4.00"},{"group":"music","sum":"2.00"},{"group":"video","sum":"1.00"}]}`},
+			// the total counts every sub once, tag groups overlap
+			{"group_by=tag", `{"sum":"7.00","groups":[{"group":"","sum":"4.00"},{"group":"family","sum":"3.00"},{"group":"hd","sum":"1.00"}]}`},
+		} {
+			status, body := do("GET", "/subs/sum?start_date=01-2024&end_date=01-2024&user_id="+user+"&"+tc.query, "")
+			if status != 200 || body != tc.expected {
+				t.Errorf("%v: expected %v, got %v %v", tc.query, tc.expected, status, body)
+			}
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package subs
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// upper bound of trial_months and intro_months, like billing_interval
+const maxPromoMonths = 120
+
+// upper bound of the days a trial ending query looks ahead
+const maxTrialWindow = 366
+
+// Trial is a sub whose trial ends on Trial_End, its last free day
+type Trial struct {
+	Sub       Sub    `json:"sub"`
+	Trial_End string `json:"trial_end"`
+}
+
+func validatePromo(sub Sub) error {
+
+	if sub.Trial_Months < 0 || sub.Trial_Months > maxPromoMonths {
+		return errors.New("invalid trial months")
+	}
+
+	if sub.Intro_Months < 0 || sub.Intro_Months > maxPromoMonths {
+		return errors.New("invalid intro months")
+	}
+
+	if sub.Intro_Price < 0 {
+		return errors.New("invalid intro price")
+	}
+
+	if sub.Intro_Price > maxPrice {
+		return errors.New("intro price too large")
+	}
+
+	if sub.Intro_Price != 0 && sub.Intro_Months == 0 {
+		return errors.New("intro price without intro months")
+	}
+
+	return nil
+}
+
+// phase is a run of days of a sub charged at one price
+type phase struct {
+	from, to int
+	price    Money
+}
+
+// subPhases mirrors the sub_phases SQL function, the days of sub charged after
+// its trial. Its intro months are charged at Intro_Price, the days after them
+// at Price. Months count from the start day, like addMonths.
+func subPhases(sub Sub) []phase {
+
+	start := startDay(sub.Start)
+	trial_end := addMonths(start, sub.Trial_Months)
+	intro_end := addMonths(start, sub.Trial_Months+sub.Intro_Months)
+
+	var phases []phase
+	if intro_end > trial_end {
+		phases = append(phases, phase{from: trial_end, to: intro_end - 1, price: sub.Intro_Price})
+	}
+
+	return append(phases, phase{from: intro_end, to: math.MaxInt32, price: sub.Price})
+}
+
+// trialEnd is the dayIndex of the last day of the trial of sub, false without
+// one or when the sub ends by then
+func trialEnd(sub Sub) (int, bool) {
+
+	if sub.Trial_Months == 0 {
+		return 0, false
+	}
+
+	last := addMonths(startDay(sub.Start), sub.Trial_Months) - 1
+	if sub.End != nil && endDay(*sub.End) <= last {
+		return 0, false
+	}
+
+	return last, true
+}
+
+// endingTrials mirrors the Trials query of PGXDB, the subs whose trial ends on
+// a YYYY-MM-DD day in [from, to], by trial end then id
+func endingTrials(subs []Sub, from string, to string) []Trial {
+
+	first, _ := time.Parse(time.DateOnly, from)
+	last, _ := time.Parse(time.DateOnly, to)
+
+	var trials []Trial
+	for _, sub := range subs {
+		day, ok := trialEnd(sub)
+		if !ok || day < dayIndex(first) || day > dayIndex(last) {
+			continue
+		}
+		trials = append(trials, Trial{Sub: sub, Trial_End: dayDate(day)})
+	}
+
+	slices.SortFunc(trials, func(a Trial, b Trial) int {
+		if c := cmp.Compare(a.Trial_End, b.Trial_End); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Sub.ID, b.Sub.ID)
+	})
+
+	return trials
+}
+
+func trialsHandler(w http.ResponseWriter, r *http.Request) {
+
+	user_id := r.URL.Query().Get("user_id")
+	if user_id != "" {
+		if err := uuid.Validate(user_id); err != nil {
+			logger.Printf("trials: resp 400: %v; req %v", err, r.URL.RawQuery)
+			http.Error(w, "invalid request: invalid user id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	days, err := strconv.Atoi(r.URL.Query().Get("ending_within"))
+	if err != nil || days < 0 || days > maxTrialWindow {
+		logger.Printf("trials: resp 400: invalid ending_within; req %v", r.URL.RawQuery)
+		http.Error(w, "invalid request: invalid ending_within", http.StatusBadRequest)
+		return
+	}
+
+	today := dayIndex(time.Now().UTC().Truncate(24 * time.Hour))
+	from, to := dayDate(today), dayDate(today+days)
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	trials, err := db.Trials(ctx, user_id, from, to)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("trials: resp 504: %v; valid req %v", err, r.URL.RawQuery)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("trials: resp 500: %v; valid req %v", err, r.URL.RawQuery)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	if trials == nil {
+		trials = []Trial{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]Trial{"trials": trials})
+	logger.Printf("trials: resp 200 with %v entries; req %v", len(trials), r.URL.RawQuery)
+}
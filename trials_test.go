@@ -0,0 +1,99 @@
+package subs
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestTrialEnd(t *testing.T) {
+
+	end := "2024-03-31"
+	for _, tc := range []struct {
+		sub      Sub
+		expected string
+	}{
+		{Sub{Start: "01-2024", Trial_Months: 2}, "2024-02-29"},
+		{Sub{Start: "2024-01-31", Trial_Months: 1}, "2024-02-28"},
+		{Sub{Start: "2024-03-31", Trial_Months: 1}, "2024-04-29"},
+		{Sub{Start: "01-2024", End: &end, Trial_Months: 2}, "2024-02-29"},
+		// without a trial or ended by its end
+		{Sub{Start: "01-2024"}, ""},
+		{Sub{Start: "01-2024", End: &end, Trial_Months: 3}, ""},
+	} {
+		var got string
+		if day, ok := trialEnd(tc.sub); ok {
+			got = dayDate(day)
+		}
+		if got != tc.expected {
+			t.Errorf("%v: expected %q, got %q", tc.sub, tc.expected, got)
+		}
+	}
+}
+
+func TestTrialsHandler(t *testing.T) {
+
+	h := newHandlerTest(t)
+	m, server := h.m, h.server
+
+	today := time.Now().UTC().Format(time.DateOnly)
+	user := addUser(t, m)
+	id, err := m.Create(context.Background(), Sub{Service: "a", Price: 1000, User_ID: user, Start: today, Trial_Months: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Create(context.Background(), Sub{Service: "b", Price: 1000, User_ID: user, Start: today}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(query string) (int, []Trial) {
+		t.Helper()
+
+		resp, err := http.Get(server.URL + "/subs/trials" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var body struct {
+			Trials []Trial `json:"trials"`
+		}
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == 200 {
+			if err := json.Unmarshal(b, &body); err != nil || body.Trials == nil {
+				t.Fatalf("unexpected body: %s, %v", b, err)
+			}
+		}
+		return resp.StatusCode, body.Trials
+	}
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, query := range []string{"", "?ending_within=-1", "?ending_within=367", "?ending_within=a", "?ending_within=7&user_id=1"} {
+			if status, _ := get(query); status != 400 {
+				t.Errorf("%v: expected status: 400, got %v", query, status)
+			}
+		}
+	})
+
+	t.Run("ending", func(t *testing.T) {
+		status, trials := get("?ending_within=31&user_id=" + user)
+		if status != 200 || len(trials) != 1 || trials[0].Sub.ID != id {
+			t.Fatalf("expected the trial of %v, got %v %v", id, status, trials)
+		}
+		if trials[0].Trial_End <= today || trials[0].Sub.Trial_Months != 1 {
+			t.Errorf("expected a trial ending after %v, got %v", today, trials[0])
+		}
+
+		if status, trials := get("?ending_within=0"); status != 200 || len(trials) != 0 {
+			t.Errorf("expected no trials ending today, got %v %v", status, trials)
+		}
+		if status, trials := get("?ending_within=31&user_id=" + uuid.NewString()); status != 200 || len(trials) != 0 {
+			t.Errorf("expected no trials of another user, got %v %v", status, trials)
+		}
+	})
+}
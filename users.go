@@ -0,0 +1,350 @@
+package subs
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+var ErrUnknownUser = errors.New("unknown user")
+var ErrUserConflict = errors.New("user exists")
+var ErrUserInUse = errors.New("user has subscriptions")
+
+// deleting a user with subs or shares fails with ErrUserInUse, unless
+// deletes cascade to them
+var userDeleteCascade = false
+
+func SetUserDeleteCascade(cascade bool) {
+	userDeleteCascade = cascade
+}
+
+const defaultTimezone = "UTC"
+
+// User owns subs, every Sub.User_ID names one. Default_Currency is the
+// currency of their spend.
+type User struct {
+	ID               string `json:"user_id"`
+	Display_Name     string `json:"display_name"`
+	Email            string `json:"email"`
+	Default_Currency string `json:"default_currency"`
+	Timezone         string `json:"timezone"`
+}
+
+// normalizeUser trims the names of user and fills in the defaults of users
+// created before they had any
+func normalizeUser(user User) User {
+
+	user.Display_Name = strings.TrimSpace(user.Display_Name)
+	user.Email = strings.TrimSpace(user.Email)
+
+	if user.Default_Currency == "" {
+		user.Default_Currency = defaultCurrency
+	}
+	if user.Timezone == "" {
+		user.Timezone = defaultTimezone
+	}
+
+	return user
+}
+
+func validateUser(user User) error {
+
+	if user.ID != "" {
+		if err := uuid.Validate(user.ID); err != nil {
+			return errors.New("invalid user id")
+		}
+	}
+
+	if user.Display_Name == "" {
+		return errors.New("empty display name")
+	}
+
+	if len(user.Display_Name) > maxServiceNameLen {
+		return errors.New("display name too long")
+	}
+
+	if user.Email != "" {
+		addr, err := mail.ParseAddress(user.Email)
+		if err != nil || addr.Address != user.Email || len(user.Email) > maxServiceNameLen {
+			return errors.New("invalid email")
+		}
+	}
+
+	if err := validateCurrency(user.Default_Currency); err != nil {
+		return err
+	}
+
+	if _, err := time.LoadLocation(user.Timezone); err != nil || user.Timezone == "Local" {
+		return errors.New("invalid timezone")
+	}
+
+	return nil
+}
+
+// compareUsers orders users by id
+func compareUsers(a User, b User) int {
+	return cmp.Compare(a.ID, b.ID)
+}
+
+func decodeUser(r *http.Request) (User, error) {
+
+	var user User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		return user, errors.New("json error")
+	}
+	defer r.Body.Close()
+
+	user = normalizeUser(user)
+	return user, validateUser(user)
+}
+
+// createUserHandler registers a user under a new id, or under the user_id of
+// the request for ids already in use elsewhere
+func createUserHandler(w http.ResponseWriter, r *http.Request) {
+
+	user, err := decodeUser(r)
+	if err != nil {
+		logger.Printf("create user: resp 400: %v; req %v", err, user)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	user.ID, err = db.CreateUser(ctx, user)
+	if err != nil {
+		if err == ErrUserConflict {
+			logger.Printf("create user: resp 409; valid req %v", user)
+			http.Error(w, "user exists", http.StatusConflict)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("create user: resp 504: %v; valid req %v", err, user)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("create user: resp 500: %v; valid req %v", err, user)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"user_id": user.ID})
+	logger.Printf("create user: resp 201 with %v; req %v", user.ID, user)
+}
+
+// readUser reads the user of the id route variable, writing the error
+// response when it fails
+func readUser(w http.ResponseWriter, r *http.Request, ctx context.Context, op string) (User, bool) {
+
+	id := mux.Vars(r)["id"]
+	if err := uuid.Validate(id); err != nil {
+		logger.Printf("%s: resp 400: %v; req %v", op, err, id)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return User{}, false
+	}
+
+	user, err := db.ReadUser(ctx, id)
+	if err != nil {
+		if err == ErrNotFound {
+			logger.Printf("%s: resp 404; valid req %v", op, id)
+			http.Error(w, "not found", http.StatusNotFound)
+			return User{}, false
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("%s: resp 504: %v; valid req %v", op, err, id)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return User{}, false
+		}
+
+		logger.Printf("%s: resp 500: %v; valid req %v", op, err, id)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return User{}, false
+	}
+
+	return user, true
+}
+
+func readUserHandler(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	user, ok := readUser(w, r, ctx, "read user")
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+	logger.Printf("read user: resp 200 with %v; req %v", user, user.ID)
+}
+
+func updateUserHandler(w http.ResponseWriter, r *http.Request) {
+
+	id := mux.Vars(r)["id"]
+	if err := uuid.Validate(id); err != nil {
+		logger.Printf("update user: resp 400: %v; req %v", err, id)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := decodeUser(r)
+	if err == nil && user.ID != "" && user.ID != id {
+		err = errors.New("user id mismatch")
+	}
+	if err != nil {
+		logger.Printf("update user: resp 400: %v; req %v, %v", err, id, user)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	user.ID = id
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	if err := db.UpdateUser(ctx, id, user); err != nil {
+		if err == ErrNotFound {
+			logger.Printf("update user: resp 404; valid req %v", id)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("update user: resp 504: %v; valid req %v, %v", err, id, user)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("update user: resp 500: %v; valid req %v, %v", err, id, user)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+	logger.Printf("update user: resp 200; req %v, %v", id, user)
+}
+
+// deleteUserHandler removes a user, and with cascading deletes their subs and
+// shares too. Otherwise a user with any fails with 409.
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+
+	id := mux.Vars(r)["id"]
+	if err := uuid.Validate(id); err != nil {
+		logger.Printf("delete user: resp 400: %v; req %v", err, id)
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	if err := db.DeleteUser(ctx, id, userDeleteCascade); err != nil {
+		if err == ErrNotFound {
+			logger.Printf("delete user: resp 404; valid req %v", id)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if err == ErrUserInUse {
+			logger.Printf("delete user: resp 409; valid req %v", id)
+			http.Error(w, "user has subscriptions", http.StatusConflict)
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("delete user: resp 504: %v; valid req %v", err, id)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("delete user: resp 500: %v; valid req %v", err, id)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Printf("delete user: resp 204; req %v", id)
+}
+
+func listUsersHandler(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	users, err := db.ListUsers(ctx)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Printf("list users: resp 504: %v", err)
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Printf("list users: resp 500: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	if users == nil {
+		users = []User{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]User{"users": users})
+	logger.Printf("list users: resp 200 with %v entries", len(users))
+}
+
+// userSubsHandler lists the subs of a user like GET /subs?user_id=, taking
+// the same list parameters
+func userSubsHandler(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	user, ok := readUser(w, r, ctx, "user subs")
+	if !ok {
+		return
+	}
+
+	v := r.URL.Query()
+	v.Set("user_id", user.ID)
+	r.URL.RawQuery = v.Encode()
+
+	listHandler(w, r)
+}
+
+// userSpendHandler sums the shares of a user like GET /subs/sum?user_id=, in
+// their default currency unless the request has one
+func userSpendHandler(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	user, ok := readUser(w, r, ctx, "user spend")
+	if !ok {
+		return
+	}
+
+	v := r.URL.Query()
+	v.Set("user_id", user.ID)
+	if !v.Has("currency") {
+		v.Set("currency", user.Default_Currency)
+	}
+	r.URL.RawQuery = v.Encode()
+
+	sumHandler(w, r)
+}
@@ -0,0 +1,203 @@
+package subs
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestValidateUser(t *testing.T) {
+
+	user := normalizeUser(User{Display_Name: " a ", Email: " a@example.com "})
+	if user != (User{Display_Name: "a", Email: "a@example.com", Default_Currency: "RUB", Timezone: "UTC"}) {
+		t.Errorf("unexpected normalized user: %v", user)
+	}
+
+	for _, user := range []User{
+		{Display_Name: "a"},
+		{ID: uuid.NewString(), Display_Name: "a", Email: "a@example.com", Default_Currency: "USD", Timezone: "Europe/Moscow"},
+		{Display_Name: strings.Repeat("a", maxServiceNameLen)},
+	} {
+		if err := validateUser(normalizeUser(user)); err != nil {
+			t.Errorf("%v: expected nil, got %v", user, err)
+		}
+	}
+
+	for _, user := range []User{
+		{},
+		{Display_Name: " "},
+		{ID: "1", Display_Name: "a"},
+		{Display_Name: strings.Repeat("a", maxServiceNameLen+1)},
+		{Display_Name: "a", Email: "a"},
+		{Display_Name: "a", Email: "A <a@example.com>"},
+		{Display_Name: "a", Default_Currency: "usd"},
+		{Display_Name: "a", Timezone: "Mars/Olympus"},
+		{Display_Name: "a", Timezone: "Local"},
+	} {
+		if err := validateUser(normalizeUser(user)); err == nil {
+			t.Errorf("%v: expected err, got nil", user)
+		}
+	}
+}
+
+func testCreateUserPayload(t *testing.T, server_url string) string {
+
+	resp, err := http.Post(server_url+"/users", "application/json", strings.NewReader(`{"display_name": "user"}`))
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		t.Errorf("expected status: 201, got: %v", resp.StatusCode)
+	}
+
+	var r struct {
+		User_ID string `json:"user_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Error(err)
+	}
+
+	return r.User_ID
+}
+
+func TestUserHandlers(t *testing.T) {
+
+	h := newHandlerTest(t)
+	server, do := h.server, h.do
+
+	var id string
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, body := range []string{`{}`, `{"display_name": " "}`, `{"display_name": "a", "email": "a"}`, `{"display_name": "a", "timezone": "Mars/Olympus"}`, `{"display_name": `} {
+			if status, _ := do("POST", "/users", body); status != 400 {
+				t.Errorf("%v: expected status: 400, got %v", body, status)
+			}
+		}
+		for _, path := range []string{"/users/abc", "/users/abc/subs", "/users/abc/spend"} {
+			if status, _ := do("GET", path, ""); status != 400 {
+				t.Errorf("%v: expected status: 400, got %v", path, status)
+			}
+		}
+	})
+
+	t.Run("create", func(t *testing.T) {
+		id = testCreateUserPayload(t, server.URL)
+		if err := uuid.Validate(id); err != nil {
+			t.Fatal(err)
+		}
+
+		status, body := do("GET", "/users/"+id, "")
+		expected := `{"user_id":"` + id + `","display_name":"user","email":"","default_currency":"RUB","timezone":"UTC"}`
+		if status != 200 || body != expected {
+			t.Errorf("expected %v, got %v %v", expected, status, body)
+		}
+
+		// users of other systems keep their ids
+		other := uuid.NewString()
+		if status, body := do("POST", "/users", `{"user_id": "`+other+`", "display_name": "other"}`); status != 201 || !strings.Contains(body, other) {
+			t.Errorf("expected user %v, got %v %v", other, status, body)
+		}
+		if status, _ := do("POST", "/users", `{"user_id": "`+other+`", "display_name": "other"}`); status != 409 {
+			t.Errorf("expected status: 409, got %v", status)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		status, body := do("PUT", "/users/"+id, `{"display_name": "Ann", "email": "ann@example.com", "default_currency": "USD", "timezone": "Europe/Moscow"}`)
+		if status != 200 || !strings.Contains(body, `"default_currency":"USD"`) {
+			t.Errorf("expected status: 200, got %v %v", status, body)
+		}
+		if status, _ := do("PUT", "/users/"+id, `{"user_id": "`+uuid.NewString()+`", "display_name": "a"}`); status != 400 {
+			t.Errorf("expected status: 400, got %v", status)
+		}
+		if status, _ := do("PUT", "/users/"+uuid.NewString(), `{"display_name": "a"}`); status != 404 {
+			t.Errorf("expected status: 404, got %v", status)
+		}
+
+		status, body = do("GET", "/users", "")
+		if status != 200 || strings.Count(body, `"user_id"`) != 2 || !strings.Contains(body, `"display_name":"Ann"`) {
+			t.Errorf("unexpected users: %v %v", status, body)
+		}
+	})
+
+	var sub_id string
+
+	t.Run("unknown user", func(t *testing.T) {
+		unknown := uuid.NewString()
+		status, body := do("POST", "/subs", `{"service_name": "a", "price": "1.00", "user_id": "`+unknown+`", "start_date": "01-2024"}`)
+		if status != 400 || body != "invalid request: unknown user" {
+			t.Errorf("expected status: 400, got %v %v", status, body)
+		}
+
+		status, body = do("POST", "/subs", `{"service_name": "a", "price": "1.00", "user_id": "`+id+`", "start_date": "01-2024", "currency": "USD"}`)
+		if status != 201 {
+			t.Fatalf("expected status: 201, got %v %v", status, body)
+		}
+		var created map[string]string
+		json.Unmarshal([]byte(body), &created)
+		sub_id = created["sub_id"]
+
+		if status, _ := do("PATCH", "/subs/"+sub_id, `{"user_id": "`+unknown+`"}`); status != 400 {
+			t.Errorf("expected status: 400, got %v", status)
+		}
+		if status, _ := do("GET", "/users/"+unknown+"/subs", ""); status != 404 {
+			t.Errorf("expected status: 404, got %v", status)
+		}
+	})
+
+	t.Run("subs", func(t *testing.T) {
+		if status, body := do("POST", "/subs", `{"service_name": "b", "price": "2.00", "user_id": "`+id+`", "start_date": "01-2024", "currency": "USD"}`); status != 201 {
+			t.Fatalf("expected status: 201, got %v %v", status, body)
+		}
+
+		status, body := do("GET", "/users/"+id+"/subs?sort=service_name&limit=1", "")
+		if status != 200 || !strings.Contains(body, `"sub_id":"`+sub_id+`"`) || strings.Count(body, `"sub_id"`) != 1 {
+			t.Errorf("expected sub %v, got %v %v", sub_id, status, body)
+		}
+	})
+
+	t.Run("spend", func(t *testing.T) {
+		// in the default currency of the user, RUB would need fx rates
+		status, body := do("GET", "/users/"+id+"/spend?start_date=01-2024&end_date=02-2024", "")
+		if status != 200 || body != `{"sum":"6.00"}` {
+			t.Errorf("expected sum: 6.00, got %v %v", status, body)
+		}
+		if status, _ := do("GET", "/users/"+id+"/spend?start_date=01-2024&end_date=02-2024&currency=RUB", ""); status != 422 {
+			t.Errorf("expected status: 422, got %v", status)
+		}
+
+		status, body = do("GET", "/users/"+id+"/spend?start_date=01-2024&end_date=02-2024&group_by=service_name", "")
+		if status != 200 || !strings.Contains(body, `{"group":"b","sum":"4.00"}`) {
+			t.Errorf("expected groups, got %v %v", status, body)
+		}
+
+		if status, _ := do("GET", "/users/"+id+"/spend", ""); status != 400 {
+			t.Errorf("expected status: 400, got %v", status)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if status, _ := do("DELETE", "/users/"+id, ""); status != 409 {
+			t.Errorf("expected status: 409, got %v", status)
+		}
+
+		SetUserDeleteCascade(true)
+		defer SetUserDeleteCascade(false)
+
+		if status, _ := do("DELETE", "/users/"+id, ""); status != 204 {
+			t.Errorf("expected status: 204, got %v", status)
+		}
+		if status, _ := do("DELETE", "/users/"+id, ""); status != 404 {
+			t.Errorf("expected status: 404, got %v", status)
+		}
+		if status, _ := do("GET", "/subs/"+sub_id, ""); status != 404 {
+			t.Errorf("expected the subs of the user deleted, got %v", status)
+		}
+	})
+}